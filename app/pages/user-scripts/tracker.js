@@ -9,9 +9,14 @@
          path: window.location.pathname,
          queryString: window.location.search,
          browser: getBrowserName(),
+         privacySignal: hasPrivacySignal(),
       };
    }
 
+   function hasPrivacySignal() {
+      return navigator.doNotTrack === "1" || window.doNotTrack === "1" || navigator.globalPrivacyControl === true;
+   }
+
    function getBrowserName() {
       const ua = navigator.userAgent;
 
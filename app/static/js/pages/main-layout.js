@@ -16,3 +16,37 @@ document.addEventListener("htmx:confirm", async (e) => {
       e.detail.issueRequest(true);
    }
 });
+
+/*
+Requests that change something must send back the CSRF token, which the server
+keeps in a cookie only this site can read. htmx requests send it as a header and
+forms as a hidden field. The server does not read the body of multipart forms to
+find the token, so file upload forms must be sent by htmx, with hx-boost.
+*/
+function csrfToken() {
+   const cookie = document.cookie.split("; ").find((c) => c.startsWith("aletics_csrf="));
+   return cookie ? decodeURIComponent(cookie.substring("aletics_csrf=".length)) : "";
+}
+
+document.addEventListener("htmx:configRequest", (e) => {
+   e.detail.headers["X-CSRF-Token"] = csrfToken();
+});
+
+document.addEventListener("submit", (e) => {
+   const form = e.target;
+
+   if (form.method.toLowerCase() !== "post") {
+      return;
+   }
+
+   let input = form.querySelector("input[name='csrf_token']");
+
+   if (!input) {
+      input = document.createElement("input");
+      input.type = "hidden";
+      input.name = "csrf_token";
+      form.appendChild(input);
+   }
+
+   input.value = csrfToken();
+});
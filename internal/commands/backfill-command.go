@@ -0,0 +1,81 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+)
+
+type BackfillCommandConfig struct {
+	PropertyService *services.PropertyService
+	RollupService   *services.RollupService
+	Out             io.Writer
+}
+
+/*
+BackfillCommand rebuilds the rollup tables from raw events, for example
+after restoring a backup or changing how rollups are computed.
+
+	aletics backfill-rollups
+	aletics backfill-rollups -property=example.com
+*/
+type BackfillCommand struct {
+	propertyService *services.PropertyService
+	rollupService   *services.RollupService
+	out             io.Writer
+}
+
+func NewBackfillCommand(config BackfillCommandConfig) *BackfillCommand {
+	return &BackfillCommand{
+		propertyService: config.PropertyService,
+		rollupService:   config.RollupService,
+		out:             config.Out,
+	}
+}
+
+func (c *BackfillCommand) Run(ctx context.Context, args []string) error {
+	var (
+		err      error
+		property models.Property
+	)
+
+	flags := flag.NewFlagSet("backfill-rollups", flag.ContinueOnError)
+	flags.SetOutput(c.out)
+
+	propertyFlag := flags.String("property", "", "ID or domain of a single property to rebuild. Rebuilds every property when empty")
+
+	flags.Usage = func() {
+		fmt.Fprintln(c.out, "usage: aletics backfill-rollups [-property=<id or domain>]")
+		flags.PrintDefaults()
+	}
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *propertyFlag != "" {
+		if property, err = findProperty(c.propertyService, *propertyFlag); err != nil {
+			return err
+		}
+	}
+
+	started := time.Now()
+
+	if err = c.rollupService.Backfill(ctx, property.ID, started); err != nil {
+		return err
+	}
+
+	name := "all properties"
+
+	if property.ID != 0 {
+		name = property.Name
+	}
+
+	fmt.Fprintf(c.out, "rebuilt rollups for %s in %s\n", name, time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,17 @@
+package commands
+
+import (
+	"strconv"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+)
+
+// findProperty looks a property up by its ID or, failing that, its domain.
+func findProperty(propertyService *services.PropertyService, idOrDomain string) (models.Property, error) {
+	if id, err := strconv.ParseUint(idOrDomain, 10, 64); err == nil {
+		return propertyService.GetProperty(uint(id))
+	}
+
+	return propertyService.GetPropertyByDomain(idOrDomain)
+}
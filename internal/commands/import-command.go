@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+)
+
+type ImportCommandConfig struct {
+	ImportService   *services.ImportService
+	PropertyService *services.PropertyService
+	Out             io.Writer
+}
+
+/*
+ImportCommand imports historical data exported from another analytics tool.
+
+	aletics import -property=example.com -source=plausible export.zip
+	aletics import -property=3 -source=google-analytics -date=2023-06-01 pages.csv
+	aletics import -property=example.com -source=umami umami.sql
+*/
+type ImportCommand struct {
+	importService   *services.ImportService
+	propertyService *services.PropertyService
+	out             io.Writer
+}
+
+func NewImportCommand(config ImportCommandConfig) *ImportCommand {
+	return &ImportCommand{
+		importService:   config.ImportService,
+		propertyService: config.PropertyService,
+		out:             config.Out,
+	}
+}
+
+func (c *ImportCommand) Run(args []string) error {
+	var (
+		err          error
+		property     models.Property
+		fallbackDate time.Time
+		content      []byte
+		result       models.Import
+	)
+
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(c.out)
+
+	propertyFlag := flags.String("property", "", "ID or domain of the property to import into")
+	sourceFlag := flags.String("source", "", "Tool the files were exported from: "+strings.Join(services.ImportSources, ", "))
+	dateFlag := flags.String("date", "", "Date (YYYY-MM-DD) to use for reports that have no date column")
+
+	flags.Usage = func() {
+		fmt.Fprintln(c.out, "usage: aletics import -property=<id or domain> -source=<source> [-date=YYYY-MM-DD] <file>...")
+		flags.PrintDefaults()
+	}
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *propertyFlag == "" || *sourceFlag == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("property, source and at least one file are required")
+	}
+
+	if property, err = findProperty(c.propertyService, *propertyFlag); err != nil {
+		return err
+	}
+
+	if *dateFlag != "" {
+		if fallbackDate, err = time.Parse("2006-01-02", *dateFlag); err != nil {
+			return fmt.Errorf("invalid date '%s': %w", *dateFlag, err)
+		}
+	}
+
+	for _, fileName := range flags.Args() {
+		if content, err = os.ReadFile(fileName); err != nil {
+			return fmt.Errorf("error reading '%s': %w", fileName, err)
+		}
+
+		if result, err = c.importService.Import(property.ID, *sourceFlag, fileName, content, fallbackDate); err != nil {
+			return fmt.Errorf("error importing '%s': %w", fileName, err)
+		}
+
+		fmt.Fprintf(c.out, "imported %d rows from %s into %s (%s to %s)\n",
+			result.Rows, fileName, property.Name, result.StartDate.Format("2006-01-02"), result.EndDate.Format("2006-01-02"))
+	}
+
+	return nil
+}
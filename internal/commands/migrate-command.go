@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adampresley/aletics/internal/migrations"
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+)
+
+type MigrateCommandConfig struct {
+	MigrationService *services.MigrationService
+	Out              io.Writer
+}
+
+/*
+MigrateCommand applies, reverses or lists schema migrations. The server
+applies pending migrations when it starts, so this is mostly useful for
+rolling back or for migrating ahead of a deployment.
+
+	aletics migrate status
+	aletics migrate up [-to=<version>]
+	aletics migrate down [-steps=<count>]
+*/
+type MigrateCommand struct {
+	migrationService *services.MigrationService
+	out              io.Writer
+}
+
+func NewMigrateCommand(config MigrateCommandConfig) *MigrateCommand {
+	return &MigrateCommand{
+		migrationService: config.MigrationService,
+		out:              config.Out,
+	}
+}
+
+func (c *MigrateCommand) Run(args []string) error {
+	var (
+		err      error
+		statuses []models.MigrationStatus
+		changed  []migrations.Migration
+	)
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(c.out)
+
+	toFlag := flags.Uint("to", 0, "up: version to migrate up to. Applies every pending migration when 0")
+	stepsFlag := flags.Int("steps", 1, "down: number of migrations to reverse")
+
+	flags.Usage = func() {
+		fmt.Fprintln(c.out, "usage: aletics migrate status | up [-to=<version>] | down [-steps=<count>]")
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("a migrate subcommand is required")
+	}
+
+	if err = flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "status":
+		if statuses, err = c.migrationService.Status(); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+
+		for _, status := range statuses {
+			applied := "pending"
+
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Local().Format(time.DateTime)
+			}
+
+			if status.Unknown {
+				applied += " (unknown to this build)"
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+
+		return w.Flush()
+
+	case "up":
+		changed, err = c.migrationService.Up(*toFlag)
+
+		for _, migration := range changed {
+			fmt.Fprintf(c.out, "applied %d %s\n", migration.Version, migration.Name)
+		}
+
+		if err == nil && len(changed) == 0 {
+			fmt.Fprintln(c.out, "the database is up to date")
+		}
+
+		return err
+
+	case "down":
+		if *stepsFlag < 1 {
+			return errors.New("steps must be at least 1")
+		}
+
+		changed, err = c.migrationService.Down(*stepsFlag)
+
+		for _, migration := range changed {
+			fmt.Fprintf(c.out, "reversed %d %s\n", migration.Version, migration.Name)
+		}
+
+		return err
+
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown migrate subcommand '%s'", args[0])
+	}
+}
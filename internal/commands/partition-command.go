@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adampresley/aletics/internal/services"
+)
+
+type PartitionCommandConfig struct {
+	PartitionService *services.PartitionService
+	Out              io.Writer
+}
+
+/*
+PartitionCommand converts the events table on Postgres into a table that
+is partitioned by month. It locks the events table while every event is
+copied, so run it during a quiet period. Once converted, the server keeps
+creating and dropping partitions on its own.
+
+	aletics partition-events
+*/
+type PartitionCommand struct {
+	partitionService *services.PartitionService
+	out              io.Writer
+}
+
+func NewPartitionCommand(config PartitionCommandConfig) *PartitionCommand {
+	return &PartitionCommand{
+		partitionService: config.PartitionService,
+		out:              config.Out,
+	}
+}
+
+func (c *PartitionCommand) Run(args []string) error {
+	var (
+		err error
+	)
+
+	flags := flag.NewFlagSet("partition-events", flag.ContinueOnError)
+	flags.SetOutput(c.out)
+
+	flags.Usage = func() {
+		fmt.Fprintln(c.out, "usage: aletics partition-events")
+		flags.PrintDefaults()
+	}
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	started := time.Now()
+
+	if err = c.partitionService.Partition(started); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "partitioned the events table by month in %s\n", time.Since(started).Round(time.Millisecond))
+	return nil
+}
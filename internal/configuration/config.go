@@ -1,6 +1,9 @@
 package configuration
 
 import (
+	"strings"
+	"time"
+
 	"github.com/adampresley/configinator"
 	"github.com/adampresley/mux"
 )
@@ -8,14 +11,40 @@ import (
 type Config struct {
 	mux.Config
 
-	CookieSecret     string `flag:"cookiesecret" env:"COOKIE_SECRET" default:"password" description:"Secret for encoding coodies"`
-	DSN              string `flag:"dsn" env:"DSN" default:"file:./aletics.db" description:"Database connection"`
-	LogLevel         string `flag:"loglevel" env:"LOG_LEVEL" default:"debug" description:"The log level to use. Valid values are 'debug', 'info', 'warn', and 'error'"`
-	MaxmindAccountID string `flag:"maxmind-account-id" env:"MAXMIND_ACCOUNT_ID" default:"" description:"MaxMind API account ID"`
-	MaxmindApiKey    string `flag:"maxmind-api-key" env:"MAXMIND_API_KEY" default:"" description:"MaxMind API key"`
-	PageSize         int    `flag:"pagesize" env:"PAGE_SIZE" default:"10" description:"The number of items to display per page"`
-	ServerPassword   string `flag:"serverpassword" env:"SERVER_PASSWORD" default:"password" description:"Password for server authentication"`
-	TLD              string `flag:"tld" env:"TLD" default:"localhost:3000" description:"Top-level domain for this server"`
+	AnalyticsDSN           string        `flag:"analytics-dsn" env:"ANALYTICS_DSN" default:"" description:"Optional columnar store for events, 'duckdb:<path>' or a 'clickhouse://' URL. Needs a build with the duckdb or clickhouse tag. Events are kept in the main database when empty"`
+	ArchiveDir             string        `flag:"archive-dir" env:"ARCHIVE_DIR" default:"" description:"When set, pruned events are written to gzipped JSON lines files in this directory instead of being discarded"`
+	AuditRetentionDays     int           `flag:"audit-retention-days" env:"AUDIT_RETENTION_DAYS" default:"365" description:"Days to keep audit log entries. 0 keeps them forever"`
+	CookieSecret           string        `flag:"cookiesecret" env:"COOKIE_SECRET" default:"password" description:"Secret for signing session cookies. The server refuses to start with the default outside development"`
+	DSN                    string        `flag:"dsn" env:"DSN" default:"file:./aletics.db" description:"Database connection, 'file:<path>', a 'postgres://' URL or 'mysql:<user>:<password>@tcp(<host>)/<database>'"`
+	LoginLockoutDuration   time.Duration `flag:"login-lockout-duration" env:"LOGIN_LOCKOUT_DURATION" default:"15m" description:"How long an account or IP address is locked out after too many failed sign in attempts"`
+	LoginMaxAttempts       int           `flag:"login-max-attempts" env:"LOGIN_MAX_ATTEMPTS" default:"5" description:"Failed sign in attempts allowed for an account before it is locked out. 0 turns off lockouts"`
+	LoginMaxAttemptsPerIP  int           `flag:"login-max-attempts-per-ip" env:"LOGIN_MAX_ATTEMPTS_PER_IP" default:"20" description:"Failed sign in attempts allowed from one IP address before it is locked out. In privacy mode they are counted by the full address in memory, and only the truncated address is stored"`
+	LogLevel               string        `flag:"loglevel" env:"LOG_LEVEL" default:"debug" description:"The log level to use. Valid values are 'debug', 'info', 'warn', and 'error'"`
+	MaxmindAccountID       string        `flag:"maxmind-account-id" env:"MAXMIND_ACCOUNT_ID" default:"" description:"MaxMind API account ID"`
+	MaxmindApiKey          string        `flag:"maxmind-api-key" env:"MAXMIND_API_KEY" default:"" description:"MaxMind API key"`
+	OIDCAdminGroups        string        `flag:"oidc-admin-groups" env:"OIDC_ADMIN_GROUPS" default:"" description:"Comma separated groups whose members become server admins when signing in with OpenID Connect. When empty, server admins are managed in Aletics, starting with the one created at /setup"`
+	OIDCAllowedDomains     string        `flag:"oidc-allowed-domains" env:"OIDC_ALLOWED_DOMAINS" default:"" description:"Comma separated email domains allowed to sign in with OpenID Connect. Empty allows any"`
+	OIDCAllowedGroups      string        `flag:"oidc-allowed-groups" env:"OIDC_ALLOWED_GROUPS" default:"" description:"Comma separated groups allowed to sign in with OpenID Connect. Empty allows any"`
+	OIDCClientID           string        `flag:"oidc-client-id" env:"OIDC_CLIENT_ID" default:"" description:"OpenID Connect client ID"`
+	OIDCClientSecret       string        `flag:"oidc-client-secret" env:"OIDC_CLIENT_SECRET" default:"" description:"OpenID Connect client secret"`
+	OIDCGroupsClaim        string        `flag:"oidc-groups-claim" env:"OIDC_GROUPS_CLAIM" default:"groups" description:"The ID token claim that lists a user's groups"`
+	OIDCIssuerURL          string        `flag:"oidc-issuer-url" env:"OIDC_ISSUER_URL" default:"" description:"OpenID Connect issuer URL. Single sign-on is enabled when this is set"`
+	OIDCRedirectURL        string        `flag:"oidc-redirect-url" env:"OIDC_REDIRECT_URL" default:"" description:"The URL the identity provider sends users back to. Defaults to /login/oidc/callback on the TLD"`
+	OIDCScopes             string        `flag:"oidc-scopes" env:"OIDC_SCOPES" default:"openid,email,profile" description:"Comma separated scopes to request from the identity provider"`
+	PageSize               int           `flag:"pagesize" env:"PAGE_SIZE" default:"10" description:"The number of items to display per page"`
+	PartitionMonths        int           `flag:"partition-months" env:"PARTITION_MONTHS" default:"3" description:"When the Postgres events table is partitioned, how many months of partitions to create ahead of time"`
+	PreviousCookieSecrets  string        `flag:"previous-cookie-secrets" env:"PREVIOUS_COOKIE_SECRETS" default:"" description:"Comma separated cookie secrets that are still accepted after rotating COOKIE_SECRET, so that nobody is signed out. Set VISITOR_SALT before rotating, as it defaults to the cookie secret"`
+	PrivacyMode            bool          `flag:"privacy-mode" env:"PRIVACY_MODE" default:"false" description:"When true, client IP addresses are truncated as soon as a request arrives, before any lookup, log line or database write, and signed in sessions keep only the browser name rather than the full user agent"`
+	PropertyDeleteGrace    time.Duration `flag:"property-delete-grace" env:"PROPERTY_DELETE_GRACE" default:"168h" description:"How long a deleted property can be restored before the retention job removes its events for good"`
+	RequireTwoFactor       bool          `flag:"require-two-factor" env:"REQUIRE_TWO_FACTOR" default:"false" description:"When true, every user must set up two-factor authentication before they can use the dashboard"`
+	RetentionDays          int           `flag:"retention-days" env:"RETENTION_DAYS" default:"0" description:"Default number of days to keep raw events. 0 keeps them forever"`
+	RetentionInterval      time.Duration `flag:"retention-interval" env:"RETENTION_INTERVAL" default:"1h" description:"How often the retention job prunes old events"`
+	RollupInterval         time.Duration `flag:"rollup-interval" env:"ROLLUP_INTERVAL" default:"5m" description:"How often completed hours and days are rolled up for faster reports. 0 disables rollups"`
+	SessionAbsoluteTimeout time.Duration `flag:"session-absolute-timeout" env:"SESSION_ABSOLUTE_TIMEOUT" default:"24h" description:"How long after signing in a session ends, however much it is used"`
+	SessionIdleTimeout     time.Duration `flag:"session-idle-timeout" env:"SESSION_IDLE_TIMEOUT" default:"2h" description:"How long a session may go unused before it ends"`
+	TrustedProxies         string        `flag:"trusted-proxies" env:"TRUSTED_PROXIES" default:"" description:"Comma separated IP addresses or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-Ip headers are believed when throttling sign in attempts. When empty, attempts are throttled by the address that connected"`
+	TLD                    string        `flag:"tld" env:"TLD" default:"localhost:3000" description:"Top-level domain for this server"`
+	VisitorSalt            string        `flag:"visitorsalt" env:"VISITOR_SALT" default:"" description:"Secret mixed into anonymous visitor hashes. Defaults to the cookie secret"`
 }
 
 func LoadConfig() Config {
@@ -23,3 +52,30 @@ func LoadConfig() Config {
 	configinator.Behold(&config)
 	return config
 }
+
+/*
+BaseURL returns the URL of this server, built from the TLD. Local servers
+are assumed to use plain HTTP.
+*/
+func (c Config) BaseURL() string {
+	for _, local := range []string{"localhost", "127.0.0.1", "::1"} {
+		if strings.Contains(c.TLD, local) {
+			return "http://" + c.TLD
+		}
+	}
+
+	return "https://" + c.TLD
+}
+
+// SplitList splits a comma separated setting, ignoring blank entries.
+func SplitList(value string) []string {
+	result := []string{}
+
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
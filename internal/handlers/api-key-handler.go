@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+)
+
+type ApiKeyHandler struct {
+	auditService    *services.AuditService
+	apiKeyService   *services.ApiKeyService
+	propertyService *services.PropertyService
+	renderer        rendering.TemplateRenderer
+}
+
+type ApiKeyHandlerConfig struct {
+	AuditService    *services.AuditService
+	ApiKeyService   *services.ApiKeyService
+	PropertyService *services.PropertyService
+	Renderer        rendering.TemplateRenderer
+}
+
+func NewApiKeyHandler(config ApiKeyHandlerConfig) *ApiKeyHandler {
+	return &ApiKeyHandler{
+		auditService:    config.AuditService,
+		apiKeyService:   config.ApiKeyService,
+		propertyService: config.PropertyService,
+		renderer:        config.Renderer,
+	}
+}
+
+func (h *ApiKeyHandler) ManageApiKeysPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/api-keys/manage"
+
+	viewData := viewdata.ManageApiKeys{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	h.loadLists(r, &viewData)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+/*
+CreateApiKeyAction creates a key for the signed in user. A key for all
+properties can only read the properties its creator can.
+*/
+func (h *ApiKeyHandler) CreateApiKeyAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err        error
+		propertyID *uint
+		apiKey     models.APIKey
+	)
+
+	pageName := "pages/api-keys/manage"
+
+	viewData := viewdata.ManageApiKeys{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:        navFor(r),
+		Name:       requests.Get[string](r, "name"),
+		PropertyID: requests.Get[uint](r, "property_id"),
+	}
+
+	user, _ := UserFromContext(r.Context())
+
+	if viewData.PropertyID > 0 {
+		if !authorizeProperty(w, r, h.propertyService, viewData.PropertyID, models.RoleViewer) {
+			return
+		}
+
+		propertyID = &viewData.PropertyID
+	}
+
+	if apiKey, viewData.NewKey, err = h.apiKeyService.CreateAPIKey(viewData.Name, propertyID, &user.ID); err != nil {
+		slog.Error("error creating api key", "name", viewData.Name, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem creating your API key."
+	} else {
+		recordAudit(h.auditService, auditActor(r), models.AuditAPIKeyCreated, apiKeyAuditTarget(apiKey), nil, map[string]any{"prefix": apiKey.Prefix, "propertyID": propertyID})
+
+		viewData.Name = ""
+		viewData.PropertyID = 0
+	}
+
+	h.loadLists(r, &viewData)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+// RevokeApiKey revokes a key. Only server admins may revoke other people's keys.
+func (h *ApiKeyHandler) RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		apiKey models.APIKey
+	)
+
+	id := requests.Get[uint](r, "id")
+	user, _ := UserFromContext(r.Context())
+
+	if apiKey, err = h.apiKeyService.GetAPIKey(id); err != nil || (!user.IsAdmin && (apiKey.UserID == nil || *apiKey.UserID != user.ID)) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err = h.apiKeyService.RevokeAPIKey(id); err != nil {
+		slog.Error("error revoking api key", "error", err, "id", id)
+		return
+	}
+
+	recordAudit(h.auditService, auditActor(r), models.AuditAPIKeyRevoked, apiKeyAuditTarget(apiKey), nil, nil)
+
+	w.Header().Set("HX-Redirect", "/api-keys")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *ApiKeyHandler) loadLists(r *http.Request, viewData *viewdata.ManageApiKeys) {
+	var (
+		err error
+	)
+
+	user, _ := UserFromContext(r.Context())
+	viewData.IsAdmin = user.IsAdmin
+
+	if viewData.ApiKeys, err = h.apiKeyService.ListAPIKeys(user); err != nil {
+		slog.Error("error getting api key list", "error", err)
+		viewData.ApiKeys = []models.APIKey{}
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting your list of API keys."
+	}
+
+	if viewData.Properties, err = h.propertyService.ListProperties(user, ""); err != nil {
+		slog.Error("error getting properties list", "error", err)
+	}
+}
+
+func apiKeyAuditTarget(apiKey models.APIKey) models.AuditTarget {
+	return models.AuditTarget{Type: models.AuditTargetAPIKey, ID: apiKey.ID, Name: apiKey.Name}
+}
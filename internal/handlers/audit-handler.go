@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+)
+
+type AuditHandler struct {
+	auditService *services.AuditService
+	pageSize     int
+	renderer     rendering.TemplateRenderer
+}
+
+type AuditHandlerConfig struct {
+	AuditService *services.AuditService
+	PageSize     int
+	Renderer     rendering.TemplateRenderer
+}
+
+func NewAuditHandler(config AuditHandlerConfig) *AuditHandler {
+	return &AuditHandler{
+		auditService: config.AuditService,
+		pageSize:     config.PageSize,
+		renderer:     config.Renderer,
+	}
+}
+
+// AuditLogPage shows admins who changed what, newest first.
+func (h *AuditHandler) AuditLogPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	pageName := "pages/audit-log/manage"
+
+	viewData := viewdata.AuditLog{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:         navFor(r),
+		Actions:     models.AuditActions,
+		TargetTypes: []string{models.AuditTargetProperty, models.AuditTargetUser, models.AuditTargetAPIKey},
+		Action:      requests.Get[string](r, "action"),
+		Actor:       requests.Get[string](r, "actor"),
+		TargetType:  requests.Get[string](r, "target_type"),
+		From:        requests.Get[string](r, "from"),
+		To:          requests.Get[string](r, "to"),
+		Page:        max(requests.Get[int](r, "page"), 1),
+	}
+
+	filter := models.AuditFilter{
+		Action:     models.AuditAction(viewData.Action),
+		Actor:      viewData.Actor,
+		TargetType: viewData.TargetType,
+		Page:       viewData.Page,
+		PageSize:   h.pageSize,
+	}
+
+	// Dates are whole days, so To includes everything on that day
+	if from, err := time.Parse(time.DateOnly, viewData.From); err == nil {
+		filter.From = from
+	}
+
+	if to, err := time.Parse(time.DateOnly, viewData.To); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	if viewData.Entries, viewData.HasNextPage, err = h.auditService.ListEntries(filter); err != nil {
+		slog.Error("error listing audit log", "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting the audit log."
+	}
+
+	h.renderer.Render(pageName, viewData, w)
+}
+
+// auditActor returns the signed in user making the request.
+func auditActor(r *http.Request) models.Actor {
+	user, _ := UserFromContext(r.Context())
+	return actorFor(user, r)
+}
+
+func actorFor(user models.User, r *http.Request) models.Actor {
+	return models.Actor{UserID: user.ID, Email: user.Email, IP: services.GetIP(r)}
+}
+
+func userAuditTarget(user models.User) models.AuditTarget {
+	return models.AuditTarget{Type: models.AuditTargetUser, ID: user.ID, Name: user.Email}
+}
+
+/*
+recordAudit adds an entry to the audit log. The change has already been
+made, so a failure is logged rather than shown.
+*/
+func recordAudit(auditService *services.AuditService, actor models.Actor, action models.AuditAction, target models.AuditTarget, before, after any) {
+	if err := auditService.Record(actor, action, target, before, after); err != nil {
+		slog.Error("error recording audit entry", "action", action, "error", err)
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+)
+
+/*
+authorizeProperty checks that the signed in user has at least the required
+role on a property. If not, it responds with 404 so that people cannot
+find out which properties exist, and returns false.
+*/
+func authorizeProperty(w http.ResponseWriter, r *http.Request, propertyService *services.PropertyService, propertyID uint, required models.Role) bool {
+	user, _ := UserFromContext(r.Context())
+	err := propertyService.Authorize(user, propertyID, required)
+
+	if err == nil {
+		return true
+	}
+
+	if errors.Is(err, services.ErrAccessDenied) {
+		slog.Error("property access denied", "user", user.ID, "property", propertyID, "required", required)
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return false
+	}
+
+	slog.Error("error authorizing property access", "user", user.ID, "property", propertyID, "error", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	return false
+}
+
+// propertyIDs returns the IDs of a list of properties.
+func propertyIDs(properties []models.Property) []uint {
+	ids := make([]uint, 0, len(properties))
+
+	for _, property := range properties {
+		ids = append(ids, property.ID)
+	}
+
+	return ids
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/adampresley/mux"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// CSRFCookieName holds the token that the page's script reads, to send
+	// it back with forms and htmx requests
+	CSRFCookieName string = "aletics_csrf"
+	CSRFHeaderName string = "X-CSRF-Token"
+	CSRFFormField  string = "csrf_token"
+
+	// maxCSRFFormBytes is how much of a form body is read to find the
+	// token, before the request is authenticated
+	maxCSRFFormBytes int64 = 1 << 20
+)
+
+type CSRFMiddlewareConfig struct {
+	Store sessions.Store
+
+	// Secrets sign the tokens. The first signs new tokens. The rest are old
+	// secrets that are still accepted, like the session cookie's.
+	Secrets []string
+
+	// ExemptPrefixes are paths that are meant to be called from other
+	// sites, and that authenticate with keys rather than the session.
+	ExemptPrefixes []string
+}
+
+/*
+NewCSRFMiddleware protects every request that changes something from
+being forged by another site. POST, PUT, PATCH and DELETE requests must
+send back the token from the aletics_csrf cookie in the X-CSRF-Token
+header or the csrf_token form field. Multipart forms, such as file
+uploads, must use the header, as their bodies are not read here. Requests
+without it get a 403.
+
+Other sites can neither read the cookie nor make a token of their own, as
+each token is signed with the cookie secret and tied to the session it was
+issued for. Keeping the token in a cookie rather than the session means
+visitors who are not signed in are not given a session at all. When
+someone signs in, their session changes, and the next page they load gets
+a new token.
+*/
+func NewCSRFMiddleware(config CSRFMiddlewareConfig) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				err     error
+				session *sessions.Session
+				token   string
+			)
+
+			if slices.ContainsFunc(config.ExemptPrefixes, func(prefix string) bool { return strings.HasPrefix(r.URL.Path, prefix) }) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// An invalid cookie still returns a new, empty session
+			if session, err = config.Store.Get(r, SessionName); err != nil {
+				slog.Debug("error reading session for CSRF token", "error", err)
+			}
+
+			if cookie, err := r.Cookie(CSRFCookieName); err == nil && signedCSRFToken(cookie.Value, session.ID, config.Secrets) {
+				token = cookie.Value
+			} else {
+				token = newCSRFToken(session.ID, config.Secrets[0])
+
+				http.SetCookie(w, &http.Cookie{
+					Name:     CSRFCookieName,
+					Value:    token,
+					Path:     "/",
+					MaxAge:   session.Options.MaxAge,
+					Secure:   session.Options.Secure || r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			if !safeMethod(r.Method) && !validCSRFToken(w, r, token) {
+				slog.Warn("request with a missing or invalid CSRF token", "method", r.Method, "path", r.URL.Path, "ip", r.RemoteAddr)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newCSRFToken returns a random token, signed for the session with the given ID.
+func newCSRFToken(sessionID, secret string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	return nonce + "." + csrfSignature(nonce, sessionID, secret)
+}
+
+/*
+signedCSRFToken returns true if token was made by newCSRFToken for the
+session with the given ID, with any of the secrets.
+*/
+func signedCSRFToken(token, sessionID string, secrets []string) bool {
+	nonce, signature, ok := strings.Cut(token, ".")
+
+	if !ok {
+		return false
+	}
+
+	return slices.ContainsFunc(secrets, func(secret string) bool {
+		return hmac.Equal([]byte(signature), []byte(csrfSignature(nonce, sessionID, secret)))
+	})
+}
+
+func csrfSignature(nonce, sessionID, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("csrf\x00" + sessionID + "\x00" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+/*
+validCSRFToken compares the token sent with a request to the session's.
+Only the first maxCSRFFormBytes of a form body are read, and multipart
+bodies are never read, so that a large upload is not parsed before the
+handler checks who sent it and applies its own limit.
+*/
+func validCSRFToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	submitted := r.Header.Get(CSRFHeaderName)
+
+	if submitted == "" && !isMultipart(r) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxCSRFFormBytes)
+		submitted = r.PostFormValue(CSRFFormField)
+	}
+
+	return submitted != "" && subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) == 1
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, "multipart/")
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func newTestCSRFHandler() http.Handler {
+	return NewCSRFMiddleware(CSRFMiddlewareConfig{
+		Store:          sessions.NewCookieStore([]byte("test secret")),
+		Secrets:        []string{"test secret"},
+		ExemptPrefixes: []string{"/api/"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+/*
+newCSRFSession loads a page the way a browser would, and returns the
+cookies it was given and the token to send back.
+*/
+func newCSRFSession(t *testing.T, handler http.Handler) ([]*http.Cookie, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	cookies := w.Result().Cookies()
+
+	for _, cookie := range cookies {
+		if cookie.Name == CSRFCookieName {
+			return cookies, cookie.Value
+		}
+	}
+
+	t.Fatalf("expected a %s cookie, got %+v", CSRFCookieName, cookies)
+	return nil, ""
+}
+
+func serveWithCookies(handler http.Handler, r *http.Request, cookies []*http.Cookie) int {
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	handler := newTestCSRFHandler()
+	cookies, token := newCSRFSession(t, handler)
+
+	_, otherToken := newCSRFSession(t, handler)
+
+	form := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/properties/create", strings.NewReader(url.Values{CSRFFormField: {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	upload := func(headerToken string) *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField(CSRFFormField, token)
+		writer.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/imports/upload", body)
+		r.Header.Set("Content-Type", writer.FormDataContentType())
+		r.Header.Set(CSRFHeaderName, headerToken)
+		return r
+	}
+
+	large := form(token)
+	large.Body = io.NopCloser(strings.NewReader(strings.Repeat("a=b&", int(maxCSRFFormBytes)) + CSRFFormField + "=" + token))
+
+	header := func(method, token string) *http.Request {
+		r := httptest.NewRequest(method, "/properties/delete/1", nil)
+		r.Header.Set(CSRFHeaderName, token)
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"GET needs no token", httptest.NewRequest(http.MethodGet, "/properties", nil), nil, http.StatusNoContent},
+		{"form field", form(token), cookies, http.StatusNoContent},
+		{"header", header(http.MethodDelete, token), cookies, http.StatusNoContent},
+		{"missing token", form(""), cookies, http.StatusForbidden},
+		{"wrong token", header(http.MethodDelete, "forged"), cookies, http.StatusForbidden},
+		{"another session's token", header(http.MethodPut, otherToken), cookies, http.StatusForbidden},
+		{"no session", form(token), nil, http.StatusForbidden},
+		{"multipart with header", upload(token), cookies, http.StatusNoContent},
+		{"multipart form field", upload(""), cookies, http.StatusForbidden},
+		{"token after the form limit", large, cookies, http.StatusForbidden},
+		{"exempt path", httptest.NewRequest(http.MethodPost, "/api/v1/events", nil), nil, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveWithCookies(handler, tt.request, tt.cookies); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCSRFMiddleware_TokenIsKeptForTheSession(t *testing.T) {
+	handler := newTestCSRFHandler()
+	cookies, _ := newCSRFSession(t, handler)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	handler.ServeHTTP(w, r)
+
+	if setCookies := w.Result().Cookies(); len(setCookies) != 0 {
+		t.Errorf("expected the existing token to be reused without new cookies, got %+v", setCookies)
+	}
+}
+
+/*
+idStore is a sessions.Store whose sessions take their ID from the sid
+cookie, so tokens can be tied to them.
+*/
+type idStore struct{}
+
+func (s idStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return s.New(r, name)
+}
+
+func (s idStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	session.Options = &sessions.Options{MaxAge: 3600}
+
+	if cookie, err := r.Cookie("sid"); err == nil {
+		session.ID = cookie.Value
+	}
+
+	return session, nil
+}
+
+func (s idStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return nil
+}
+
+func TestCSRFMiddleware_TokenIsTiedToTheSession(t *testing.T) {
+	handler := NewCSRFMiddleware(CSRFMiddlewareConfig{
+		Store:   idStore{},
+		Secrets: []string{"new secret", "old secret"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	post := func(sessionID, token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/properties/create", nil)
+		r.Header.Set(CSRFHeaderName, token)
+		r.AddCookie(&http.Cookie{Name: "sid", Value: sessionID})
+		r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: token})
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	token := newCSRFToken("a", "old secret")
+
+	if got := post("a", token); got != http.StatusNoContent {
+		t.Errorf("expected a token signed with a previous secret to be accepted, got %d", got)
+	}
+
+	// A token copied into another session's cookies is no use
+	if got := post("b", token); got != http.StatusForbidden {
+		t.Errorf("expected 403 with another session's token, got %d", got)
+	}
+
+	// Nor is one made up without the secret
+	if got := post("a", "made.up"); got != http.StatusForbidden {
+		t.Errorf("expected 403 with an unsigned token, got %d", got)
+	}
+
+	if got := post("a", newCSRFToken("a", "retired secret")); got != http.StatusForbidden {
+		t.Errorf("expected 403 with a token signed with a retired secret, got %d", got)
+	}
+
+	// Once someone signs in and their session changes, the next page gets a new token
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sid", Value: "b"})
+	r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: token})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || !signedCSRFToken(cookies[0].Value, "b", []string{"new secret"}) {
+		t.Errorf("expected a new token for the new session, got %+v", cookies)
+	}
+}
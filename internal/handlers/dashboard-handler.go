@@ -3,9 +3,11 @@ package handlers
 import (
 	"cmp"
 	"encoding/json"
+	"errors"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/adampresley/aletics/internal/models"
@@ -13,43 +15,67 @@ import (
 	"github.com/adampresley/aletics/internal/viewdata"
 	"github.com/adampresley/httphelpers/requests"
 	"github.com/adampresley/rendering"
-	"github.com/gorilla/sessions"
 )
 
 type DashboardHandler struct {
-	propertyService *services.PropertyService
-	reportService   *services.ReportService
-	renderer        rendering.TemplateRenderer
-	serverPassword  string
-	store           *sessions.CookieStore
+	auditService        *services.AuditService
+	loginAttemptService *services.LoginAttemptService
+	propertyService     *services.PropertyService
+	reportService       *services.ReportService
+	renderer            rendering.TemplateRenderer
+	ssoEnabled          bool
+	store               *services.SessionStore
+	userService         *services.UserService
 }
 
 type DashboardHandlerConfig struct {
-	PropertyService *services.PropertyService
-	ReportService   *services.ReportService
-	Renderer        rendering.TemplateRenderer
-	ServerPassword  string
-	Store           *sessions.CookieStore
+	AuditService        *services.AuditService
+	LoginAttemptService *services.LoginAttemptService
+	PropertyService     *services.PropertyService
+	ReportService       *services.ReportService
+	Renderer            rendering.TemplateRenderer
+	SSOEnabled          bool
+	Store               *services.SessionStore
+	UserService         *services.UserService
 }
 
 func NewDashboardHandler(config DashboardHandlerConfig) *DashboardHandler {
 	return &DashboardHandler{
-		propertyService: config.PropertyService,
-		reportService:   config.ReportService,
-		renderer:        config.Renderer,
-		serverPassword:  config.ServerPassword,
-		store:           config.Store,
+		auditService:        config.AuditService,
+		loginAttemptService: config.LoginAttemptService,
+		propertyService:     config.PropertyService,
+		reportService:       config.ReportService,
+		renderer:            config.Renderer,
+		ssoEnabled:          config.SSOEnabled,
+		store:               config.Store,
+		userService:         config.UserService,
 	}
 }
 
 func (h *DashboardHandler) LoginPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		hasAdmin bool
+	)
+
 	pageName := "pages/login"
 
 	viewData := viewdata.Login{
 		BaseViewModel: rendering.BaseViewModel{
 			IsHtmx: requests.IsHtmx(r),
 		},
-		Password: "",
+		SSOEnabled: h.ssoEnabled,
+	}
+
+	if hasAdmin, err = h.userService.HasAdmin(); err != nil {
+		slog.Error("error checking for an admin", "error", err)
+	}
+
+	// The first admin is created with the setup token, even with single
+	// sign-on, unless the provider has already made someone an admin
+	if err == nil && !hasAdmin {
+		http.Redirect(w, r, "/setup", http.StatusSeeOther)
+		return
 	}
 
 	h.renderer.Render(pageName, viewData, w)
@@ -57,8 +83,10 @@ func (h *DashboardHandler) LoginPage(w http.ResponseWriter, r *http.Request) {
 
 func (h *DashboardHandler) LoginAction(w http.ResponseWriter, r *http.Request) {
 	var (
-		err     error
-		session *sessions.Session
+		err      error
+		user     models.User
+		next     string
+		throttle models.LoginThrottle
 	)
 
 	pageName := "pages/login"
@@ -67,33 +95,41 @@ func (h *DashboardHandler) LoginAction(w http.ResponseWriter, r *http.Request) {
 		BaseViewModel: rendering.BaseViewModel{
 			IsHtmx: requests.IsHtmx(r),
 		},
-		Password: requests.Get[string](r, "password"),
+		Email:      requests.Get[string](r, "email"),
+		SSOEnabled: h.ssoEnabled,
 	}
 
-	if viewData.Password != h.serverPassword {
-		ip := services.GetIP(r)
-		slog.Error("invalid loginn attempt", "ip", ip)
+	ip := throttleIP(r)
+
+	if throttle, err = h.loginAttemptService.Check(viewData.Email, ip); err != nil {
+		slog.Error("error checking login attempts", "error", err)
+	}
+
+	if !throttle.RetryAt.IsZero() {
+		slog.Warn("login attempt throttled", "ip", loggedIP(r), "email", viewData.Email, "lockedOut", throttle.LockedOut)
 
 		viewData.IsError = true
-		viewData.Message = "Invalid password"
+		viewData.Message = loginThrottledMessage(throttle)
 
 		h.renderer.Render(pageName, viewData, w)
 		return
 	}
 
-	if session, err = h.store.Get(r, "aletics_session"); err != nil {
-		slog.Error("error getting session", "error", err)
+	if user, err = h.userService.Authenticate(viewData.Email, requests.Get[string](r, "password")); err != nil {
+		if errors.Is(err, services.ErrInvalidCredentials) {
+			slog.Error("invalid login attempt", "ip", loggedIP(r), "email", viewData.Email)
+			viewData.Message = recordLoginFailure(h.loginAttemptService, r, viewData.Email, models.LoginFailurePassword, "Invalid email or password")
+		} else {
+			slog.Error("error authenticating user", "error", err)
+			viewData.Message = "An unexpected error occurred while validating your password. Please try again"
+		}
 
 		viewData.IsError = true
-		viewData.Message = "An unexpected error occurred while validating your password. Please try again"
-
 		h.renderer.Render(pageName, viewData, w)
 		return
 	}
 
-	session.Values["authenticated"] = true
-
-	if err = session.Save(r, w); err != nil {
+	if next, err = SignIn(h.store, w, r, user); err != nil {
 		slog.Error("error saving session", "error", err)
 
 		viewData.IsError = true
@@ -103,25 +139,28 @@ func (h *DashboardHandler) LoginAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// Users with two-factor authentication have not signed in until they enter their code
+	if !user.TwoFactorEnabled() {
+		if err = h.loginAttemptService.RecordSuccess(user.Email, ip); err != nil {
+			slog.Error("error recording login attempt", "error", err)
+		}
+
+		recordAudit(h.auditService, actorFor(user, r), models.AuditLogin, userAuditTarget(user), nil, map[string]any{"method": "password"})
+	}
+
+	slog.Info("user entered their password", "user", user.ID, "ip", loggedIP(r), "twoFactor", user.TwoFactorEnabled())
+	http.Redirect(w, r, next, http.StatusSeeOther)
 }
 
 func (h *DashboardHandler) LogoutAction(w http.ResponseWriter, r *http.Request) {
-	var (
-		err     error
-		session *sessions.Session
-	)
-
-	if session, err = h.store.Get(r, "aletics_session"); err != nil {
-		slog.Error("error getting session", "error", err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+	if userID, err := SessionUserID(h.store, r); err == nil && userID != 0 {
+		if user, err := h.userService.GetUser(userID); err == nil {
+			recordAudit(h.auditService, actorFor(user, r), models.AuditLogout, userAuditTarget(user), nil, nil)
+		}
 	}
 
-	session.Options.MaxAge = -1
-
-	if err = session.Save(r, w); err != nil {
-		slog.Error("error saving session", "error", err)
+	if err := EndSession(h.store, w, r); err != nil {
+		slog.Error("error ending session", "error", err)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
@@ -154,9 +193,11 @@ func (h *DashboardHandler) DashboardPage(w http.ResponseWriter, r *http.Request)
 	}
 
 	/*
-	 * Get all properties for the dropdown
+	 * Get the properties this user can see for the dropdown
 	 */
-	if properties, err = h.propertyService.ListProperties(""); err != nil {
+	user, _ := UserFromContext(r.Context())
+
+	if properties, err = h.propertyService.ListProperties(user, ""); err != nil {
 		slog.Error("error getting properties list", "error", err)
 	}
 
@@ -166,8 +207,12 @@ func (h *DashboardHandler) DashboardPage(w http.ResponseWriter, r *http.Request)
 	selectedPropertyID = requests.Get[uint](r, "property_id")
 	selectedTimeRange = cmp.Or(requests.Get[string](r, "time_range"), "7d")
 
-	if selectedPropertyID == 0 && len(properties) > 0 {
-		selectedPropertyID = properties[0].ID
+	if !slices.ContainsFunc(properties, func(property models.Property) bool { return property.ID == selectedPropertyID }) {
+		selectedPropertyID = 0
+
+		if len(properties) > 0 {
+			selectedPropertyID = properties[0].ID
+		}
 	}
 
 	start, end, timeframe = calculateDateRange(selectedTimeRange)
@@ -176,6 +221,7 @@ func (h *DashboardHandler) DashboardPage(w http.ResponseWriter, r *http.Request)
 		BaseViewModel: rendering.BaseViewModel{
 			IsHtmx: requests.IsHtmx(r),
 		},
+		Nav:                navFor(r),
 		Properties:         properties,
 		SelectedPropertyID: selectedPropertyID,
 		SelectedTimeRange:  selectedTimeRange,
@@ -239,7 +285,6 @@ func calculateDateRange(timeRange string) (time.Time, time.Time, string) {
 		start = end.AddDate(0, -1, 0)
 	case "6m":
 		start = end.AddDate(0, -6, 0)
-	case "7d":
 	default:
 		start = end.AddDate(0, 0, -7)
 	}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalculateDateRange(t *testing.T) {
+	tests := []struct {
+		timeRange string
+		days      int
+		timeframe string
+	}{
+		{"7d", 7, "daily"},
+		{"30d", 30, "daily"},
+		{"", 7, "daily"},
+		{"24h", 1, "hourly"},
+	}
+
+	for _, tt := range tests {
+		start, end, timeframe := calculateDateRange(tt.timeRange)
+		days := int(end.Sub(start).Round(24*time.Hour) / (24 * time.Hour))
+
+		// Months vary in length, so 30d may be a day either side
+		if days < tt.days-1 || days > tt.days+1 || timeframe != tt.timeframe {
+			t.Errorf("%q: expected about %d days %s, got %d days %s from %s", tt.timeRange, tt.days, tt.timeframe, days, timeframe, start)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/fileuploads"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+)
+
+const (
+	maxImportFileSize int64 = 100 << 20
+)
+
+type ImportHandler struct {
+	importService   *services.ImportService
+	propertyService *services.PropertyService
+	renderer        rendering.TemplateRenderer
+}
+
+type ImportHandlerConfig struct {
+	ImportService   *services.ImportService
+	PropertyService *services.PropertyService
+	Renderer        rendering.TemplateRenderer
+}
+
+func NewImportHandler(config ImportHandlerConfig) *ImportHandler {
+	return &ImportHandler{
+		importService:   config.ImportService,
+		propertyService: config.PropertyService,
+		renderer:        config.Renderer,
+	}
+}
+
+func (h *ImportHandler) ManageImportsPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/imports/manage"
+
+	viewData := viewdata.ManageImports{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	h.loadLists(r, &viewData)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *ImportHandler) UploadImportAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err          error
+		fallbackDate time.Time
+		content      []byte
+		fileName     string
+		result       models.Import
+	)
+
+	pageName := "pages/imports/manage"
+
+	viewData := viewdata.ManageImports{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	err = fileuploads.ReadUploadedFile("file", r, func(file fileuploads.FileUpload, options *fileuploads.UploadOptions) error {
+		var err error
+
+		viewData.PropertyID = requests.Get[uint](r, "property_id")
+		viewData.Source = requests.Get[string](r, "source")
+		viewData.Date = requests.Get[string](r, "date")
+		fileName = r.MultipartForm.File["file"][0].Filename
+
+		content, err = io.ReadAll(file.File)
+		return err
+	}, fileuploads.WithMaxFileSize(maxImportFileSize))
+
+	if err != nil {
+		slog.Error("error reading uploaded import file", "error", err)
+		h.renderError(pageName, r, &viewData, w, "There was a problem reading your uploaded file.")
+		return
+	}
+
+	if !authorizeProperty(w, r, h.propertyService, viewData.PropertyID, models.RoleAdmin) {
+		return
+	}
+
+	if viewData.Date != "" {
+		if fallbackDate, err = time.Parse("2006-01-02", viewData.Date); err != nil {
+			h.renderError(pageName, r, &viewData, w, "The report date must be a valid date.")
+			return
+		}
+	}
+
+	if result, err = h.importService.Import(viewData.PropertyID, viewData.Source, fileName, content, fallbackDate); err != nil {
+		slog.Error("error importing file", "propertyID", viewData.PropertyID, "source", viewData.Source, "fileName", fileName, "error", err)
+
+		message := fmt.Sprintf("There was a problem importing your file: %s", err.Error())
+
+		if errors.Is(err, services.ErrNothingToImport) {
+			message = "No data that Aletics can import was found in your file."
+		}
+
+		h.renderError(pageName, r, &viewData, w, message)
+		return
+	}
+
+	viewData.Message = escapedMessage(fmt.Sprintf("Imported %d rows from %s.", result.Rows, fileName))
+
+	h.loadLists(r, &viewData)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *ImportHandler) DeleteImport(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result models.Import
+	)
+
+	id := requests.Get[uint](r, "id")
+
+	if result, err = h.importService.GetImport(id); err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if !authorizeProperty(w, r, h.propertyService, result.PropertyID, models.RoleAdmin) {
+		return
+	}
+
+	if err = h.importService.DeleteImport(id); err != nil {
+		slog.Error("error deleting import", "error", err, "id", id)
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/imports")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *ImportHandler) renderError(pageName string, r *http.Request, viewData *viewdata.ManageImports, w http.ResponseWriter, message string) {
+	viewData.IsError = true
+	viewData.Message = escapedMessage(message)
+
+	h.loadLists(r, viewData)
+	h.renderer.Render(pageName, *viewData, w)
+}
+
+// loadLists fills in the properties the signed in user may import into.
+func (h *ImportHandler) loadLists(r *http.Request, viewData *viewdata.ManageImports) {
+	var (
+		err error
+	)
+
+	user, _ := UserFromContext(r.Context())
+	viewData.Sources = services.ImportSources
+
+	if viewData.Properties, err = h.propertyService.ListEditableProperties(user); err != nil {
+		slog.Error("error getting properties list", "error", err)
+	}
+
+	if viewData.Imports, err = h.importService.ListImports(propertyIDs(viewData.Properties)); err != nil {
+		slog.Error("error getting import list", "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting your list of imports."
+	}
+}
+
+/*
+escapedMessage converts plain text, which may contain user input such as a
+file name, into a message that is safe to render as HTML.
+*/
+func escapedMessage(message string) template.HTML {
+	return template.HTML(template.HTMLEscapeString(message))
+}
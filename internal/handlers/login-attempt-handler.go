@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+)
+
+// recentLoginFailures is how many failed attempts admins see.
+const recentLoginFailures int = 200
+
+type LoginAttemptHandler struct {
+	loginAttemptService *services.LoginAttemptService
+	renderer            rendering.TemplateRenderer
+}
+
+type LoginAttemptHandlerConfig struct {
+	LoginAttemptService *services.LoginAttemptService
+	Renderer            rendering.TemplateRenderer
+}
+
+func NewLoginAttemptHandler(config LoginAttemptHandlerConfig) *LoginAttemptHandler {
+	return &LoginAttemptHandler{
+		loginAttemptService: config.LoginAttemptService,
+		renderer:            config.Renderer,
+	}
+}
+
+// ManageLoginAttemptsPage shows admins the most recent failed sign in attempts.
+func (h *LoginAttemptHandler) ManageLoginAttemptsPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	pageName := "pages/login-attempts/manage"
+
+	viewData := viewdata.ManageLoginAttempts{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	if viewData.Attempts, err = h.loginAttemptService.ListFailures(recentLoginFailures); err != nil {
+		slog.Error("error listing login attempts", "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting failed sign in attempts."
+	}
+
+	h.renderer.Render(pageName, viewData, w)
+}
+
+/*
+recordLoginFailure records a failed attempt and returns message, or a
+lockout message if this attempt locked the account or IP address.
+*/
+func recordLoginFailure(loginAttemptService *services.LoginAttemptService, r *http.Request, email string, reason models.LoginFailureReason, message template.HTML) template.HTML {
+	var (
+		err      error
+		throttle models.LoginThrottle
+	)
+
+	ip := throttleIP(r)
+
+	if err = loginAttemptService.RecordFailure(email, ip, reason); err != nil {
+		slog.Error("error recording login attempt", "error", err)
+		return message
+	}
+
+	if throttle, err = loginAttemptService.Check(email, ip); err != nil {
+		slog.Error("error checking login attempts", "error", err)
+		return message
+	}
+
+	if throttle.LockedOut {
+		slog.Warn("sign in locked out", "ip", loggedIP(r), "email", email, "until", throttle.RetryAt)
+		return loginThrottledMessage(throttle)
+	}
+
+	return message
+}
+
+// loginThrottledMessage tells someone how long to wait before trying again.
+func loginThrottledMessage(throttle models.LoginThrottle) template.HTML {
+	wait := time.Until(throttle.RetryAt)
+
+	if throttle.LockedOut {
+		minutes := int(math.Ceil(wait.Minutes()))
+		return template.HTML(fmt.Sprintf("Too many failed sign in attempts. Please try again in %d minute(s).", max(minutes, 1)))
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	return template.HTML(fmt.Sprintf("Please wait %d second(s) before trying again.", max(seconds, 1)))
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	oidcSessionName string = "aletics_oidc"
+
+	// oidcLoginMaxAge is how long someone has to sign in at the provider
+	oidcLoginMaxAge int = 10 * 60
+)
+
+type OIDCHandler struct {
+	auditService *services.AuditService
+	oidcService  *services.OIDCService
+	renderer     rendering.TemplateRenderer
+	store        *services.SessionStore
+}
+
+type OIDCHandlerConfig struct {
+	AuditService *services.AuditService
+	OIDCService  *services.OIDCService
+	Renderer     rendering.TemplateRenderer
+	Store        *services.SessionStore
+}
+
+func NewOIDCHandler(config OIDCHandlerConfig) *OIDCHandler {
+	return &OIDCHandler{
+		auditService: config.AuditService,
+		oidcService:  config.OIDCService,
+		renderer:     config.Renderer,
+		store:        config.Store,
+	}
+}
+
+/*
+LoginAction sends someone to the identity provider. The state, nonce and
+PKCE verifier are kept in a short lived cookie until they come back.
+*/
+func (h *OIDCHandler) LoginAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		url     string
+		login   services.OIDCLogin
+		session *sessions.Session
+	)
+
+	if url, login, err = h.oidcService.StartLogin(); err != nil {
+		slog.Error("error starting single sign-on", "error", err)
+		h.renderError(w, r, "An unexpected error occurred while starting single sign-on. Please try again")
+		return
+	}
+
+	if session, err = h.store.Get(r, oidcSessionName); err != nil {
+		slog.Error("error getting session", "error", err)
+	}
+
+	session.Options.MaxAge = oidcLoginMaxAge
+	session.Options.HttpOnly = true
+	session.Values["state"] = login.State
+	session.Values["nonce"] = login.Nonce
+	session.Values["codeVerifier"] = login.CodeVerifier
+
+	if err = session.Save(r, w); err != nil {
+		slog.Error("error saving session", "error", err)
+		h.renderError(w, r, "An unexpected error occurred while starting single sign-on. Please try again")
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// CallbackAction is where the identity provider sends people back to.
+func (h *OIDCHandler) CallbackAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		user    models.User
+		next    string
+		login   services.OIDCLogin
+		session *sessions.Session
+	)
+
+	if session, err = h.store.Get(r, oidcSessionName); err != nil {
+		slog.Error("error getting session", "error", err)
+	}
+
+	login.State, _ = session.Values["state"].(string)
+	login.Nonce, _ = session.Values["nonce"].(string)
+	login.CodeVerifier, _ = session.Values["codeVerifier"].(string)
+
+	// Each sign in request can only be used once
+	session.Options.MaxAge = -1
+
+	if err = session.Save(r, w); err != nil {
+		slog.Error("error saving session", "error", err)
+	}
+
+	if providerError := requests.Get[string](r, "error"); providerError != "" {
+		slog.Error("identity provider returned an error", "error", providerError, "description", requests.Get[string](r, "error_description"))
+		h.renderError(w, r, "Single sign-on was cancelled or failed. Please try again")
+		return
+	}
+
+	user, err = h.oidcService.FinishLogin(r.Context(), login, requests.Get[string](r, "state"), requests.Get[string](r, "code"))
+
+	if err != nil {
+		slog.Error("error finishing single sign-on", "ip", services.GetIP(r), "error", err)
+
+		switch {
+		case errors.Is(err, services.ErrOIDCStateMismatch):
+			h.renderError(w, r, "Your sign in request has expired. Please try again")
+
+		case errors.Is(err, services.ErrOIDCEmailUnverified):
+			h.renderError(w, r, "Your identity provider has not verified your email address.")
+
+		case errors.Is(err, services.ErrOIDCNotAllowed):
+			h.renderError(w, r, "Your account is not allowed to sign in to this server.")
+
+		case errors.Is(err, services.ErrEmailTaken):
+			h.renderError(w, r, "Another account already uses your email address. Ask an admin for help.")
+
+		default:
+			h.renderError(w, r, "An unexpected error occurred during single sign-on. Please try again")
+		}
+
+		return
+	}
+
+	if next, err = SignIn(h.store, w, r, user); err != nil {
+		slog.Error("error saving session", "error", err)
+		h.renderError(w, r, "An unexpected error occurred during single sign-on. Please try again")
+		return
+	}
+
+	if !user.TwoFactorEnabled() {
+		recordAudit(h.auditService, actorFor(user, r), models.AuditLogin, userAuditTarget(user), nil, map[string]any{"method": "single sign-on"})
+	}
+
+	slog.Info("user signed in with single sign-on", "user", user.ID, "ip", services.GetIP(r), "twoFactor", user.TwoFactorEnabled())
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (h *OIDCHandler) renderError(w http.ResponseWriter, r *http.Request, message template.HTML) {
+	viewData := viewdata.Login{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx:  requests.IsHtmx(r),
+			IsError: true,
+			Message: message,
+		},
+		SSOEnabled: true,
+	}
+
+	h.renderer.Render("pages/login", viewData, w)
+}
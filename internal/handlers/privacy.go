@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/adampresley/aletics/internal/services"
+)
+
+/*
+AnonymizeIPMiddleware truncates the client's IP address, with
+services.AnonymizeIP, before anything else sees the request. It replaces
+RemoteAddr and removes the proxy headers that carry the original address,
+so services.GetIP, and everything that uses it, only ever gets the
+truncated address. The full address is kept on the request context, only
+so that a property's excluded IPs can be checked against it, with
+clientIP, and sign in attempts throttled by it, with throttleIP. Neither is
+logged or stored; loggedIP truncates the throttle address for logs.
+
+With it in place, no full IP address reaches a log line, the geo lookup
+cache or MaxMind, or is stored in events, sessions, login attempts or the
+audit log. Events never store the user agent, only the browser name taken
+from it, and their visitor ID is a salted hash of the truncated address
+and user agent that changes every day. TrackerService and SessionStore do
+the rest in privacy mode, for addresses sent to the server events API and
+for the user agents of signed in sessions.
+*/
+func AnonymizeIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fullIP := services.GetIP(r)
+		ip := services.AnonymizeIP(fullIP)
+		ctx := context.WithValue(r.Context(), clientIPContextKey, fullIP)
+		ctx = context.WithValue(ctx, privacyContextKey, true)
+
+		anonymized := r.Clone(ctx)
+		anonymized.Header.Del("X-Forwarded-For")
+		anonymized.Header.Del("X-Real-Ip")
+		anonymized.Header.Del("Forwarded")
+		anonymized.RemoteAddr = net.JoinHostPort(ip, "0")
+
+		next.ServeHTTP(w, anonymized)
+	})
+}
+
+/*
+clientIP returns the client's full address, from before
+AnonymizeIPMiddleware truncated it. It must never be logged or stored.
+*/
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+
+	return services.GetIP(r)
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/rester/clientoptions"
+	"github.com/jellydator/ttlcache/v3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+/*
+TestPrivacyModeStoresNoIPOrUserAgent sends a page view, a server event, a
+sign in and a session through privacy mode, then checks that neither the
+full IP addresses nor the user agent appear in any table, any log line or
+any request to MaxMind.
+*/
+func TestPrivacyModeStoresNoIPOrUserAgent(t *testing.T) {
+	const (
+		browserIP = "203.0.113.77"
+		serverIP  = "2001:db8:1234:5678::99"
+		userAgent = "Mozilla/5.0 (X11; Linux x86_64) Gecko/20100101 Firefox/130.0 FingerprintableAgent"
+	)
+
+	var (
+		logs    bytes.Buffer
+		lookups []string
+		mutex   sync.Mutex
+	)
+
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	maxmind := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		lookups = append(lookups, r.URL.Path)
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"country": {"iso_code": "US", "names": {"en": "United States"}}}`))
+	}))
+
+	defer maxmind.Close()
+
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	if _, err = services.NewMigrationService(services.MigrationServiceConfig{DB: db}).Up(0); err != nil {
+		t.Fatalf("error migrating database: %v", err)
+	}
+
+	property := models.Property{Name: "Site", Domain: "example.com", Token: "token", Active: true}
+	db.Create(&property)
+
+	trackerService := services.NewTrackerService(services.TrackerServiceConfig{
+		DB: db,
+		GeoLocator: services.NewGeoLocator(services.GeoLocatorConfig{
+			IpCache: ttlcache.New(ttlcache.WithTTL[string, *models.CountryLookup](time.Hour)),
+			IpLookupService: services.NewIpLookupService(services.IpLookupServiceConfig{
+				RestConfig: clientoptions.New(maxmind.URL),
+			}),
+		}),
+		PrivacyMode: true,
+		VisitorSalt: "salt",
+	})
+
+	store := services.NewSessionStore(services.SessionStoreConfig{
+		DB:              db,
+		Secrets:         []string{"secret"},
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: time.Hour,
+		PrivacyMode:     true,
+	})
+
+	loginAttempts := services.NewLoginAttemptService(services.LoginAttemptServiceConfig{DB: db, MaxAttempts: 5, MaxAttemptsPerIP: 20, LockoutDuration: time.Hour, PrivacyMode: true})
+	auditService := services.NewAuditService(services.AuditServiceConfig{DB: db})
+	trackerHandler := NewTrackerHandler(TrackerHandlerConfig{TrackerService: trackerService})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /aletics/v1/track", trackerHandler.TrackEvent)
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		ip := throttleIP(r)
+		slog.Info("user entered their password", "ip", loggedIP(r))
+
+		loginAttempts.RecordFailure("ada@example.com", ip, models.LoginFailurePassword)
+		loginAttempts.RecordSuccess("ada@example.com", ip)
+		recordAudit(auditService, actorFor(models.User{Email: "ada@example.com"}, r), models.AuditLogin, models.AuditTarget{}, nil, nil)
+
+		session, _ := store.Get(r, "test")
+		session.Values[services.SessionUserIDKey] = uint(1)
+		session.Save(r, w)
+	})
+
+	handler := NewThrottleIPMiddleware(nil)(AnonymizeIPMiddleware(mux))
+
+	track := httptest.NewRequest(http.MethodPost, "/aletics/v1/track", strings.NewReader(`{"token": "token", "path": "/"}`))
+	track.Header.Set("X-Forwarded-For", browserIP+", 10.0.0.1")
+	track.Header.Set("User-Agent", userAgent)
+	handler.ServeHTTP(httptest.NewRecorder(), track)
+
+	login := httptest.NewRequest(http.MethodPost, "/login", nil)
+	login.RemoteAddr = browserIP + ":4321"
+	login.Header.Set("User-Agent", userAgent)
+	handler.ServeHTTP(httptest.NewRecorder(), login)
+
+	results, err := trackerService.TrackServerEvents(property, []models.ServerEvent{{URL: "/pricing", IP: serverIP, UserAgent: userAgent}})
+
+	if err != nil || results[0].Error != "" {
+		t.Fatalf("error tracking server event: %+v, %v", results, err)
+	}
+
+	// Everything was recorded, with truncated addresses
+	for table, want := range map[string]int64{"events": 2, "sessions": 1, "login_attempts": 2, "audit_entries": 1} {
+		var count int64
+		db.Table(table).Count(&count)
+
+		if count != want {
+			t.Fatalf("expected %d rows in %s, got %d", want, table, count)
+		}
+	}
+
+	var session models.Session
+	db.First(&session)
+
+	if session.IP != "203.0.113.0" || session.UserAgent != "Firefox" {
+		t.Errorf("expected a truncated address and the browser name, got %q and %q", session.IP, session.UserAgent)
+	}
+
+	var country string
+	db.Model(&models.Event{}).Where("path = ?", "/").Pluck("country", &country)
+
+	if country != "United States" {
+		t.Errorf("expected the truncated address to still be located, got %q", country)
+	}
+
+	identifying := []string{browserIP, serverIP, "2001:db8:1234:5678", "FingerprintableAgent"}
+
+	tables, err := db.Migrator().GetTables()
+
+	if err != nil {
+		t.Fatalf("error listing tables: %v", err)
+	}
+
+	for _, table := range tables {
+		var rows []map[string]any
+
+		if err = db.Table(table).Find(&rows).Error; err != nil {
+			t.Fatalf("error reading %s: %v", table, err)
+		}
+
+		b, _ := json.Marshal(rows)
+
+		for _, value := range identifying {
+			if strings.Contains(string(b), value) {
+				t.Errorf("expected %q not to be stored, found it in %s: %s", value, table, b)
+			}
+		}
+	}
+
+	for _, value := range identifying {
+		if strings.Contains(logs.String(), value) {
+			t.Errorf("expected %q not to be logged, got:\n%s", value, logs.String())
+		}
+	}
+
+	for _, path := range lookups {
+		if path != "/country/203.0.113.0" && path != "/country/2001:db8:1234::" {
+			t.Errorf("expected only truncated addresses to be sent to MaxMind, got %s", path)
+		}
+	}
+}
+
+func TestAnonymizeIPMiddleware(t *testing.T) {
+	var got string
+
+	handler := AnonymizeIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = services.GetIP(r) + " " + r.Header.Get("X-Real-Ip")
+	}))
+
+	tests := []struct {
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"198.51.100.23:5000", nil, "198.51.100.0 "},
+		{"[2001:db8:abcd:12::1]:5000", nil, "2001:db8:abcd:: "},
+		{"10.0.0.1:5000", map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.1"}, "203.0.113.0 "},
+		{"10.0.0.1:5000", map[string]string{"X-Real-Ip": "203.0.113.7"}, "203.0.113.0 "},
+		{"not an address", nil, " "},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+
+		for key, value := range tt.headers {
+			r.Header.Set(key, value)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != tt.want {
+			t.Errorf("%s %v: expected %q, got %q", tt.remoteAddr, tt.headers, tt.want, got)
+		}
+	}
+}
+
+/*
+TestPrivacyModeExclusionsUseTheFullIP checks that an excluded address is
+matched before it is truncated, so its neighbours in the same /24 are still
+tracked, for page views and server events alike.
+*/
+func TestPrivacyModeExclusionsUseTheFullIP(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+
+	if _, err = services.NewMigrationService(services.MigrationServiceConfig{DB: db}).Up(0); err != nil {
+		t.Fatalf("error migrating database: %v", err)
+	}
+
+	property := models.Property{Name: "Site", Domain: "example.com", Token: "token", Active: true, ExcludedIPs: "203.0.113.77"}
+	db.Create(&property)
+
+	trackerService := services.NewTrackerService(services.TrackerServiceConfig{DB: db, PrivacyMode: true, VisitorSalt: "salt"})
+	trackerHandler := NewTrackerHandler(TrackerHandlerConfig{TrackerService: trackerService})
+	handler := AnonymizeIPMiddleware(http.HandlerFunc(trackerHandler.TrackEvent))
+
+	for _, ip := range []string{"203.0.113.77", "203.0.113.78"} {
+		r := httptest.NewRequest(http.MethodPost, "/aletics/v1/track", strings.NewReader(`{"token": "token", "path": "/`+ip+`"}`))
+		r.RemoteAddr = ip + ":4321"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	results, err := trackerService.TrackServerEvents(property, []models.ServerEvent{
+		{URL: "/server/203.0.113.77", IP: "203.0.113.77"},
+		{URL: "/server/203.0.113.78", IP: "203.0.113.78"},
+	})
+
+	if err != nil {
+		t.Fatalf("error tracking server events: %v", err)
+	}
+
+	if results[0].Error == "" || results[1].Error != "" {
+		t.Errorf("expected only the excluded address to be rejected, got %+v", results)
+	}
+
+	var paths []string
+	db.Model(&models.Event{}).Order("path").Pluck("path", &paths)
+
+	if want := []string{"/203.0.113.78", "/server/203.0.113.78"}; !slices.Equal(paths, want) {
+		t.Errorf("expected events %v, got %v", want, paths)
+	}
+}
@@ -1,29 +1,37 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/adampresley/aletics/internal/models"
 	"github.com/adampresley/aletics/internal/services"
 	"github.com/adampresley/aletics/internal/viewdata"
 	"github.com/adampresley/httphelpers/requests"
 	"github.com/adampresley/rendering"
+	"gorm.io/gorm"
 )
 
+// maxTokenGracePeriod is the longest an old tracking token is accepted after rotation.
+const maxTokenGracePeriod time.Duration = 30 * 24 * time.Hour
+
 type PropertyHandler struct {
 	propertyService *services.PropertyService
 	renderer        rendering.TemplateRenderer
 	tld             string
+	userService     *services.UserService
 }
 
 type PropertyHandlerConfig struct {
 	PropertyService *services.PropertyService
 	Renderer        rendering.TemplateRenderer
 	TLD             string
+	UserService     *services.UserService
 }
 
 func NewPropertyHandler(config PropertyHandlerConfig) *PropertyHandler {
@@ -31,6 +39,7 @@ func NewPropertyHandler(config PropertyHandlerConfig) *PropertyHandler {
 		propertyService: config.PropertyService,
 		renderer:        config.Renderer,
 		tld:             config.TLD,
+		userService:     config.UserService,
 	}
 }
 
@@ -51,11 +60,17 @@ func (h *PropertyHandler) ManagePropertiesPage(w http.ResponseWriter, r *http.Re
 				},
 			},
 		},
-		Properties: []models.Property{},
-		Name:       requests.Get[string](r, "name"),
+		Nav:                navFor(r),
+		Properties:         []models.Property{},
+		ArchivedProperties: []models.Property{},
+		Name:               requests.Get[string](r, "name"),
+		Roles:              map[uint]models.Role{},
 	}
 
-	if viewData.Properties, err = h.propertyService.ListProperties(viewData.Name); err != nil {
+	user, _ := UserFromContext(r.Context())
+	viewData.IsAdmin = user.IsAdmin
+
+	if viewData.Properties, err = h.propertyService.ListProperties(user, viewData.Name); err != nil {
 		slog.Error("error getting properties list", "error", err)
 		viewData.IsError = true
 		viewData.Message = "There was a problem getting your list of properties."
@@ -64,6 +79,16 @@ func (h *PropertyHandler) ManagePropertiesPage(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	for _, property := range viewData.Properties {
+		if viewData.Roles[property.ID], err = h.propertyService.GetRole(user, property.ID); err != nil {
+			slog.Error("error getting property role", "id", property.ID, "error", err)
+		}
+	}
+
+	if viewData.ArchivedProperties, err = h.propertyService.ListArchivedProperties(user); err != nil {
+		slog.Error("error getting archived properties", "error", err)
+	}
+
 	h.renderer.Render(pageName, viewData, w)
 }
 
@@ -76,6 +101,7 @@ func (h *PropertyHandler) CreatePropertyPage(w http.ResponseWriter, r *http.Requ
 		BaseViewModel: rendering.BaseViewModel{
 			IsHtmx: requests.IsHtmx(r),
 		},
+		Nav: navFor(r),
 		Property: models.Property{
 			Name:   requests.Get[string](r, "name"),
 			Domain: requests.Get[string](r, "domain"),
@@ -97,6 +123,7 @@ func (h *PropertyHandler) CreatePropertyAction(w http.ResponseWriter, r *http.Re
 		BaseViewModel: rendering.BaseViewModel{
 			IsHtmx: requests.IsHtmx(r),
 		},
+		Nav: navFor(r),
 		Property: models.Property{
 			Name:   requests.Get[string](r, "name"),
 			Domain: requests.Get[string](r, "domain"),
@@ -105,7 +132,7 @@ func (h *PropertyHandler) CreatePropertyAction(w http.ResponseWriter, r *http.Re
 		},
 	}
 
-	if _, err = h.propertyService.CreateProperty(viewData.Property.Name, viewData.Property.Domain); err != nil {
+	if _, err = h.propertyService.CreateProperty(auditActor(r), viewData.Property.Name, viewData.Property.Domain); err != nil {
 		slog.Error("error creating property", "name", viewData.Property.Name, "domain", viewData.Property.Domain, "error", err)
 		viewData.IsError = true
 		viewData.Message = "There was a problem creating your property."
@@ -128,12 +155,19 @@ func (h *PropertyHandler) EditPropertyPage(w http.ResponseWriter, r *http.Reques
 		BaseViewModel: rendering.BaseViewModel{
 			IsHtmx: requests.IsHtmx(r),
 		},
+		Nav:           navFor(r),
 		Property:      models.Property{},
 		TrackerScript: "",
 	}
 
 	id := requests.Get[uint](r, "id")
 
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleAdmin) {
+		return
+	}
+
+	viewData.Role = h.currentRole(r, id)
+
 	if viewData.Property, err = h.propertyService.GetProperty(id); err != nil {
 		slog.Error("error getting property", "id", id, "error", err)
 		viewData.IsError = true
@@ -158,37 +192,221 @@ func (h *PropertyHandler) EditPropertyAction(w http.ResponseWriter, r *http.Requ
 		BaseViewModel: rendering.BaseViewModel{
 			IsHtmx: requests.IsHtmx(r),
 		},
+		Nav: navFor(r),
 		Property: models.Property{
-			Name:   requests.Get[string](r, "name"),
-			Domain: requests.Get[string](r, "domain"),
-			Active: requests.Get[bool](r, "active"),
+			Name:          requests.Get[string](r, "name"),
+			Domain:        requests.Get[string](r, "domain"),
+			Active:        requests.Get[bool](r, "active"),
+			RetentionDays: requests.Get[int](r, "retention_days"),
+
+			ExcludedIPs:         requests.Get[string](r, "excluded_ips"),
+			ExcludedPaths:       requests.Get[string](r, "excluded_paths"),
+			StrippedQueryParams: requests.Get[string](r, "stripped_query_params"),
+			PrivacySignals:      models.PrivacySignalMode(requests.Get[string](r, "privacy_signals")),
 		},
 	}
 
 	id := requests.Get[uint](r, "id")
 	viewData.Property.ID = id
 
-	if err = h.propertyService.UpdateProperty(id, viewData.Property); err != nil {
-		slog.Error("error updating property", "id", id, "error", err)
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleAdmin) {
+		return
+	}
+
+	viewData.Role = h.currentRole(r, id)
+
+	if viewData.Property.RetentionDays < models.RetentionForever {
+		viewData.IsError = true
+		viewData.Message = "Retention must be a number of days, 0 for the server default, or -1 to keep events forever."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if err = h.propertyService.UpdateProperty(auditActor(r), id, viewData.Property); err != nil {
+		viewData.IsError = true
+
+		switch {
+		case errors.Is(err, services.ErrInvalidExcludedIP):
+			viewData.Message = "Excluded IPs must be IP addresses, like 203.0.113.7, or CIDR ranges, like 10.0.0.0/8."
+		case errors.Is(err, services.ErrInvalidExcludedPath):
+			viewData.Message = "Excluded paths must start with /."
+		case errors.Is(err, services.ErrInvalidPrivacySignals):
+			viewData.Message = "Choose what to do when visitors ask not to be tracked."
+		case errors.Is(err, services.ErrTrackingSettingTooLong):
+			viewData.Message = "Each exclusion list may be at most 2000 characters."
+		default:
+			slog.Error("error updating property", "id", id, "error", err)
+			viewData.Message = "There was a problem updating your property."
+		}
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if viewData.Property, err = h.propertyService.GetProperty(id); err != nil {
+		slog.Error("error getting property", "id", id, "error", err)
+	}
+
+	viewData.TrackerScript = h.generateTrackerScript(viewData.Property.Token)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+/*
+GenerateSecretKeyAction creates a new private secret key for a property and
+shows it once. Any previous key stops working immediately.
+*/
+func (h *PropertyHandler) GenerateSecretKeyAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	pageName := "pages/properties/edit"
+
+	viewData := viewdata.EditProperty{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	id := requests.Get[uint](r, "id")
+
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleAdmin) {
+		return
+	}
+
+	viewData.Role = h.currentRole(r, id)
+
+	if viewData.NewSecretKey, err = h.propertyService.GenerateSecretKey(auditActor(r), id); err != nil {
+		slog.Error("error generating secret key", "id", id, "error", err)
 		viewData.IsError = true
-		viewData.Message = "There was a problem updating your property."
+		viewData.Message = "There was a problem generating a secret key."
+	}
+
+	if viewData.Property, err = h.propertyService.GetProperty(id); err != nil {
+		slog.Error("error getting property", "id", id, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting your property."
 
 		h.renderer.Render(pageName, viewData, w)
 		return
 	}
 
+	viewData.TrackerScript = h.generateTrackerScript(viewData.Property.Token)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+/*
+RotateTokenAction gives a property a new tracking token. The old one is
+accepted for the chosen grace period while the tracker script is updated.
+*/
+func (h *PropertyHandler) RotateTokenAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err   error
+		grace time.Duration
+	)
+
+	pageName := "pages/properties/edit"
+
+	viewData := viewdata.EditProperty{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	id := requests.Get[uint](r, "id")
+
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleAdmin) {
+		return
+	}
+
+	viewData.Role = h.currentRole(r, id)
+
+	if grace, err = time.ParseDuration(requests.Get[string](r, "grace")); err != nil || grace < 0 || grace > maxTokenGracePeriod {
+		http.Error(w, "Invalid grace period", http.StatusBadRequest)
+		return
+	}
+
+	if viewData.Property, err = h.propertyService.RotateToken(auditActor(r), id, grace); err != nil {
+		slog.Error("error rotating token", "id", id, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem rotating the tracking token."
+
+		if viewData.Property, err = h.propertyService.GetProperty(id); err != nil {
+			slog.Error("error getting property", "id", id, "error", err)
+		}
+	} else {
+		slog.Info("property token rotated", "id", id, "grace", grace)
+		viewData.Message = "The tracking token has been rotated. Update the tracker script on your site."
+	}
+
+	viewData.TrackerScript = h.generateTrackerScript(viewData.Property.Token)
 	h.renderer.Render(pageName, viewData, w)
 }
 
+/*
+DeleteProperty archives a property. The owner confirms by typing its name,
+sent by htmx in the HX-Prompt header. It can be restored until the grace
+period is over.
+*/
 func (h *PropertyHandler) DeleteProperty(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		property models.Property
+	)
+
+	id := requests.Get[uint](r, "id")
+
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleOwner) {
+		return
+	}
+
+	if property, err = h.propertyService.GetProperty(id); err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if strings.TrimSpace(r.Header.Get("HX-Prompt")) != property.Name {
+		http.Error(w, "Type the property's name to delete it", http.StatusBadRequest)
+		return
+	}
+
+	if err = h.propertyService.ArchiveProperty(auditActor(r), id); err != nil {
+		slog.Error("error archiving property", "error", err, "id", id)
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/properties")
+	w.WriteHeader(http.StatusOK)
+}
+
+// RestorePropertyAction brings back a property that was deleted, during the grace period.
+func (h *PropertyHandler) RestorePropertyAction(w http.ResponseWriter, r *http.Request) {
 	var (
 		err error
 	)
 
 	id := requests.Get[uint](r, "id")
 
-	if err = h.propertyService.DeleteProperty(id); err != nil {
-		slog.Error("error deleting property", "error", err, "id", id)
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleOwner) {
+		return
+	}
+
+	if err = h.propertyService.RestoreProperty(auditActor(r), id); err != nil {
+		if errors.Is(err, services.ErrPurgeStarted) {
+			http.Error(w, "The property's data is already being removed", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		slog.Error("error restoring property", "error", err, "id", id)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -196,6 +414,132 @@ func (h *PropertyHandler) DeleteProperty(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 }
 
+/*
+MembersPage lists who has a role on a property. Only owners may see and
+change it.
+*/
+func (h *PropertyHandler) MembersPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/properties/members"
+	id := requests.Get[uint](r, "id")
+
+	viewData := viewdata.PropertyMembers{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:  navFor(r),
+		Role: models.RoleViewer,
+	}
+
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleOwner) {
+		return
+	}
+
+	h.loadMembers(id, &viewData)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+// GrantRoleAction gives the user with the entered email a role on a property.
+func (h *PropertyHandler) GrantRoleAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		user models.User
+	)
+
+	pageName := "pages/properties/members"
+	id := requests.Get[uint](r, "id")
+
+	viewData := viewdata.PropertyMembers{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:   navFor(r),
+		Email: requests.Get[string](r, "email"),
+		Role:  models.Role(requests.Get[string](r, "role")),
+	}
+
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleOwner) {
+		return
+	}
+
+	if user, err = h.userService.GetUserByEmail(viewData.Email); err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.Error("error getting user by email", "error", err)
+		}
+
+		viewData.IsError = true
+		viewData.Message = "There is no user with that email. Ask an admin to create their account first."
+
+		h.loadMembers(id, &viewData)
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if err = h.propertyService.GrantRole(auditActor(r), id, user.ID, viewData.Role); err != nil {
+		slog.Error("error granting role", "property", id, "user", user.ID, "role", viewData.Role, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem granting the role."
+
+		h.loadMembers(id, &viewData)
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/properties/members/%d", id), http.StatusSeeOther)
+}
+
+func (h *PropertyHandler) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	id := requests.Get[uint](r, "id")
+	userID := requests.Get[uint](r, "userID")
+
+	if !authorizeProperty(w, r, h.propertyService, id, models.RoleOwner) {
+		return
+	}
+
+	if err = h.propertyService.RevokeRole(auditActor(r), id, userID); err != nil {
+		slog.Error("error revoking role", "property", id, "user", userID, "error", err)
+		return
+	}
+
+	w.Header().Set("HX-Redirect", fmt.Sprintf("/properties/members/%d", id))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *PropertyHandler) loadMembers(id uint, viewData *viewdata.PropertyMembers) {
+	var (
+		err error
+	)
+
+	viewData.Roles = models.Roles
+
+	if viewData.Property, err = h.propertyService.GetProperty(id); err != nil {
+		slog.Error("error getting property", "id", id, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting your property."
+	}
+
+	if viewData.PropertyRoles, err = h.propertyService.ListPropertyRoles(id); err != nil {
+		slog.Error("error getting property roles", "id", id, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting the people who can see this property."
+	}
+}
+
+// currentRole returns the signed in user's role on a property.
+func (h *PropertyHandler) currentRole(r *http.Request, id uint) models.Role {
+	user, _ := UserFromContext(r.Context())
+	role, err := h.propertyService.GetRole(user, id)
+
+	if err != nil {
+		slog.Error("error getting property role", "id", id, "error", err)
+	}
+
+	return role
+}
+
 func (h *PropertyHandler) generateTrackerScript(token string) template.JS {
 	nonSslTlds := []string{"localhost", "127.0.0.1", "::1"}
 	protocol := "https"
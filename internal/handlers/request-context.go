@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/viewdata"
+)
+
+type contextKey string
+
+const (
+	apiKeyContextKey     contextKey = "apiKey"
+	clientIPContextKey   contextKey = "clientIP"
+	privacyContextKey    contextKey = "privacy"
+	propertyContextKey   contextKey = "property"
+	throttleIPContextKey contextKey = "throttleIP"
+	userContextKey       contextKey = "user"
+)
+
+/*
+WithAPIKey returns a copy of ctx carrying the authenticated API key. This is
+used by the API authentication middleware.
+*/
+func WithAPIKey(ctx context.Context, apiKey models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, apiKey)
+}
+
+// APIKeyFromContext returns the authenticated API key, if there is one.
+func APIKeyFromContext(ctx context.Context) (models.APIKey, bool) {
+	apiKey, ok := ctx.Value(apiKeyContextKey).(models.APIKey)
+	return apiKey, ok
+}
+
+/*
+WithProperty returns a copy of ctx carrying the property authenticated by
+its secret key. This is used by the ingestion API middleware.
+*/
+func WithProperty(ctx context.Context, property models.Property) context.Context {
+	return context.WithValue(ctx, propertyContextKey, property)
+}
+
+// PropertyFromContext returns the authenticated property, if there is one.
+func PropertyFromContext(ctx context.Context) (models.Property, bool) {
+	property, ok := ctx.Value(propertyContextKey).(models.Property)
+	return property, ok
+}
+
+/*
+WithUser returns a copy of ctx carrying the signed in dashboard user. This
+is used by the session authentication middleware.
+*/
+func WithUser(ctx context.Context, user models.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the signed in user, if there is one.
+func UserFromContext(ctx context.Context) (models.User, bool) {
+	user, ok := ctx.Value(userContextKey).(models.User)
+	return user, ok
+}
+
+// navFor returns what the main layout shows the signed in user.
+func navFor(r *http.Request) viewdata.Nav {
+	user, _ := UserFromContext(r.Context())
+	return viewdata.Nav{ShowAdminLinks: user.IsAdmin}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+)
+
+type RetentionHandler struct {
+	retentionService *services.RetentionService
+	renderer         rendering.TemplateRenderer
+}
+
+type RetentionHandlerConfig struct {
+	RetentionService *services.RetentionService
+	Renderer         rendering.TemplateRenderer
+}
+
+func NewRetentionHandler(config RetentionHandlerConfig) *RetentionHandler {
+	return &RetentionHandler{
+		retentionService: config.RetentionService,
+		renderer:         config.Renderer,
+	}
+}
+
+func (h *RetentionHandler) ManageRetentionPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/retention/manage"
+
+	viewData := viewdata.ManageRetention{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	h.loadSummaries(&viewData)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+/*
+PruneNowAction runs the retention job immediately instead of waiting for
+its next scheduled run.
+*/
+func (h *RetentionHandler) PruneNowAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		result models.PruneResult
+	)
+
+	pageName := "pages/retention/manage"
+
+	viewData := viewdata.ManageRetention{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	if result, err = h.retentionService.Prune(r.Context(), time.Now()); err != nil {
+		viewData.IsError = true
+		viewData.Message = "There was a problem pruning old events."
+
+		if errors.Is(err, services.ErrPruneRunning) {
+			viewData.Message = "The retention job is already running. Try again when it has finished."
+		} else {
+			slog.Error("error pruning events", "error", err)
+		}
+	} else {
+		viewData.Message = escapedMessage(fmt.Sprintf("Removed %d events.", result.Deleted))
+	}
+
+	h.loadSummaries(&viewData)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *RetentionHandler) loadSummaries(viewData *viewdata.ManageRetention) {
+	var (
+		err error
+	)
+
+	viewData.DefaultRetentionDays = h.retentionService.DefaultRetentionDays()
+	viewData.LastRun = h.retentionService.LastRun()
+
+	if viewData.Summaries, err = h.retentionService.ListRetentionSummaries(); err != nil {
+		slog.Error("error getting retention summaries", "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting your stored event counts."
+	}
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	SessionName string = "aletics_session"
+
+	sessionUserIDKey        string = services.SessionUserIDKey
+	sessionPendingUserIDKey string = "pending_user_id"
+	sessionPendingAtKey     string = "pending_at"
+
+	// twoFactorTimeout is how long someone has to enter their two-factor
+	// code after their password
+	twoFactorTimeout time.Duration = 5 * time.Minute
+)
+
+/*
+SignIn is called once a user has proved who they are, with a password or
+single sign-on. Users with two-factor authentication must then enter a
+code, so they are only signed in part way. It returns the page to send
+them to next.
+*/
+func SignIn(store *services.SessionStore, w http.ResponseWriter, r *http.Request, user models.User) (string, error) {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if !user.TwoFactorEnabled() {
+		return "/", StartSession(store, w, r, user)
+	}
+
+	if session, err = store.Get(r, SessionName); err != nil {
+		return "", err
+	}
+
+	delete(session.Values, sessionUserIDKey)
+	session.Values[sessionPendingUserIDKey] = user.ID
+	session.Values[sessionPendingAtKey] = time.Now().Unix()
+
+	return "/login/two-factor", session.Save(r, w)
+}
+
+/*
+StartSession signs a user in by storing their ID in the session. The
+session gets a new ID, so one planted in the browser beforehand cannot be
+used to ride along.
+*/
+func StartSession(store *services.SessionStore, w http.ResponseWriter, r *http.Request, user models.User) error {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = store.Get(r, SessionName); err != nil {
+		return err
+	}
+
+	if err = store.Renew(session); err != nil {
+		return err
+	}
+
+	delete(session.Values, sessionPendingUserIDKey)
+	delete(session.Values, sessionPendingAtKey)
+	session.Values[sessionUserIDKey] = user.ID
+	return session.Save(r, w)
+}
+
+// EndSession signs the current user out.
+func EndSession(store *services.SessionStore, w http.ResponseWriter, r *http.Request) error {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = store.Get(r, SessionName); err != nil {
+		return err
+	}
+
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
+
+/*
+SessionUserID returns the ID of the user signed in to the session. It
+returns 0 if nobody is signed in.
+*/
+func SessionUserID(store *services.SessionStore, r *http.Request) (uint, error) {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = store.Get(r, SessionName); err != nil {
+		return 0, err
+	}
+
+	id, _ := session.Values[sessionUserIDKey].(uint)
+	return id, nil
+}
+
+/*
+PendingTwoFactorUserID returns the ID of the user who entered their
+password but not yet their two-factor code. It returns 0 if there is
+nobody, or if they took too long.
+*/
+func PendingTwoFactorUserID(store *services.SessionStore, r *http.Request) (uint, error) {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	if session, err = store.Get(r, SessionName); err != nil {
+		return 0, err
+	}
+
+	id, _ := session.Values[sessionPendingUserIDKey].(uint)
+	pendingAt, _ := session.Values[sessionPendingAtKey].(int64)
+
+	if time.Since(time.Unix(pendingAt, 0)) > twoFactorTimeout {
+		return 0, nil
+	}
+
+	return id, nil
+}
@@ -0,0 +1,491 @@
+package handlers
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/httphelpers/responses"
+	"gorm.io/gorm"
+)
+
+/*
+The stats API is a compatible subset of Plausible's Stats API (v1), so
+existing scripts and dashboards written against Plausible can be pointed
+at Aletics. See https://plausible.io/docs/stats-api-v1.
+*/
+
+const (
+	apiDateFormat string = "2006-01-02"
+
+	// maxCustomPeriodDays bounds a custom period, and maxTimeseriesBuckets
+	// how many buckets a timeseries may fill, as every empty bucket is
+	// still returned
+	maxCustomPeriodDays  int = 3660
+	maxTimeseriesBuckets int = 10000
+
+	// maxBreakdownLimit is Plausible's own limit. maxBreakdownRows bounds
+	// how deep pages can go, as every row up to the page is read
+	maxBreakdownLimit int = 1000
+	maxBreakdownRows  int = 10000
+)
+
+/*
+statsApiProperties maps Plausible property names, used by breakdowns and
+filters, to report dimensions.
+*/
+var statsApiProperties = map[string]string{
+	"event:page":         "path",
+	"visit:browser":      "browser",
+	"visit:country":      "country_code",
+	"visit:country_name": "country",
+}
+
+var statsApiMetrics = []string{"visitors", "pageviews", "events"}
+
+type StatsApiHandler struct {
+	propertyService *services.PropertyService
+	reportService   *services.ReportService
+}
+
+type StatsApiHandlerConfig struct {
+	PropertyService *services.PropertyService
+	ReportService   *services.ReportService
+}
+
+func NewStatsApiHandler(config StatsApiHandlerConfig) *StatsApiHandler {
+	return &StatsApiHandler{
+		propertyService: config.PropertyService,
+		reportService:   config.ReportService,
+	}
+}
+
+type statsQuery struct {
+	PropertyID uint
+	Period     string
+	Start      time.Time
+	End        time.Time
+	Metrics    []string
+	Filters    []models.ReportFilter
+}
+
+type statsError struct {
+	status  int
+	message string
+}
+
+func (e statsError) Error() string {
+	return e.message
+}
+
+/*
+Aggregate returns summary numbers for a site.
+
+	GET /api/v1/stats/aggregate?site_id=example.com&period=30d&metrics=visitors,pageviews
+*/
+func (h *StatsApiHandler) Aggregate(w http.ResponseWriter, r *http.Request) {
+	var (
+		err   error
+		query statsQuery
+		stats models.AggregateStats
+	)
+
+	if query, err = h.parseQuery(r); err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	if stats, err = h.reportService.GetAggregate(query.PropertyID, query.Start, query.End, query.Filters); err != nil {
+		slog.Error("error getting aggregate stats", "propertyID", query.PropertyID, "error", err)
+		writeStatsError(w, statsError{status: http.StatusInternalServerError, message: "error retrieving aggregate stats"})
+		return
+	}
+
+	results := map[string]any{}
+
+	for _, metric := range query.Metrics {
+		results[metric] = map[string]int{"value": metricValue(metric, stats.Pageviews, stats.Visitors)}
+	}
+
+	responses.JsonOK(w, map[string]any{"results": results})
+}
+
+/*
+Timeseries returns numbers for each time bucket in the period. The
+interval may be "hour", "date" or "month", and defaults to "hour" for a
+single day, "month" for 6mo and 12mo, and "date" otherwise.
+
+	GET /api/v1/stats/timeseries?site_id=example.com&period=6mo&interval=month
+*/
+func (h *StatsApiHandler) Timeseries(w http.ResponseWriter, r *http.Request) {
+	var (
+		err   error
+		query statsQuery
+		items []models.TimeseriesItem
+	)
+
+	if query, err = h.parseQuery(r); err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	interval := requests.Get[string](r, "interval")
+
+	if interval == "" {
+		switch query.Period {
+		case "day":
+			interval = "hour"
+		case "6mo", "12mo":
+			interval = "month"
+		default:
+			interval = "date"
+		}
+	}
+
+	if _, ok := services.TimeseriesIntervals[interval]; !ok {
+		writeStatsError(w, statsError{status: http.StatusBadRequest, message: fmt.Sprintf("invalid interval '%s'. Valid intervals are 'hour', 'date' and 'month'", interval)})
+		return
+	}
+
+	if timeseriesBuckets(query.Start, query.End, interval) > maxTimeseriesBuckets {
+		writeStatsError(w, statsError{status: http.StatusBadRequest, message: fmt.Sprintf("the period has more than %d %s intervals. Use a shorter period or a longer interval", maxTimeseriesBuckets, interval)})
+		return
+	}
+
+	if items, err = h.reportService.GetTimeseries(query.PropertyID, query.Start, query.End, interval, query.Filters); err != nil {
+		slog.Error("error getting timeseries stats", "propertyID", query.PropertyID, "error", err)
+		writeStatsError(w, statsError{status: http.StatusInternalServerError, message: "error retrieving timeseries stats"})
+		return
+	}
+
+	results := make([]map[string]any, 0, len(items))
+
+	for _, item := range items {
+		row := map[string]any{"date": item.Label}
+
+		for _, metric := range query.Metrics {
+			row[metric] = metricValue(metric, item.Pageviews, item.Visitors)
+		}
+
+		results = append(results, row)
+	}
+
+	responses.JsonOK(w, map[string]any{"results": results})
+}
+
+/*
+Breakdown returns numbers grouped by a property such as event:page,
+visit:browser, visit:country or visit:country_name.
+
+	GET /api/v1/stats/breakdown?site_id=example.com&property=event:page&limit=10
+*/
+func (h *StatsApiHandler) Breakdown(w http.ResponseWriter, r *http.Request) {
+	var (
+		err       error
+		query     statsQuery
+		items     []models.BreakdownItem
+		dimension string
+		ok        bool
+	)
+
+	if query, err = h.parseQuery(r); err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	property := cmp.Or(requests.Get[string](r, "property"), "event:page")
+
+	if dimension, ok = statsApiProperties[property]; !ok {
+		writeStatsError(w, statsError{status: http.StatusBadRequest, message: fmt.Sprintf("invalid property '%s'", property)})
+		return
+	}
+
+	limit, page, err := parseBreakdownPaging(r)
+
+	if err != nil {
+		writeStatsError(w, err)
+		return
+	}
+
+	if items, err = h.reportService.GetBreakdown(query.PropertyID, query.Start, query.End, dimension, limit*page, query.Filters); err != nil {
+		slog.Error("error getting breakdown stats", "propertyID", query.PropertyID, "property", property, "error", err)
+		writeStatsError(w, statsError{status: http.StatusInternalServerError, message: "error retrieving breakdown stats"})
+		return
+	}
+
+	key := property[strings.Index(property, ":")+1:]
+	results := make([]map[string]any, 0, limit)
+
+	for _, item := range items[min(limit*(page-1), len(items)):] {
+		row := map[string]any{key: item.Value}
+
+		for _, metric := range query.Metrics {
+			row[metric] = metricValue(metric, item.Pageviews, item.Visitors)
+		}
+
+		results = append(results, row)
+	}
+
+	responses.JsonOK(w, map[string]any{"results": results})
+}
+
+/*
+parseBreakdownPaging reads the limit, which defaults to 100, and the page,
+which starts at 1.
+*/
+func parseBreakdownPaging(r *http.Request) (int, int, error) {
+	limit := 100
+	page := 1
+
+	if requests.Get[string](r, "limit") != "" {
+		if limit = requests.Get[int](r, "limit"); limit < 1 || limit > maxBreakdownLimit {
+			return 0, 0, statsError{status: http.StatusBadRequest, message: fmt.Sprintf("the limit must be a number between 1 and %d", maxBreakdownLimit)}
+		}
+	}
+
+	if requests.Get[string](r, "page") != "" {
+		if page = requests.Get[int](r, "page"); page < 1 {
+			return 0, 0, statsError{status: http.StatusBadRequest, message: "the page must be a number of at least 1"}
+		}
+	}
+
+	if page > maxBreakdownRows/limit {
+		return 0, 0, statsError{status: http.StatusBadRequest, message: fmt.Sprintf("pages can reach at most %d results", maxBreakdownRows)}
+	}
+
+	return limit, page, nil
+}
+
+/*
+parseQuery reads the parameters common to every stats endpoint, resolves
+site_id to a property and verifies the authenticated API key may read it.
+*/
+func (h *StatsApiHandler) parseQuery(r *http.Request) (statsQuery, error) {
+	var (
+		err      error
+		result   statsQuery
+		apiKey   models.APIKey
+		property models.Property
+		ok       bool
+	)
+
+	if apiKey, ok = APIKeyFromContext(r.Context()); !ok {
+		return result, statsError{status: http.StatusUnauthorized, message: "missing api key"}
+	}
+
+	siteID := requests.Get[string](r, "site_id")
+
+	if siteID == "" {
+		return result, statsError{status: http.StatusBadRequest, message: "missing site ID. Please provide the required site_id parameter with your request"}
+	}
+
+	if property, err = h.propertyService.GetPropertyByDomain(siteID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return result, statsError{status: http.StatusUnauthorized, message: "invalid api key or site id. Please make sure you're using a valid api key with access to the site you've requested"}
+		}
+
+		return result, fmt.Errorf("error retrieving property by domain: %w", err)
+	}
+
+	if err = h.propertyService.AuthorizeAPIKey(apiKey, property.ID); err != nil {
+		if errors.Is(err, services.ErrAccessDenied) {
+			return result, statsError{status: http.StatusUnauthorized, message: "invalid api key or site id. Please make sure you're using a valid api key with access to the site you've requested"}
+		}
+
+		return result, err
+	}
+
+	result.PropertyID = property.ID
+	result.Period = cmp.Or(requests.Get[string](r, "period"), "30d")
+
+	if result.Start, result.End, err = calculatePeriod(result.Period, requests.Get[string](r, "date"), time.Now()); err != nil {
+		return result, statsError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	for metric := range strings.SplitSeq(cmp.Or(requests.Get[string](r, "metrics"), "visitors"), ",") {
+		metric = strings.TrimSpace(metric)
+
+		if !slices.Contains(statsApiMetrics, metric) {
+			return result, statsError{status: http.StatusBadRequest, message: fmt.Sprintf("the metric '%s' is not recognized", metric)}
+		}
+
+		result.Metrics = append(result.Metrics, metric)
+	}
+
+	if result.Filters, err = parseStatsFilters(requests.Get[string](r, "filters")); err != nil {
+		return result, statsError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	return result, nil
+}
+
+/*
+calculatePeriod turns a Plausible period into a time range. The date
+parameter anchors day, 7d, 30d, month, 6mo, 12mo and year periods and
+defaults to today. For a custom period it holds the start and end dates
+separated by a comma.
+*/
+func calculatePeriod(period, date string, now time.Time) (time.Time, time.Time, error) {
+	var (
+		err        error
+		anchor     time.Time
+		start, end time.Time
+	)
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	endOfDay := func(t time.Time) time.Time { return t.AddDate(0, 0, 1).Add(-time.Nanosecond) }
+
+	if period == "custom" {
+		dates := strings.Split(date, ",")
+
+		if len(dates) != 2 {
+			return start, end, fmt.Errorf("the 'date' parameter must be two dates separated by a comma for a custom period")
+		}
+
+		if start, err = time.Parse(apiDateFormat, strings.TrimSpace(dates[0])); err != nil {
+			return start, end, fmt.Errorf("invalid start date '%s'. Dates must be formatted as YYYY-MM-DD", dates[0])
+		}
+
+		if end, err = time.Parse(apiDateFormat, strings.TrimSpace(dates[1])); err != nil {
+			return start, end, fmt.Errorf("invalid end date '%s'. Dates must be formatted as YYYY-MM-DD", dates[1])
+		}
+
+		if end.Before(start) {
+			return start, end, fmt.Errorf("the end date of a custom period must not be before its start date")
+		}
+
+		if end.Sub(start) > time.Duration(maxCustomPeriodDays)*24*time.Hour {
+			return start, end, fmt.Errorf("a custom period may span at most %d days", maxCustomPeriodDays)
+		}
+
+		return start, endOfDay(end), nil
+	}
+
+	anchor = today
+
+	if date != "" {
+		if anchor, err = time.Parse(apiDateFormat, date); err != nil {
+			return start, end, fmt.Errorf("invalid date '%s'. Dates must be formatted as YYYY-MM-DD", date)
+		}
+	}
+
+	firstOfMonth := time.Date(anchor.Year(), anchor.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case "day":
+		return anchor, endOfDay(anchor), nil
+	case "7d":
+		return anchor.AddDate(0, 0, -6), endOfDay(anchor), nil
+	case "30d":
+		return anchor.AddDate(0, 0, -29), endOfDay(anchor), nil
+	case "month":
+		return firstOfMonth, firstOfMonth.AddDate(0, 1, 0).Add(-time.Nanosecond), nil
+	case "6mo":
+		return firstOfMonth.AddDate(0, -5, 0), firstOfMonth.AddDate(0, 1, 0).Add(-time.Nanosecond), nil
+	case "12mo":
+		return firstOfMonth.AddDate(0, -11, 0), firstOfMonth.AddDate(0, 1, 0).Add(-time.Nanosecond), nil
+	case "year":
+		firstOfYear := time.Date(anchor.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		return firstOfYear, firstOfYear.AddDate(1, 0, 0).Add(-time.Nanosecond), nil
+	}
+
+	return start, end, fmt.Errorf("invalid period '%s'. Valid periods are 'day', '7d', '30d', 'month', '6mo', '12mo', 'year' and 'custom'", period)
+}
+
+// timeseriesBuckets returns how many buckets of interval a timeseries from start to end has.
+func timeseriesBuckets(start, end time.Time, interval string) int {
+	switch interval {
+	case "hour":
+		return int(end.Sub(start)/time.Hour) + 1
+	case "month":
+		return (end.Year()-start.Year())*12 + int(end.Month()) - int(start.Month()) + 1
+	default:
+		return int(end.Sub(start)/(24*time.Hour)) + 1
+	}
+}
+
+/*
+parseStatsFilters parses Plausible's filter syntax. Filters are separated
+by ";", each is a property, an operator of "==" or "!=" and one or more
+values separated by "|". Values may contain "*" wildcards.
+
+	event:page==/blog/**;visit:browser!=Chrome|Firefox
+*/
+func parseStatsFilters(value string) ([]models.ReportFilter, error) {
+	var (
+		result = []models.ReportFilter{}
+	)
+
+	if strings.TrimSpace(value) == "" {
+		return result, nil
+	}
+
+	for expression := range strings.SplitSeq(value, ";") {
+		var (
+			filter   models.ReportFilter
+			operator = "=="
+		)
+
+		if strings.Contains(expression, "!=") {
+			operator = "!="
+			filter.Negate = true
+		}
+
+		parts := strings.SplitN(expression, operator, 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid filter '%s'", expression)
+		}
+
+		property := strings.TrimSpace(parts[0])
+		dimension, ok := statsApiProperties[property]
+
+		if !ok {
+			return nil, fmt.Errorf("invalid filter property '%s'", property)
+		}
+
+		filter.Dimension = dimension
+
+		for v := range strings.SplitSeq(parts[1], "|") {
+			filter.Values = append(filter.Values, strings.TrimSpace(v))
+		}
+
+		result = append(result, filter)
+	}
+
+	return result, nil
+}
+
+/*
+metricValue returns the number for a metric. Aletics only records
+pageviews, so "events" is the same as "pageviews".
+*/
+func metricValue(metric string, pageviews, visitors int) int {
+	if metric == "visitors" {
+		return visitors
+	}
+
+	return pageviews
+}
+
+func writeStatsError(w http.ResponseWriter, err error) {
+	var (
+		se statsError
+	)
+
+	if errors.As(err, &se) {
+		responses.Json(w, se.status, map[string]string{"error": se.message})
+		return
+	}
+
+	slog.Error("error handling stats api request", "error", err)
+	responses.Json(w, http.StatusInternalServerError, map[string]string{"error": "an unexpected error occurred"})
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func TestParseStatsFilters(t *testing.T) {
+	filters, err := parseStatsFilters("event:page==/blog/**;visit:browser!=Chrome|Firefox")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []models.ReportFilter{
+		{Dimension: "path", Values: []string{"/blog/**"}},
+		{Dimension: "browser", Negate: true, Values: []string{"Chrome", "Firefox"}},
+	}
+
+	if !reflect.DeepEqual(filters, expected) {
+		t.Errorf("expected %+v, got %+v", expected, filters)
+	}
+
+	for _, invalid := range []string{"visit:source==Google", "event:page", "event:page~=/"} {
+		if _, err = parseStatsFilters(invalid); err == nil {
+			t.Errorf("expected an error for filter %q", invalid)
+		}
+	}
+}
+
+func TestCalculatePeriod(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		period, date string
+		start, end   string
+	}{
+		{period: "day", start: "2026-03-10", end: "2026-03-10"},
+		{period: "7d", start: "2026-03-04", end: "2026-03-10"},
+		{period: "30d", date: "2026-02-28", start: "2026-01-30", end: "2026-02-28"},
+		{period: "month", start: "2026-03-01", end: "2026-03-31"},
+		{period: "6mo", start: "2025-10-01", end: "2026-03-31"},
+		{period: "12mo", start: "2025-04-01", end: "2026-03-31"},
+		{period: "year", start: "2026-01-01", end: "2026-12-31"},
+		{period: "custom", date: "2026-01-05,2026-01-07", start: "2026-01-05", end: "2026-01-07"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			start, end, err := calculatePeriod(tt.period, tt.date, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if start.Format(apiDateFormat) != tt.start || end.Format(apiDateFormat) != tt.end {
+				t.Errorf("expected %s - %s, got %s - %s", tt.start, tt.end, start, end)
+			}
+
+			if !start.Equal(start.Truncate(24 * time.Hour)) {
+				t.Errorf("expected start to be midnight, got %s", start)
+			}
+		})
+	}
+
+	if _, _, err := calculatePeriod("custom", "2026-01-05", now); err == nil {
+		t.Error("expected an error for a custom period with one date")
+	}
+
+	if _, _, err := calculatePeriod("realtime", "", now); err == nil {
+		t.Error("expected an error for an unsupported period")
+	}
+
+	if _, _, err := calculatePeriod("custom", "2026-01-07,2026-01-05", now); err == nil {
+		t.Error("expected an error for a custom period that ends before it starts")
+	}
+
+	if _, _, err := calculatePeriod("custom", "1000-01-01,2026-01-05", now); err == nil {
+		t.Error("expected an error for an unbounded custom period")
+	}
+}
+
+func TestParseBreakdownPaging(t *testing.T) {
+	tests := []struct {
+		query       string
+		limit, page int
+		wantErr     bool
+	}{
+		{query: "", limit: 100, page: 1},
+		{query: "limit=10&page=3", limit: 10, page: 3},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=-1", wantErr: true},
+		{query: "limit=-5&page=2", wantErr: true},
+		{query: "limit=abc", wantErr: true},
+		{query: "limit=5000", wantErr: true},
+		{query: "page=0", wantErr: true},
+		{query: "limit=1000&page=11", wantErr: true},
+		{query: "limit=2&page=9223372036854775807", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/breakdown?"+tt.query, nil)
+		limit, page, err := parseBreakdownPaging(r)
+
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got limit %d and page %d", tt.query, limit, page)
+			}
+
+			continue
+		}
+
+		if err != nil || limit != tt.limit || page != tt.page {
+			t.Errorf("%s: expected limit %d and page %d, got %d, %d and %v", tt.query, tt.limit, tt.page, limit, page, err)
+		}
+	}
+}
+
+func TestTimeseriesBuckets(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 12, 31, 23, 59, 59, 0, time.UTC)
+
+	for interval, want := range map[string]int{"hour": 8760, "date": 365, "month": 12} {
+		if got := timeseriesBuckets(start, end, interval); got != want {
+			t.Errorf("%s: expected %d buckets, got %d", interval, want, got)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+
+	"github.com/adampresley/aletics/internal/services"
+)
+
+/*
+NewThrottleIPMiddleware works out the address that sign in attempts are
+throttled by, with services.GetTrustedIP, so that nobody can dodge a
+lockout by sending a different X-Forwarded-For with each attempt. It must
+run before AnonymizeIPMiddleware, which removes the proxy headers.
+*/
+func NewThrottleIPMiddleware(trustedProxies []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), throttleIPContextKey, services.GetTrustedIP(r, trustedProxies))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+/*
+throttleIP returns the address that sign in attempts from r are throttled
+by. Without the middleware, proxy headers are never believed. In privacy
+mode it is still the full address, so it must not be logged; use loggedIP.
+*/
+func throttleIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(throttleIPContextKey).(string); ok {
+		return ip
+	}
+
+	return services.GetTrustedIP(r, nil)
+}
+
+// loggedIP returns the throttle address of r for logs, truncated in privacy mode.
+func loggedIP(r *http.Request) string {
+	if privacy, _ := r.Context().Value(privacyContextKey).(bool); privacy {
+		return services.AnonymizeIP(throttleIP(r))
+	}
+
+	return throttleIP(r)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adampresley/aletics/internal/services"
+)
+
+func TestThrottleIPMiddleware(t *testing.T) {
+	var got string
+
+	trustedProxies, err := services.ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err = services.ParseTrustedProxies([]string{"proxy.example.com"}); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = throttleIP(r) + " " + loggedIP(r)
+	})
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"untrusted sender", NewThrottleIPMiddleware(trustedProxies)(next), "203.0.113.9:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9 203.0.113.9"},
+		{"trusted proxy", NewThrottleIPMiddleware(trustedProxies)(next), "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, "198.51.100.1 198.51.100.1"},
+		{"spoofed hop", NewThrottleIPMiddleware(trustedProxies)(next), "[2001:db8::1]:5000", map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.1"}, "198.51.100.1 198.51.100.1"},
+		{"real ip", NewThrottleIPMiddleware(trustedProxies)(next), "10.0.0.1:5000", map[string]string{"X-Real-Ip": "198.51.100.1"}, "198.51.100.1 198.51.100.1"},
+		{"proxy alone", NewThrottleIPMiddleware(trustedProxies)(next), "10.0.0.1:5000", nil, "10.0.0.1 10.0.0.1"},
+		{"no trusted proxies", NewThrottleIPMiddleware(nil)(next), "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "10.0.0.1 10.0.0.1"},
+		{"no middleware", next, "10.0.0.1:5000", map[string]string{"X-Real-Ip": "198.51.100.1"}, "10.0.0.1 10.0.0.1"},
+		{"privacy mode", NewThrottleIPMiddleware(trustedProxies)(AnonymizeIPMiddleware(next)), "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1 198.51.100.0"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = tt.remoteAddr
+
+		for key, value := range tt.headers {
+			r.Header.Set(key, value)
+		}
+
+		tt.handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
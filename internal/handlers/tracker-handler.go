@@ -2,110 +2,39 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
-	"slices"
 
 	"github.com/adampresley/aletics/internal/models"
 	"github.com/adampresley/aletics/internal/services"
 	"github.com/adampresley/httphelpers/requests"
 	"github.com/adampresley/httphelpers/responses"
-	"github.com/jellydator/ttlcache/v3"
 )
 
 type TrackerHandler struct {
-	ipCache         *ttlcache.Cache[string, *models.CountryLookup]
-	ipLookupService *services.IpLookupService
-	trackerService  *services.TrackerService
+	trackerService *services.TrackerService
 }
 
 type TrackerHandlerConfig struct {
-	IpCache         *ttlcache.Cache[string, *models.CountryLookup]
-	IpLookupService *services.IpLookupService
-	TrackerService  *services.TrackerService
+	TrackerService *services.TrackerService
 }
 
 func NewTrackerHandler(config TrackerHandlerConfig) *TrackerHandler {
 	return &TrackerHandler{
-		ipCache:         config.IpCache,
-		ipLookupService: config.IpLookupService,
-		trackerService:  config.TrackerService,
+		trackerService: config.TrackerService,
 	}
 }
 
 func (h *TrackerHandler) TrackEvent(w http.ResponseWriter, r *http.Request) {
 	var (
-		err           error
-		b             []byte
-		newEvent      = models.NewEvent{}
-		event         = &models.Event{}
-		cacheItem     *ttlcache.Item[string, *models.CountryLookup]
-		ok            bool
-		countryName   string
-		countryCode   string
-		continentName string
-		continentCode string
+		err      error
+		b        []byte
+		newEvent = models.NewEvent{}
+		event    = &models.Event{}
 	)
 
 	ip := services.GetIP(r)
-	slog.Info("checking cache for IP", "ip", ip)
-
-	cacheItem, ok = h.ipCache.GetOrSetFunc(ip, func() *models.CountryLookup {
-		slog.Info("ip cache miss", "ip", ip)
-
-		if slices.Contains([]string{"127.0.0.1", "localhost", "::1"}, ip) {
-			slog.Warn("skipping ip lookup for local address", "ip", ip)
-			return nil
-		}
-
-		newCountryInfo, err := h.ipLookupService.GetCountryInfo(ip)
-
-		if err != nil {
-			slog.Error("error retrieving country info for IP", "ip", ip, "error", err)
-			return nil
-		}
-
-		return newCountryInfo
-	})
-
-	if ok {
-		slog.Info("ip cache hit", "ip", ip)
-	}
-
-	if cacheItem.Value() != nil {
-		ci := cacheItem.Value()
-
-		if ci.Country != nil {
-			if _, ok = ci.Country.Names["en"]; ok {
-				countryName = ci.Country.Names["en"]
-			} else if len(ci.Country.Names) > 0 {
-				// assign first available key in names map as country name
-				for _, v := range ci.Country.Names {
-					countryName = v
-					break
-				}
-			}
-
-			if ci.Country.IsoCode != nil {
-				countryCode = *ci.Country.IsoCode
-			}
-		}
-
-		if ci.Continent != nil {
-			if _, ok = ci.Continent.Names["en"]; ok {
-				continentName = ci.Continent.Names["en"]
-			} else if len(ci.Continent.Names) > 0 {
-				for _, v := range ci.Continent.Names {
-					continentName = v
-					break
-				}
-			}
-
-			if ci.Continent.Code != nil {
-				continentCode = *ci.Continent.Code
-			}
-		}
-	}
 
 	if b, err = requests.Bytes(r); err != nil {
 		slog.Error("error reading tracker event body", "error", err)
@@ -119,13 +48,22 @@ func (h *TrackerHandler) TrackEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newEvent.Country = countryName
-	newEvent.CountryCode = countryCode
-	newEvent.Continent = continentName
-	newEvent.ContinentCode = continentCode
 	newEvent.Origin = r.Header.Get("Origin")
+	newEvent.IP = ip
+	newEvent.ExclusionIP = clientIP(r)
+	newEvent.UserAgent = r.UserAgent()
+
+	// The headers are checked as well as what the script sent, so that an
+	// old cached copy of the script cannot bypass them
+	newEvent.PrivacySignal = newEvent.PrivacySignal || r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
 
 	if event, err = h.trackerService.TrackEvent(newEvent); err != nil {
+		// Excluded visitors are not told, so the tracker script does not retry
+		if errors.Is(err, services.ErrEventExcluded) {
+			responses.TextOK(w, "ok")
+			return
+		}
+
 		slog.Error("error tracking tracker event", "error", err)
 		responses.TextInternalServerError(w, "Error writing tracker event")
 		return
@@ -134,3 +72,103 @@ func (h *TrackerHandler) TrackEvent(w http.ResponseWriter, r *http.Request) {
 	slog.Info("tracked event", "id", event.ID, "path", event.Path, "browser", event.Browser)
 	responses.TextOK(w, "ok")
 }
+
+type serverEventsRequest struct {
+	Events []json.RawMessage `json:"events"`
+}
+
+type serverEventsResponse struct {
+	Accepted int                        `json:"accepted"`
+	Rejected int                        `json:"rejected"`
+	Results  []models.ServerEventResult `json:"results"`
+}
+
+/*
+TrackServerEvents accepts a batch of events from a backend or mobile app.
+The property is identified by its secret key. Each event is validated on
+its own and the response reports the outcome of every event.
+
+	POST /api/v1/events
+	{"events": [{"url": "https://example.com/pricing", "ip": "203.0.113.7", "userAgent": "...", "timestamp": "2026-01-02T15:04:05Z", "props": {"plan": "pro"}}]}
+*/
+func (h *TrackerHandler) TrackServerEvents(w http.ResponseWriter, r *http.Request) {
+	var (
+		err            error
+		b              []byte
+		ok             bool
+		property       models.Property
+		body           serverEventsRequest
+		serverEvents   []models.ServerEvent
+		indexes        []int
+		serviceResults []models.ServerEventResult
+	)
+
+	if property, ok = PropertyFromContext(r.Context()); !ok {
+		responses.JsonErrorMessage(w, http.StatusUnauthorized, "missing property secret key")
+		return
+	}
+
+	if b, err = requests.Bytes(r); err != nil {
+		slog.Error("error reading server events body", "error", err)
+		responses.JsonErrorMessage(w, http.StatusBadRequest, "error reading request body")
+		return
+	}
+
+	if err = json.Unmarshal(b, &body); err != nil {
+		responses.JsonErrorMessage(w, http.StatusBadRequest, "request body must be a JSON object with an 'events' array")
+		return
+	}
+
+	// Checked before decoding, so an oversized batch is never decoded
+	if len(body.Events) > services.MaxServerEventBatch {
+		responses.JsonErrorMessage(w, http.StatusRequestEntityTooLarge, services.ErrBatchTooLarge.Error())
+		return
+	}
+
+	response := serverEventsResponse{
+		Results: make([]models.ServerEventResult, len(body.Events)),
+	}
+
+	/*
+	 * Decode each event separately so a malformed event is reported
+	 * against its own index instead of rejecting the whole batch.
+	 */
+	for index, raw := range body.Events {
+		var serverEvent models.ServerEvent
+
+		if err = json.Unmarshal(raw, &serverEvent); err != nil {
+			response.Results[index] = models.ServerEventResult{Index: index, Error: "invalid event: " + err.Error()}
+			continue
+		}
+
+		serverEvents = append(serverEvents, serverEvent)
+		indexes = append(indexes, index)
+	}
+
+	if serviceResults, err = h.trackerService.TrackServerEvents(property, serverEvents); err != nil {
+		if errors.Is(err, services.ErrBatchTooLarge) {
+			responses.JsonErrorMessage(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+
+		slog.Error("error tracking server events", "propertyID", property.ID, "error", err)
+		responses.JsonErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for i, result := range serviceResults {
+		result.Index = indexes[i]
+		response.Results[indexes[i]] = result
+	}
+
+	for _, result := range response.Results {
+		if result.Error == "" {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+	}
+
+	slog.Info("tracked server events", "propertyID", property.ID, "accepted", response.Accepted, "rejected", response.Rejected)
+	responses.JsonOK(w, response)
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+)
+
+func TestTrackServerEvents_BatchTooLarge(t *testing.T) {
+	// The batch is rejected before any event is decoded or tracked, so no
+	// tracker service is needed
+	handler := NewTrackerHandler(TrackerHandlerConfig{})
+	events := strings.Repeat(`"not an event",`, services.MaxServerEventBatch)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(`{"events": [`+events+`"one too many"]}`))
+	r = r.WithContext(WithProperty(r.Context(), models.Property{Active: true}))
+	w := httptest.NewRecorder()
+
+	handler.TrackServerEvents(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected %d, got %d: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+)
+
+type TwoFactorHandler struct {
+	auditService        *services.AuditService
+	loginAttemptService *services.LoginAttemptService
+	renderer            rendering.TemplateRenderer
+	required            bool
+	store               *services.SessionStore
+	twoFactorService    *services.TwoFactorService
+	userService         *services.UserService
+}
+
+type TwoFactorHandlerConfig struct {
+	AuditService        *services.AuditService
+	LoginAttemptService *services.LoginAttemptService
+	Renderer            rendering.TemplateRenderer
+
+	// Required means every user must set up two-factor authentication,
+	// so they cannot turn it off.
+	Required         bool
+	Store            *services.SessionStore
+	TwoFactorService *services.TwoFactorService
+	UserService      *services.UserService
+}
+
+func NewTwoFactorHandler(config TwoFactorHandlerConfig) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		auditService:        config.AuditService,
+		loginAttemptService: config.LoginAttemptService,
+		renderer:            config.Renderer,
+		required:            config.Required,
+		store:               config.Store,
+		twoFactorService:    config.TwoFactorService,
+		userService:         config.UserService,
+	}
+}
+
+// LoginPage asks for a two-factor code after someone enters their password.
+func (h *TwoFactorHandler) LoginPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/two-factor/login"
+
+	viewData := viewdata.TwoFactorLogin{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+	}
+
+	if userID, err := PendingTwoFactorUserID(h.store, r); err != nil || userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *TwoFactorHandler) LoginAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		userID   uint
+		user     models.User
+		throttle models.LoginThrottle
+	)
+
+	pageName := "pages/two-factor/login"
+
+	viewData := viewdata.TwoFactorLogin{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+	}
+
+	if userID, err = PendingTwoFactorUserID(h.store, r); err != nil || userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if user, err = h.userService.GetUser(userID); err != nil {
+		slog.Error("error getting user", "user", userID, "error", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	ip := throttleIP(r)
+
+	if throttle, err = h.loginAttemptService.Check(user.Email, ip); err != nil {
+		slog.Error("error checking login attempts", "error", err)
+	}
+
+	if !throttle.RetryAt.IsZero() {
+		slog.Warn("two-factor attempt throttled", "ip", loggedIP(r), "user", userID, "lockedOut", throttle.LockedOut)
+
+		viewData.IsError = true
+		viewData.Message = loginThrottledMessage(throttle)
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if err = h.twoFactorService.Verify(userID, requests.Get[string](r, "code")); err != nil {
+		if errors.Is(err, services.ErrInvalidTwoFactorCode) {
+			slog.Error("invalid two-factor code", "ip", loggedIP(r), "user", userID)
+			viewData.Message = recordLoginFailure(h.loginAttemptService, r, user.Email, models.LoginFailureTwoFactor, "Invalid code. Please try again")
+		} else {
+			slog.Error("error verifying two-factor code", "user", userID, "error", err)
+			viewData.Message = "An unexpected error occurred while checking your code. Please try again"
+		}
+
+		viewData.IsError = true
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if err = StartSession(h.store, w, r, user); err != nil {
+		slog.Error("error saving session", "error", err)
+
+		viewData.IsError = true
+		viewData.Message = "An unexpected error occurred while checking your code. Please try again"
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if err = h.loginAttemptService.RecordSuccess(user.Email, ip); err != nil {
+		slog.Error("error recording login attempt", "error", err)
+	}
+
+	recordAudit(h.auditService, actorFor(user, r), models.AuditLogin, userAuditTarget(user), nil, map[string]any{"method": "two-factor"})
+
+	slog.Info("user logged in", "user", user.ID, "ip", loggedIP(r))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+/*
+ManagePage lets users set up two-factor authentication, or shows how many
+recovery codes they have left once they have.
+*/
+func (h *TwoFactorHandler) ManagePage(w http.ResponseWriter, r *http.Request) {
+	currentUser, _ := UserFromContext(r.Context())
+	viewData := h.manageViewData(r, currentUser)
+
+	if viewData.Required && !viewData.Enabled {
+		viewData.IsWarning = true
+		viewData.Message = "This server requires two-factor authentication. Please set it up to continue."
+	}
+
+	h.renderer.Render("pages/two-factor/manage", viewData, w)
+}
+
+// EnableAction finishes setting up two-factor authentication.
+func (h *TwoFactorHandler) EnableAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err           error
+		recoveryCodes []string
+	)
+
+	currentUser, _ := UserFromContext(r.Context())
+
+	if recoveryCodes, err = h.twoFactorService.EnableTwoFactor(currentUser.ID, requests.Get[string](r, "code")); err != nil {
+		viewData := h.manageViewData(r, currentUser)
+		viewData.IsError = true
+		viewData.Message = twoFactorErrorMessage(err, "There was a problem setting up two-factor authentication.")
+
+		if !errors.Is(err, services.ErrInvalidTwoFactorCode) {
+			slog.Error("error enabling two-factor authentication", "user", currentUser.ID, "error", err)
+		}
+
+		h.renderer.Render("pages/two-factor/manage", viewData, w)
+		return
+	}
+
+	slog.Info("two-factor authentication enabled", "user", currentUser.ID)
+	recordAudit(h.auditService, auditActor(r), models.AuditTwoFactorEnabled, userAuditTarget(currentUser), nil, nil)
+	h.renderRecoveryCodes(w, r, currentUser, recoveryCodes, "Two-factor authentication is on.")
+}
+
+// RecoveryCodesAction replaces the user's recovery codes once they enter a code.
+func (h *TwoFactorHandler) RecoveryCodesAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err           error
+		recoveryCodes []string
+	)
+
+	currentUser, _ := UserFromContext(r.Context())
+
+	if err = h.twoFactorService.Verify(currentUser.ID, requests.Get[string](r, "code")); err == nil {
+		recoveryCodes, err = h.twoFactorService.RegenerateRecoveryCodes(currentUser.ID)
+	}
+
+	if err != nil {
+		h.renderManageError(w, r, currentUser, err, "There was a problem generating new recovery codes.")
+		return
+	}
+
+	slog.Info("recovery codes regenerated", "user", currentUser.ID)
+	recordAudit(h.auditService, auditActor(r), models.AuditRecoveryCodesReplaced, userAuditTarget(currentUser), nil, nil)
+	h.renderRecoveryCodes(w, r, currentUser, recoveryCodes, "Your old recovery codes no longer work.")
+}
+
+// DisableAction turns two-factor authentication off once the user enters a code.
+func (h *TwoFactorHandler) DisableAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	currentUser, _ := UserFromContext(r.Context())
+
+	if h.required {
+		http.Error(w, "Two-factor authentication is required on this server", http.StatusBadRequest)
+		return
+	}
+
+	if err = h.twoFactorService.Verify(currentUser.ID, requests.Get[string](r, "code")); err == nil {
+		err = h.twoFactorService.DisableTwoFactor(currentUser.ID)
+	}
+
+	if err != nil {
+		h.renderManageError(w, r, currentUser, err, "There was a problem turning off two-factor authentication.")
+		return
+	}
+
+	slog.Info("two-factor authentication disabled", "user", currentUser.ID)
+	recordAudit(h.auditService, auditActor(r), models.AuditTwoFactorDisabled, userAuditTarget(currentUser), nil, nil)
+	http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+}
+
+/*
+ResetAction lets admins turn off two-factor authentication for a user who
+has lost their authenticator app and recovery codes.
+*/
+func (h *TwoFactorHandler) ResetAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		user models.User
+	)
+
+	currentUser, _ := UserFromContext(r.Context())
+	id := requests.Get[uint](r, "id")
+
+	if user, err = h.userService.GetUser(id); err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err = h.twoFactorService.DisableTwoFactor(id); err != nil {
+		slog.Error("error resetting two-factor authentication", "id", id, "error", err)
+		http.Error(w, "There was a problem resetting two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("two-factor authentication reset", "user", id, "by", currentUser.ID)
+	recordAudit(h.auditService, auditActor(r), models.AuditTwoFactorReset, userAuditTarget(user), nil, nil)
+	w.Header().Set("HX-Redirect", "/users")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TwoFactorHandler) manageViewData(r *http.Request, user models.User) viewdata.ManageTwoFactor {
+	var (
+		err        error
+		enrollment services.TOTPEnrollment
+	)
+
+	viewData := viewdata.ManageTwoFactor{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:      navFor(r),
+		Enabled:  user.TwoFactorEnabled(),
+		Required: h.required,
+	}
+
+	if viewData.Enabled {
+		if viewData.RemainingRecoveryCodes, err = h.twoFactorService.RemainingRecoveryCodes(user.ID); err != nil {
+			slog.Error("error counting recovery codes", "user", user.ID, "error", err)
+		}
+
+		return viewData
+	}
+
+	if enrollment, err = h.twoFactorService.StartEnrollment(user); err != nil {
+		slog.Error("error starting two-factor enrollment", "user", user.ID, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem starting two-factor authentication setup."
+		return viewData
+	}
+
+	viewData.Secret = enrollment.Secret
+	viewData.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(enrollment.QRCodePNG))
+	return viewData
+}
+
+func (h *TwoFactorHandler) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, currentUser models.User, recoveryCodes []string, message template.HTML) {
+	var (
+		err error
+	)
+
+	// Reload the user so the page shows that two-factor authentication is on
+	if currentUser, err = h.userService.GetUser(currentUser.ID); err != nil {
+		slog.Error("error getting user", "user", currentUser.ID, "error", err)
+	}
+
+	viewData := h.manageViewData(r, currentUser)
+	viewData.RecoveryCodes = recoveryCodes
+	viewData.Message = message
+
+	h.renderer.Render("pages/two-factor/manage", viewData, w)
+}
+
+func (h *TwoFactorHandler) renderManageError(w http.ResponseWriter, r *http.Request, currentUser models.User, err error, fallback template.HTML) {
+	if !errors.Is(err, services.ErrInvalidTwoFactorCode) {
+		slog.Error("error managing two-factor authentication", "user", currentUser.ID, "error", err)
+	}
+
+	viewData := h.manageViewData(r, currentUser)
+	viewData.IsError = true
+	viewData.Message = twoFactorErrorMessage(err, fallback)
+
+	h.renderer.Render("pages/two-factor/manage", viewData, w)
+}
+
+func twoFactorErrorMessage(err error, fallback template.HTML) template.HTML {
+	if errors.Is(err, services.ErrInvalidTwoFactorCode) {
+		return "That code is not valid. Please try again."
+	}
+
+	return fallback
+}
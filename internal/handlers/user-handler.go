@@ -0,0 +1,540 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+	"github.com/gorilla/sessions"
+)
+
+type UserHandler struct {
+	auditService *services.AuditService
+	renderer     rendering.TemplateRenderer
+	setupToken   string
+	store        *services.SessionStore
+	userService  *services.UserService
+}
+
+type UserHandlerConfig struct {
+	AuditService *services.AuditService
+	Renderer     rendering.TemplateRenderer
+
+	// SetupToken must be entered to create the first admin. It is
+	// written to the log when the server starts without any users.
+	SetupToken  string
+	Store       *services.SessionStore
+	UserService *services.UserService
+}
+
+func NewUserHandler(config UserHandlerConfig) *UserHandler {
+	return &UserHandler{
+		auditService: config.AuditService,
+		renderer:     config.Renderer,
+		setupToken:   config.SetupToken,
+		store:        config.Store,
+		userService:  config.UserService,
+	}
+}
+
+/*
+SetupPage asks for the first admin account. Once any user exists it
+sends people to the login page instead.
+*/
+func (h *UserHandler) SetupPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/setup"
+
+	viewData := viewdata.Setup{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+	}
+
+	if !h.needsSetup() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *UserHandler) SetupAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		user models.User
+	)
+
+	pageName := "pages/setup"
+
+	viewData := viewdata.Setup{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Email: requests.Get[string](r, "email"),
+		Name:  requests.Get[string](r, "name"),
+	}
+
+	if !h.needsSetup() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if h.setupToken == "" || subtle.ConstantTimeCompare([]byte(requests.Get[string](r, "setup_token")), []byte(h.setupToken)) != 1 {
+		slog.Error("invalid setup token", "ip", services.GetIP(r))
+		viewData.IsError = true
+		viewData.Message = "Invalid setup token. The token is written to the server log when the server starts without an admin."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if !passwordsMatch(r) {
+		viewData.IsError = true
+		viewData.Message = "The passwords do not match."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	user = models.User{Email: viewData.Email, Name: viewData.Name}
+
+	if user, err = h.userService.CreateFirstAdmin(user, requests.Get[string](r, "password")); err != nil {
+		if errors.Is(err, services.ErrSetupComplete) {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		slog.Error("error creating first admin", "email", viewData.Email, "error", err)
+		viewData.IsError = true
+		viewData.Message = userErrorMessage(err, "There was a problem creating your account.")
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	slog.Info("first admin created", "user", user.ID)
+	recordAudit(h.auditService, actorFor(user, r), models.AuditUserCreated, userAuditTarget(user), nil, userAuditValues(user))
+
+	if err = StartSession(h.store, w, r, user); err != nil {
+		slog.Error("error saving session", "error", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h *UserHandler) ManageUsersPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	pageName := "pages/users/manage"
+	currentUser, _ := UserFromContext(r.Context())
+
+	viewData := viewdata.ManageUsers{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:           navFor(r),
+		CurrentUserID: currentUser.ID,
+	}
+
+	if viewData.Users, err = h.userService.ListUsers(); err != nil {
+		slog.Error("error getting user list", "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting the list of users."
+	}
+
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *UserHandler) CreateUserPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/users/create"
+
+	viewData := viewdata.CreateUser{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+	}
+
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *UserHandler) CreateUserAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		user models.User
+	)
+
+	pageName := "pages/users/create"
+
+	viewData := viewdata.CreateUser{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+		User: models.User{
+			Email:   requests.Get[string](r, "email"),
+			Name:    requests.Get[string](r, "name"),
+			IsAdmin: requests.Get[bool](r, "is_admin"),
+		},
+	}
+
+	if !passwordsMatch(r) {
+		viewData.IsError = true
+		viewData.Message = "The passwords do not match."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if user, err = h.userService.CreateUser(viewData.User, requests.Get[string](r, "password")); err != nil {
+		slog.Error("error creating user", "email", viewData.Email, "error", err)
+		viewData.IsError = true
+		viewData.Message = userErrorMessage(err, "There was a problem creating the user.")
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	recordAudit(h.auditService, auditActor(r), models.AuditUserCreated, userAuditTarget(user), nil, userAuditValues(user))
+
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+func (h *UserHandler) EditUserPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	pageName := "pages/users/edit"
+	currentUser, _ := UserFromContext(r.Context())
+	id := requests.Get[uint](r, "id")
+
+	viewData := viewdata.EditUser{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:           navFor(r),
+		IsCurrentUser: id == currentUser.ID,
+	}
+
+	if viewData.User, err = h.userService.GetUser(id); err != nil {
+		slog.Error("error getting user", "id", id, "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting the user."
+	}
+
+	h.renderer.Render(pageName, viewData, w)
+}
+
+/*
+EditUserAction saves a user's details. The password is only changed when
+a new one is entered.
+*/
+func (h *UserHandler) EditUserAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		existing models.User
+		session  *sessions.Session
+	)
+
+	pageName := "pages/users/edit"
+	currentUser, _ := UserFromContext(r.Context())
+	id := requests.Get[uint](r, "id")
+	password := requests.Get[string](r, "password")
+
+	viewData := viewdata.EditUser{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav: navFor(r),
+		User: models.User{
+			Email:   requests.Get[string](r, "email"),
+			Name:    requests.Get[string](r, "name"),
+			IsAdmin: requests.Get[bool](r, "is_admin"),
+		},
+		IsCurrentUser: id == currentUser.ID,
+	}
+
+	viewData.User.ID = id
+
+	// Admins cannot lock themselves out of user management
+	if viewData.IsCurrentUser {
+		viewData.User.IsAdmin = true
+	}
+
+	if password != "" && !passwordsMatch(r) {
+		viewData.IsError = true
+		viewData.Message = "The passwords do not match."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if existing, err = h.userService.GetUser(id); err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err = h.userService.UpdateUser(id, viewData.User, password); err != nil {
+		slog.Error("error updating user", "id", id, "error", err)
+		viewData.IsError = true
+		viewData.Message = userErrorMessage(err, "There was a problem updating the user.")
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if before, after := userChanges(existing, viewData.User, password != ""); len(after) > 0 {
+		recordAudit(h.auditService, auditActor(r), models.AuditUserUpdated, userAuditTarget(viewData.User), before, after)
+	}
+
+	// A new password signs the user out everywhere, unless admins are
+	// changing their own, which keeps the session they are using
+	if password != "" {
+		if viewData.IsCurrentUser {
+			if session, err = h.store.Get(r, SessionName); err == nil {
+				err = h.store.EndOtherUserSessions(id, session)
+			}
+		} else {
+			err = h.store.EndUserSessions(id)
+		}
+
+		if err != nil {
+			slog.Error("error ending sessions", "user", id, "error", err)
+		}
+	}
+
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		user models.User
+	)
+
+	currentUser, _ := UserFromContext(r.Context())
+	id := requests.Get[uint](r, "id")
+
+	if id == currentUser.ID {
+		http.Error(w, "You cannot delete yourself", http.StatusBadRequest)
+		return
+	}
+
+	if user, err = h.userService.GetUser(id); err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err = h.userService.DeleteUser(id); err != nil {
+		slog.Error("error deleting user", "error", err, "id", id)
+		return
+	}
+
+	recordAudit(h.auditService, auditActor(r), models.AuditUserDeleted, userAuditTarget(user), userAuditValues(user), nil)
+
+	w.Header().Set("HX-Redirect", "/users")
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+AccountPage lets any signed in user change their own password, and see
+where else they are signed in.
+*/
+func (h *UserHandler) AccountPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "pages/account"
+	currentUser, _ := UserFromContext(r.Context())
+
+	viewData := h.accountViewData(r, currentUser)
+	h.renderer.Render(pageName, viewData, w)
+}
+
+// EndOtherSessionsAction signs the current user out everywhere else.
+func (h *UserHandler) EndOtherSessionsAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	pageName := "pages/account"
+	currentUser, _ := UserFromContext(r.Context())
+
+	if session, err = h.store.Get(r, SessionName); err == nil {
+		err = h.store.EndOtherUserSessions(currentUser.ID, session)
+	}
+
+	if err != nil {
+		slog.Error("error ending other sessions", "user", currentUser.ID, "error", err)
+
+		viewData := h.accountViewData(r, currentUser)
+		viewData.IsError = true
+		viewData.Message = "There was a problem signing you out of your other sessions."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	slog.Info("other sessions ended", "user", currentUser.ID)
+	recordAudit(h.auditService, auditActor(r), models.AuditSessionsEnded, userAuditTarget(currentUser), nil, nil)
+
+	viewData := h.accountViewData(r, currentUser)
+	viewData.Message = "You have been signed out everywhere else."
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *UserHandler) ChangePasswordAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	pageName := "pages/account"
+	currentUser, _ := UserFromContext(r.Context())
+	viewData := h.accountViewData(r, currentUser)
+
+	if _, err = h.userService.Authenticate(currentUser.Email, requests.Get[string](r, "current_password")); err != nil {
+		if !errors.Is(err, services.ErrInvalidCredentials) {
+			slog.Error("error checking current password", "user", currentUser.ID, "error", err)
+		}
+
+		viewData.IsError = true
+		viewData.Message = "Your current password is incorrect."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if !passwordsMatch(r) {
+		viewData.IsError = true
+		viewData.Message = "The passwords do not match."
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if err = h.userService.SetPassword(currentUser.ID, requests.Get[string](r, "password")); err != nil {
+		slog.Error("error changing password", "user", currentUser.ID, "error", err)
+		viewData.IsError = true
+		viewData.Message = userErrorMessage(err, "There was a problem changing your password.")
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	recordAudit(h.auditService, auditActor(r), models.AuditPasswordChanged, userAuditTarget(currentUser), nil, nil)
+
+	// Anyone who signed in with the old password is signed out
+	if session, err = h.store.Get(r, SessionName); err == nil {
+		err = h.store.EndOtherUserSessions(currentUser.ID, session)
+	}
+
+	if err != nil {
+		slog.Error("error ending other sessions", "user", currentUser.ID, "error", err)
+	}
+
+	viewData = h.accountViewData(r, currentUser)
+	viewData.Message = "Your password has been changed, and you have been signed out everywhere else."
+	h.renderer.Render(pageName, viewData, w)
+}
+
+func (h *UserHandler) accountViewData(r *http.Request, user models.User) viewdata.Account {
+	var (
+		err     error
+		session *sessions.Session
+	)
+
+	viewData := viewdata.Account{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:  navFor(r),
+		User: user,
+	}
+
+	if session, err = h.store.Get(r, SessionName); err == nil {
+		viewData.Sessions, err = h.store.ListUserSessions(user.ID, session)
+	}
+
+	if err != nil {
+		slog.Error("error listing sessions", "user", user.ID, "error", err)
+	}
+
+	return viewData
+}
+
+func (h *UserHandler) needsSetup() bool {
+	hasAdmin, err := h.userService.HasAdmin()
+
+	if err != nil {
+		slog.Error("error checking for an admin", "error", err)
+		return false
+	}
+
+	return !hasAdmin
+}
+
+func passwordsMatch(r *http.Request) bool {
+	return requests.Get[string](r, "password") == requests.Get[string](r, "confirm_password")
+}
+
+/*
+userErrorMessage returns a message for validation errors the person
+filling in the form can fix, and fallback for anything else.
+*/
+func userErrorMessage(err error, fallback template.HTML) template.HTML {
+	validationErrors := []error{
+		services.ErrInvalidEmail,
+		services.ErrEmailTaken,
+		services.ErrPasswordTooShort,
+		services.ErrPasswordTooLong,
+		services.ErrLastAdmin,
+	}
+
+	for _, validationErr := range validationErrors {
+		if errors.Is(err, validationErr) {
+			return template.HTML(template.HTMLEscapeString(validationErr.Error()))
+		}
+	}
+
+	return fallback
+}
+
+// userAuditValues are the details of a user that the audit log records.
+func userAuditValues(user models.User) map[string]any {
+	return map[string]any{"email": user.Email, "name": user.Name, "admin": user.IsAdmin}
+}
+
+// userChanges returns the old and new values of the fields that differ.
+func userChanges(existing, updated models.User, passwordChanged bool) (map[string]any, map[string]any) {
+	before := map[string]any{}
+	after := map[string]any{}
+
+	changed := func(field string, old, new any) {
+		if old != new {
+			before[field] = old
+			after[field] = new
+		}
+	}
+
+	changed("email", existing.Email, updated.Email)
+	changed("name", existing.Name, updated.Name)
+	changed("admin", existing.IsAdmin, updated.IsAdmin)
+
+	// Passwords are never recorded, only that one was set
+	if passwordChanged {
+		after["password"] = "changed"
+	}
+
+	return before, after
+}
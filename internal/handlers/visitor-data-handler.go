@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/aletics/internal/viewdata"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/rendering"
+	"gorm.io/gorm"
+)
+
+const (
+	visitorDataPreviewLimit int = 50
+)
+
+type VisitorDataHandler struct {
+	propertyService    *services.PropertyService
+	renderer           rendering.TemplateRenderer
+	visitorDataService *services.VisitorDataService
+}
+
+type VisitorDataHandlerConfig struct {
+	PropertyService    *services.PropertyService
+	Renderer           rendering.TemplateRenderer
+	VisitorDataService *services.VisitorDataService
+}
+
+func NewVisitorDataHandler(config VisitorDataHandlerConfig) *VisitorDataHandler {
+	return &VisitorDataHandler{
+		propertyService:    config.PropertyService,
+		renderer:           config.Renderer,
+		visitorDataService: config.VisitorDataService,
+	}
+}
+
+// VisitorDataPage shows the form for finding the events a visitor asked about.
+func (h *VisitorDataHandler) VisitorDataPage(w http.ResponseWriter, r *http.Request) {
+	viewData := h.newViewData(r)
+	h.renderer.Render("pages/visitor-data/manage", viewData, w)
+}
+
+/*
+PreviewAction shows how many events match the criteria, and the first of
+them, so they can be checked before exporting or deleting.
+*/
+func (h *VisitorDataHandler) PreviewAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	pageName := "pages/visitor-data/manage"
+	viewData := h.newViewData(r)
+	criteria, problem := visitorDataCriteria(viewData)
+
+	if problem != "" {
+		viewData.IsError = true
+		viewData.Message = escapedMessage(problem)
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if viewData.Events, viewData.Total, err = h.visitorDataService.PreviewEvents(criteria, visitorDataPreviewLimit); err != nil {
+		viewData.IsError = true
+		viewData.Message = escapedMessage(visitorDataErrorMessage(err, "There was a problem finding the matching events."))
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	viewData.Previewed = true
+	h.renderer.Render(pageName, viewData, w)
+}
+
+/*
+ExportAction downloads every event matching the criteria as JSON lines.
+The export is recorded in the audit log.
+*/
+func (h *VisitorDataHandler) ExportAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	criteria, problem := visitorDataCriteria(h.newViewData(r))
+
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	if _, err = h.propertyService.GetProperty(criteria.PropertyID); err != nil {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+
+	// Nothing is written until an event matches, so a request with bad
+	// criteria still gets an error status
+	if _, _, err = h.visitorDataService.PreviewEvents(criteria, 0); err != nil {
+		if errors.Is(err, services.ErrNoCriteria) || errors.Is(err, services.ErrVisitorDataColumnar) {
+			http.Error(w, visitorDataErrorMessage(err, ""), http.StatusBadRequest)
+			return
+		}
+
+		slog.Error("error finding visitor data", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="visitor-data-%d-%s.jsonl"`, criteria.PropertyID, time.Now().UTC().Format("20060102-150405")))
+
+	if _, err = h.visitorDataService.ExportEvents(auditActor(r), criteria, w); err != nil {
+		slog.Error("error exporting visitor data", "error", err)
+	}
+}
+
+/*
+DeleteAction removes every event matching the criteria for good, once the
+property's name has been typed to confirm it.
+*/
+func (h *VisitorDataHandler) DeleteAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		deleted  int64
+		property models.Property
+	)
+
+	pageName := "pages/visitor-data/manage"
+	viewData := h.newViewData(r)
+	criteria, problem := visitorDataCriteria(viewData)
+
+	if problem != "" {
+		viewData.IsError = true
+		viewData.Message = escapedMessage(problem)
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if property, err = h.propertyService.GetProperty(criteria.PropertyID); err != nil {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+
+	if requests.Get[string](r, "confirm_name") != property.Name {
+		viewData.IsError = true
+		viewData.Message = "Type the property's name to confirm that the matching events should be deleted."
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	if deleted, err = h.visitorDataService.DeleteEvents(auditActor(r), criteria); err != nil {
+		viewData.IsError = true
+		viewData.Message = escapedMessage(visitorDataErrorMessage(err, "There was a problem deleting the matching events."))
+
+		if deleted > 0 && !errors.Is(err, services.ErrArchiveInUse) {
+			viewData.Message = escapedMessage(fmt.Sprintf("Deleted %d events, then there was a problem. Preview again to check what is left.", deleted))
+		}
+
+		h.renderer.Render(pageName, viewData, w)
+		return
+	}
+
+	slog.Info("visitor data deleted", "property", property.ID, "events", deleted)
+	viewData.Message = escapedMessage(fmt.Sprintf("Deleted %d events.", deleted))
+	h.renderer.Render(pageName, viewData, w)
+}
+
+// newViewData returns the page with the properties to choose from and the criteria as entered.
+func (h *VisitorDataHandler) newViewData(r *http.Request) viewdata.VisitorData {
+	var (
+		err error
+	)
+
+	user, _ := UserFromContext(r.Context())
+
+	viewData := viewdata.VisitorData{
+		BaseViewModel: rendering.BaseViewModel{
+			IsHtmx: requests.IsHtmx(r),
+		},
+		Nav:          navFor(r),
+		PropertyID:   requests.Get[uint](r, "property_id"),
+		From:         requests.Get[string](r, "from"),
+		To:           requests.Get[string](r, "to"),
+		PathPattern:  requests.Get[string](r, "path"),
+		QueryParam:   requests.Get[string](r, "query_param"),
+		QueryValue:   requests.Get[string](r, "query_value"),
+		PropKey:      requests.Get[string](r, "prop_key"),
+		PropValue:    requests.Get[string](r, "prop_value"),
+		PreviewLimit: visitorDataPreviewLimit,
+	}
+
+	if viewData.Properties, err = h.propertyService.ListProperties(user, ""); err != nil {
+		slog.Error("error listing properties", "error", err)
+		viewData.IsError = true
+		viewData.Message = "There was a problem getting your properties."
+	}
+
+	return viewData
+}
+
+/*
+visitorDataCriteria turns the criteria as entered into the criteria the
+service expects, or returns what is wrong with them. Dates are whole days,
+so To includes everything on that day.
+*/
+func visitorDataCriteria(viewData viewdata.VisitorData) (models.VisitorDataCriteria, string) {
+	var (
+		err error
+	)
+
+	criteria := models.VisitorDataCriteria{
+		PropertyID:  viewData.PropertyID,
+		PathPattern: viewData.PathPattern,
+		QueryParam:  viewData.QueryParam,
+		QueryValue:  viewData.QueryValue,
+		PropKey:     viewData.PropKey,
+		PropValue:   viewData.PropValue,
+	}
+
+	if criteria.PropertyID == 0 {
+		return criteria, "Choose a property."
+	}
+
+	if viewData.From != "" {
+		if criteria.From, err = time.Parse(time.DateOnly, viewData.From); err != nil {
+			return criteria, "From must be a date."
+		}
+	}
+
+	if viewData.To != "" {
+		if criteria.To, err = time.Parse(time.DateOnly, viewData.To); err != nil {
+			return criteria, "To must be a date."
+		}
+
+		criteria.To = criteria.To.AddDate(0, 0, 1)
+	}
+
+	if criteria.QueryValue != "" && criteria.QueryParam == "" {
+		return criteria, "Enter the query parameter the value belongs to."
+	}
+
+	if criteria.PropValue != "" && criteria.PropKey == "" {
+		return criteria, "Enter the custom property the value belongs to."
+	}
+
+	return criteria, ""
+}
+
+func visitorDataErrorMessage(err error, fallback string) string {
+	switch {
+	case errors.Is(err, services.ErrNoCriteria):
+		return "Choose a time range, path, query parameter or custom property, so that not every event of the property matches."
+
+	case errors.Is(err, services.ErrVisitorDataColumnar):
+		return "Events kept in a columnar analytics store cannot be searched here."
+
+	case errors.Is(err, services.ErrArchiveInUse):
+		return "The retention job is writing to an event archive, so the events in it were not deleted. Delete them again once it has finished."
+
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return "That property does not exist."
+
+	default:
+		slog.Error("error handling visitor data request", "error", err)
+		return fallback
+	}
+}
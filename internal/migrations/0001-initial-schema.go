@@ -0,0 +1,151 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+initialSchema creates the tables that used to be created by AutoMigrate.
+It is safe to run against a database that AutoMigrate already set up, as
+it only adds what is missing.
+*/
+var initialSchema = Migration{
+	Version: 1,
+	Name:    "initial schema",
+	Up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(
+			&v1Property{}, &v1Event{}, &v1EventProp{}, &v1APIKey{},
+			&v1Import{}, &v1ImportedStat{},
+			&v1HourlyRollup{}, &v1DailyRollup{}, &v1RollupState{},
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(
+			&v1RollupState{}, &v1DailyRollup{}, &v1HourlyRollup{},
+			&v1ImportedStat{}, &v1Import{},
+			&v1APIKey{}, &v1EventProp{}, &v1Event{}, &v1Property{},
+		)
+	},
+}
+
+type v1Property struct {
+	gorm.Model
+
+	Name   string
+	Domain string
+	Token  string `gorm:"unique"`
+	Active bool
+
+	RetentionDays int
+
+	SecretKeyHash   string
+	SecretKeyPrefix string
+}
+
+func (v1Property) TableName() string { return "properties" }
+
+type v1Event struct {
+	gorm.Model
+
+	PropertyID uint
+	Property   v1Property
+
+	VisitorID     string
+	Path          string
+	QueryString   string
+	Referrer      string
+	Browser       string
+	Country       string
+	CountryCode   string
+	Continent     string
+	ContinentCode string
+	Props         []v1EventProp `gorm:"foreignKey:EventID"`
+}
+
+func (v1Event) TableName() string { return "events" }
+
+type v1EventProp struct {
+	ID      uint `gorm:"primarykey"`
+	EventID uint `gorm:"index"`
+	Key     string
+	Value   string
+}
+
+func (v1EventProp) TableName() string { return "event_props" }
+
+type v1APIKey struct {
+	gorm.Model
+
+	Name       string
+	Prefix     string
+	KeyHash    string `gorm:"size:64;uniqueIndex"`
+	PropertyID *uint
+	Property   *v1Property
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (v1APIKey) TableName() string { return "api_keys" }
+
+type v1Import struct {
+	gorm.Model
+
+	PropertyID uint
+	Property   v1Property
+
+	Source    string
+	FileName  string
+	Rows      int
+	StartDate time.Time
+	EndDate   time.Time
+}
+
+func (v1Import) TableName() string { return "imports" }
+
+type v1ImportedStat struct {
+	ID         uint      `gorm:"primarykey"`
+	ImportID   uint      `gorm:"index"`
+	PropertyID uint      `gorm:"index:idx_imported_stats_lookup"`
+	Date       time.Time `gorm:"index:idx_imported_stats_lookup"`
+	Dimension  string    `gorm:"index:idx_imported_stats_lookup"`
+	Value      string
+	Pageviews  int
+	Visitors   int
+}
+
+func (v1ImportedStat) TableName() string { return "imported_stats" }
+
+type v1HourlyRollup struct {
+	ID         uint      `gorm:"primarykey"`
+	PropertyID uint      `gorm:"index:idx_hourly_rollups_lookup"`
+	Bucket     time.Time `gorm:"index:idx_hourly_rollups_lookup"`
+	Dimension  string    `gorm:"index:idx_hourly_rollups_lookup"`
+	Value      string
+	Pageviews  int
+	Visitors   int
+}
+
+func (v1HourlyRollup) TableName() string { return "hourly_rollups" }
+
+type v1DailyRollup struct {
+	ID         uint      `gorm:"primarykey"`
+	PropertyID uint      `gorm:"index:idx_daily_rollups_lookup"`
+	Bucket     time.Time `gorm:"index:idx_daily_rollups_lookup"`
+	Dimension  string    `gorm:"index:idx_daily_rollups_lookup"`
+	Value      string
+	Pageviews  int
+	Visitors   int
+}
+
+func (v1DailyRollup) TableName() string { return "daily_rollups" }
+
+type v1RollupState struct {
+	Name            string `gorm:"primarykey"`
+	CompleteThrough time.Time
+	Watermark       time.Time
+	UpdatedAt       time.Time
+}
+
+func (v1RollupState) TableName() string { return "rollup_states" }
@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+/*
+reportIndexes adds the indexes the report queries need. Every report
+selects the events of one property within a created_at range, so events
+get a composite index on both. The rollup aggregator looks for events by
+created_at and updated_at across all properties, so those get their own.
+
+The rollup and imported stats lookups always match a property and a
+dimension exactly and scan a range of buckets, so the range column is
+moved to the end of their indexes.
+*/
+var reportIndexes = Migration{
+	Version: 2,
+	Name:    "report indexes",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			createIndex("events", "idx_events_property_created_at", "property_id, created_at"),
+			createIndex("events", "idx_events_created_at", "created_at"),
+			createIndex("events", "idx_events_updated_at", "updated_at"),
+			replaceIndex("hourly_rollups", "idx_hourly_rollups_lookup", "property_id, dimension, bucket"),
+			replaceIndex("daily_rollups", "idx_daily_rollups_lookup", "property_id, dimension, bucket"),
+			replaceIndex("imported_stats", "idx_imported_stats_lookup", "property_id, dimension, date"),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropIndex("events", "idx_events_property_created_at"),
+			dropIndex("events", "idx_events_created_at"),
+			dropIndex("events", "idx_events_updated_at"),
+			replaceIndex("hourly_rollups", "idx_hourly_rollups_lookup", "property_id, bucket, dimension"),
+			replaceIndex("daily_rollups", "idx_daily_rollups_lookup", "property_id, bucket, dimension"),
+			replaceIndex("imported_stats", "idx_imported_stats_lookup", "property_id, date, dimension"),
+		)
+	},
+}
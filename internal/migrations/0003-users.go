@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// users adds dashboard accounts, replacing the shared server password.
+var users = Migration{
+	Version: 3,
+	Name:    "users",
+	Up: func(tx *gorm.DB) error {
+		return tx.Migrator().CreateTable(&v3User{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&v3User{})
+	},
+}
+
+type v3User struct {
+	gorm.Model
+
+	Email        string `gorm:"size:255;uniqueIndex"`
+	Name         string
+	PasswordHash string
+	IsAdmin      bool
+	LastLoginAt  *time.Time
+}
+
+func (v3User) TableName() string { return "users" }
@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+propertyRoles lets users be granted a role on individual properties, and
+records who created each API key so a key can never read more than its
+creator.
+*/
+var propertyRoles = Migration{
+	Version: 4,
+	Name:    "property roles",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			createTable(&v4PropertyRole{}),
+			addColumn(&v4APIKey{}, "UserID"),
+			createIndex("api_keys", "idx_api_keys_user_id", "user_id"),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropIndex("api_keys", "idx_api_keys_user_id"),
+
+			// AutoMigrate creates this constraint, migrations do not
+			dropConstraint("api_keys", "fk_api_keys_user"),
+			dropColumn(&v4APIKey{}, "UserID"),
+			dropTable(&v4PropertyRole{}),
+		)
+	},
+}
+
+type v4PropertyRole struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	UserID     uint `gorm:"uniqueIndex:idx_property_roles_user_property,priority:1"`
+	User       v3User
+	PropertyID uint `gorm:"uniqueIndex:idx_property_roles_user_property,priority:2;index"`
+	Property   v1Property
+	Role       string `gorm:"size:20"`
+}
+
+func (v4PropertyRole) TableName() string { return "property_roles" }
+
+type v4APIKey struct {
+	UserID *uint
+}
+
+func (v4APIKey) TableName() string { return "api_keys" }
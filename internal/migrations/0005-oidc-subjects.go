@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+/*
+oidcSubjects links users to their account at the OpenID Connect provider,
+so that they are still recognized if their email changes there.
+*/
+var oidcSubjects = Migration{
+	Version: 5,
+	Name:    "oidc subjects",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			addColumn(&v5User{}, "OIDCSubject"),
+			createUniqueIndex("users", "idx_users_oidc_subject", "oidc_subject"),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropIndex("users", "idx_users_oidc_subject"),
+			dropColumn(&v5User{}, "OIDCSubject"),
+		)
+	},
+}
+
+type v5User struct {
+	OIDCSubject *string `gorm:"column:oidc_subject;size:255"`
+}
+
+func (v5User) TableName() string { return "users" }
@@ -0,0 +1,50 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+twoFactor lets users protect their account with a TOTP authenticator app,
+and keeps the one-time recovery codes for when they lose it.
+*/
+var twoFactor = Migration{
+	Version: 6,
+	Name:    "two factor",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			addColumn(&v6User{}, "TOTPSecret"),
+			addColumn(&v6User{}, "TOTPEnabledAt"),
+			addColumn(&v6User{}, "TOTPLastStep"),
+			createTable(&v6RecoveryCode{}),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropTable(&v6RecoveryCode{}),
+			dropColumn(&v6User{}, "TOTPLastStep"),
+			dropColumn(&v6User{}, "TOTPEnabledAt"),
+			dropColumn(&v6User{}, "TOTPSecret"),
+		)
+	},
+}
+
+type v6User struct {
+	TOTPSecret    string     `gorm:"column:totp_secret;size:64;not null;default:''"`
+	TOTPEnabledAt *time.Time `gorm:"column:totp_enabled_at"`
+	TOTPLastStep  int64      `gorm:"column:totp_last_step;not null;default:0"`
+}
+
+func (v6User) TableName() string { return "users" }
+
+type v6RecoveryCode struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	CodeHash  string `gorm:"size:64"`
+	UsedAt    *time.Time
+}
+
+func (v6RecoveryCode) TableName() string { return "recovery_codes" }
@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// loginAttempts records sign in attempts so that password guessing can be slowed down.
+var loginAttempts = Migration{
+	Version: 7,
+	Name:    "login attempts",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			createTable(&v7LoginAttempt{}),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropTable(&v7LoginAttempt{}),
+		)
+	},
+}
+
+type v7LoginAttempt struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	Email     string    `gorm:"size:255;index"`
+	IP        string    `gorm:"size:45;index"`
+	Succeeded bool
+	Reason    string `gorm:"size:20"`
+}
+
+func (v7LoginAttempt) TableName() string { return "login_attempts" }
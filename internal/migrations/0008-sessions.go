@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// sessions keeps browser sessions in the database, so that they can be ended.
+var sessions = Migration{
+	Version: 8,
+	Name:    "sessions",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			createTable(&v8Session{}),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropTable(&v8Session{}),
+		)
+	},
+}
+
+type v8Session struct {
+	ID         string `gorm:"primarykey;size:64"`
+	Name       string `gorm:"size:50"`
+	UserID     *uint  `gorm:"index"`
+	Data       []byte
+	IP         string `gorm:"size:45"`
+	UserAgent  string `gorm:"size:255"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time `gorm:"index"`
+	ExpiresAt  time.Time `gorm:"index"`
+}
+
+func (v8Session) TableName() string { return "sessions" }
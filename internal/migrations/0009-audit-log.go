@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// auditLog records administrative actions.
+var auditLog = Migration{
+	Version: 9,
+	Name:    "audit log",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			createTable(&v9AuditEntry{}),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropTable(&v9AuditEntry{}),
+		)
+	},
+}
+
+type v9AuditEntry struct {
+	ID         uint      `gorm:"primarykey"`
+	CreatedAt  time.Time `gorm:"index"`
+	ActorID    *uint     `gorm:"index"`
+	ActorEmail string    `gorm:"size:255"`
+	Action     string    `gorm:"size:50;index"`
+	TargetType string    `gorm:"size:20"`
+	TargetID   uint
+	TargetName string `gorm:"size:255"`
+	Before     string
+	After      string
+	IP         string `gorm:"size:45"`
+}
+
+func (v9AuditEntry) TableName() string { return "audit_entries" }
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+tokenRotation keeps a property's previous tracking token for a grace
+period after it is replaced.
+*/
+var tokenRotation = Migration{
+	Version: 10,
+	Name:    "token rotation",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			addColumn(&v10Property{}, "PreviousToken"),
+			addColumn(&v10Property{}, "PreviousTokenExpiresAt"),
+			createIndex("properties", "idx_properties_previous_token", "previous_token"),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropIndex("properties", "idx_properties_previous_token"),
+			dropColumn(&v10Property{}, "PreviousTokenExpiresAt"),
+			dropColumn(&v10Property{}, "PreviousToken"),
+		)
+	},
+}
+
+type v10Property struct {
+	PreviousToken          string `gorm:"size:36;not null;default:''"`
+	PreviousTokenExpiresAt *time.Time
+}
+
+func (v10Property) TableName() string { return "properties" }
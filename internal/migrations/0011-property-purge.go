@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+propertyPurge tracks when an archived property's events are removed.
+Properties deleted before this migration are left without a purge date,
+so nothing is removed until an admin restores them, or restores and
+deletes them again.
+*/
+var propertyPurge = Migration{
+	Version: 11,
+	Name:    "property purge",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			addColumn(&v11Property{}, "PurgeAfter"),
+			addColumn(&v11Property{}, "EventsPurged"),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropColumn(&v11Property{}, "EventsPurged"),
+			dropColumn(&v11Property{}, "PurgeAfter"),
+		)
+	},
+}
+
+type v11Property struct {
+	PurgeAfter   *time.Time
+	EventsPurged int64 `gorm:"not null;default:0"`
+}
+
+func (v11Property) TableName() string { return "properties" }
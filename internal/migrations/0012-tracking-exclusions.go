@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+/*
+trackingExclusions lets a property ignore its own staff and admin pages,
+and keep sensitive query parameters out of its events.
+*/
+var trackingExclusions = Migration{
+	Version: 12,
+	Name:    "tracking exclusions",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			addColumn(&v12Property{}, "ExcludedIPs"),
+			addColumn(&v12Property{}, "ExcludedPaths"),
+			addColumn(&v12Property{}, "StrippedQueryParams"),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropColumn(&v12Property{}, "StrippedQueryParams"),
+			dropColumn(&v12Property{}, "ExcludedPaths"),
+			dropColumn(&v12Property{}, "ExcludedIPs"),
+		)
+	},
+}
+
+type v12Property struct {
+	ExcludedIPs         string `gorm:"size:2000;not null;default:''"`
+	ExcludedPaths       string `gorm:"size:2000;not null;default:''"`
+	StrippedQueryParams string `gorm:"size:2000;not null;default:''"`
+}
+
+func (v12Property) TableName() string { return "properties" }
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"gorm.io/gorm"
+)
+
+/*
+privacySignals lets a property honor Do Not Track and Global Privacy
+Control. Existing properties keep ignoring them, as they do now.
+*/
+var privacySignals = Migration{
+	Version: 13,
+	Name:    "privacy signals",
+	Up: func(tx *gorm.DB) error {
+		return execAll(tx,
+			addColumn(&v13Property{}, "PrivacySignals"),
+		)
+	},
+	Down: func(tx *gorm.DB) error {
+		return execAll(tx,
+			dropColumn(&v13Property{}, "PrivacySignals"),
+		)
+	},
+}
+
+type v13Property struct {
+	PrivacySignals string `gorm:"size:20;not null;default:''"`
+}
+
+func (v13Property) TableName() string { return "properties" }
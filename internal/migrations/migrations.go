@@ -0,0 +1,150 @@
+/*
+Package migrations holds the ordered changes to the relational database
+schema. They are applied by services.MigrationService, which records each
+one in the schema_migrations table.
+
+To change the schema, add a file named after the next version and append
+its migration to All. Never edit a migration that has been released. Each
+migration describes the tables as they were at that version rather than
+using the structs in the models package, which keep changing.
+
+Up and Down run in a transaction. Use tx.Dialector.Name() when a change
+needs SQL that differs between "sqlite", "postgres" and "mysql".
+*/
+package migrations
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+
+	// Down reverses Up. Leave it nil if the migration cannot be reversed.
+	Down func(tx *gorm.DB) error
+}
+
+// All is every migration, oldest first.
+var All = []Migration{
+	initialSchema,
+	reportIndexes,
+	users,
+	propertyRoles,
+	oidcSubjects,
+	twoFactor,
+	loginAttempts,
+	sessions,
+	auditLog,
+	tokenRotation,
+	propertyPurge,
+	trackingExclusions,
+	privacySignals,
+}
+
+// step is one change made by a migration.
+type step func(tx *gorm.DB) error
+
+func execAll(tx *gorm.DB, steps ...step) error {
+	for _, step := range steps {
+		if err := step(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+createIndex creates an index on a comma separated list of columns, unless
+an index with that name already exists. The SQL is the same on every
+dialect.
+*/
+func createIndex(table, name, columns string) step {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasIndex(table, name) {
+			return nil
+		}
+
+		return tx.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", name, table, columns)).Error
+	}
+}
+
+func dropIndex(table, name string) step {
+	return func(tx *gorm.DB) error {
+		if !tx.Migrator().HasIndex(table, name) {
+			return nil
+		}
+
+		return tx.Migrator().DropIndex(table, name)
+	}
+}
+
+// replaceIndex drops an index and creates it again with new columns.
+func replaceIndex(table, name, columns string) step {
+	return func(tx *gorm.DB) error {
+		return execAll(tx, dropIndex(table, name), createIndex(table, name, columns))
+	}
+}
+
+// createTable creates the table for a frozen struct, unless it already exists.
+func createTable(model any) step {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasTable(model) {
+			return nil
+		}
+
+		return tx.Migrator().CreateTable(model)
+	}
+}
+
+func dropTable(model any) step {
+	return func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(model)
+	}
+}
+
+// addColumn adds a field of a frozen struct as a column, unless it already exists.
+func addColumn(model any, field string) step {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasColumn(model, field) {
+			return nil
+		}
+
+		return tx.Migrator().AddColumn(model, field)
+	}
+}
+
+func dropColumn(model any, field string) step {
+	return func(tx *gorm.DB) error {
+		if !tx.Migrator().HasColumn(model, field) {
+			return nil
+		}
+
+		return tx.Migrator().DropColumn(model, field)
+	}
+}
+
+func dropConstraint(table, name string) step {
+	return func(tx *gorm.DB) error {
+		if !tx.Migrator().HasConstraint(table, name) {
+			return nil
+		}
+
+		return tx.Migrator().DropConstraint(table, name)
+	}
+}
+
+// createUniqueIndex is createIndex for an index that enforces uniqueness.
+func createUniqueIndex(table, name, columns string) step {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasIndex(table, name) {
+			return nil
+		}
+
+		return tx.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", name, table, columns)).Error
+	}
+}
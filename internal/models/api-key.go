@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+APIKey grants read-only access to the stats API. Only a SHA-256 hash of
+the key is stored. The Prefix is kept in the clear so a key can be
+recognized in the UI. A nil PropertyID means the key may read every
+property.
+
+UserID is the user who created the key. The key can never read more than
+that user's roles allow. Keys created before user accounts have none.
+*/
+type APIKey struct {
+	gorm.Model
+
+	Name       string
+	Prefix     string
+	KeyHash    string `gorm:"size:64;uniqueIndex"`
+	PropertyID *uint
+	Property   *Property `json:"-"`
+	UserID     *uint     `gorm:"index"`
+	User       *User     `json:"-"`
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// CanAccessProperty returns true if this key may read stats for the given property.
+func (k APIKey) CanAccessProperty(propertyID uint) bool {
+	return k.PropertyID == nil || *k.PropertyID == propertyID
+}
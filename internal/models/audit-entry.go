@@ -0,0 +1,111 @@
+package models
+
+import "time"
+
+// AuditAction is what was done, as recorded in the audit log.
+type AuditAction string
+
+const (
+	AuditLogin                 AuditAction = "login"
+	AuditLogout                AuditAction = "logout"
+	AuditPropertyCreated       AuditAction = "property created"
+	AuditPropertyUpdated       AuditAction = "property updated"
+	AuditPropertyArchived      AuditAction = "property archived"
+	AuditPropertyRestored      AuditAction = "property restored"
+	AuditPropertyPurged        AuditAction = "property purged"
+	AuditTokenRotated          AuditAction = "token rotated"
+	AuditSecretKeyGenerated    AuditAction = "secret key generated"
+	AuditRoleGranted           AuditAction = "role granted"
+	AuditRoleRevoked           AuditAction = "role revoked"
+	AuditUserCreated           AuditAction = "user created"
+	AuditUserUpdated           AuditAction = "user updated"
+	AuditUserDeleted           AuditAction = "user deleted"
+	AuditPasswordChanged       AuditAction = "password changed"
+	AuditSessionsEnded         AuditAction = "sessions ended"
+	AuditTwoFactorEnabled      AuditAction = "two-factor enabled"
+	AuditTwoFactorDisabled     AuditAction = "two-factor disabled"
+	AuditTwoFactorReset        AuditAction = "two-factor reset"
+	AuditRecoveryCodesReplaced AuditAction = "recovery codes replaced"
+	AuditAPIKeyCreated         AuditAction = "api key created"
+	AuditAPIKeyRevoked         AuditAction = "api key revoked"
+	AuditVisitorDataExported   AuditAction = "visitor data exported"
+	AuditVisitorDataDeleted    AuditAction = "visitor data deleted"
+)
+
+// AuditActions lists every action, for filtering the audit log.
+var AuditActions = []AuditAction{
+	AuditLogin,
+	AuditLogout,
+	AuditPropertyCreated,
+	AuditPropertyUpdated,
+	AuditPropertyArchived,
+	AuditPropertyRestored,
+	AuditPropertyPurged,
+	AuditTokenRotated,
+	AuditSecretKeyGenerated,
+	AuditRoleGranted,
+	AuditRoleRevoked,
+	AuditUserCreated,
+	AuditUserUpdated,
+	AuditUserDeleted,
+	AuditPasswordChanged,
+	AuditSessionsEnded,
+	AuditTwoFactorEnabled,
+	AuditTwoFactorDisabled,
+	AuditTwoFactorReset,
+	AuditRecoveryCodesReplaced,
+	AuditAPIKeyCreated,
+	AuditAPIKeyRevoked,
+	AuditVisitorDataExported,
+	AuditVisitorDataDeleted,
+}
+
+const (
+	AuditTargetProperty string = "property"
+	AuditTargetUser     string = "user"
+	AuditTargetAPIKey   string = "api key"
+)
+
+// Actor is who did something, and from where.
+type Actor struct {
+	UserID uint
+	Email  string
+	IP     string
+}
+
+// AuditTarget is what something was done to.
+type AuditTarget struct {
+	Type string
+	ID   uint
+	Name string
+}
+
+/*
+AuditEntry records an administrative action. Before and After hold the
+values that changed, as JSON. The actor's email and the target's name are
+copied, so that entries still make sense once they are deleted.
+*/
+type AuditEntry struct {
+	ID         uint        `gorm:"primarykey"`
+	CreatedAt  time.Time   `gorm:"index"`
+	ActorID    *uint       `gorm:"index"`
+	ActorEmail string      `gorm:"size:255"`
+	Action     AuditAction `gorm:"size:50;index"`
+	TargetType string      `gorm:"size:20"`
+	TargetID   uint
+	TargetName string `gorm:"size:255"`
+	Before     string
+	After      string
+	IP         string `gorm:"size:45"`
+}
+
+// AuditFilter narrows the audit log. Empty fields match everything.
+type AuditFilter struct {
+	Action     AuditAction
+	Actor      string
+	TargetType string
+	From       time.Time
+	To         time.Time
+	Page       int
+	PageSize   int
+}
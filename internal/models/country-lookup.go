@@ -14,3 +14,11 @@ type Country struct {
 	IsoCode *string           `json:"iso_code"`
 	Names   map[string]string `json:"names"`
 }
+
+// GeoLocation is the location information recorded with an event.
+type GeoLocation struct {
+	Country       string
+	CountryCode   string
+	Continent     string
+	ContinentCode string
+}
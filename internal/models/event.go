@@ -1,31 +1,92 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
 
+	"gorm.io/gorm"
+)
+
+/*
+Event is a single pageview. The indexes on property_id, created_at and
+updated_at that the reports rely on are created by the "report indexes"
+migration, as gorm.Model's fields cannot be tagged here.
+*/
 type Event struct {
 	gorm.Model
 
 	PropertyID uint     `json:"propertyId"`
 	Property   Property `json:"-"`
 
-	Path          string `json:"path"`
-	QueryString   string `json:"queryString"`
-	Browser       string `json:"browser"`
-	Country       string `json:"country"`
-	CountryCode   string `json:"countryCode"`
-	Continent     string `json:"continent"`
-	ContinentCode string `json:"continentCode"`
+	VisitorID     string      `json:"-"`
+	Path          string      `json:"path"`
+	QueryString   string      `json:"queryString"`
+	Referrer      string      `json:"referrer"`
+	Browser       string      `json:"browser"`
+	Country       string      `json:"country"`
+	CountryCode   string      `json:"countryCode"`
+	Continent     string      `json:"continent"`
+	ContinentCode string      `json:"continentCode"`
+	Props         []EventProp `json:"props,omitempty"`
+}
+
+/*
+EventProp is a custom property attached to an event, such as a plan name
+or an A/B test variant.
+*/
+type EventProp struct {
+	ID      uint   `gorm:"primarykey" json:"-"`
+	EventID uint   `gorm:"index" json:"-"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
 }
 
 type NewEvent struct {
-	Token  string `json:"token"`
-	Origin string `json:"-"`
-
-	Path          string `json:"path"`
-	QueryString   string `json:"queryString"`
-	Browser       string `json:"browser"`
-	Country       string `json:"-"`
-	CountryCode   string `json:"-"`
-	Continent     string `json:"-"`
-	ContinentCode string `json:"-"`
+	Token     string `json:"token"`
+	Origin    string `json:"-"`
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
+
+	// ExclusionIP is the visitor's full address when IP has already been
+	// truncated in privacy mode. It is only checked against the property's
+	// excluded IPs and is never stored.
+	ExclusionIP string `json:"-"`
+
+	Path          string            `json:"path"`
+	QueryString   string            `json:"queryString"`
+	Referrer      string            `json:"-"`
+	Browser       string            `json:"browser"`
+	Country       string            `json:"-"`
+	CountryCode   string            `json:"-"`
+	Continent     string            `json:"-"`
+	ContinentCode string            `json:"-"`
+	Timestamp     time.Time         `json:"-"`
+	Props         map[string]string `json:"-"`
+
+	// PrivacySignal is true when the visitor sent Do Not Track or Global
+	// Privacy Control, either as a header or from the tracker script.
+	PrivacySignal bool `json:"privacySignal"`
+}
+
+/*
+ServerEvent is a single event sent to the server-side ingestion API. Unlike
+browser events, the caller supplies the client details explicitly.
+*/
+type ServerEvent struct {
+	URL       string            `json:"url"`
+	Referrer  string            `json:"referrer"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"userAgent"`
+	Timestamp *time.Time        `json:"timestamp"`
+	Props     map[string]string `json:"props"`
+
+	// PrivacySignal is true when the user asked not to be tracked, with Do
+	// Not Track, Global Privacy Control or an app's own setting.
+	PrivacySignal bool `json:"privacySignal"`
+}
+
+// ServerEventResult reports whether a single event in a batch was accepted.
+type ServerEventResult struct {
+	Index int    `json:"index"`
+	ID    uint   `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
 }
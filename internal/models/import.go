@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+Import records a single upload of historical data from another analytics
+tool. Deleting an import removes the stats it created.
+*/
+type Import struct {
+	gorm.Model
+
+	PropertyID uint     `json:"propertyId"`
+	Property   Property `json:"-"`
+
+	Source    string    `json:"source"`
+	FileName  string    `json:"fileName"`
+	Rows      int       `json:"rows"`
+	StartDate time.Time `json:"startDate"`
+	EndDate   time.Time `json:"endDate"`
+}
+
+/*
+ImportedStat is a daily aggregate imported from another analytics tool. A
+blank Dimension holds the site totals for the day, otherwise the row holds
+the numbers for a single value of that dimension (path, browser, country
+or country_code).
+*/
+type ImportedStat struct {
+	ID         uint      `gorm:"primarykey"`
+	ImportID   uint      `gorm:"index"`
+	PropertyID uint      `gorm:"index:idx_imported_stats_lookup,priority:1"`
+	Date       time.Time `gorm:"index:idx_imported_stats_lookup,priority:3"`
+	Dimension  string    `gorm:"index:idx_imported_stats_lookup,priority:2"`
+	Value      string
+	Pageviews  int
+	Visitors   int
+}
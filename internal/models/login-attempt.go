@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// LoginFailureReason is which step of signing in failed.
+type LoginFailureReason string
+
+const (
+	LoginFailurePassword  LoginFailureReason = "password"
+	LoginFailureTwoFactor LoginFailureReason = "two-factor code"
+)
+
+/*
+LoginAttempt records someone signing in with a password, successfully or
+not. Failed attempts slow down and then lock out further attempts for the
+same account or from the same IP address.
+*/
+type LoginAttempt struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	Email     string    `gorm:"size:255;index"`
+	IP        string    `gorm:"size:45;index"`
+	Succeeded bool
+	Reason    LoginFailureReason `gorm:"size:20"`
+}
+
+/*
+LoginThrottle says when someone may next try to sign in. LockedOut is true
+when they have failed too many times, rather than just being slowed down.
+*/
+type LoginThrottle struct {
+	RetryAt   time.Time
+	LockedOut bool
+}
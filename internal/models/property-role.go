@@ -0,0 +1,82 @@
+package models
+
+import "time"
+
+/*
+Role is what a user may do with a property. Each role includes everything
+the roles below it allow.
+
+  - viewer: see the property's reports
+  - admin: change the property's settings and import data into it
+  - owner: delete the property and decide who else can see it
+*/
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleAdmin  Role = "admin"
+	RoleOwner  Role = "owner"
+)
+
+// Roles lists every role, least privileged first.
+var Roles = []Role{RoleViewer, RoleAdmin, RoleOwner}
+
+// Allows returns true if this role grants at least the access of required.
+func (r Role) Allows(required Role) bool {
+	return r.rank() >= required.rank() && r.rank() > 0
+}
+
+// Valid returns true if r is one of the defined roles.
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// CanEdit returns true if the role may change a property's settings.
+func (r Role) CanEdit() bool {
+	return r.Allows(RoleAdmin)
+}
+
+// CanDelete returns true if the role may delete a property and manage its roles.
+func (r Role) CanDelete() bool {
+	return r.Allows(RoleOwner)
+}
+
+// RolesAllowing returns every role that grants at least the access of required.
+func RolesAllowing(required Role) []Role {
+	result := []Role{}
+
+	for _, role := range Roles {
+		if role.Allows(required) {
+			result = append(result, role)
+		}
+	}
+
+	return result
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleAdmin:
+		return 2
+	case RoleOwner:
+		return 3
+	}
+
+	return 0
+}
+
+/*
+PropertyRole grants a user a role on one property. Server admins do not
+need one, they may do anything with every property.
+*/
+type PropertyRole struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	UserID     uint     `gorm:"uniqueIndex:idx_property_roles_user_property,priority:1"`
+	User       User     `json:"-"`
+	PropertyID uint     `gorm:"uniqueIndex:idx_property_roles_user_property,priority:2;index"`
+	Property   Property `json:"-"`
+	Role       Role     `gorm:"size:20"`
+}
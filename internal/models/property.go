@@ -1,6 +1,37 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+PrivacySignalMode is what a property does with events from visitors who ask
+not to be tracked, with Do Not Track or Global Privacy Control.
+
+  - ignore: record them like any other
+  - anonymize: record the page view, but not where it came from or who it was
+  - drop: do not record them at all
+*/
+type PrivacySignalMode string
+
+const (
+	PrivacySignalsIgnore    PrivacySignalMode = ""
+	PrivacySignalsAnonymize PrivacySignalMode = "anonymize"
+	PrivacySignalsDrop      PrivacySignalMode = "drop"
+)
+
+// Valid returns true if m is one of the defined modes.
+func (m PrivacySignalMode) Valid() bool {
+	return m == PrivacySignalsIgnore || m == PrivacySignalsAnonymize || m == PrivacySignalsDrop
+}
+
+/*
+RetentionForever is the retention period a property uses to keep its raw
+events forever, even when the server has a default retention period.
+*/
+const RetentionForever int = -1
 
 type Property struct {
 	gorm.Model
@@ -9,4 +40,49 @@ type Property struct {
 	Domain string
 	Token  string `gorm:"unique"`
 	Active bool
+
+	// PreviousToken is the token before it was last rotated. It is still
+	// accepted until PreviousTokenExpiresAt, so that pages can be updated.
+	PreviousToken          string `gorm:"size:36;index"`
+	PreviousTokenExpiresAt *time.Time
+
+	// ExcludedIPs, ExcludedPaths and StrippedQueryParams are lists with one
+	// entry per line. Events from an excluded IP address or CIDR range, or
+	// for a path matching an excluded pattern, are not recorded. Stripped
+	// query parameters are removed before an event is stored.
+	ExcludedIPs         string `gorm:"size:2000"`
+	ExcludedPaths       string `gorm:"size:2000"`
+	StrippedQueryParams string `gorm:"size:2000"`
+
+	// PrivacySignals is what happens to events from browsers that send Do
+	// Not Track or Global Privacy Control.
+	PrivacySignals PrivacySignalMode `gorm:"size:20"`
+
+	// RetentionDays is how long raw events are kept before the retention job
+	// removes them. 0 uses the server's default retention period, and
+	// RetentionForever keeps them forever.
+	RetentionDays int
+
+	// SecretKeyHash is the SHA-256 of the property's private secret key,
+	// used by server-side integrations. The key itself is never stored.
+	SecretKeyHash   string `json:"-"`
+	SecretKeyPrefix string `json:"-"`
+
+	// PurgeAfter is set when the property is archived (soft deleted). Until
+	// then it can be restored. After it, the retention job removes its
+	// events in batches, counting them in EventsPurged, and then the
+	// property itself. Properties archived before purging existed have
+	// none, and are kept until they are restored.
+	PurgeAfter   *time.Time
+	EventsPurged int64
+}
+
+// PreviousTokenValid returns true while the previous token is still accepted.
+func (p Property) PreviousTokenValid(now time.Time) bool {
+	return p.PreviousToken != "" && p.PreviousTokenExpiresAt != nil && now.Before(*p.PreviousTokenExpiresAt)
+}
+
+// Restorable returns true while an archived property may still be restored.
+func (p Property) Restorable(now time.Time) bool {
+	return p.PurgeAfter == nil || now.Before(*p.PurgeAfter)
 }
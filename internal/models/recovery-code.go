@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+/*
+RecoveryCode is a one-time code that signs a user in when they do not have
+their authenticator app. Only a hash of the code is stored.
+*/
+type RecoveryCode struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	CodeHash  string `gorm:"size:64"`
+	UsedAt    *time.Time
+}
@@ -29,3 +29,34 @@ type CountryCountItem struct {
 	Country string `json:"country"`
 	Count   int    `json:"count"`
 }
+
+// AggregateStats holds summary numbers for a property within a time range.
+type AggregateStats struct {
+	Pageviews int `json:"pageviews"`
+	Visitors  int `json:"visitors"`
+}
+
+// TimeseriesItem holds summary numbers for a single time bucket.
+type TimeseriesItem struct {
+	Label     string `json:"label"`
+	Pageviews int    `json:"pageviews"`
+	Visitors  int    `json:"visitors"`
+}
+
+// BreakdownItem holds summary numbers for a single value of a dimension.
+type BreakdownItem struct {
+	Value     string `json:"value"`
+	Pageviews int    `json:"pageviews"`
+	Visitors  int    `json:"visitors"`
+}
+
+/*
+ReportFilter narrows a report to events whose dimension matches (or, when
+Negate is set, does not match) any of the given values. A "*" in a value
+is a wildcard.
+*/
+type ReportFilter struct {
+	Dimension string
+	Negate    bool
+	Values    []string
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+/*
+RetentionSummary describes how much raw event data is currently kept for a
+property.
+*/
+type RetentionSummary struct {
+	Property Property
+
+	// RetentionDays is the retention period in effect for the property,
+	// either its own or the server default. 0 means events are kept forever.
+	RetentionDays int
+	OldestEvent   *time.Time
+	Events        int64
+}
+
+// PruneResult records the outcome of a run of the retention job.
+type PruneResult struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Deleted    int64
+	Archived   bool
+	Error      string
+
+	// PropertiesPurged counts archived properties removed for good
+	PropertiesPurged int
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+/*
+HourlyRollup holds pre-aggregated numbers for one hour. As with
+ImportedStat, a blank Dimension holds the site totals for the hour,
+otherwise the row holds the numbers for a single value of that dimension.
+*/
+type HourlyRollup struct {
+	ID         uint      `gorm:"primarykey"`
+	PropertyID uint      `gorm:"index:idx_hourly_rollups_lookup,priority:1"`
+	Bucket     time.Time `gorm:"index:idx_hourly_rollups_lookup,priority:3"`
+	Dimension  string    `gorm:"index:idx_hourly_rollups_lookup,priority:2"`
+	Value      string
+	Pageviews  int
+	Visitors   int
+}
+
+// DailyRollup holds pre-aggregated numbers for one day. See HourlyRollup.
+type DailyRollup struct {
+	ID         uint      `gorm:"primarykey"`
+	PropertyID uint      `gorm:"index:idx_daily_rollups_lookup,priority:1"`
+	Bucket     time.Time `gorm:"index:idx_daily_rollups_lookup,priority:3"`
+	Dimension  string    `gorm:"index:idx_daily_rollups_lookup,priority:2"`
+	Value      string
+	Pageviews  int
+	Visitors   int
+}
+
+/*
+RollupState tracks how far the rollups of one granularity ("hourly" or
+"daily") have been built. Every bucket before CompleteThrough has been
+rolled up. Watermark is the ingestion time up to which late events, those
+recorded after their bucket was rolled up, have been picked up.
+*/
+type RollupState struct {
+	Name            string `gorm:"primarykey"`
+	CompleteThrough time.Time
+	Watermark       time.Time
+	UpdatedAt       time.Time
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// SchemaMigration records a migration that has been applied to the database.
+type SchemaMigration struct {
+	Version   uint `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+/*
+MigrationStatus describes a migration that is either known to this build,
+applied to the database, or both. Unknown migrations were applied by a
+newer build.
+*/
+type MigrationStatus struct {
+	Version   uint
+	Name      string
+	AppliedAt *time.Time
+	Unknown   bool
+}
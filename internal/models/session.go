@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+/*
+Session is a browser session kept on the server. The cookie only holds a
+random ID, and ID here is its hash, so that the sessions table cannot be
+used to sign in. Data holds the session's values.
+*/
+type Session struct {
+	ID         string `gorm:"primarykey;size:64"`
+	Name       string `gorm:"size:50"`
+	UserID     *uint  `gorm:"index"`
+	Data       []byte
+	IP         string `gorm:"size:45"`
+	UserAgent  string `gorm:"size:255"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time `gorm:"index"`
+	ExpiresAt  time.Time `gorm:"index"`
+
+	// Current is true for the session making the request
+	Current bool `gorm:"-"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+User is someone who can sign in to the dashboard. Only a bcrypt hash of
+the password is stored. Admins can manage other users.
+
+Users who sign in with OpenID Connect have an OIDCSubject, the ID of their
+account at the provider. They may have no password.
+
+Users may add a second factor, a TOTP authenticator app. TOTPSecret is set
+when they start enrolling, and TOTPEnabledAt once they have proved their
+app works. TOTPLastStep is the last time step a code was accepted for, so
+that a code cannot be used twice.
+*/
+type User struct {
+	gorm.Model
+
+	Email        string `gorm:"size:255;uniqueIndex"`
+	Name         string
+	PasswordHash string `json:"-"`
+	IsAdmin      bool
+	LastLoginAt  *time.Time
+	OIDCSubject  *string `gorm:"column:oidc_subject;size:255;uniqueIndex" json:"-"`
+
+	TOTPSecret    string     `gorm:"column:totp_secret;size:64" json:"-"`
+	TOTPEnabledAt *time.Time `gorm:"column:totp_enabled_at"`
+	TOTPLastStep  int64      `gorm:"column:totp_last_step" json:"-"`
+}
+
+// DisplayName returns the user's name, or their email if they have no name.
+func (u User) DisplayName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+
+	return u.Email
+}
+
+// TwoFactorEnabled returns true when the user must enter a TOTP code to sign in.
+func (u User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+/*
+VisitorDataCriteria selects the raw events of a property that a visitor
+asked to see or have deleted. Every field that is set must match. From
+and To bound when events were recorded, To excluded, and PathPattern may
+use * to match any run of characters.
+*/
+type VisitorDataCriteria struct {
+	PropertyID uint      `json:"propertyId"`
+	From       time.Time `json:"from,omitzero"`
+	To         time.Time `json:"to,omitzero"`
+
+	PathPattern string `json:"path,omitempty"`
+	QueryParam  string `json:"queryParam,omitempty"`
+	QueryValue  string `json:"queryValue,omitempty"`
+	PropKey     string `json:"propKey,omitempty"`
+	PropValue   string `json:"propValue,omitempty"`
+}
+
+/*
+Narrowed returns true when something other than the property narrows the
+events, so that a request can never match every event of a property by
+accident.
+*/
+func (c VisitorDataCriteria) Narrowed() bool {
+	return !c.From.IsZero() || !c.To.IsZero() || c.PathPattern != "" || c.QueryParam != "" || c.PropKey != ""
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	apiKeyPrefix       string = "alk_"
+	apiKeyDisplayChars int    = 8
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid api key")
+)
+
+type ApiKeyServiceConfig struct {
+	DB *gorm.DB
+}
+
+type ApiKeyService struct {
+	db *gorm.DB
+}
+
+func NewApiKeyService(config ApiKeyServiceConfig) *ApiKeyService {
+	return &ApiKeyService{
+		db: config.DB,
+	}
+}
+
+/*
+ListAPIKeys returns the unrevoked keys a user created, or every key for
+server admins.
+*/
+func (s *ApiKeyService) ListAPIKeys(user models.User) ([]models.APIKey, error) {
+	var (
+		err     error
+		apiKeys []models.APIKey
+	)
+
+	query := s.db.
+		Preload("Property").
+		Preload("User").
+		Where("revoked_at IS NULL").
+		Order("created_at DESC")
+
+	if !user.IsAdmin {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	err = query.Find(&apiKeys).Error
+
+	if err != nil {
+		return []models.APIKey{}, err
+	}
+
+	return apiKeys, nil
+}
+
+func (s *ApiKeyService) GetAPIKey(id uint) (models.APIKey, error) {
+	var (
+		err    error
+		apiKey models.APIKey
+	)
+
+	if err = s.db.Where("revoked_at IS NULL").First(&apiKey, id).Error; err != nil {
+		return models.APIKey{}, err
+	}
+
+	return apiKey, nil
+}
+
+/*
+CreateAPIKey generates a new random API key for the user with the given
+ID. The plaintext key is returned once and is never stored; callers must
+show it to the user immediately. A nil propertyID creates a key that can
+read every property the user can.
+*/
+func (s *ApiKeyService) CreateAPIKey(name string, propertyID *uint, userID *uint) (models.APIKey, string, error) {
+	var (
+		err       error
+		plaintext string
+		apiKey    models.APIKey
+	)
+
+	if plaintext, err = generateSecret(apiKeyPrefix); err != nil {
+		return models.APIKey{}, "", fmt.Errorf("error generating api key: %w", err)
+	}
+
+	apiKey = models.APIKey{
+		Name:       name,
+		Prefix:     plaintext[:len(apiKeyPrefix)+apiKeyDisplayChars],
+		KeyHash:    hashSecret(plaintext),
+		PropertyID: propertyID,
+		UserID:     userID,
+	}
+
+	if err = s.db.Create(&apiKey).Error; err != nil {
+		return models.APIKey{}, "", err
+	}
+
+	return apiKey, plaintext, nil
+}
+
+func (s *ApiKeyService) RevokeAPIKey(id uint) error {
+	var (
+		err error
+	)
+
+	err = s.db.
+		Model(&models.APIKey{}).
+		Where("id = ?", id).
+		Update("revoked_at", time.Now()).Error
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+Authenticate looks up an unrevoked API key by its plaintext value. On
+success the key's last used timestamp is updated.
+*/
+func (s *ApiKeyService) Authenticate(plaintext string) (models.APIKey, error) {
+	var (
+		err    error
+		apiKey models.APIKey
+	)
+
+	if plaintext == "" {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+
+	err = s.db.
+		Where("key_hash = ?", hashSecret(plaintext)).
+		Where("revoked_at IS NULL").
+		First(&apiKey).Error
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.APIKey{}, ErrInvalidAPIKey
+		}
+
+		return models.APIKey{}, fmt.Errorf("error retrieving api key: %w", err)
+	}
+
+	now := time.Now()
+	apiKey.LastUsedAt = &now
+
+	if err = s.db.Model(&apiKey).Update("last_used_at", now).Error; err != nil {
+		return models.APIKey{}, fmt.Errorf("error updating api key last used time: %w", err)
+	}
+
+	return apiKey, nil
+}
+
+/*
+generateSecret returns a random, URL-safe string with the given prefix.
+*/
+func generateSecret(prefix string) (string, error) {
+	var (
+		err error
+		b   = make([]byte, 32)
+	)
+
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+hashSecret returns the hex encoded SHA-256 of a high entropy secret. This
+is suitable for random keys, not for user chosen passwords.
+*/
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
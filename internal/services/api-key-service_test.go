@@ -0,0 +1,67 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestApiKeyService_CreateAndAuthenticate(t *testing.T) {
+	svc := NewApiKeyService(ApiKeyServiceConfig{DB: newTestDB(t)})
+	propertyID := uint(7)
+
+	apiKey, plaintext, err := svc.CreateAPIKey("bi scripts", &propertyID, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(plaintext, apiKeyPrefix) {
+		t.Errorf("expected key to start with %q, got %q", apiKeyPrefix, plaintext)
+	}
+
+	if apiKey.KeyHash == plaintext || strings.Contains(apiKey.KeyHash, plaintext) {
+		t.Error("expected plaintext key not to be stored")
+	}
+
+	if !strings.HasPrefix(plaintext, apiKey.Prefix) {
+		t.Errorf("expected prefix %q to match key", apiKey.Prefix)
+	}
+
+	authenticated, err := svc.Authenticate(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected error authenticating: %v", err)
+	}
+
+	if authenticated.ID != apiKey.ID {
+		t.Errorf("expected key %d, got %d", apiKey.ID, authenticated.ID)
+	}
+
+	if authenticated.LastUsedAt == nil {
+		t.Error("expected last used time to be set")
+	}
+
+	if !authenticated.CanAccessProperty(7) || authenticated.CanAccessProperty(8) {
+		t.Error("expected key to be scoped to property 7")
+	}
+}
+
+func TestApiKeyService_RevokedKeyIsRejected(t *testing.T) {
+	svc := NewApiKeyService(ApiKeyServiceConfig{DB: newTestDB(t)})
+
+	apiKey, plaintext, err := svc.CreateAPIKey("status page", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err = svc.RevokeAPIKey(apiKey.ID); err != nil {
+		t.Fatalf("unexpected error revoking: %v", err)
+	}
+
+	if _, err = svc.Authenticate(plaintext); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("expected ErrInvalidAPIKey, got %v", err)
+	}
+
+	if _, err = svc.Authenticate("alk_not-a-real-key"); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("expected ErrInvalidAPIKey for unknown key, got %v", err)
+	}
+}
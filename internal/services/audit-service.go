@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+type AuditServiceConfig struct {
+	DB *gorm.DB
+
+	// RetentionDays is how long entries are kept. 0 keeps them forever.
+	RetentionDays int
+}
+
+/*
+AuditService keeps a record of who changed what. Changes to properties are
+recorded by PropertyService in the same transaction as the change itself.
+Everything else is recorded by the handlers.
+*/
+type AuditService struct {
+	db            *gorm.DB
+	retentionDays int
+}
+
+func NewAuditService(config AuditServiceConfig) *AuditService {
+	return &AuditService{
+		db:            config.DB,
+		retentionDays: config.RetentionDays,
+	}
+}
+
+/*
+Record adds an entry to the audit log. before and after are stored as
+JSON, and may be nil.
+*/
+func (s *AuditService) Record(actor models.Actor, action models.AuditAction, target models.AuditTarget, before, after any) error {
+	return recordAudit(s.db, actor, action, target, before, after)
+}
+
+/*
+ListEntries returns a page of entries matching filter, newest first, and
+whether there are more.
+*/
+func (s *AuditService) ListEntries(filter models.AuditFilter) ([]models.AuditEntry, bool, error) {
+	var (
+		err     error
+		entries []models.AuditEntry
+	)
+
+	query := s.db.Model(&models.AuditEntry{})
+
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+
+	if filter.Actor != "" {
+		query = query.Where("LOWER(actor_email) LIKE LOWER(?)", "%"+filter.Actor+"%")
+	}
+
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+
+	pageSize := max(filter.PageSize, 1)
+	page := max(filter.Page, 1)
+
+	// One extra entry says whether there is another page
+	err = query.
+		Order("created_at DESC, id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize + 1).
+		Find(&entries).Error
+
+	if err != nil {
+		return []models.AuditEntry{}, false, err
+	}
+
+	if len(entries) > pageSize {
+		return entries[:pageSize], true, nil
+	}
+
+	return entries, false, nil
+}
+
+/*
+Start removes entries older than the retention period immediately, and
+then once every interval until ctx is cancelled. It blocks, so run it in
+its own goroutine.
+*/
+func (s *AuditService) Start(ctx context.Context, interval time.Duration) {
+	if s.retentionDays <= 0 || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if removed, err := s.Prune(time.Now()); err != nil {
+			slog.Error("error pruning audit log", "error", err)
+		} else if removed > 0 {
+			slog.Info("pruned audit log", "removed", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune removes entries older than the retention period as of now.
+func (s *AuditService) Prune(now time.Time) (int64, error) {
+	if s.retentionDays <= 0 {
+		return 0, nil
+	}
+
+	result := s.db.
+		Where("created_at < ?", now.AddDate(0, 0, -s.retentionDays)).
+		Delete(&models.AuditEntry{})
+
+	return result.RowsAffected, result.Error
+}
+
+// recordAudit adds an entry using tx, so that it can share a transaction with the change.
+func recordAudit(tx *gorm.DB, actor models.Actor, action models.AuditAction, target models.AuditTarget, before, after any) error {
+	var (
+		err error
+	)
+
+	entry := models.AuditEntry{
+		ActorEmail: actor.Email,
+		Action:     action,
+		TargetType: target.Type,
+		TargetID:   target.ID,
+		TargetName: target.Name,
+		IP:         actor.IP,
+	}
+
+	if actor.UserID != 0 {
+		entry.ActorID = &actor.UserID
+	}
+
+	if entry.Before, err = auditJSON(before); err != nil {
+		return err
+	}
+
+	if entry.After, err = auditJSON(after); err != nil {
+		return err
+	}
+
+	return tx.Create(&entry).Error
+}
+
+func auditJSON(value any) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+
+	b, err := json.Marshal(value)
+	return string(b), err
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func TestAuditService_PropertyChangesAreRecorded(t *testing.T) {
+	db := newTestDB(t)
+	audit := NewAuditService(AuditServiceConfig{DB: db})
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	properties := NewPropertyService(PropertyServiceConfig{DB: db, ArchiveGrace: 24 * time.Hour, Now: func() time.Time { return now }})
+	users := NewUserService(UserServiceConfig{DB: db})
+
+	ada := models.Actor{UserID: 1, Email: "ada@example.com", IP: "10.0.0.1"}
+	bob, _ := users.CreateUser(models.User{Email: "bob@example.com"}, "password1")
+
+	property, err := properties.CreateProperty(ada, "Blog", "blog.com")
+
+	if err != nil {
+		t.Fatalf("error creating property: %v", err)
+	}
+
+	// Saving without changes is not recorded
+	properties.UpdateProperty(ada, property.ID, property)
+	properties.UpdateProperty(ada, property.ID, models.Property{Name: "Blog", Domain: "blog.com", Active: false, RetentionDays: 30})
+	properties.GrantRole(ada, property.ID, bob.ID, models.RoleViewer)
+	properties.GrantRole(ada, property.ID, bob.ID, models.RoleAdmin)
+	properties.RevokeRole(ada, property.ID, bob.ID)
+	properties.ArchiveProperty(ada, property.ID)
+
+	entries, _, err := audit.ListEntries(models.AuditFilter{PageSize: 10})
+
+	if err != nil {
+		t.Fatalf("error listing entries: %v", err)
+	}
+
+	want := []struct {
+		action models.AuditAction
+		before string
+		after  string
+	}{
+		{models.AuditPropertyArchived, `{"domain":"blog.com","name":"Blog"}`, `{"purgeAfter":"2026-03-02T12:00:00Z"}`},
+		{models.AuditRoleRevoked, `{"role":"admin","user":"bob@example.com"}`, ""},
+		{models.AuditRoleGranted, `{"role":"viewer","user":"bob@example.com"}`, `{"role":"admin","user":"bob@example.com"}`},
+		{models.AuditRoleGranted, "", `{"role":"viewer","user":"bob@example.com"}`},
+		{models.AuditPropertyUpdated, `{"active":true,"retentionDays":0}`, `{"active":false,"retentionDays":30}`},
+		{models.AuditPropertyCreated, "", `{"domain":"blog.com","name":"Blog"}`},
+	}
+
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), entries)
+	}
+
+	for i, w := range want {
+		entry := entries[i]
+
+		if entry.Action != w.action || entry.Before != w.before || entry.After != w.after {
+			t.Errorf("entry %d: expected %s %s -> %s, got %s %s -> %s", i, w.action, w.before, w.after, entry.Action, entry.Before, entry.After)
+		}
+
+		if entry.ActorID == nil || *entry.ActorID != ada.UserID || entry.ActorEmail != ada.Email || entry.IP != ada.IP {
+			t.Errorf("entry %d: expected the actor to be recorded, got %+v", i, entry)
+		}
+
+		if entry.TargetType != models.AuditTargetProperty || entry.TargetID != property.ID || entry.TargetName != "Blog" {
+			t.Errorf("entry %d: expected the property to be the target, got %+v", i, entry)
+		}
+	}
+}
+
+func TestAuditService_ListEntriesFiltersAndPages(t *testing.T) {
+	db := newTestDB(t)
+	audit := NewAuditService(AuditServiceConfig{DB: db})
+
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	ada := models.Actor{UserID: 1, Email: "ada@example.com"}
+	bob := models.Actor{UserID: 2, Email: "bob@example.com"}
+
+	for i, actor := range []models.Actor{ada, bob, ada, ada} {
+		audit.Record(actor, models.AuditLogin, models.AuditTarget{Type: models.AuditTargetUser, ID: actor.UserID}, nil, nil)
+		db.Model(&models.AuditEntry{}).Where("id = ?", i+1).Update("created_at", day.AddDate(0, 0, i))
+	}
+
+	audit.Record(bob, models.AuditLogout, models.AuditTarget{Type: models.AuditTargetUser, ID: bob.UserID}, nil, nil)
+	db.Model(&models.AuditEntry{}).Where("id = ?", 5).Update("created_at", day.AddDate(0, 0, 4))
+
+	tests := []struct {
+		name     string
+		filter   models.AuditFilter
+		wantIDs  []uint
+		wantMore bool
+	}{
+		{"everything", models.AuditFilter{PageSize: 10}, []uint{5, 4, 3, 2, 1}, false},
+		{"action", models.AuditFilter{Action: models.AuditLogout, PageSize: 10}, []uint{5}, false},
+		{"actor", models.AuditFilter{Actor: "ADA@", PageSize: 10}, []uint{4, 3, 1}, false},
+		{"dates", models.AuditFilter{From: day.AddDate(0, 0, 1), To: day.AddDate(0, 0, 3), PageSize: 10}, []uint{3, 2}, false},
+		{"first page", models.AuditFilter{PageSize: 2}, []uint{5, 4}, true},
+		{"last page", models.AuditFilter{Page: 3, PageSize: 2}, []uint{1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, more, err := audit.ListEntries(tt.filter)
+
+			if err != nil {
+				t.Fatalf("error listing entries: %v", err)
+			}
+
+			ids := []uint{}
+
+			for _, entry := range entries {
+				ids = append(ids, entry.ID)
+			}
+
+			if len(ids) != len(tt.wantIDs) || more != tt.wantMore {
+				t.Fatalf("expected %v (more %v), got %v (more %v)", tt.wantIDs, tt.wantMore, ids, more)
+			}
+
+			for i := range ids {
+				if ids[i] != tt.wantIDs[i] {
+					t.Errorf("expected %v, got %v", tt.wantIDs, ids)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestAuditService_Prune(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, age := range []int{400, 366, 364, 1} {
+		db.Create(&models.AuditEntry{CreatedAt: now.AddDate(0, 0, -age), Action: models.AuditLogin})
+	}
+
+	if removed, err := NewAuditService(AuditServiceConfig{DB: db}).Prune(now); err != nil || removed != 0 {
+		t.Errorf("expected entries to be kept forever without a retention period, got %d, %v", removed, err)
+	}
+
+	if removed, err := NewAuditService(AuditServiceConfig{DB: db, RetentionDays: 365}).Prune(now); err != nil || removed != 2 {
+		t.Errorf("expected the two oldest entries to be removed, got %d, %v", removed, err)
+	}
+}
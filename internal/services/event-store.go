@@ -0,0 +1,210 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+/*
+EventStore is where raw events are written by TrackerService and read by
+ReportService. By default events live in the relational database along with
+everything else, see GormEventStore. Large sites can keep them in a
+columnar database instead, see SQLEventStore.
+*/
+type EventStore interface {
+	// RecordEvent stores a new event and sets its ID.
+	RecordEvent(event *models.Event) error
+	Aggregate(query EventQuery) (models.AggregateStats, error)
+	Timeseries(query EventQuery, interval string) ([]models.TimeseriesItem, error)
+
+	// Breakdown returns the numbers per value of a dimension, most viewed
+	// first. A limit of 0 or less returns all values.
+	Breakdown(query EventQuery, dimension string, limit int) ([]models.BreakdownItem, error)
+}
+
+/*
+ColumnarEventStore is an EventStore that keeps events outside of the
+relational database. Rollups are built from the relational events table, so
+they are not used with a columnar store, and the retention job prunes
+events through it instead.
+*/
+type ColumnarEventStore interface {
+	EventStore
+
+	// CountEvents returns how many events a property has and when the oldest
+	// of them was recorded.
+	CountEvents(propertyID uint) (int64, *time.Time, error)
+	DeleteEventsBefore(propertyID uint, before time.Time) (int64, error)
+	Close() error
+}
+
+// EventQuery selects the events of a property within a time range.
+type EventQuery struct {
+	PropertyID uint
+	Start      time.Time
+	End        time.Time
+
+	// InclusiveEnd includes events recorded exactly at End.
+	InclusiveEnd bool
+	Filters      []models.ReportFilter
+}
+
+/*
+GormEventStore keeps events in the events table of the relational
+database.
+*/
+type GormEventStore struct {
+	db *gorm.DB
+}
+
+func NewGormEventStore(db *gorm.DB) *GormEventStore {
+	return &GormEventStore{
+		db: db,
+	}
+}
+
+func (s *GormEventStore) RecordEvent(event *models.Event) error {
+	return s.db.Create(event).Error
+}
+
+func (s *GormEventStore) Aggregate(query EventQuery) (models.AggregateStats, error) {
+	var (
+		err    error
+		q      *gorm.DB
+		result models.AggregateStats
+	)
+
+	if q, err = s.eventsQuery(query); err != nil {
+		return models.AggregateStats{}, err
+	}
+
+	if err = q.Select(metricsSQL).Scan(&result).Error; err != nil {
+		return models.AggregateStats{}, err
+	}
+
+	return result, nil
+}
+
+func (s *GormEventStore) Timeseries(query EventQuery, interval string) ([]models.TimeseriesItem, error) {
+	var (
+		err      error
+		labelSQL string
+		q        *gorm.DB
+		result   []models.TimeseriesItem
+	)
+
+	if labelSQL, err = timeBucketSQL(s.db, interval, "created_at"); err != nil {
+		return nil, err
+	}
+
+	if q, err = s.eventsQuery(query); err != nil {
+		return nil, err
+	}
+
+	err = q.
+		Select(labelSQL + " as label, " + metricsSQL).
+		Group("label").
+		Order("label ASC").
+		Scan(&result).Error
+
+	return result, err
+}
+
+func (s *GormEventStore) Breakdown(query EventQuery, dimension string, limit int) ([]models.BreakdownItem, error) {
+	var (
+		err    error
+		ok     bool
+		column string
+		q      *gorm.DB
+		result []models.BreakdownItem
+	)
+
+	if column, ok = BreakdownDimensions[dimension]; !ok {
+		return nil, fmt.Errorf("invalid breakdown dimension: %s", dimension)
+	}
+
+	if q, err = s.eventsQuery(query); err != nil {
+		return nil, err
+	}
+
+	q = q.
+		Select(column + " as value, " + metricsSQL).
+		Group(column).
+		Order("pageviews DESC").
+		Order(column + " ASC")
+
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	err = q.Scan(&result).Error
+	return result, err
+}
+
+func (s *GormEventStore) eventsQuery(query EventQuery) (*gorm.DB, error) {
+	q := s.db.
+		Model(&models.Event{}).
+		Where("property_id = ?", query.PropertyID)
+
+	if query.InclusiveEnd {
+		q = q.Where("created_at BETWEEN ? AND ?", query.Start, query.End)
+	} else {
+		q = q.Where("created_at >= ? AND created_at < ?", query.Start, query.End)
+	}
+
+	for _, filter := range query.Filters {
+		clause, args, err := filterSQL(filter, likeSQL(s.db))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if clause != "" {
+			q = q.Where(clause, args...)
+		}
+	}
+
+	return q, nil
+}
+
+/*
+filterSQL returns a WHERE clause for a filter. The values within a filter
+are OR'd together. likeSQL is the dialect's LIKE clause for wildcard
+values, with %s standing in for the column.
+*/
+func filterSQL(filter models.ReportFilter, likeSQL string) (string, []any, error) {
+	column, ok := BreakdownDimensions[filter.Dimension]
+
+	if !ok {
+		return "", nil, fmt.Errorf("invalid filter dimension: %s", filter.Dimension)
+	}
+
+	if len(filter.Values) == 0 {
+		return "", nil, nil
+	}
+
+	clauses := make([]string, 0, len(filter.Values))
+	args := make([]any, 0, len(filter.Values))
+
+	for _, value := range filter.Values {
+		if strings.Contains(value, "*") {
+			clauses = append(clauses, fmt.Sprintf(likeSQL, column))
+			args = append(args, wildcardToLike(value))
+		} else {
+			clauses = append(clauses, column+" = ?")
+			args = append(args, value)
+		}
+	}
+
+	clause := "(" + strings.Join(clauses, " OR ") + ")"
+
+	if filter.Negate {
+		clause = "NOT " + clause
+	}
+
+	return clause, args, nil
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+type GeoLocatorConfig struct {
+	IpCache         *ttlcache.Cache[string, *models.CountryLookup]
+	IpLookupService *IpLookupService
+}
+
+/*
+GeoLocator resolves client IP addresses to a country and continent,
+caching lookups so each address is only sent to MaxMind once per TTL.
+*/
+type GeoLocator struct {
+	ipCache         *ttlcache.Cache[string, *models.CountryLookup]
+	ipLookupService *IpLookupService
+}
+
+func NewGeoLocator(config GeoLocatorConfig) *GeoLocator {
+	return &GeoLocator{
+		ipCache:         config.IpCache,
+		ipLookupService: config.IpLookupService,
+	}
+}
+
+/*
+Locate returns the location for an IP address. Lookup failures are logged
+and result in an empty location.
+*/
+func (g *GeoLocator) Locate(ip string) models.GeoLocation {
+	var (
+		ok        bool
+		result    models.GeoLocation
+		cacheItem *ttlcache.Item[string, *models.CountryLookup]
+	)
+
+	if ip == "" {
+		return result
+	}
+
+	slog.Info("checking cache for IP", "ip", ip)
+
+	cacheItem, ok = g.ipCache.GetOrSetFunc(ip, func() *models.CountryLookup {
+		slog.Info("ip cache miss", "ip", ip)
+
+		if localAddress(ip) {
+			slog.Warn("skipping ip lookup for local address", "ip", ip)
+			return nil
+		}
+
+		newCountryInfo, err := g.ipLookupService.GetCountryInfo(ip)
+
+		if err != nil {
+			slog.Error("error retrieving country info for IP", "ip", ip, "error", err)
+			return nil
+		}
+
+		return newCountryInfo
+	})
+
+	if ok {
+		slog.Info("ip cache hit", "ip", ip)
+	}
+
+	if cacheItem.Value() == nil {
+		return result
+	}
+
+	ci := cacheItem.Value()
+
+	if ci.Country != nil {
+		result.Country = englishOrFirstName(ci.Country.Names)
+
+		if ci.Country.IsoCode != nil {
+			result.CountryCode = *ci.Country.IsoCode
+		}
+	}
+
+	if ci.Continent != nil {
+		result.Continent = englishOrFirstName(ci.Continent.Names)
+
+		if ci.Continent.Code != nil {
+			result.ContinentCode = *ci.Continent.Code
+		}
+	}
+
+	return result
+}
+
+/*
+localAddress returns true for addresses MaxMind cannot locate, including
+truncated ones such as 127.0.0.0 and 10.1.2.0.
+*/
+func localAddress(ip string) bool {
+	if ip == "localhost" {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && (addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsLinkLocalUnicast())
+}
+
+/*
+englishOrFirstName returns the English name from a MaxMind names map, or
+the first available name if there is no English one.
+*/
+func englishOrFirstName(names map[string]string) string {
+	if name, ok := names["en"]; ok {
+		return name
+	}
+
+	for _, v := range names {
+		return v
+	}
+
+	return ""
+}
@@ -0,0 +1,672 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	ImportSourcePlausible       string = "plausible"
+	ImportSourceGoogleAnalytics string = "google-analytics"
+	ImportSourceUmami           string = "umami"
+
+	// maxImportUnzippedSize bounds the total size of the files in a ZIP
+	// upload once expanded, as only the upload itself is size limited
+	maxImportUnzippedSize int64 = 512 << 20
+)
+
+var (
+	ImportSources = []string{ImportSourcePlausible, ImportSourceGoogleAnalytics, ImportSourceUmami}
+
+	ErrNothingToImport = errors.New("no importable data was found in the file")
+	ErrImportTooLarge  = fmt.Errorf("the files in the zip file add up to more than %d MB", maxImportUnzippedSize>>20)
+)
+
+/*
+importDateLayouts are the date formats found in exports from the supported
+tools, tried in order.
+*/
+var importDateLayouts = []string{
+	"2006-01-02",
+	"20060102",
+	"1/2/06",
+	"1/2/2006",
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05.000Z",
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05.999999999-07",
+}
+
+/*
+importDimensionColumns lists, per dimension, the column headers that hold
+that dimension's values in Google Analytics (GA4 and Universal Analytics)
+exports.
+*/
+var importDimensionColumns = map[string][]string{
+	"path":    {"page path and screen class", "page path", "page", "landing page", "page path + query string"},
+	"browser": {"browser"},
+	"country": {"country"},
+}
+
+var (
+	importDateColumns      = []string{"date", "day index", "day"}
+	importPageviewsColumns = []string{"pageviews", "views", "screen page views", "screenpageviews"}
+	importVisitorsColumns  = []string{"visitors", "users", "total users", "active users"}
+)
+
+/*
+plausibleImportFiles maps the table name prefix of each file in a Plausible
+CSV export to the dimension it holds and the column with its values. Files
+not listed here (sources, devices, etc.) are skipped.
+*/
+var plausibleImportFiles = map[string]struct {
+	dimension string
+	column    string
+}{
+	"imported_visitors":  {dimension: "", column: ""},
+	"imported_pages":     {dimension: "path", column: "page"},
+	"imported_browsers":  {dimension: "browser", column: "browser"},
+	"imported_locations": {dimension: "country_code", column: "country"},
+}
+
+type ImportServiceConfig struct {
+	DB *gorm.DB
+}
+
+type ImportService struct {
+	db *gorm.DB
+}
+
+func NewImportService(config ImportServiceConfig) *ImportService {
+	return &ImportService{
+		db: config.DB,
+	}
+}
+
+// ListImports returns the imports into any of the given properties.
+func (s *ImportService) ListImports(propertyIDs []uint) ([]models.Import, error) {
+	var (
+		err     error
+		imports []models.Import
+	)
+
+	if len(propertyIDs) == 0 {
+		return []models.Import{}, nil
+	}
+
+	err = s.db.
+		Preload("Property").
+		Where("property_id IN ?", propertyIDs).
+		Order("created_at DESC").
+		Find(&imports).Error
+
+	if err != nil {
+		return []models.Import{}, err
+	}
+
+	return imports, nil
+}
+
+/*
+Import reads an export from another analytics tool and stores it as daily
+aggregates for a property. The content may be a single CSV file or a ZIP
+of CSV files. Reports that have no date column are attributed to
+fallbackDate.
+*/
+func (s *ImportService) Import(propertyID uint, source, fileName string, content []byte, fallbackDate time.Time) (models.Import, error) {
+	var (
+		err   error
+		acc   = newImportAccumulator()
+		files map[string][]byte
+	)
+
+	if !slices.Contains(ImportSources, source) {
+		return models.Import{}, fmt.Errorf("unsupported import source '%s'", source)
+	}
+
+	if files, err = importFiles(fileName, content, maxImportUnzippedSize); err != nil {
+		return models.Import{}, err
+	}
+
+	for name, fileContent := range files {
+		switch {
+		case source == ImportSourcePlausible:
+			err = parsePlausibleCSV(name, fileContent, acc)
+		case source == ImportSourceGoogleAnalytics:
+			err = parseGoogleAnalyticsCSV(fileContent, fallbackDate, acc)
+		case source == ImportSourceUmami && isSQLDump(name):
+			err = s.parseUmamiDump(propertyID, fileContent, acc)
+		case source == ImportSourceUmami:
+			err = parseUmamiCSV(fileContent, acc)
+		}
+
+		if err != nil {
+			return models.Import{}, fmt.Errorf("error reading '%s': %w", name, err)
+		}
+	}
+
+	stats := acc.stats(propertyID)
+
+	if len(stats) == 0 {
+		return models.Import{}, ErrNothingToImport
+	}
+
+	result := models.Import{
+		PropertyID: propertyID,
+		Source:     source,
+		FileName:   fileName,
+		Rows:       len(stats),
+		StartDate:  stats[0].Date,
+		EndDate:    stats[0].Date,
+	}
+
+	for _, stat := range stats {
+		if stat.Date.Before(result.StartDate) {
+			result.StartDate = stat.Date
+		}
+
+		if stat.Date.After(result.EndDate) {
+			result.EndDate = stat.Date
+		}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&result).Error; err != nil {
+			return err
+		}
+
+		for i := range stats {
+			stats[i].ImportID = result.ID
+		}
+
+		return tx.CreateInBatches(stats, 500).Error
+	})
+
+	if err != nil {
+		return models.Import{}, fmt.Errorf("error saving imported stats: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *ImportService) GetImport(id uint) (models.Import, error) {
+	var (
+		err    error
+		result models.Import
+	)
+
+	if err = s.db.First(&result, id).Error; err != nil {
+		return models.Import{}, err
+	}
+
+	return result, nil
+}
+
+// DeleteImport removes an import and all of the stats it created.
+func (s *ImportService) DeleteImport(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("import_id = ?", id).Delete(&models.ImportedStat{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&models.Import{}, id).Error
+	})
+}
+
+/*
+importFiles returns the CSV and SQL files contained in an upload, keyed by
+file name. A ZIP archive is expanded, anything else is treated as a single
+file.
+The expanded files may add up to at most limit bytes, whatever sizes the
+archive claims for them.
+*/
+func importFiles(fileName string, content []byte, limit int64) (map[string][]byte, error) {
+	var (
+		err    error
+		reader *zip.Reader
+		rc     io.ReadCloser
+		b      []byte
+		result = map[string][]byte{}
+	)
+
+	remaining := limit
+
+	if !bytes.HasPrefix(content, []byte("PK\x03\x04")) {
+		result[filepath.Base(fileName)] = content
+		return result, nil
+	}
+
+	if reader, err = zip.NewReader(bytes.NewReader(content), int64(len(content))); err != nil {
+		return nil, fmt.Errorf("error reading zip file: %w", err)
+	}
+
+	for _, f := range reader.File {
+		if f.FileInfo().IsDir() || !strings.EqualFold(filepath.Ext(f.Name), ".csv") && !isSQLDump(f.Name) {
+			continue
+		}
+
+		if f.UncompressedSize64 > uint64(remaining) {
+			return nil, ErrImportTooLarge
+		}
+
+		if rc, err = f.Open(); err != nil {
+			return nil, fmt.Errorf("error opening '%s' in zip file: %w", f.Name, err)
+		}
+
+		b, err = io.ReadAll(io.LimitReader(rc, remaining+1))
+		rc.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading '%s' in zip file: %w", f.Name, err)
+		}
+
+		if remaining -= int64(len(b)); remaining < 0 {
+			return nil, ErrImportTooLarge
+		}
+
+		result[filepath.Base(f.Name)] = b
+	}
+
+	return result, nil
+}
+
+/*
+parsePlausibleCSV reads one table from Plausible's CSV export. The table is
+identified by the file name, e.g. imported_pages_20240101_20241231.csv.
+*/
+func parsePlausibleCSV(fileName string, content []byte, acc *importAccumulator) error {
+	var (
+		err  error
+		rows [][]string
+	)
+
+	for prefix, table := range plausibleImportFiles {
+		if !strings.HasPrefix(strings.ToLower(fileName), prefix) {
+			continue
+		}
+
+		if rows, err = readImportCSV(content); err != nil {
+			return err
+		}
+
+		columns := headerIndexes(rows[0])
+		valueColumn := -1
+
+		if table.dimension != "" {
+			if valueColumn = findColumn(columns, []string{table.column}); valueColumn < 0 {
+				return fmt.Errorf("missing '%s' column", table.column)
+			}
+		}
+
+		return addTabularRows(rows, columns, table.dimension, valueColumn, time.Time{}, acc)
+	}
+
+	return nil
+}
+
+/*
+parseGoogleAnalyticsCSV reads a report downloaded from Google Analytics (GA4
+or Universal Analytics). Reports list their dimensions first, followed by
+metrics, so the first non-date column decides which dimension the report
+holds. A report with only a date column holds site totals.
+*/
+func parseGoogleAnalyticsCSV(content []byte, fallbackDate time.Time, acc *importAccumulator) error {
+	var (
+		err       error
+		rows      [][]string
+		dimension string
+	)
+
+	if rows, err = readImportCSV(content); err != nil {
+		return err
+	}
+
+	columns := headerIndexes(rows[0])
+	valueColumn := -1
+	firstColumn := strings.ToLower(strings.TrimSpace(rows[0][0]))
+
+	if slices.Contains(importDateColumns, firstColumn) && len(rows[0]) > 1 {
+		firstColumn = strings.ToLower(strings.TrimSpace(rows[0][1]))
+	}
+
+	for candidate, names := range importDimensionColumns {
+		if slices.Contains(names, firstColumn) {
+			dimension = candidate
+			valueColumn = columns[firstColumn]
+		}
+	}
+
+	isMetric := slices.Contains(importPageviewsColumns, firstColumn) || slices.Contains(importVisitorsColumns, firstColumn)
+
+	if dimension == "" && !isMetric && !slices.Contains(importDateColumns, firstColumn) {
+		return fmt.Errorf("unsupported report dimension '%s'", rows[0][0])
+	}
+
+	if findColumn(columns, importDateColumns) < 0 && fallbackDate.IsZero() {
+		return fmt.Errorf("the report has no date column, please provide the date the report covers")
+	}
+
+	return addTabularRows(rows, columns, dimension, valueColumn, fallbackDate, acc)
+}
+
+/*
+parseUmamiCSV reads Umami's data export, which holds one row per raw event
+joined with its session. Rows are rolled up into daily totals, pages,
+browsers and countries, counting distinct sessions as visitors.
+*/
+func parseUmamiCSV(content []byte, acc *importAccumulator) error {
+	var (
+		err  error
+		rows [][]string
+	)
+
+	if rows, err = readImportCSV(content); err != nil {
+		return err
+	}
+
+	return addUmamiRows(rows, acc)
+}
+
+/*
+addUmamiRows rolls up Umami events, with a header row naming the columns
+first, into daily totals, pages, browsers and countries.
+*/
+func addUmamiRows(rows [][]string, acc *importAccumulator) error {
+	var (
+		err error
+		day time.Time
+	)
+
+	columns := headerIndexes(rows[0])
+	createdAt := findColumn(columns, []string{"created_at"})
+	path := findColumn(columns, []string{"url_path"})
+	browser := findColumn(columns, []string{"browser"})
+	country := findColumn(columns, []string{"country"})
+	session := findColumn(columns, []string{"session_id"})
+	eventType := findColumn(columns, []string{"event_type"})
+
+	if createdAt < 0 || path < 0 {
+		return fmt.Errorf("missing 'created_at' or 'url_path' column, is this an Umami data export?")
+	}
+
+	for _, row := range rows[1:] {
+		// Event type 1 is a page view, anything else is a custom event
+		if cell(row, eventType) != "" && cell(row, eventType) != "1" {
+			continue
+		}
+
+		if day, err = parseImportDate(cell(row, createdAt)); err != nil {
+			return err
+		}
+
+		sessionID := cell(row, session)
+
+		acc.addEvent(day, "", "", sessionID)
+		acc.addEvent(day, "path", cell(row, path), sessionID)
+
+		if browser >= 0 {
+			acc.addEvent(day, "browser", umamiBrowserName(cell(row, browser)), sessionID)
+		}
+
+		if country >= 0 {
+			acc.addEvent(day, "country_code", strings.ToUpper(cell(row, country)), sessionID)
+		}
+	}
+
+	return nil
+}
+
+/*
+addTabularRows adds rows that already hold aggregate numbers. A valueColumn
+of -1 means the rows are site totals.
+*/
+func addTabularRows(rows [][]string, columns map[string]int, dimension string, valueColumn int, fallbackDate time.Time, acc *importAccumulator) error {
+	var (
+		err       error
+		day       time.Time
+		pageviews int
+		visitors  int
+	)
+
+	dateColumn := findColumn(columns, importDateColumns)
+	pageviewsColumn := findColumn(columns, importPageviewsColumns)
+	visitorsColumn := findColumn(columns, importVisitorsColumns)
+
+	if pageviewsColumn < 0 && visitorsColumn < 0 {
+		return fmt.Errorf("no pageviews or visitors column found")
+	}
+
+	for _, row := range rows[1:] {
+		day = fallbackDate
+
+		if dateColumn >= 0 {
+			if day, err = parseImportDate(cell(row, dateColumn)); err != nil {
+				return err
+			}
+		}
+
+		if pageviews, err = parseImportNumber(cell(row, pageviewsColumn)); err != nil {
+			return err
+		}
+
+		if visitors, err = parseImportNumber(cell(row, visitorsColumn)); err != nil {
+			return err
+		}
+
+		value := ""
+
+		if valueColumn >= 0 {
+			value = cell(row, valueColumn)
+		}
+
+		acc.add(day, dimension, value, pageviews, visitors)
+	}
+
+	return nil
+}
+
+/*
+readImportCSV returns the header and data rows of a CSV export. Comment
+lines starting with "#" and blank lines before the header are skipped, as
+Google Analytics adds them. Reading stops at the first blank line after
+the data, which is where Universal Analytics starts its summary sections.
+*/
+func readImportCSV(content []byte) ([][]string, error) {
+	var (
+		err    error
+		record []string
+		result [][]string
+	)
+
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.Comment = '#'
+
+	for {
+		if record, err = reader.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("error reading csv: %w", err)
+		}
+
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			if len(result) > 0 {
+				break
+			}
+
+			continue
+		}
+
+		result = append(result, record)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("the file is empty")
+	}
+
+	return result, nil
+}
+
+func headerIndexes(header []string) map[string]int {
+	result := make(map[string]int, len(header))
+
+	for i, name := range header {
+		result[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	return result
+}
+
+func findColumn(columns map[string]int, names []string) int {
+	for _, name := range names {
+		if index, ok := columns[name]; ok {
+			return index
+		}
+	}
+
+	return -1
+}
+
+func cell(row []string, index int) string {
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+
+	return strings.TrimSpace(row[index])
+}
+
+func parseImportDate(value string) (time.Time, error) {
+	for _, layout := range importDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.UTC()
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized date '%s'", value)
+}
+
+func parseImportNumber(value string) (int, error) {
+	value = strings.ReplaceAll(value, ",", "")
+
+	if value == "" {
+		return 0, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("unrecognized number '%s'", value)
+	}
+
+	return int(math.Round(f)), nil
+}
+
+/*
+umamiBrowserName maps Umami's browser identifiers onto the browser names
+recorded by the Aletics tracker.
+*/
+func umamiBrowserName(value string) string {
+	switch strings.ToLower(value) {
+	case "chrome", "crios", "chromium-webview":
+		return "Chrome"
+	case "firefox", "fxios":
+		return "Firefox"
+	case "edge", "edge-chromium", "edge-ios":
+		return "Edge"
+	case "safari", "ios", "ios-webview":
+		return "Safari"
+	}
+
+	return "Unknown"
+}
+
+type importKey struct {
+	date      time.Time
+	dimension string
+	value     string
+}
+
+type importCounts struct {
+	pageviews int
+	visitors  int
+	sessions  map[string]struct{}
+}
+
+/*
+importAccumulator sums imported numbers per day, dimension and value so
+that each combination becomes a single ImportedStat row.
+*/
+type importAccumulator struct {
+	keys   []importKey
+	counts map[importKey]*importCounts
+}
+
+func newImportAccumulator() *importAccumulator {
+	return &importAccumulator{
+		counts: map[importKey]*importCounts{},
+	}
+}
+
+func (a *importAccumulator) get(key importKey) *importCounts {
+	counts, ok := a.counts[key]
+
+	if !ok {
+		counts = &importCounts{sessions: map[string]struct{}{}}
+		a.counts[key] = counts
+		a.keys = append(a.keys, key)
+	}
+
+	return counts
+}
+
+func (a *importAccumulator) add(day time.Time, dimension, value string, pageviews, visitors int) {
+	counts := a.get(importKey{date: day, dimension: dimension, value: value})
+	counts.pageviews += pageviews
+	counts.visitors += visitors
+}
+
+func (a *importAccumulator) addEvent(day time.Time, dimension, value, sessionID string) {
+	counts := a.get(importKey{date: day, dimension: dimension, value: value})
+	counts.pageviews++
+
+	if sessionID != "" {
+		counts.sessions[sessionID] = struct{}{}
+	}
+}
+
+func (a *importAccumulator) stats(propertyID uint) []models.ImportedStat {
+	result := make([]models.ImportedStat, 0, len(a.keys))
+
+	for _, key := range a.keys {
+		counts := a.counts[key]
+
+		result = append(result, models.ImportedStat{
+			PropertyID: propertyID,
+			Date:       key.date,
+			Dimension:  key.dimension,
+			Value:      key.value,
+			Pageviews:  counts.pageviews,
+			Visitors:   counts.visitors + len(counts.sessions),
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func zipFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	buffer := &bytes.Buffer{}
+	writer := zip.NewWriter(buffer)
+
+	for name, content := range files {
+		f, err := writer.Create(name)
+
+		if err != nil {
+			t.Fatalf("error creating zip entry: %v", err)
+		}
+
+		if _, err = f.Write([]byte(content)); err != nil {
+			t.Fatalf("error writing zip entry: %v", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("error closing zip: %v", err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestImportService_Plausible(t *testing.T) {
+	db := newTestDB(t)
+	svc := NewImportService(ImportServiceConfig{DB: db})
+	reports := NewReportService(ReportServiceConfig{DB: db})
+
+	content := zipFiles(t, map[string]string{
+		"imported_visitors_20250101_20250102.csv": "date,visitors,pageviews,bounces,visits,visit_duration\n2025-01-01,10,25,3,12,100\n2025-01-02,5,8,1,5,50\n",
+		"imported_pages_20250101_20250102.csv":    "date,hostname,page,visits,visitors,pageviews,exits,time_on_page\n2025-01-01,example.com,/,10,8,20,5,0\n2025-01-01,example.com,/about,2,2,5,1,0\n",
+		"imported_browsers_20250101_20250102.csv": "date,browser,browser_version,visitors,visits,visit_duration,bounces,pageviews\n2025-01-01,Firefox,120,4,4,0,0,9\n2025-01-01,Firefox,121,1,1,0,0,2\n",
+		"imported_sources_20250101_20250102.csv":  "date,source,visitors\n2025-01-01,Google,4\n",
+	})
+
+	result, err := svc.Import(1, ImportSourcePlausible, "export.zip", content, time.Time{})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !result.StartDate.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) || !result.EndDate.Equal(time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the import to cover 2025-01-01 to 2025-01-02, got %v to %v", result.StartDate, result.EndDate)
+	}
+
+	start, end := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)
+	aggregate, err := reports.GetAggregate(1, start, end, nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if aggregate.Pageviews != 33 || aggregate.Visitors != 15 {
+		t.Errorf("expected 33 pageviews and 15 visitors, got %+v", aggregate)
+	}
+
+	browsers, err := reports.GetBreakdown(1, start, end, "browser", 10, nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(browsers) != 1 || browsers[0].Value != "Firefox" || browsers[0].Pageviews != 11 {
+		t.Errorf("expected browser versions to be combined into one Firefox row, got %+v", browsers)
+	}
+
+	if err = svc.DeleteImport(result.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if aggregate, _ = reports.GetAggregate(1, start, end, nil); aggregate.Pageviews != 0 {
+		t.Errorf("expected deleting the import to remove its stats, got %+v", aggregate)
+	}
+}
+
+func TestImportService_GoogleAnalytics(t *testing.T) {
+	db := newTestDB(t)
+	svc := NewImportService(ImportServiceConfig{DB: db})
+	reports := NewReportService(ReportServiceConfig{DB: db})
+
+	content := []byte("# ----------------------------------------\n# Pages and screens\n# ----------------------------------------\n\nPage path and screen class,Date,Views,Active users\n/,20250301,\"1,200\",300\n/pricing,20250301,40,20\n/,20250302,10,5\n")
+
+	if _, err := svc.Import(1, ImportSourceGoogleAnalytics, "pages.csv", content, time.Time{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	paths, err := reports.GetBreakdown(1, time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC), "path", 10, nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(paths) != 2 || paths[0].Value != "/" || paths[0].Pageviews != 1210 || paths[1].Pageviews != 40 {
+		t.Errorf("unexpected path breakdown: %+v", paths)
+	}
+
+	noDate := []byte("Browser,Users,Views\nChrome,10,30\n")
+
+	if _, err = svc.Import(1, ImportSourceGoogleAnalytics, "browsers.csv", noDate, time.Time{}); err == nil {
+		t.Errorf("expected an error for a report without a date column or fallback date")
+	}
+
+	if _, err = svc.Import(1, ImportSourceGoogleAnalytics, "browsers.csv", noDate, time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Errorf("unexpected error with a fallback date: %v", err)
+	}
+}
+
+func TestImportService_Umami(t *testing.T) {
+	db := newTestDB(t)
+	svc := NewImportService(ImportServiceConfig{DB: db})
+
+	content := []byte("website_id,session_id,created_at,url_path,event_type,browser,country\n" +
+		"w,s1,2025-05-01 10:00:00,/,1,chrome,us\n" +
+		"w,s1,2025-05-01 10:01:00,/docs,1,chrome,us\n" +
+		"w,s1,2025-05-01 10:02:00,/docs,2,chrome,us\n" +
+		"w,s2,2025-05-01 11:00:00,/,1,firefox,de\n")
+
+	if _, err := svc.Import(1, ImportSourceUmami, "umami.csv", content, time.Time{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var stats []models.ImportedStat
+	db.Where("dimension IN ?", []string{"", "country_code"}).Order("dimension, value").Find(&stats)
+
+	want := []models.ImportedStat{
+		{Dimension: "", Value: "", Pageviews: 3, Visitors: 2},
+		{Dimension: "country_code", Value: "DE", Pageviews: 1, Visitors: 1},
+		{Dimension: "country_code", Value: "US", Pageviews: 2, Visitors: 1},
+	}
+
+	if len(stats) != len(want) {
+		t.Fatalf("expected %d stats, got %+v", len(want), stats)
+	}
+
+	for i := range want {
+		if stats[i].Dimension != want[i].Dimension || stats[i].Value != want[i].Value || stats[i].Pageviews != want[i].Pageviews || stats[i].Visitors != want[i].Visitors {
+			t.Errorf("stat %d: expected %+v, got %+v", i, want[i], stats[i])
+		}
+	}
+
+	if _, err := svc.Import(1, ImportSourceUmami, "empty.csv", []byte("created_at,url_path\n"), time.Time{}); !errors.Is(err, ErrNothingToImport) {
+		t.Errorf("expected ErrNothingToImport, got %v", err)
+	}
+}
+
+func TestImportFiles_LimitsExpandedSize(t *testing.T) {
+	content := zipFiles(t, map[string]string{
+		"a.csv": strings.Repeat("date,visitors\n", 50),
+		"b.csv": strings.Repeat("date,visitors\n", 50),
+	})
+
+	if _, err := importFiles("export.zip", content, 2000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := importFiles("export.zip", content, 1000); !errors.Is(err, ErrImportTooLarge) {
+		t.Errorf("expected ErrImportTooLarge, got %v", err)
+	}
+}
+
+func TestImportService_UmamiDump(t *testing.T) {
+	db := newTestDB(t)
+	svc := NewImportService(ImportServiceConfig{DB: db})
+	property := models.Property{Name: "Site", Domain: "example.com", Token: "token", Active: true}
+	db.Create(&property)
+
+	dump := `--
+-- PostgreSQL database dump
+--
+
+COPY public.website (website_id, name, domain, created_at) FROM stdin;
+w1	Site	www.example.com	2025-01-01 00:00:00+00
+w2	Other	other.com	2025-01-01 00:00:00+00
+\.
+
+COPY public.website_event (event_id, website_id, session_id, created_at, url_path, url_query, event_type, event_name) FROM stdin;
+e1	w1	s1	2025-05-01 10:00:00.123+00	/	\N	1	\N
+e2	w1	s1	2025-05-01 10:01:00+00	/docs\tfaq	utm=x	1	\N
+e3	w1	s1	2025-05-01 10:02:00+00	/docs	\N	2	signup
+e4	w1	s2	2025-05-02 23:30:00-02	/	\N	1	\N
+e5	w2	s3	2025-05-01 10:00:00+00	/	\N	1	\N
+\.
+
+COPY public.session (session_id, website_id, hostname, browser, os, country) FROM stdin;
+s1	w1	example.com	chrome	Linux	US
+s2	w1	example.com	firefox	Mac OS	DE
+s3	w2	other.com	safari	iOS	FR
+\.
+`
+
+	if _, err := svc.Import(property.ID, ImportSourceUmami, "umami.sql", []byte(dump), time.Time{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var stats []models.ImportedStat
+	db.Order("date, dimension, value").Find(&stats)
+
+	got := []string{}
+
+	for _, stat := range stats {
+		got = append(got, fmt.Sprintf("%s %s=%s %d/%d", stat.Date.Format("01-02"), stat.Dimension, stat.Value, stat.Pageviews, stat.Visitors))
+	}
+
+	// The custom event and the other website are skipped, and the event
+	// late on the 2nd in UTC-2 is on the 3rd in UTC
+	want := []string{
+		"05-01 = 2/1",
+		"05-01 browser=Chrome 2/1",
+		"05-01 country_code=US 2/1",
+		"05-01 path=/ 1/1",
+		"05-01 path=/docs\tfaq 1/1",
+		"05-03 = 1/1",
+		"05-03 browser=Firefox 1/1",
+		"05-03 country_code=DE 1/1",
+		"05-03 path=/ 1/1",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	mysql := []byte("INSERT INTO `website_event` VALUES ('e1','w1');\n")
+
+	if _, err := svc.Import(property.ID, ImportSourceUmami, "umami.sql", mysql, time.Time{}); err == nil || !strings.Contains(err.Error(), "MySQL") {
+		t.Errorf("expected MySQL dumps to be rejected, got %v", err)
+	}
+}
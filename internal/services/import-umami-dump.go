@@ -0,0 +1,323 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+/*
+umamiDumpTables are the tables read from a dump of an Umami database, and
+the columns used from each.
+*/
+var umamiDumpTables = map[string][]string{
+	"website":       {"website_id", "domain"},
+	"website_event": {"website_id", "session_id", "created_at", "url_path", "event_type"},
+	"session":       {"session_id", "browser", "country"},
+}
+
+// dumpTable is the data of one table in a database dump.
+type dumpTable struct {
+	columns map[string]int
+	rows    [][]string
+}
+
+func (t dumpTable) value(row []string, column string) string {
+	index, ok := t.columns[column]
+
+	if !ok {
+		return ""
+	}
+
+	return cell(row, index)
+}
+
+func isSQLDump(fileName string) bool {
+	return strings.EqualFold(filepath.Ext(fileName), ".sql")
+}
+
+/*
+parseUmamiDump reads a plain SQL dump of an Umami database made with
+pg_dump, which holds every website on the server. Only the events of the
+website whose domain matches the property's are imported, or of the only
+website in the dump. Umami on MySQL dumps its data as INSERT statements,
+which are not supported, so its CSV export must be used instead.
+*/
+func (s *ImportService) parseUmamiDump(propertyID uint, content []byte, acc *importAccumulator) error {
+	var (
+		err       error
+		property  models.Property
+		websiteID string
+	)
+
+	if bytes.Contains(content, []byte("INSERT INTO `website_event`")) {
+		return fmt.Errorf("MySQL dumps of Umami are not supported, use the CSV from Umami's data export instead")
+	}
+
+	tables, err := readPostgresDump(content, umamiDumpTables)
+
+	if err != nil {
+		return err
+	}
+
+	events, ok := tables["website_event"]
+
+	if !ok {
+		return fmt.Errorf("no website_event table found, is this a pg_dump of an Umami database?")
+	}
+
+	if err = s.db.Unscoped().First(&property, propertyID).Error; err != nil {
+		return fmt.Errorf("error getting property: %w", err)
+	}
+
+	if websiteID, err = umamiWebsiteID(tables, property.Domain); err != nil {
+		return err
+	}
+
+	browsers := map[string]string{}
+	countries := map[string]string{}
+
+	sessions := tables["session"]
+
+	for _, row := range sessions.rows {
+		sessionID := sessions.value(row, "session_id")
+		browsers[sessionID] = sessions.value(row, "browser")
+		countries[sessionID] = sessions.value(row, "country")
+	}
+
+	rows := [][]string{{"created_at", "url_path", "event_type", "session_id", "browser", "country"}}
+
+	for _, row := range events.rows {
+		if events.value(row, "website_id") != websiteID {
+			continue
+		}
+
+		sessionID := events.value(row, "session_id")
+
+		rows = append(rows, []string{
+			events.value(row, "created_at"),
+			events.value(row, "url_path"),
+			events.value(row, "event_type"),
+			sessionID,
+			browsers[sessionID],
+			countries[sessionID],
+		})
+	}
+
+	return addUmamiRows(rows, acc)
+}
+
+/*
+umamiWebsiteID picks the website to import from a dump: the only one with
+events, or the one whose domain is the property's, with or without www.
+*/
+func umamiWebsiteID(tables map[string]dumpTable, domain string) (string, error) {
+	ids := map[string]struct{}{}
+	events := tables["website_event"]
+
+	for _, row := range events.rows {
+		ids[events.value(row, "website_id")] = struct{}{}
+	}
+
+	if len(ids) == 1 {
+		for id := range ids {
+			return id, nil
+		}
+	}
+
+	websites := tables["website"]
+	domain = strings.TrimPrefix(strings.ToLower(domain), "www.")
+
+	for _, row := range websites.rows {
+		if strings.TrimPrefix(strings.ToLower(websites.value(row, "domain")), "www.") == domain {
+			return websites.value(row, "website_id"), nil
+		}
+	}
+
+	return "", fmt.Errorf("the dump holds several websites and none of them has the domain '%s'", domain)
+}
+
+/*
+readPostgresDump returns the data of the wanted tables from a plain SQL
+dump made by pg_dump, which writes each table as a COPY statement followed
+by one tab separated row per line, ending with a line holding "\.". Only
+the wanted columns are kept.
+*/
+func readPostgresDump(content []byte, wanted map[string][]string) (map[string]dumpTable, error) {
+	var (
+		table   string
+		current dumpTable
+		keep    []int
+	)
+
+	result := map[string]dumpTable{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if table != "" {
+			if line == `\.` {
+				result[table] = current
+				table = ""
+				continue
+			}
+
+			fields := strings.Split(line, "\t")
+			row := make([]string, len(keep))
+
+			for i, index := range keep {
+				if index < len(fields) {
+					row[i] = unescapeCopyValue(fields[index])
+				}
+			}
+
+			current.rows = append(current.rows, row)
+			continue
+		}
+
+		name, columns, ok := parseCopyStatement(line)
+
+		if !ok {
+			continue
+		}
+
+		if _, ok = wanted[name]; !ok {
+			continue
+		}
+
+		table = name
+		current = dumpTable{columns: map[string]int{}}
+		keep = nil
+
+		for i, column := range columns {
+			for _, wantedColumn := range wanted[name] {
+				if column == wantedColumn {
+					current.columns[column] = len(keep)
+					keep = append(keep, i)
+				}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading dump: %w", err)
+	}
+
+	if table != "" {
+		return nil, fmt.Errorf("the dump ends part way through the %s table", table)
+	}
+
+	return result, nil
+}
+
+/*
+parseCopyStatement reads the table name, without its schema, and column
+names from a line such as
+
+	COPY public.website_event (event_id, website_id, created_at) FROM stdin;
+*/
+func parseCopyStatement(line string) (string, []string, bool) {
+	rest, ok := strings.CutPrefix(line, "COPY ")
+
+	if !ok || !strings.HasSuffix(line, " FROM stdin;") {
+		return "", nil, false
+	}
+
+	name, rest, ok := strings.Cut(rest, " (")
+
+	if !ok {
+		return "", nil, false
+	}
+
+	list, _, ok := strings.Cut(rest, ")")
+
+	if !ok {
+		return "", nil, false
+	}
+
+	if index := strings.LastIndex(name, "."); index >= 0 {
+		name = name[index+1:]
+	}
+
+	columns := []string{}
+
+	for column := range strings.SplitSeq(list, ",") {
+		columns = append(columns, strings.Trim(strings.TrimSpace(column), `"`))
+	}
+
+	return strings.Trim(name, `"`), columns, true
+}
+
+/*
+unescapeCopyValue decodes a value in COPY's text format, where \N is NULL
+and backslash escapes stand for tabs, newlines and other bytes.
+*/
+func unescapeCopyValue(value string) string {
+	if value == `\N` {
+		return ""
+	}
+
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		i++
+
+		switch value[i] {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			end := i + 1
+
+			for end < len(value) && end < i+3 && strings.IndexByte("0123456789abcdefABCDEF", value[end]) >= 0 {
+				end++
+			}
+
+			if n, err := strconv.ParseUint(value[i+1:end], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i = end - 1
+			} else {
+				b.WriteByte('x')
+			}
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := i
+
+			for end < len(value) && end < i+3 && value[end] >= '0' && value[end] <= '7' {
+				end++
+			}
+
+			n, _ := strconv.ParseUint(value[i:end], 8, 8)
+			b.WriteByte(byte(n))
+			i = end - 1
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,298 @@
+package services
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// loginAttemptsKeptFor is how long attempts are kept for admins to review
+	loginAttemptsKeptFor time.Duration = 30 * 24 * time.Hour
+
+	// maxLoginDelay caps how long someone waits between failed attempts
+	// before they are locked out
+	maxLoginDelay time.Duration = 30 * time.Second
+)
+
+type LoginAttemptServiceConfig struct {
+	DB *gorm.DB
+
+	// MaxAttempts is how many failed attempts an account may have within
+	// LockoutDuration before it is locked out. 0 turns off throttling.
+	MaxAttempts int
+
+	// MaxAttemptsPerIP is the same for a single IP address. It should be
+	// higher, as many people may share one address.
+	MaxAttemptsPerIP int
+
+	LockoutDuration time.Duration
+
+	// PrivacyMode stores attempts with truncated IP addresses. Failures are
+	// still counted by the full address, in memory only, so one client
+	// cannot lock out everyone sharing its /24 or /48.
+	PrivacyMode bool
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+/*
+LoginAttemptService slows down password guessing. Each failed attempt
+makes the next one wait longer, and too many lock out the account or IP
+address until LockoutDuration has passed since the last failure. Signing
+in to an account clears its failures, but not those of the IP address.
+*/
+type LoginAttemptService struct {
+	db               *gorm.DB
+	maxAttempts      int
+	maxAttemptsPerIP int
+	lockoutDuration  time.Duration
+	privacyMode      bool
+	now              func() time.Time
+
+	// ipFailures holds the recent failures of each full IP address, newest
+	// first, in privacy mode
+	ipMutex    sync.Mutex
+	ipFailures map[string][]time.Time
+}
+
+func NewLoginAttemptService(config LoginAttemptServiceConfig) *LoginAttemptService {
+	now := config.Now
+
+	if now == nil {
+		now = time.Now
+	}
+
+	return &LoginAttemptService{
+		db:               config.DB,
+		maxAttempts:      config.MaxAttempts,
+		maxAttemptsPerIP: config.MaxAttemptsPerIP,
+		lockoutDuration:  config.LockoutDuration,
+		privacyMode:      config.PrivacyMode,
+		now:              now,
+		ipFailures:       map[string][]time.Time{},
+	}
+}
+
+/*
+Check returns when someone may next try to sign in to the given account
+from the given IP address. A zero RetryAt means they may try now.
+*/
+func (s *LoginAttemptService) Check(email, ip string) (models.LoginThrottle, error) {
+	var (
+		err       error
+		byAccount models.LoginThrottle
+		byIP      models.LoginThrottle
+	)
+
+	if s.maxAttempts <= 0 {
+		return models.LoginThrottle{}, nil
+	}
+
+	if byAccount, err = s.throttle("email", normalizeLoginEmail(email), s.maxAttempts, true); err != nil {
+		return models.LoginThrottle{}, err
+	}
+
+	if s.privacyMode {
+		byIP = s.throttleFor(s.recentIPFailures(ip), s.maxAttemptsPerIP)
+	} else if byIP, err = s.throttle("ip", ip, s.maxAttemptsPerIP, false); err != nil {
+		return models.LoginThrottle{}, err
+	}
+
+	if byIP.RetryAt.After(byAccount.RetryAt) {
+		return byIP, nil
+	}
+
+	return byAccount, nil
+}
+
+// RecordFailure records a wrong password or two-factor code.
+func (s *LoginAttemptService) RecordFailure(email, ip string, reason models.LoginFailureReason) error {
+	if s.privacyMode {
+		s.recordIPFailure(ip)
+	}
+
+	return s.record(models.LoginAttempt{Email: normalizeLoginEmail(email), IP: ip, Reason: reason})
+}
+
+// RecordSuccess records someone signing in, which clears their account's failures.
+func (s *LoginAttemptService) RecordSuccess(email, ip string) error {
+	return s.record(models.LoginAttempt{Email: normalizeLoginEmail(email), IP: ip, Succeeded: true})
+}
+
+// ListFailures returns the most recent failed attempts, newest first.
+func (s *LoginAttemptService) ListFailures(limit int) ([]models.LoginAttempt, error) {
+	var (
+		err      error
+		attempts []models.LoginAttempt
+	)
+
+	err = s.db.
+		Where("succeeded = ?", false).
+		Order("created_at desc").
+		Limit(limit).
+		Find(&attempts).Error
+
+	if err != nil {
+		return []models.LoginAttempt{}, err
+	}
+
+	return attempts, nil
+}
+
+func (s *LoginAttemptService) record(attempt models.LoginAttempt) error {
+	var (
+		err error
+	)
+
+	attempt.CreatedAt = s.now()
+
+	if s.privacyMode {
+		attempt.IP = AnonymizeIP(attempt.IP)
+	}
+
+	if err = s.db.Create(&attempt).Error; err != nil {
+		return err
+	}
+
+	// Old attempts no longer affect anything, so they are cleared as we go
+	return s.db.Where("created_at < ?", attempt.CreatedAt.Add(-loginAttemptsKeptFor)).Delete(&models.LoginAttempt{}).Error
+}
+
+/*
+throttle works out when the next attempt for one account or IP address is
+allowed, from its recent failures.
+*/
+func (s *LoginAttemptService) throttle(column, value string, maxAttempts int, clearedBySuccess bool) (models.LoginThrottle, error) {
+	var (
+		err      error
+		failures []models.LoginAttempt
+		success  models.LoginAttempt
+	)
+
+	if value == "" || maxAttempts <= 0 {
+		return models.LoginThrottle{}, nil
+	}
+
+	since := s.now().Add(-s.lockoutDuration)
+
+	if clearedBySuccess {
+		result := s.db.
+			Where(column+" = ? AND succeeded = ? AND created_at > ?", value, true, since).
+			Order("created_at desc").
+			Limit(1).
+			Find(&success)
+
+		if result.Error != nil {
+			return models.LoginThrottle{}, result.Error
+		}
+
+		if result.RowsAffected > 0 {
+			since = success.CreatedAt
+		}
+	}
+
+	err = s.db.
+		Where(column+" = ? AND succeeded = ? AND created_at > ?", value, false, since).
+		Order("created_at desc").
+		Limit(maxAttempts).
+		Find(&failures).Error
+
+	if err != nil {
+		return models.LoginThrottle{}, err
+	}
+
+	times := make([]time.Time, 0, len(failures))
+
+	for _, failure := range failures {
+		times = append(times, failure.CreatedAt)
+	}
+
+	return s.throttleFor(times, maxAttempts), nil
+}
+
+/*
+throttleFor works out when the next attempt is allowed after the given
+recent failures, newest first.
+*/
+func (s *LoginAttemptService) throttleFor(failures []time.Time, maxAttempts int) models.LoginThrottle {
+	if len(failures) == 0 || maxAttempts <= 0 {
+		return models.LoginThrottle{}
+	}
+
+	last := failures[0]
+
+	if len(failures) >= maxAttempts {
+		return models.LoginThrottle{RetryAt: last.Add(s.lockoutDuration), LockedOut: true}
+	}
+
+	retryAt := last.Add(loginDelay(len(failures)))
+
+	if !retryAt.After(s.now()) {
+		return models.LoginThrottle{}
+	}
+
+	return models.LoginThrottle{RetryAt: retryAt}
+}
+
+/*
+recordIPFailure counts a failure against the full IP address in memory,
+and forgets addresses whose failures no longer affect anything.
+*/
+func (s *LoginAttemptService) recordIPFailure(ip string) {
+	if ip == "" {
+		return
+	}
+
+	now := s.now()
+	since := now.Add(-s.lockoutDuration)
+
+	s.ipMutex.Lock()
+	defer s.ipMutex.Unlock()
+
+	for key, failures := range s.ipFailures {
+		if !failures[0].After(since) {
+			delete(s.ipFailures, key)
+		}
+	}
+
+	failures := append([]time.Time{now}, s.ipFailures[ip]...)
+	s.ipFailures[ip] = failures[:min(len(failures), max(s.maxAttemptsPerIP, 1))]
+}
+
+// recentIPFailures returns the failures of the full IP address within the lockout duration, newest first.
+func (s *LoginAttemptService) recentIPFailures(ip string) []time.Time {
+	since := s.now().Add(-s.lockoutDuration)
+
+	s.ipMutex.Lock()
+	defer s.ipMutex.Unlock()
+
+	result := []time.Time{}
+
+	for _, failure := range s.ipFailures[ip] {
+		if failure.After(since) {
+			result = append(result, failure)
+		}
+	}
+
+	return result
+}
+
+// loginDelay doubles with each failure: 1s, 2s, 4s and so on.
+func loginDelay(failures int) time.Duration {
+	delay := time.Second << (failures - 1)
+
+	if delay <= 0 || delay > maxLoginDelay {
+		return maxLoginDelay
+	}
+
+	return delay
+}
+
+func normalizeLoginEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func newTestLoginAttemptService(t *testing.T) (*LoginAttemptService, *time.Time) {
+	t.Helper()
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	svc := NewLoginAttemptService(LoginAttemptServiceConfig{
+		DB:               newTestDB(t),
+		MaxAttempts:      3,
+		MaxAttemptsPerIP: 5,
+		LockoutDuration:  15 * time.Minute,
+		Now:              func() time.Time { return now },
+	})
+
+	return svc, &now
+}
+
+func TestLoginAttemptService_ProgressiveDelayAndLockout(t *testing.T) {
+	svc, now := newTestLoginAttemptService(t)
+
+	if throttle, _ := svc.Check("ada@example.com", "10.0.0.1"); !throttle.RetryAt.IsZero() {
+		t.Fatalf("expected no throttle before any failures, got %+v", throttle)
+	}
+
+	svc.RecordFailure("ada@example.com", "10.0.0.1", models.LoginFailurePassword)
+
+	if throttle, _ := svc.Check("ADA@example.com", "10.0.0.2"); !throttle.RetryAt.Equal(now.Add(time.Second)) || throttle.LockedOut {
+		t.Errorf("expected a one second delay for the account, got %+v", throttle)
+	}
+
+	*now = now.Add(time.Second)
+	svc.RecordFailure("ada@example.com", "10.0.0.1", models.LoginFailurePassword)
+
+	if throttle, _ := svc.Check("ada@example.com", "10.0.0.1"); !throttle.RetryAt.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("expected the delay to double, got %+v", throttle)
+	}
+
+	*now = now.Add(2 * time.Second)
+
+	if throttle, _ := svc.Check("ada@example.com", "10.0.0.1"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected to be allowed once the delay has passed, got %+v", throttle)
+	}
+
+	svc.RecordFailure("ada@example.com", "10.0.0.1", models.LoginFailureTwoFactor)
+	throttle, _ := svc.Check("ada@example.com", "10.0.0.9")
+
+	if !throttle.LockedOut || !throttle.RetryAt.Equal(now.Add(15*time.Minute)) {
+		t.Errorf("expected the account to be locked out for 15 minutes, got %+v", throttle)
+	}
+
+	if throttle, _ := svc.Check("bob@example.com", "10.0.0.2"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected other accounts not to be affected, got %+v", throttle)
+	}
+
+	*now = now.Add(15 * time.Minute)
+
+	if throttle, _ := svc.Check("ada@example.com", "10.0.0.1"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected the lockout to end, got %+v", throttle)
+	}
+
+	if failures, _ := svc.ListFailures(10); len(failures) != 3 || failures[0].Reason != models.LoginFailureTwoFactor {
+		t.Errorf("expected three failures, newest first, got %+v", failures)
+	}
+}
+
+func TestLoginAttemptService_SuccessClearsAccountOnly(t *testing.T) {
+	svc, now := newTestLoginAttemptService(t)
+
+	for _, email := range []string{"ada@example.com", "ada@example.com", "bob@example.com", "cy@example.com"} {
+		*now = now.Add(time.Minute)
+		svc.RecordFailure(email, "10.0.0.1", models.LoginFailurePassword)
+	}
+
+	*now = now.Add(time.Minute)
+	svc.RecordSuccess("ada@example.com", "10.0.0.1")
+
+	if throttle, _ := svc.Check("ada@example.com", "10.0.0.2"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected signing in to clear the account's failures, got %+v", throttle)
+	}
+
+	svc.RecordFailure("dee@example.com", "10.0.0.1", models.LoginFailurePassword)
+
+	if throttle, _ := svc.Check("eve@example.com", "10.0.0.1"); !throttle.LockedOut {
+		t.Errorf("expected the IP address to be locked out, got %+v", throttle)
+	}
+
+	if throttle, _ := svc.Check("eve@example.com", "10.0.0.2"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected other IP addresses not to be affected, got %+v", throttle)
+	}
+}
+
+func TestLoginAttemptService_Disabled(t *testing.T) {
+	svc := NewLoginAttemptService(LoginAttemptServiceConfig{DB: newTestDB(t)})
+
+	for range 10 {
+		svc.RecordFailure("ada@example.com", "10.0.0.1", models.LoginFailurePassword)
+	}
+
+	if throttle, _ := svc.Check("ada@example.com", "10.0.0.1"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected no throttling when turned off, got %+v", throttle)
+	}
+}
+
+func TestLoginAttemptService_PrivacyModeThrottlesFullIP(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	svc := NewLoginAttemptService(LoginAttemptServiceConfig{
+		DB:               db,
+		MaxAttempts:      3,
+		MaxAttemptsPerIP: 2,
+		LockoutDuration:  15 * time.Minute,
+		PrivacyMode:      true,
+		Now:              func() time.Time { return now },
+	})
+
+	svc.RecordFailure("ada@example.com", "203.0.113.7", models.LoginFailurePassword)
+	svc.RecordFailure("bob@example.com", "203.0.113.7", models.LoginFailurePassword)
+
+	if throttle, _ := svc.Check("cy@example.com", "203.0.113.7"); !throttle.LockedOut {
+		t.Errorf("expected the address to be locked out, got %+v", throttle)
+	}
+
+	// Others behind the same /24 are not
+	if throttle, _ := svc.Check("cy@example.com", "203.0.113.8"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected a neighbouring address not to be throttled, got %+v", throttle)
+	}
+
+	var ips []string
+	db.Model(&models.LoginAttempt{}).Distinct("ip").Pluck("ip", &ips)
+
+	if len(ips) != 1 || ips[0] != "203.0.113.0" {
+		t.Errorf("expected only the truncated address to be stored, got %v", ips)
+	}
+
+	now = now.Add(15 * time.Minute)
+
+	if throttle, _ := svc.Check("cy@example.com", "203.0.113.7"); !throttle.RetryAt.IsZero() {
+		t.Errorf("expected the lockout to end, got %+v", throttle)
+	}
+}
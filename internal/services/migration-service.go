@@ -0,0 +1,256 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/adampresley/aletics/internal/migrations"
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSchemaTooNew      = errors.New("the database has migrations this build does not know about, it was probably migrated by a newer version of aletics")
+	ErrIrreversible      = errors.New("migration cannot be reversed")
+	ErrUnknownMigration  = errors.New("unknown migration version")
+	ErrNothingToRollBack = errors.New("no migrations have been applied")
+)
+
+type MigrationServiceConfig struct {
+	DB *gorm.DB
+
+	// Migrations defaults to migrations.All.
+	Migrations []migrations.Migration
+}
+
+/*
+MigrationService applies the versioned schema migrations and records them
+in the schema_migrations table.
+*/
+type MigrationService struct {
+	db         *gorm.DB
+	migrations []migrations.Migration
+}
+
+func NewMigrationService(config MigrationServiceConfig) *MigrationService {
+	result := &MigrationService{
+		db:         config.DB,
+		migrations: slices.Clone(config.Migrations),
+	}
+
+	if result.migrations == nil {
+		result.migrations = slices.Clone(migrations.All)
+	}
+
+	slices.SortFunc(result.migrations, func(a, b migrations.Migration) int {
+		return int(a.Version) - int(b.Version)
+	})
+
+	return result
+}
+
+/*
+Status returns every known migration and whether it has been applied,
+followed by any applied migrations this build does not know about.
+*/
+func (s *MigrationService) Status() ([]models.MigrationStatus, error) {
+	var (
+		err     error
+		applied map[uint]models.SchemaMigration
+		result  []models.MigrationStatus
+	)
+
+	if applied, err = s.appliedMigrations(); err != nil {
+		return nil, err
+	}
+
+	for _, migration := range s.migrations {
+		status := models.MigrationStatus{Version: migration.Version, Name: migration.Name}
+
+		if record, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &record.AppliedAt
+			delete(applied, migration.Version)
+		}
+
+		result = append(result, status)
+	}
+
+	for _, record := range applied {
+		result = append(result, models.MigrationStatus{
+			Version:   record.Version,
+			Name:      record.Name,
+			AppliedAt: &record.AppliedAt,
+			Unknown:   true,
+		})
+	}
+
+	slices.SortStableFunc(result, func(a, b models.MigrationStatus) int {
+		return int(a.Version) - int(b.Version)
+	})
+
+	return result, nil
+}
+
+/*
+Up applies every pending migration up to and including version target, in
+order. A target of 0 applies all of them. It refuses to run against a
+database that has migrations it does not know about.
+*/
+func (s *MigrationService) Up(target uint) ([]migrations.Migration, error) {
+	var (
+		err     error
+		applied map[uint]models.SchemaMigration
+		result  []migrations.Migration
+	)
+
+	if applied, err = s.checkedAppliedMigrations(); err != nil {
+		return nil, err
+	}
+
+	if target != 0 && !s.isKnown(target) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMigration, target)
+	}
+
+	for _, migration := range s.migrations {
+		if target != 0 && migration.Version > target {
+			break
+		}
+
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		slog.Info("applying migration", "migration", migration.Version, "name", migration.Name)
+
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&models.SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now().UTC(),
+			}).Error
+		})
+
+		if err != nil {
+			return result, fmt.Errorf("error applying migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		result = append(result, migration)
+	}
+
+	return result, nil
+}
+
+/*
+Down reverses the most recently applied migrations, newest first, and
+stops after steps of them.
+*/
+func (s *MigrationService) Down(steps int) ([]migrations.Migration, error) {
+	var (
+		err     error
+		applied map[uint]models.SchemaMigration
+		result  []migrations.Migration
+	)
+
+	if applied, err = s.checkedAppliedMigrations(); err != nil {
+		return nil, err
+	}
+
+	if len(applied) == 0 {
+		return nil, ErrNothingToRollBack
+	}
+
+	for _, migration := range slices.Backward(s.migrations) {
+		if len(result) >= steps {
+			break
+		}
+
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		if migration.Down == nil {
+			return result, fmt.Errorf("%w: %d (%s)", ErrIrreversible, migration.Version, migration.Name)
+		}
+
+		slog.Info("reversing migration", "migration", migration.Version, "name", migration.Name)
+
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+
+			return tx.Delete(&models.SchemaMigration{}, migration.Version).Error
+		})
+
+		if err != nil {
+			return result, fmt.Errorf("error reversing migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		result = append(result, migration)
+	}
+
+	return result, nil
+}
+
+func (s *MigrationService) checkedAppliedMigrations() (map[uint]models.SchemaMigration, error) {
+	var (
+		err     error
+		applied map[uint]models.SchemaMigration
+		unknown []uint
+	)
+
+	if applied, err = s.appliedMigrations(); err != nil {
+		return nil, err
+	}
+
+	for version := range applied {
+		if !s.isKnown(version) {
+			unknown = append(unknown, version)
+		}
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return nil, fmt.Errorf("%w (unknown versions %v)", ErrSchemaTooNew, unknown)
+	}
+
+	return applied, nil
+}
+
+func (s *MigrationService) appliedMigrations() (map[uint]models.SchemaMigration, error) {
+	var (
+		err     error
+		records []models.SchemaMigration
+	)
+
+	if !s.db.Migrator().HasTable(&models.SchemaMigration{}) {
+		if err = s.db.Migrator().CreateTable(&models.SchemaMigration{}); err != nil {
+			return nil, fmt.Errorf("error creating schema_migrations table: %w", err)
+		}
+	}
+
+	if err = s.db.Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[uint]models.SchemaMigration, len(records))
+
+	for _, record := range records {
+		result[record.Version] = record
+	}
+
+	return result, nil
+}
+
+func (s *MigrationService) isKnown(version uint) bool {
+	return slices.ContainsFunc(s.migrations, func(migration migrations.Migration) bool {
+		return migration.Version == version
+	})
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/migrations"
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newEmptyTestDB returns an in-memory SQLite database without any tables.
+func newEmptyTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+
+	if err != nil {
+		t.Fatalf("error opening test database: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	return db
+}
+
+func TestMigrationService_UpDownStatus(t *testing.T) {
+	db := newEmptyTestDB(t)
+
+	testMigrations := []migrations.Migration{
+		{
+			Version: 2,
+			Name:    "add notes",
+			Up:      func(tx *gorm.DB) error { return tx.Exec("ALTER TABLE widgets ADD COLUMN notes TEXT").Error },
+			Down:    func(tx *gorm.DB) error { return tx.Exec("ALTER TABLE widgets DROP COLUMN notes").Error },
+		},
+		{
+			Version: 1,
+			Name:    "create widgets",
+			Up:      func(tx *gorm.DB) error { return tx.Exec("CREATE TABLE widgets (id INTEGER PRIMARY KEY)").Error },
+		},
+	}
+
+	svc := NewMigrationService(MigrationServiceConfig{DB: db, Migrations: testMigrations})
+
+	applied, err := svc.Up(1)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(applied) != 1 || applied[0].Version != 1 {
+		t.Fatalf("expected only migration 1 to be applied, got %+v", applied)
+	}
+
+	statuses, _ := svc.Status()
+
+	if len(statuses) != 2 || statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil {
+		t.Errorf("expected migration 1 applied and 2 pending, got %+v", statuses)
+	}
+
+	if applied, _ = svc.Up(0); len(applied) != 1 || !db.Migrator().HasColumn("widgets", "notes") {
+		t.Errorf("expected migration 2 to add the notes column, got %+v", applied)
+	}
+
+	if applied, _ = svc.Up(0); len(applied) != 0 {
+		t.Errorf("expected nothing to apply, got %+v", applied)
+	}
+
+	reversed, err := svc.Down(1)
+
+	if err != nil || len(reversed) != 1 || db.Migrator().HasColumn("widgets", "notes") {
+		t.Errorf("expected migration 2 to be reversed, got %+v, %v", reversed, err)
+	}
+
+	if _, err = svc.Down(1); !errors.Is(err, ErrIrreversible) {
+		t.Errorf("expected ErrIrreversible, got %v", err)
+	}
+
+	if _, err = svc.Up(7); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("expected ErrUnknownMigration, got %v", err)
+	}
+}
+
+func TestMigrationService_FailedMigrationIsNotRecorded(t *testing.T) {
+	db := newEmptyTestDB(t)
+
+	svc := NewMigrationService(MigrationServiceConfig{DB: db, Migrations: []migrations.Migration{
+		{
+			Version: 1,
+			Name:    "broken",
+			Up: func(tx *gorm.DB) error {
+				tx.Exec("CREATE TABLE widgets (id INTEGER PRIMARY KEY)")
+				return tx.Exec("SELECT * FROM missing").Error
+			},
+		},
+	}})
+
+	if _, err := svc.Up(0); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	var count int64
+	db.Model(&models.SchemaMigration{}).Count(&count)
+
+	if count != 0 || db.Migrator().HasTable("widgets") {
+		t.Errorf("expected the failed migration to be rolled back")
+	}
+}
+
+func TestMigrationService_RefusesNewerSchema(t *testing.T) {
+	db := newTestDB(t)
+	db.Create(&models.SchemaMigration{Version: 9999, Name: "from the future"})
+
+	svc := NewMigrationService(MigrationServiceConfig{DB: db})
+
+	if _, err := svc.Up(0); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew from Up, got %v", err)
+	}
+
+	if _, err := svc.Down(1); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew from Down, got %v", err)
+	}
+
+	statuses, err := svc.Status()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	last := statuses[len(statuses)-1]
+
+	if last.Version != 9999 || !last.Unknown {
+		t.Errorf("expected the unknown migration to be listed, got %+v", last)
+	}
+}
+
+/*
+preMigrationsProperty is a property as it was before there were
+migrations. The current model has columns that later migrations add, which
+they would find already there.
+*/
+type preMigrationsProperty struct {
+	gorm.Model
+
+	Name   string
+	Domain string
+	Token  string `gorm:"unique"`
+	Active bool
+
+	RetentionDays int
+
+	SecretKeyHash   string
+	SecretKeyPrefix string
+}
+
+func (preMigrationsProperty) TableName() string { return "properties" }
+
+/*
+preMigrationsAPIKey is an API key as it was before there were migrations.
+The current model links to a user, which AutoMigrate would create a users
+table for.
+*/
+type preMigrationsAPIKey struct {
+	gorm.Model
+
+	Name       string
+	Prefix     string
+	KeyHash    string `gorm:"size:64;uniqueIndex"`
+	PropertyID *uint
+	Property   *preMigrationsProperty
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (preMigrationsAPIKey) TableName() string { return "api_keys" }
+
+/*
+TestMigrationService_ExistingDatabase migrates a database that was set up
+by AutoMigrate before there were migrations, then reverses everything.
+*/
+func TestMigrationService_ExistingDatabase(t *testing.T) {
+	db := newEmptyTestDB(t)
+
+	err := db.AutoMigrate(
+		&preMigrationsProperty{}, &models.Event{}, &models.EventProp{}, &preMigrationsAPIKey{},
+		&models.Import{}, &models.ImportedStat{},
+		&models.HourlyRollup{}, &models.DailyRollup{}, &models.RollupState{},
+	)
+
+	if err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+
+	db.Create(&preMigrationsProperty{Name: "Test", Domain: "example.com", Token: "token"})
+	svc := NewMigrationService(MigrationServiceConfig{DB: db})
+
+	if _, err = svc.Up(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var properties int64
+	db.Model(&models.Property{}).Count(&properties)
+
+	if properties != 1 {
+		t.Errorf("expected existing data to be kept")
+	}
+
+	if _, err = svc.Down(len(migrations.All)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, table := range []string{"properties", "events", "event_props", "api_keys", "imports", "rollup_states"} {
+		if db.Migrator().HasTable(table) {
+			t.Errorf("expected %s to be dropped", table)
+		}
+	}
+}
+
+/*
+TestMigrationService_PropertyPurgeKeepsDeletedProperties checks that
+properties deleted before purging existed are not purged by the first
+retention run after the upgrade, and can still be restored.
+*/
+func TestMigrationService_PropertyPurgeKeepsDeletedProperties(t *testing.T) {
+	db := newEmptyTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	svc := NewMigrationService(MigrationServiceConfig{DB: db})
+
+	if _, err := svc.Up(10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := db.Exec(
+		"INSERT INTO properties (name, domain, token, active, created_at, updated_at, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		"Old", "old.example.com", "old", true, now.AddDate(0, -2, 0), now.AddDate(0, -2, 0), now.AddDate(0, -1, 0),
+	).Error
+
+	if err != nil {
+		t.Fatalf("error seeding property: %v", err)
+	}
+
+	db.Exec("INSERT INTO events (property_id, path, created_at, updated_at) VALUES (1, '/', ?, ?)", now, now)
+
+	if _, err = svc.Up(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var property models.Property
+	db.Unscoped().First(&property)
+
+	if property.PurgeAfter != nil || !property.Restorable(now) {
+		t.Fatalf("expected no purge date and a restorable property, got %+v", property)
+	}
+
+	retention := NewRetentionService(RetentionServiceConfig{DB: db, BatchWait: time.Nanosecond})
+
+	if result, err := retention.Prune(context.Background(), now); err != nil || result.PropertiesPurged != 0 {
+		t.Errorf("expected nothing to be purged, got %+v, %v", result, err)
+	}
+
+	var events int64
+	db.Model(&models.Event{}).Count(&events)
+
+	if events != 1 {
+		t.Errorf("expected the deleted property's event to be kept, got %d", events)
+	}
+
+	properties := NewPropertyService(PropertyServiceConfig{DB: db, Now: func() time.Time { return now }})
+
+	if err = properties.RestoreProperty(models.Actor{}, property.ID); err != nil {
+		t.Errorf("expected the property to be restorable, got %v", err)
+	}
+}
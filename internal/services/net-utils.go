@@ -1,11 +1,22 @@
 package services
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 )
 
+const (
+	// anonymizedIPv4Bits and anonymizedIPv6Bits are how much of an address
+	// AnonymizeIP keeps. This is enough to find the country, but not the
+	// household or device.
+	anonymizedIPv4Bits int = 24
+	anonymizedIPv6Bits int = 48
+)
+
 func GetIP(r *http.Request) string {
 	// Check X-Forwarded-For (comma-separated list of IPs)
 	forwarded := r.Header.Get("X-Forwarded-For")
@@ -29,3 +40,102 @@ func GetIP(r *http.Request) string {
 	}
 	return ip
 }
+
+/*
+GetTrustedIP returns the client's IP address, but unlike GetIP it only
+believes X-Forwarded-For and X-Real-Ip when the request comes from one of
+the trusted proxies, as anyone can send those headers. X-Forwarded-For is
+read from the right, where each proxy appends the address it was connected
+from, skipping the trusted proxies. With no trusted proxies, this is
+always the address the request came from.
+*/
+func GetTrustedIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	client := remote.Addr().Unmap()
+	trusted := func(addr netip.Addr) bool {
+		return slices.ContainsFunc(trustedProxies, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+	}
+
+	if !trusted(client) {
+		return client.String()
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+
+			if err != nil {
+				break
+			}
+
+			if client = addr.Unmap(); !trusted(client) {
+				break
+			}
+		}
+
+		return client.String()
+	}
+
+	if realIP, err := netip.ParseAddr(r.Header.Get("X-Real-Ip")); err == nil {
+		return realIP.Unmap().String()
+	}
+
+	return client.String()
+}
+
+/*
+ParseTrustedProxies reads the IP addresses and CIDR ranges of the reverse
+proxies whose headers GetTrustedIP believes.
+*/
+func ParseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	result := []netip.Prefix{}
+
+	for _, entry := range entries {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			result = append(result, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxies must be IP addresses or CIDR ranges: '%s'", entry)
+		}
+
+		addr = addr.Unmap()
+		result = append(result, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return result, nil
+}
+
+/*
+AnonymizeIP truncates an IP address, zeroing the last octet of an IPv4
+address and all but the first 48 bits of an IPv6 one, so 203.0.113.7
+becomes 203.0.113.0. Anything that is not an IP address returns an empty
+string, so it cannot leak through.
+*/
+func AnonymizeIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+
+	if err != nil {
+		return ""
+	}
+
+	addr = addr.Unmap().WithZone("")
+	bits := anonymizedIPv6Bits
+
+	if addr.Is4() {
+		bits = anonymizedIPv4Bits
+	}
+
+	prefix, _ := addr.Prefix(bits)
+	return prefix.Addr().String()
+}
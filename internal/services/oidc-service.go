@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrOIDCStateMismatch   = errors.New("the sign in request has expired or was not started here")
+	ErrOIDCEmailUnverified = errors.New("your identity provider has not verified your email address")
+	ErrOIDCNotAllowed      = errors.New("your account is not allowed to sign in to this server")
+)
+
+type OIDCServiceConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// AllowedDomains and AllowedGroups limit who may sign in. When both
+	// are set, a user must match both. Empty allows anyone.
+	AllowedDomains []string
+	AllowedGroups  []string
+
+	// Members of AdminGroups become server admins, everyone else does
+	// not. When empty, server admins are managed in Aletics.
+	AdminGroups []string
+	GroupsClaim string
+
+	// HTTPClient talks to the provider. It defaults to http.DefaultClient.
+	HTTPClient  *http.Client
+	UserService *UserService
+}
+
+/*
+OIDCService signs users in with an OpenID Connect provider using the
+authorization code flow with PKCE.
+*/
+type OIDCService struct {
+	allowedDomains []string
+	allowedGroups  []string
+	adminGroups    []string
+	groupsClaim    string
+	httpClient     *http.Client
+	oauth2Config   oauth2.Config
+	userService    *UserService
+	verifier       *oidc.IDTokenVerifier
+}
+
+/*
+OIDCLogin is what must be remembered between sending someone to the
+provider and them coming back.
+*/
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+/*
+NewOIDCService discovers the provider's endpoints from its issuer URL, so
+the provider must be reachable.
+*/
+func NewOIDCService(ctx context.Context, config OIDCServiceConfig) (*OIDCService, error) {
+	var (
+		err      error
+		provider *oidc.Provider
+	)
+
+	httpClient := config.HTTPClient
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	if provider, err = oidc.NewProvider(oidc.ClientContext(ctx, httpClient), config.IssuerURL); err != nil {
+		return nil, fmt.Errorf("error discovering OpenID Connect provider: %w", err)
+	}
+
+	scopes := config.Scopes
+
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+
+	return &OIDCService{
+		allowedDomains: lowerAll(config.AllowedDomains),
+		allowedGroups:  config.AllowedGroups,
+		adminGroups:    config.AdminGroups,
+		groupsClaim:    config.GroupsClaim,
+		httpClient:     httpClient,
+		userService:    config.UserService,
+		verifier:       provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		oauth2Config: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  config.RedirectURL,
+			Scopes:       scopes,
+		},
+	}, nil
+}
+
+/*
+StartLogin returns the provider URL to send someone to, and the values to
+keep until they come back to FinishLogin.
+*/
+func (s *OIDCService) StartLogin() (string, OIDCLogin, error) {
+	var (
+		err   error
+		login OIDCLogin
+	)
+
+	if login.State, err = generateSecret(""); err != nil {
+		return "", OIDCLogin{}, err
+	}
+
+	if login.Nonce, err = generateSecret(""); err != nil {
+		return "", OIDCLogin{}, err
+	}
+
+	login.CodeVerifier = oauth2.GenerateVerifier()
+
+	url := s.oauth2Config.AuthCodeURL(
+		login.State,
+		oidc.Nonce(login.Nonce),
+		oauth2.S256ChallengeOption(login.CodeVerifier),
+	)
+
+	return url, login, nil
+}
+
+/*
+FinishLogin exchanges the code the provider sent back for an ID token,
+checks it, and returns the local user it belongs to.
+*/
+func (s *OIDCService) FinishLogin(ctx context.Context, login OIDCLogin, state, code string) (models.User, error) {
+	var (
+		err       error
+		token     *oauth2.Token
+		idToken   *oidc.IDToken
+		claims    oidcClaims
+		rawClaims map[string]any
+	)
+
+	if login.State == "" || state != login.State {
+		return models.User{}, ErrOIDCStateMismatch
+	}
+
+	ctx = oidc.ClientContext(ctx, s.httpClient)
+
+	if token, err = s.oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(login.CodeVerifier)); err != nil {
+		return models.User{}, fmt.Errorf("error exchanging authorization code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+
+	if !ok {
+		return models.User{}, errors.New("the provider did not return an ID token")
+	}
+
+	if idToken, err = s.verifier.Verify(ctx, rawIDToken); err != nil {
+		return models.User{}, fmt.Errorf("error verifying ID token: %w", err)
+	}
+
+	if idToken.Nonce != login.Nonce {
+		return models.User{}, errors.New("the ID token was not issued for this sign in")
+	}
+
+	if err = idToken.Claims(&claims); err != nil {
+		return models.User{}, fmt.Errorf("error reading ID token claims: %w", err)
+	}
+
+	if err = idToken.Claims(&rawClaims); err != nil {
+		return models.User{}, fmt.Errorf("error reading ID token claims: %w", err)
+	}
+
+	if !claims.EmailVerified {
+		return models.User{}, ErrOIDCEmailUnverified
+	}
+
+	groups := claimStrings(rawClaims[s.groupsClaim])
+
+	if !s.allowed(claims.Email, groups) {
+		return models.User{}, ErrOIDCNotAllowed
+	}
+
+	identity := ExternalIdentity{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Name:    claims.Name,
+	}
+
+	if len(s.adminGroups) > 0 {
+		isAdmin := containsAny(groups, s.adminGroups)
+		identity.IsAdmin = &isAdmin
+	}
+
+	return s.userService.SignInExternal(identity)
+}
+
+func (s *OIDCService) allowed(email string, groups []string) bool {
+	if len(s.allowedDomains) > 0 {
+		domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+
+		if !slices.Contains(s.allowedDomains, domain) {
+			return false
+		}
+	}
+
+	if len(s.allowedGroups) > 0 && !containsAny(groups, s.allowedGroups) {
+		return false
+	}
+
+	return true
+}
+
+/*
+claimStrings reads a claim that providers send either as a list of
+strings or as a single string.
+*/
+func claimStrings(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+
+	case []any:
+		result := make([]string, 0, len(value))
+
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+
+		return result
+	}
+
+	return nil
+}
+
+func containsAny(values, wanted []string) bool {
+	return slices.ContainsFunc(values, func(value string) bool {
+		return slices.Contains(wanted, value)
+	})
+}
+
+func lowerAll(values []string) []string {
+	result := make([]string, 0, len(values))
+
+	for _, value := range values {
+		result = append(result, strings.ToLower(value))
+	}
+
+	return result
+}
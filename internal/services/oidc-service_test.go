@@ -0,0 +1,350 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/go-jose/go-jose/v4"
+)
+
+/*
+testIdentityProvider is a minimal OpenID Connect provider. It hands out
+codes for whatever claims the test asks for, and checks the client secret
+and PKCE verifier when they are exchanged.
+*/
+type testIdentityProvider struct {
+	server *httptest.Server
+	signer jose.Signer
+	jwks   jose.JSONWebKeySet
+
+	lock  sync.Mutex
+	codes map[string]testAuthorization
+}
+
+type testAuthorization struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, nil)
+	if err != nil {
+		t.Fatalf("error creating signer: %v", err)
+	}
+
+	idp := &testIdentityProvider{
+		signer: signer,
+		jwks:   jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}},
+		codes:  map[string]testAuthorization{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(idp.jwks)
+	})
+	mux.HandleFunc("POST /token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *testIdentityProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                idp.server.URL,
+		"authorization_endpoint":                idp.server.URL + "/authorize",
+		"token_endpoint":                        idp.server.URL + "/token",
+		"jwks_uri":                              idp.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *testIdentityProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, _ := r.BasicAuth()
+
+	if clientID != "aletics" || clientSecret != "secret" {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	idp.lock.Lock()
+	authorization, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.lock.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != authorization.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   idp.server.URL,
+		"aud":   "aletics",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": authorization.nonce,
+	}
+
+	for name, value := range authorization.claims {
+		claims[name] = value
+	}
+
+	payload, _ := json.Marshal(claims)
+	signed, _ := idp.signer.Sign(payload)
+	idToken, _ := signed.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+/*
+authorize stands in for the person signing in at the provider. It returns
+the code the provider would send back for the given claims.
+*/
+func (idp *testIdentityProvider) authorize(t *testing.T, authURL string, claims map[string]any) string {
+	t.Helper()
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("error parsing authorization URL: %v", err)
+	}
+
+	query := parsed.Query()
+
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("expected a S256 PKCE challenge, got %q", authURL)
+	}
+
+	code := rand.Text()
+
+	idp.lock.Lock()
+	idp.codes[code] = testAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	idp.lock.Unlock()
+
+	return code
+}
+
+func newTestOIDCService(t *testing.T, idp *testIdentityProvider, config OIDCServiceConfig) *OIDCService {
+	t.Helper()
+
+	config.IssuerURL = idp.server.URL
+	config.ClientID = "aletics"
+	config.ClientSecret = "secret"
+	config.RedirectURL = "http://localhost/login/oidc/callback"
+	config.GroupsClaim = "groups"
+
+	if config.UserService == nil {
+		config.UserService = NewUserService(UserServiceConfig{DB: newTestDB(t)})
+	}
+
+	svc, err := NewOIDCService(context.Background(), config)
+	if err != nil {
+		t.Fatalf("error creating OIDC service: %v", err)
+	}
+
+	return svc
+}
+
+// signIn runs the whole flow for someone with the given claims.
+func signIn(t *testing.T, idp *testIdentityProvider, svc *OIDCService, claims map[string]any) (models.User, error) {
+	t.Helper()
+
+	authURL, login, err := svc.StartLogin()
+	if err != nil {
+		t.Fatalf("unexpected error starting login: %v", err)
+	}
+
+	code := idp.authorize(t, authURL, claims)
+	return svc.FinishLogin(context.Background(), login, login.State, code)
+}
+
+func TestOIDCService_SignIn(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	svc := newTestOIDCService(t, idp, OIDCServiceConfig{})
+	claims := map[string]any{"sub": "ada-1", "email": "Ada@Example.com", "email_verified": true, "name": "Ada"}
+
+	user, err := signIn(t, idp, svc, claims)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if user.ID == 0 || user.Email != "ada@example.com" || user.Name != "Ada" || user.IsAdmin {
+		t.Errorf("expected a new non-admin user, got %+v", user)
+	}
+
+	claims["email"] = "ada@new.example.com"
+
+	again, err := signIn(t, idp, svc, claims)
+	if err != nil {
+		t.Fatalf("unexpected error signing in again: %v", err)
+	}
+
+	if again.ID != user.ID {
+		t.Errorf("expected the subject to find user %d, got %d", user.ID, again.ID)
+	}
+}
+
+func TestOIDCService_LinksExistingUser(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	users := NewUserService(UserServiceConfig{DB: newTestDB(t)})
+	svc := newTestOIDCService(t, idp, OIDCServiceConfig{UserService: users})
+
+	existing, _ := users.CreateFirstAdmin(models.User{Email: "ada@example.com"}, "correct horse")
+
+	user, err := signIn(t, idp, svc, map[string]any{"sub": "ada-1", "email": "ada@example.com", "email_verified": true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if user.ID != existing.ID || !user.IsAdmin || user.OIDCSubject == nil || *user.OIDCSubject != "ada-1" {
+		t.Errorf("expected user %d to be linked, got %+v", existing.ID, user)
+	}
+
+	// A different subject cannot take over the linked account
+	_, err = signIn(t, idp, svc, map[string]any{"sub": "mallory", "email": "ada@example.com", "email_verified": true})
+
+	if !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken, got %v", err)
+	}
+}
+
+func TestOIDCService_RejectsBadLogins(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	svc := newTestOIDCService(t, idp, OIDCServiceConfig{})
+	claims := map[string]any{"sub": "ada-1", "email": "ada@example.com", "email_verified": true}
+
+	authURL, login, _ := svc.StartLogin()
+	code := idp.authorize(t, authURL, claims)
+
+	if _, err := svc.FinishLogin(context.Background(), login, "forged", code); !errors.Is(err, ErrOIDCStateMismatch) {
+		t.Errorf("expected ErrOIDCStateMismatch, got %v", err)
+	}
+
+	login.CodeVerifier = "not the verifier"
+
+	if _, err := svc.FinishLogin(context.Background(), login, login.State, code); err == nil {
+		t.Error("expected a wrong PKCE verifier to fail")
+	}
+
+	claims["email_verified"] = false
+
+	if _, err := signIn(t, idp, svc, claims); !errors.Is(err, ErrOIDCEmailUnverified) {
+		t.Errorf("expected ErrOIDCEmailUnverified, got %v", err)
+	}
+}
+
+func TestOIDCService_Restrictions(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	svc := newTestOIDCService(t, idp, OIDCServiceConfig{
+		AllowedDomains: []string{"Example.com"},
+		AllowedGroups:  []string{"analytics"},
+		AdminGroups:    []string{"analytics-admins"},
+	})
+
+	tests := []struct {
+		email   string
+		groups  any
+		allowed bool
+		isAdmin bool
+	}{
+		{"ada@example.com", []string{"analytics"}, true, false},
+		{"bob@example.com", []string{"analytics", "analytics-admins"}, true, true},
+		{"cy@EXAMPLE.com", "analytics", true, false},
+		{"dee@example.com", []string{"sales"}, false, false},
+		{"eve@other.com", []string{"analytics"}, false, false},
+		{"fay@example.com", nil, false, false},
+	}
+
+	for _, tt := range tests {
+		user, err := signIn(t, idp, svc, map[string]any{"sub": tt.email, "email": tt.email, "email_verified": true, "groups": tt.groups})
+
+		if !tt.allowed {
+			if !errors.Is(err, ErrOIDCNotAllowed) {
+				t.Errorf("%s in %v: expected ErrOIDCNotAllowed, got %v", tt.email, tt.groups, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s in %v: unexpected error %v", tt.email, tt.groups, err)
+			continue
+		}
+
+		if user.IsAdmin != tt.isAdmin {
+			t.Errorf("%s in %v: expected admin %v, got %v", tt.email, tt.groups, tt.isAdmin, user.IsAdmin)
+		}
+	}
+}
+
+/*
+TestOIDCService_FreshInstallGrantsNoAdmin checks that with nothing
+restricting who may sign in, whoever signs in first on a new install does
+not become an admin, and setup stays open for the setup token.
+*/
+func TestOIDCService_FreshInstallGrantsNoAdmin(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	users := NewUserService(UserServiceConfig{DB: newTestDB(t)})
+	svc := newTestOIDCService(t, idp, OIDCServiceConfig{UserService: users})
+
+	user, err := signIn(t, idp, svc, map[string]any{"sub": "mallory", "email": "mallory@gmail.example", "email_verified": true})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if user.IsAdmin {
+		t.Error("expected the first single sign-on user not to be an admin")
+	}
+
+	if hasAdmin, _ := users.HasAdmin(); hasAdmin {
+		t.Error("expected setup to stay open")
+	}
+
+	admin, err := users.CreateFirstAdmin(models.User{Email: "ada@example.com"}, "correct horse")
+
+	if err != nil || !admin.IsAdmin {
+		t.Errorf("expected setup to create the first admin, got %+v, %v", admin, err)
+	}
+
+	// Admin groups are the only way single sign-on makes an admin
+	t.Run("admin groups", func(t *testing.T) {
+		svc := newTestOIDCService(t, idp, OIDCServiceConfig{AdminGroups: []string{"aletics-admins"}})
+
+		user, err := signIn(t, idp, svc, map[string]any{"sub": "ada", "email": "ada@example.com", "email_verified": true, "groups": []string{"aletics-admins"}})
+
+		if err != nil || !user.IsAdmin {
+			t.Errorf("expected a member of the admin groups to be an admin, got %+v, %v", user, err)
+		}
+	})
+}
@@ -0,0 +1,452 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPartitionMonthsAhead int = 3
+
+	// partitionBoundLayout formats partition bounds as Postgres timestamptz
+	// literals.
+	partitionBoundLayout string = "2006-01-02 15:04:05-07"
+)
+
+var (
+	ErrPartitioningUnsupported = errors.New("event partitioning requires Postgres")
+	ErrAlreadyPartitioned      = errors.New("the events table is already partitioned")
+)
+
+var (
+	// monthlyPartitionPattern matches the names of the monthly partitions.
+	monthlyPartitionPattern = regexp.MustCompile(`^events_\d{4}_\d{2}$`)
+
+	// unpartitionedTablePattern matches the table in the index definitions
+	// of the events table while it is being partitioned.
+	unpartitionedTablePattern = regexp.MustCompile(` ON (?:\S+\.)?events_unpartitioned `)
+)
+
+type PartitionServiceConfig struct {
+	DB               *gorm.DB
+	RetentionService *RetentionService
+
+	// MonthsAhead is how many months after the current one get a partition
+	// ahead of time. Defaults to 3.
+	MonthsAhead int
+}
+
+/*
+PartitionService manages the optional monthly partitioning of the events
+table on Postgres. Once the table has been converted with Partition, every
+month gets its own partition, plus a default partition that catches events
+outside of them. Reports always select a created_at range, so Postgres only
+reads the partitions for the months in a report.
+
+Maintain creates the upcoming partitions and drops the partitions that are
+older than the retention period of every property, which is much cheaper
+than deleting their rows one batch at a time.
+*/
+type PartitionService struct {
+	db               *gorm.DB
+	retentionService *RetentionService
+	monthsAhead      int
+}
+
+func NewPartitionService(config PartitionServiceConfig) *PartitionService {
+	result := &PartitionService{
+		db:               config.DB,
+		retentionService: config.RetentionService,
+		monthsAhead:      config.MonthsAhead,
+	}
+
+	if result.monthsAhead <= 0 {
+		result.monthsAhead = defaultPartitionMonthsAhead
+	}
+
+	return result
+}
+
+// IsPartitioned returns true if the events table is a partitioned table.
+func (s *PartitionService) IsPartitioned() (bool, error) {
+	var (
+		err         error
+		partitioned bool
+	)
+
+	if s.db.Dialector.Name() != "postgres" {
+		return false, nil
+	}
+
+	err = s.db.Raw(`SELECT EXISTS (
+		SELECT 1 FROM pg_partitioned_table pt
+		JOIN pg_class c ON c.oid = pt.partrelid
+		WHERE c.relname = 'events' AND pg_table_is_visible(c.oid)
+	)`).Scan(&partitioned).Error
+
+	return partitioned, err
+}
+
+/*
+Partition converts the events table into a table partitioned by month of
+created_at and copies every event into it. The table is locked while this
+runs, so tracking waits until it is done. Events are copied with their IDs,
+but event_props can no longer have a foreign key to events, as Postgres
+requires unique keys on a partitioned table to include the partition key.
+*/
+func (s *PartitionService) Partition(now time.Time) error {
+	var (
+		err         error
+		partitioned bool
+	)
+
+	if s.db.Dialector.Name() != "postgres" {
+		return ErrPartitioningUnsupported
+	}
+
+	if partitioned, err = s.IsPartitioned(); err != nil {
+		return err
+	}
+
+	if partitioned {
+		return ErrAlreadyPartitioned
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var (
+			err       error
+			sequence  string
+			oldest    *time.Time
+			indexDefs []string
+		)
+
+		// Index names are unique per schema, so the primary key of the old
+		// table is renamed out of the way. This renames its index too
+		err = execStatements(tx,
+			"LOCK TABLE events IN ACCESS EXCLUSIVE MODE",
+			"ALTER TABLE events RENAME TO events_unpartitioned",
+			"ALTER TABLE events_unpartitioned RENAME CONSTRAINT events_pkey TO events_unpartitioned_pkey",
+		)
+
+		if err != nil {
+			return fmt.Errorf("error renaming the events table: %w", err)
+		}
+
+		err = tx.Raw(`SELECT indexdef FROM pg_indexes
+			WHERE tablename = 'events_unpartitioned' AND schemaname = current_schema() AND indexname <> 'events_unpartitioned_pkey'`).
+			Scan(&indexDefs).Error
+
+		if err != nil {
+			return fmt.Errorf("error reading the events indexes: %w", err)
+		}
+
+		if err = tx.Raw("SELECT pg_get_serial_sequence('events_unpartitioned', 'id')").Scan(&sequence).Error; err != nil {
+			return fmt.Errorf("error finding the events ID sequence: %w", err)
+		}
+
+		if err = tx.Raw("SELECT MIN(created_at) FROM events_unpartitioned").Scan(&oldest).Error; err != nil {
+			return fmt.Errorf("error finding the oldest event: %w", err)
+		}
+
+		err = execStatements(tx,
+			"CREATE TABLE events (LIKE events_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (created_at)",
+			"ALTER TABLE events ADD PRIMARY KEY (id, created_at)",
+			"ALTER SEQUENCE "+sequence+" OWNED BY events.id",
+			"CREATE TABLE events_default PARTITION OF events DEFAULT",
+		)
+
+		if err != nil {
+			return fmt.Errorf("error creating the partitioned events table: %w", err)
+		}
+
+		first := startOfMonth(now)
+
+		if oldest != nil {
+			first = startOfMonth(*oldest)
+		}
+
+		for month := first; !month.After(s.lastMonth(now)); month = month.AddDate(0, 1, 0) {
+			if err = createMonthlyPartition(tx, month); err != nil {
+				return err
+			}
+		}
+
+		err = execStatements(tx,
+			"INSERT INTO events SELECT * FROM events_unpartitioned",
+			"ALTER TABLE event_props DROP CONSTRAINT IF EXISTS fk_events_props",
+			"DROP TABLE events_unpartitioned",
+			"ALTER TABLE events ADD CONSTRAINT fk_events_property FOREIGN KEY (property_id) REFERENCES properties (id)",
+		)
+
+		if err != nil {
+			return fmt.Errorf("error copying events: %w", err)
+		}
+
+		// Recreate the indexes, which Postgres then creates on every partition
+		for _, indexDef := range indexDefs {
+			indexDef = unpartitionedTablePattern.ReplaceAllString(indexDef, " ON events ")
+
+			if err = tx.Exec(indexDef).Error; err != nil {
+				return fmt.Errorf("error recreating index: %w", err)
+			}
+		}
+
+		slog.Info("partitioned the events table", "from", first.Format("2006-01"), "to", s.lastMonth(now).Format("2006-01"))
+		return nil
+	})
+}
+
+/*
+Start maintains the partitions immediately and then once every interval
+until ctx is cancelled. It does nothing while the events table is not
+partitioned. It blocks, so run it in its own goroutine.
+*/
+func (s *PartitionService) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Maintain(time.Now()); err != nil {
+			slog.Error("error maintaining event partitions", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+Maintain creates the partitions for the current month and the months
+ahead, then detaches and drops the monthly partitions that have expired.
+*/
+func (s *PartitionService) Maintain(now time.Time) error {
+	var (
+		err         error
+		partitioned bool
+		months      []time.Time
+		cutoff      *time.Time
+	)
+
+	if partitioned, err = s.IsPartitioned(); err != nil || !partitioned {
+		return err
+	}
+
+	if months, err = s.monthlyPartitions(); err != nil {
+		return err
+	}
+
+	for month := startOfMonth(now); !month.After(s.lastMonth(now)); month = month.AddDate(0, 1, 0) {
+		if slices.ContainsFunc(months, month.Equal) {
+			continue
+		}
+
+		if err = s.db.Transaction(func(tx *gorm.DB) error { return createMonthlyPartition(tx, month) }); err != nil {
+			return err
+		}
+
+		slog.Info("created event partition", "partition", monthlyPartitionName(month))
+	}
+
+	if cutoff, err = s.retentionCutoff(now); err != nil || cutoff == nil {
+		return err
+	}
+
+	for _, month := range expiredPartitions(months, *cutoff) {
+		if err = s.dropMonthlyPartition(month); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+retentionCutoff returns the time before which no property keeps events,
+or nil if some property keeps its events forever.
+*/
+func (s *PartitionService) retentionCutoff(now time.Time) (*time.Time, error) {
+	var (
+		err        error
+		properties []models.Property
+		cutoff     *time.Time
+	)
+
+	if s.retentionService == nil {
+		return nil, nil
+	}
+
+	if err = s.db.Unscoped().Find(&properties).Error; err != nil {
+		return nil, fmt.Errorf("error listing properties: %w", err)
+	}
+
+	for _, property := range properties {
+		days := s.retentionService.RetentionDays(property)
+
+		if days == 0 {
+			return nil, nil
+		}
+
+		propertyCutoff := now.AddDate(0, 0, -days)
+
+		if cutoff == nil || propertyCutoff.Before(*cutoff) {
+			cutoff = &propertyCutoff
+		}
+	}
+
+	return cutoff, nil
+}
+
+/*
+dropMonthlyPartition removes the props of the events in a partition, then
+detaches and drops it. When the retention job archives events, partitions
+are only dropped once it has archived and deleted every event in them.
+*/
+func (s *PartitionService) dropMonthlyPartition(month time.Time) error {
+	var (
+		err       error
+		hasEvents bool
+	)
+
+	name := monthlyPartitionName(month)
+
+	if s.retentionService != nil && s.retentionService.archiveDir != "" {
+		if err = s.db.Raw("SELECT EXISTS (SELECT 1 FROM " + name + ")").Scan(&hasEvents).Error; err != nil {
+			return err
+		}
+
+		if hasEvents {
+			slog.Info("waiting for the retention job to archive expired partition", "partition", name)
+			return nil
+		}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		return execStatements(tx,
+			"DELETE FROM event_props WHERE event_id IN (SELECT id FROM "+name+")",
+			"ALTER TABLE events DETACH PARTITION "+name,
+			"DROP TABLE "+name,
+		)
+	})
+
+	if err != nil {
+		return fmt.Errorf("error dropping partition %s: %w", name, err)
+	}
+
+	slog.Info("dropped expired event partition", "partition", name)
+	return nil
+}
+
+// monthlyPartitions returns the first day of the month of every monthly partition.
+func (s *PartitionService) monthlyPartitions() ([]time.Time, error) {
+	var (
+		err    error
+		names  []string
+		result []time.Time
+	)
+
+	err = s.db.Raw(`SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'events' AND pg_table_is_visible(p.oid)`).Scan(&names).Error
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing event partitions: %w", err)
+	}
+
+	for _, name := range names {
+		if month, ok := parseMonthlyPartitionName(name); ok {
+			result = append(result, month)
+		}
+	}
+
+	slices.SortFunc(result, time.Time.Compare)
+	return result, nil
+}
+
+// lastMonth returns the first day of the last month that gets a partition ahead of time.
+func (s *PartitionService) lastMonth(now time.Time) time.Time {
+	return startOfMonth(now).AddDate(0, s.monthsAhead, 0)
+}
+
+/*
+createMonthlyPartition creates the partition for a month. Events for that
+month that were recorded before it existed are in the default partition,
+so they are moved into the new table before it is attached.
+*/
+func createMonthlyPartition(tx *gorm.DB, month time.Time) error {
+	name := monthlyPartitionName(month)
+	from := month.Format(partitionBoundLayout)
+	to := month.AddDate(0, 1, 0).Format(partitionBoundLayout)
+
+	err := execStatements(tx,
+		"CREATE TABLE "+name+" (LIKE events INCLUDING DEFAULTS)",
+		fmt.Sprintf(`WITH moved AS (DELETE FROM events_default WHERE created_at >= '%s' AND created_at < '%s' RETURNING *)
+			INSERT INTO %s SELECT * FROM moved`, from, to, name),
+		fmt.Sprintf("ALTER TABLE events ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')", name, from, to),
+	)
+
+	if err != nil {
+		return fmt.Errorf("error creating partition %s: %w", name, err)
+	}
+
+	return nil
+}
+
+/*
+expiredPartitions returns the months, out of those given, whose partition
+only holds events older than cutoff.
+*/
+func expiredPartitions(months []time.Time, cutoff time.Time) []time.Time {
+	var result []time.Time
+
+	for _, month := range months {
+		if !month.AddDate(0, 1, 0).After(cutoff) {
+			result = append(result, month)
+		}
+	}
+
+	return result
+}
+
+func monthlyPartitionName(month time.Time) string {
+	return month.UTC().Format("events_2006_01")
+}
+
+func parseMonthlyPartitionName(name string) (time.Time, bool) {
+	if !monthlyPartitionPattern.MatchString(name) {
+		return time.Time{}, false
+	}
+
+	month, err := time.Parse("events_2006_01", name)
+	return month, err == nil
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func execStatements(tx *gorm.DB, statements ...string) error {
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func TestPartitionService_ExpiredPartitions(t *testing.T) {
+	months := []time.Time{
+		time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		cutoff time.Time
+		want   int
+	}{
+		{time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC), 0},
+		{time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), 1},
+		{time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC), 2},
+	}
+
+	for _, tt := range tests {
+		if got := expiredPartitions(months, tt.cutoff); len(got) != tt.want {
+			t.Errorf("cutoff %v: expected %d expired partitions, got %v", tt.cutoff, tt.want, got)
+		}
+	}
+}
+
+func TestPartitionService_RetentionCutoff(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	db.Create(&models.Property{Name: "Short", Domain: "short.com", Token: "short", RetentionDays: 30})
+	db.Create(&models.Property{Name: "Default", Domain: "default.com", Token: "default"})
+
+	retention := NewRetentionService(RetentionServiceConfig{DB: db, DefaultRetentionDays: 90})
+	svc := NewPartitionService(PartitionServiceConfig{DB: db, RetentionService: retention})
+
+	cutoff, err := svc.retentionCutoff(now)
+
+	if err != nil || cutoff == nil || !cutoff.Equal(now.AddDate(0, 0, -90)) {
+		t.Fatalf("expected the default retention to set the cutoff, got %v, %v", cutoff, err)
+	}
+
+	// A property kept forever means no partition ever expires
+	db.Model(&models.Property{}).Where("token = ?", "default").Update("retention_days", models.RetentionForever)
+
+	if cutoff, err = svc.retentionCutoff(now); err != nil || cutoff != nil {
+		t.Errorf("expected no cutoff, got %v, %v", cutoff, err)
+	}
+}
+
+func TestPartitionService_PartitionNames(t *testing.T) {
+	month := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	if name := monthlyPartitionName(month); name != "events_2026_05" {
+		t.Errorf("unexpected partition name %s", name)
+	}
+
+	if parsed, ok := parseMonthlyPartitionName("events_2026_05"); !ok || !parsed.Equal(month) {
+		t.Errorf("expected events_2026_05 to parse as %v, got %v", month, parsed)
+	}
+
+	for _, name := range []string{"events_default", "events_2026_5", "events_unpartitioned"} {
+		if _, ok := parseMonthlyPartitionName(name); ok {
+			t.Errorf("expected %s not to be a monthly partition", name)
+		}
+	}
+}
+
+func TestPartitionService_RequiresPostgres(t *testing.T) {
+	svc := NewPartitionService(PartitionServiceConfig{DB: newTestDB(t)})
+
+	if err := svc.Partition(time.Now()); !errors.Is(err, ErrPartitioningUnsupported) {
+		t.Errorf("expected ErrPartitioningUnsupported, got %v", err)
+	}
+
+	if err := svc.Maintain(time.Now()); err != nil {
+		t.Errorf("expected maintenance to do nothing, got %v", err)
+	}
+}
+
+/*
+TestPartitionService_Postgres partitions a populated events table, then
+checks that reports, tracking, partition pruning and dropping expired
+partitions all work. It needs ALETICS_TEST_POSTGRES_DSN.
+*/
+func TestPartitionService_Postgres(t *testing.T) {
+	db := newExternalTestDB(t, "postgres")
+	now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+
+	db.Create(&models.Property{Name: "Test", Domain: "example.com", Token: "token", RetentionDays: 60})
+
+	for _, createdAt := range []time.Time{
+		time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, 4, 10, 0, 0, 0, 0, time.UTC),
+	} {
+		event := models.Event{PropertyID: 1, VisitorID: "a", Path: "/", Props: []models.EventProp{{Key: "plan", Value: "pro"}}}
+		event.CreatedAt = createdAt
+
+		if err := db.Create(&event).Error; err != nil {
+			t.Fatalf("error seeding events: %v", err)
+		}
+	}
+
+	retention := NewRetentionService(RetentionServiceConfig{DB: db})
+	svc := NewPartitionService(PartitionServiceConfig{DB: db, RetentionService: retention, MonthsAhead: 2})
+
+	if err := svc.Partition(now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := svc.Partition(now); !errors.Is(err, ErrAlreadyPartitioned) {
+		t.Errorf("expected ErrAlreadyPartitioned, got %v", err)
+	}
+
+	months, err := svc.monthlyPartitions()
+
+	if err != nil || len(months) != 6 {
+		t.Fatalf("expected partitions for January to June, got %v, %v", months, err)
+	}
+
+	reports := NewReportService(ReportServiceConfig{DB: db})
+
+	if aggregate, _ := reports.GetAggregate(1, now.AddDate(-1, 0, 0), now, nil); aggregate.Pageviews != 3 {
+		t.Errorf("expected 3 pageviews after partitioning, got %+v", aggregate)
+	}
+
+	event := models.Event{PropertyID: 1, VisitorID: "b", Path: "/new"}
+	event.CreatedAt = now
+
+	if err = db.Create(&event).Error; err != nil || event.ID <= 3 {
+		t.Fatalf("expected the event to be tracked with a new ID, got %d, %v", event.ID, err)
+	}
+
+	var plan []string
+	db.Raw("EXPLAIN SELECT COUNT(*) FROM events WHERE property_id = 1 AND created_at BETWEEN ? AND ?", now.AddDate(0, 0, -7), now).Scan(&plan)
+
+	if joined := strings.Join(plan, "\n"); strings.Contains(joined, "events_2026_03") || !strings.Contains(joined, "events_2026_04") {
+		t.Errorf("expected only the April partition to be read:\n%s", joined)
+	}
+
+	// With 60 days of retention, January and February expire by May 20
+	if err = svc.Maintain(time.Date(2026, 5, 20, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	months, _ = svc.monthlyPartitions()
+
+	if len(months) != 5 || months[0].Month() != time.March || months[len(months)-1].Month() != time.July {
+		t.Errorf("expected partitions for March to July, got %v", months)
+	}
+
+	var props []models.EventProp
+	db.Find(&props)
+
+	if len(props) != 2 || slices.ContainsFunc(props, func(prop models.EventProp) bool { return prop.EventID == 1 }) {
+		t.Errorf("expected the props of dropped events to be removed, got %+v", props)
+	}
+}
@@ -1,28 +1,80 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/adampresley/aletics/internal/models"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+const (
+	secretKeyPrefix string = "als_"
+)
+
+var (
+	ErrInvalidSecretKey = errors.New("invalid property secret key")
+	ErrAccessDenied     = errors.New("you do not have access to this property")
+	ErrInvalidRole      = errors.New("invalid role")
+	ErrPurgeStarted     = errors.New("the property's data is already being removed")
+)
+
 type PropertyServiceConfig struct {
 	DB *gorm.DB
+
+	// ArchiveGrace is how long an archived property can be restored before
+	// its events are removed for good.
+	ArchiveGrace time.Duration
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
 }
 
 type PropertyService struct {
-	db *gorm.DB
+	db           *gorm.DB
+	archiveGrace time.Duration
+	now          func() time.Time
 }
 
 func NewPropertyService(config PropertyServiceConfig) *PropertyService {
+	now := config.Now
+
+	if now == nil {
+		now = time.Now
+	}
+
 	return &PropertyService{
-		db: config.DB,
+		db:           config.DB,
+		archiveGrace: config.ArchiveGrace,
+		now:          now,
 	}
 }
 
-func (s *PropertyService) ListProperties(filter string) ([]models.Property, error) {
+/*
+ListProperties returns the properties a user has any role on, or every
+property for server admins.
+*/
+func (s *PropertyService) ListProperties(user models.User, filter string) ([]models.Property, error) {
+	return s.listProperties(user, models.RoleViewer, filter, false)
+}
+
+// ListEditableProperties returns the properties a user may change.
+func (s *PropertyService) ListEditableProperties(user models.User) ([]models.Property, error) {
+	return s.listProperties(user, models.RoleAdmin, "", false)
+}
+
+/*
+ListArchivedProperties returns the archived properties a user owns, that
+are waiting to be restored or purged.
+*/
+func (s *PropertyService) ListArchivedProperties(user models.User) ([]models.Property, error) {
+	return s.listProperties(user, models.RoleOwner, "", true)
+}
+
+func (s *PropertyService) listProperties(user models.User, required models.Role, filter string, archived bool) ([]models.Property, error) {
 	var (
 		err        error
 		properties []models.Property
@@ -33,6 +85,19 @@ func (s *PropertyService) ListProperties(filter string) ([]models.Property, erro
 		Model(&models.Property{}).
 		Order("LOWER(name) asc")
 
+	if archived {
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+
+	if !user.IsAdmin {
+		granted := s.db.
+			Model(&models.PropertyRole{}).
+			Select("property_id").
+			Where("user_id = ? AND role IN ?", user.ID, models.RolesAllowing(required))
+
+		query = query.Where("id IN (?)", granted)
+	}
+
 	if filter != "" {
 		query = query.Where("name LIKE ?", "%"+filter+"%")
 	}
@@ -57,7 +122,24 @@ func (s *PropertyService) GetProperty(id uint) (models.Property, error) {
 	return property, nil
 }
 
-func (s *PropertyService) CreateProperty(name, domain string) (models.Property, error) {
+/*
+GetPropertyByDomain returns the property for a domain. Domains are compared
+case-insensitively.
+*/
+func (s *PropertyService) GetPropertyByDomain(domain string) (models.Property, error) {
+	var (
+		err      error
+		property models.Property
+	)
+
+	if err = s.db.Where("LOWER(domain) = LOWER(?)", domain).First(&property).Error; err != nil {
+		return models.Property{}, err
+	}
+
+	return property, nil
+}
+
+func (s *PropertyService) CreateProperty(actor models.Actor, name, domain string) (models.Property, error) {
 	var (
 		err      error
 		property models.Property
@@ -70,43 +152,445 @@ func (s *PropertyService) CreateProperty(name, domain string) (models.Property,
 		Active: true,
 	}
 
-	if err = s.db.Create(&property).Error; err != nil {
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&property).Error; err != nil {
+			return err
+		}
+
+		after := map[string]any{"name": name, "domain": domain}
+		return recordAudit(tx, actor, models.AuditPropertyCreated, propertyAuditTarget(property), nil, after)
+	})
+
+	if err != nil {
 		return models.Property{}, err
 	}
 
 	return property, nil
 }
 
-func (s *PropertyService) UpdateProperty(id uint, property models.Property) error {
+func (s *PropertyService) UpdateProperty(actor models.Actor, id uint, property models.Property) error {
 	var (
 		err              error
 		existingProperty models.Property
 	)
 
+	if err = normalizeTrackingSettings(&property); err != nil {
+		return err
+	}
+
 	if err = s.db.First(&existingProperty, id).Error; err != nil {
 		return err
 	}
 
+	before, after := propertyChanges(existingProperty, property)
+
 	existingProperty.Name = property.Name
 	existingProperty.Domain = property.Domain
 	existingProperty.Active = property.Active
+	existingProperty.RetentionDays = property.RetentionDays
+	existingProperty.ExcludedIPs = property.ExcludedIPs
+	existingProperty.ExcludedPaths = property.ExcludedPaths
+	existingProperty.StrippedQueryParams = property.StrippedQueryParams
+	existingProperty.PrivacySignals = property.PrivacySignals
 
-	fmt.Printf("\nexistingProperty: %+v\n", existingProperty)
-	if err = s.db.Save(&existingProperty).Error; err != nil {
-		return err
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&existingProperty).Error; err != nil {
+			return err
+		}
+
+		if len(after) == 0 {
+			return nil
+		}
+
+		return recordAudit(tx, actor, models.AuditPropertyUpdated, propertyAuditTarget(existingProperty), before, after)
+	})
+}
+
+/*
+RotateToken replaces a property's tracking token, for when it is being
+abused. The old token is still accepted for grace, so that pages can be
+updated without losing events. A grace of 0 stops it working immediately.
+*/
+func (s *PropertyService) RotateToken(actor models.Actor, id uint, grace time.Duration) (models.Property, error) {
+	var (
+		err      error
+		property models.Property
+	)
+
+	if err = s.db.First(&property, id).Error; err != nil {
+		return models.Property{}, err
+	}
+
+	before := map[string]any{"token": property.Token}
+	property.PreviousToken = ""
+	property.PreviousTokenExpiresAt = nil
+
+	if grace > 0 {
+		expiresAt := s.now().Add(grace)
+		property.PreviousToken = property.Token
+		property.PreviousTokenExpiresAt = &expiresAt
+	}
+
+	property.Token = uuid.New().String()
+	after := map[string]any{"token": property.Token, "previousTokenExpiresAt": property.PreviousTokenExpiresAt}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Model(&property).
+			Select("token", "previous_token", "previous_token_expires_at").
+			Updates(&property).Error
+
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, actor, models.AuditTokenRotated, propertyAuditTarget(property), before, after)
+	})
+
+	if err != nil {
+		return models.Property{}, err
+	}
+
+	return property, nil
+}
+
+/*
+GetRole returns the role a user has on a property. Server admins are
+owners of every property. An empty role means no access.
+*/
+func (s *PropertyService) GetRole(user models.User, propertyID uint) (models.Role, error) {
+	var (
+		err          error
+		propertyRole models.PropertyRole
+	)
+
+	if user.IsAdmin {
+		return models.RoleOwner, nil
+	}
+
+	if err = s.db.Where("user_id = ? AND property_id = ?", user.ID, propertyID).First(&propertyRole).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return propertyRole.Role, nil
+}
+
+/*
+Authorize returns ErrAccessDenied unless the user has at least the
+required role on a property.
+*/
+func (s *PropertyService) Authorize(user models.User, propertyID uint, required models.Role) error {
+	var (
+		err  error
+		role models.Role
+	)
+
+	if role, err = s.GetRole(user, propertyID); err != nil {
+		return fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if !role.Allows(required) {
+		return ErrAccessDenied
 	}
 
 	return nil
 }
 
-func (s *PropertyService) DeleteProperty(id uint) error {
+/*
+AuthorizeAPIKey returns ErrAccessDenied unless an API key may read a
+property. A key can never read more than the user who created it.
+*/
+func (s *PropertyService) AuthorizeAPIKey(apiKey models.APIKey, propertyID uint) error {
+	var (
+		err  error
+		user models.User
+	)
+
+	if !apiKey.CanAccessProperty(propertyID) {
+		return ErrAccessDenied
+	}
+
+	if apiKey.UserID == nil {
+		return nil
+	}
+
+	if err = s.db.First(&user, *apiKey.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAccessDenied
+		}
+
+		return fmt.Errorf("error retrieving api key user: %w", err)
+	}
+
+	return s.Authorize(user, propertyID, models.RoleViewer)
+}
+
+// ListPropertyRoles returns everyone granted a role on a property.
+func (s *PropertyService) ListPropertyRoles(propertyID uint) ([]models.PropertyRole, error) {
 	var (
-		err error
+		err   error
+		roles []models.PropertyRole
 	)
 
-	if err = s.db.Delete(&models.Property{}, id).Error; err != nil {
+	err = s.db.
+		Preload("User").
+		Joins("JOIN users ON users.id = property_roles.user_id").
+		Where("property_roles.property_id = ?", propertyID).
+		Order("LOWER(users.email) asc").
+		Find(&roles).Error
+
+	if err != nil {
+		return []models.PropertyRole{}, err
+	}
+
+	return roles, nil
+}
+
+// GrantRole gives a user a role on a property, replacing any role they had.
+func (s *PropertyService) GrantRole(actor models.Actor, propertyID, userID uint, role models.Role) error {
+	if !role.Valid() {
+		return ErrInvalidRole
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		previous, err := revokeRole(tx, propertyID, userID)
+
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Create(&models.PropertyRole{UserID: userID, PropertyID: propertyID, Role: role}).Error; err != nil {
+			return err
+		}
+
+		return recordRoleAudit(tx, actor, models.AuditRoleGranted, propertyID, userID, previous, role)
+	})
+}
+
+func (s *PropertyService) RevokeRole(actor models.Actor, propertyID, userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		previous, err := revokeRole(tx, propertyID, userID)
+
+		if err != nil || previous == "" {
+			return err
+		}
+
+		return recordRoleAudit(tx, actor, models.AuditRoleRevoked, propertyID, userID, previous, "")
+	})
+}
+
+/*
+ArchiveProperty stops a property collecting events and hides it. It can
+be restored until the grace period is over, then the retention job
+removes its events and the property for good.
+*/
+func (s *PropertyService) ArchiveProperty(actor models.Actor, id uint) error {
+	var (
+		err      error
+		property models.Property
+	)
+
+	if err = s.db.First(&property, id).Error; err != nil {
 		return err
 	}
 
-	return nil
+	now := s.now()
+	purgeAfter := now.Add(s.archiveGrace)
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Model(&property).
+			Updates(map[string]any{
+				"deleted_at":    now,
+				"purge_after":   purgeAfter,
+				"events_purged": 0,
+			}).Error
+
+		if err != nil {
+			return err
+		}
+
+		before := map[string]any{"name": property.Name, "domain": property.Domain}
+		after := map[string]any{"purgeAfter": purgeAfter}
+		return recordAudit(tx, actor, models.AuditPropertyArchived, propertyAuditTarget(property), before, after)
+	})
+}
+
+/*
+RestoreProperty brings back an archived property. Once the grace period is
+over its events are being removed, and it returns ErrPurgeStarted.
+*/
+func (s *PropertyService) RestoreProperty(actor models.Actor, id uint) error {
+	var (
+		err      error
+		property models.Property
+	)
+
+	if err = s.db.Unscoped().Where("deleted_at IS NOT NULL").First(&property, id).Error; err != nil {
+		return err
+	}
+
+	if !property.Restorable(s.now()) {
+		return ErrPurgeStarted
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Unscoped().
+			Model(&property).
+			Updates(map[string]any{
+				"deleted_at":  nil,
+				"purge_after": nil,
+			}).Error
+
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, actor, models.AuditPropertyRestored, propertyAuditTarget(property), nil, nil)
+	})
+}
+
+/*
+GenerateSecretKey creates a new private secret key for a property, replacing
+any existing one. The plaintext key is returned once and is never stored.
+*/
+func (s *PropertyService) GenerateSecretKey(actor models.Actor, id uint) (string, error) {
+	var (
+		err       error
+		plaintext string
+		property  models.Property
+	)
+
+	if plaintext, err = generateSecret(secretKeyPrefix); err != nil {
+		return "", fmt.Errorf("error generating secret key: %w", err)
+	}
+
+	if err = s.db.First(&property, id).Error; err != nil {
+		return "", err
+	}
+
+	// Only the prefixes are recorded, as they are all that is ever shown
+	before := map[string]any{"prefix": property.SecretKeyPrefix}
+	after := map[string]any{"prefix": plaintext[:len(secretKeyPrefix)+apiKeyDisplayChars]}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Model(&models.Property{}).
+			Where("id = ?", id).
+			Updates(map[string]any{
+				"secret_key_hash":   hashSecret(plaintext),
+				"secret_key_prefix": after["prefix"],
+			}).Error
+
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, actor, models.AuditSecretKeyGenerated, propertyAuditTarget(property), before, after)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return plaintext, nil
+}
+
+// AuthenticateSecretKey returns the property a private secret key belongs to.
+func (s *PropertyService) AuthenticateSecretKey(plaintext string) (models.Property, error) {
+	var (
+		err      error
+		property models.Property
+	)
+
+	if !strings.HasPrefix(plaintext, secretKeyPrefix) {
+		return models.Property{}, ErrInvalidSecretKey
+	}
+
+	if err = s.db.Where("secret_key_hash = ?", hashSecret(plaintext)).First(&property).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Property{}, ErrInvalidSecretKey
+		}
+
+		return models.Property{}, fmt.Errorf("error retrieving property by secret key: %w", err)
+	}
+
+	return property, nil
+}
+
+func propertyAuditTarget(property models.Property) models.AuditTarget {
+	return models.AuditTarget{Type: models.AuditTargetProperty, ID: property.ID, Name: property.Name}
+}
+
+// propertyChanges returns the old and new values of the fields that differ.
+func propertyChanges(existing, updated models.Property) (map[string]any, map[string]any) {
+	before := map[string]any{}
+	after := map[string]any{}
+
+	changed := func(field string, old, new any) {
+		if old != new {
+			before[field] = old
+			after[field] = new
+		}
+	}
+
+	changed("name", existing.Name, updated.Name)
+	changed("domain", existing.Domain, updated.Domain)
+	changed("active", existing.Active, updated.Active)
+	changed("retentionDays", existing.RetentionDays, updated.RetentionDays)
+	changed("excludedIPs", existing.ExcludedIPs, updated.ExcludedIPs)
+	changed("excludedPaths", existing.ExcludedPaths, updated.ExcludedPaths)
+	changed("strippedQueryParams", existing.StrippedQueryParams, updated.StrippedQueryParams)
+	changed("privacySignals", existing.PrivacySignals, updated.PrivacySignals)
+
+	return before, after
+}
+
+// revokeRole removes a user's role on a property, and returns the role they had.
+func revokeRole(tx *gorm.DB, propertyID, userID uint) (models.Role, error) {
+	var (
+		err  error
+		role models.PropertyRole
+	)
+
+	err = tx.Where("user_id = ? AND property_id = ?", userID, propertyID).Limit(1).Find(&role).Error
+
+	if err != nil || role.ID == 0 {
+		return "", err
+	}
+
+	return role.Role, tx.Where("user_id = ? AND property_id = ?", userID, propertyID).Delete(&models.PropertyRole{}).Error
+}
+
+func recordRoleAudit(tx *gorm.DB, actor models.Actor, action models.AuditAction, propertyID, userID uint, previous, role models.Role) error {
+	var (
+		err      error
+		property models.Property
+		user     models.User
+		before   any
+		after    any
+	)
+
+	if err = tx.First(&property, propertyID).Error; err != nil {
+		return err
+	}
+
+	if err = tx.First(&user, userID).Error; err != nil {
+		return err
+	}
+
+	if previous != "" {
+		before = map[string]any{"user": user.Email, "role": previous}
+	}
+
+	if role != "" {
+		after = map[string]any{"user": user.Email, "role": role}
+	}
+
+	return recordAudit(tx, actor, action, propertyAuditTarget(property), before, after)
 }
@@ -0,0 +1,235 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+// newRoleTestData creates two properties, a server admin and a client user.
+func newRoleTestData(t *testing.T) (*gorm.DB, *PropertyService, models.User, models.User) {
+	t.Helper()
+
+	db := newTestDB(t)
+	properties := NewPropertyService(PropertyServiceConfig{DB: db})
+	users := NewUserService(UserServiceConfig{DB: db})
+
+	properties.CreateProperty(models.Actor{}, "Agency", "agency.com")
+	properties.CreateProperty(models.Actor{}, "Client", "client.com")
+
+	admin, err := users.CreateFirstAdmin(models.User{Email: "admin@agency.com"}, "correct horse")
+	if err != nil {
+		t.Fatalf("error creating admin: %v", err)
+	}
+
+	client, err := users.CreateUser(models.User{Email: "someone@client.com"}, "correct horse")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	return db, properties, admin, client
+}
+
+func TestPropertyService_ListPropertiesByRole(t *testing.T) {
+	_, svc, admin, client := newRoleTestData(t)
+
+	if properties, _ := svc.ListProperties(admin, ""); len(properties) != 2 {
+		t.Errorf("expected server admins to see every property, got %+v", properties)
+	}
+
+	if properties, _ := svc.ListProperties(client, ""); len(properties) != 0 {
+		t.Errorf("expected a user without roles to see nothing, got %+v", properties)
+	}
+
+	if err := svc.GrantRole(models.Actor{}, 2, client.ID, models.RoleViewer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if properties, _ := svc.ListProperties(client, ""); len(properties) != 1 || properties[0].ID != 2 {
+		t.Errorf("expected only the client property, got %+v", properties)
+	}
+
+	if properties, _ := svc.ListEditableProperties(client); len(properties) != 0 {
+		t.Errorf("expected viewers not to be able to edit, got %+v", properties)
+	}
+
+	if err := svc.GrantRole(models.Actor{}, 2, client.ID, models.RoleAdmin); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if properties, _ := svc.ListEditableProperties(client); len(properties) != 1 {
+		t.Errorf("expected the new role to replace the old one, got %+v", properties)
+	}
+
+	if roles, _ := svc.ListPropertyRoles(2); len(roles) != 1 || roles[0].User.Email != client.Email {
+		t.Errorf("expected one member with their user loaded, got %+v", roles)
+	}
+
+	if err := svc.GrantRole(models.Actor{}, 2, client.ID, "superuser"); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("expected ErrInvalidRole, got %v", err)
+	}
+}
+
+func TestPropertyService_Authorize(t *testing.T) {
+	_, svc, admin, client := newRoleTestData(t)
+	svc.GrantRole(models.Actor{}, 2, client.ID, models.RoleAdmin)
+
+	tests := []struct {
+		user       models.User
+		propertyID uint
+		required   models.Role
+		allowed    bool
+	}{
+		{admin, 1, models.RoleOwner, true},
+		{client, 2, models.RoleViewer, true},
+		{client, 2, models.RoleAdmin, true},
+		{client, 2, models.RoleOwner, false},
+		{client, 1, models.RoleViewer, false},
+	}
+
+	for _, tt := range tests {
+		err := svc.Authorize(tt.user, tt.propertyID, tt.required)
+
+		if tt.allowed && err != nil {
+			t.Errorf("%s on %d as %s: unexpected error %v", tt.user.Email, tt.propertyID, tt.required, err)
+		}
+
+		if !tt.allowed && !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("%s on %d as %s: expected ErrAccessDenied, got %v", tt.user.Email, tt.propertyID, tt.required, err)
+		}
+	}
+
+	if err := svc.RevokeRole(models.Actor{}, 2, client.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := svc.Authorize(client, 2, models.RoleViewer); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("expected access to be revoked, got %v", err)
+	}
+}
+
+func TestPropertyService_AuthorizeAPIKey(t *testing.T) {
+	db, svc, _, client := newRoleTestData(t)
+	apiKeys := NewApiKeyService(ApiKeyServiceConfig{DB: db})
+	svc.GrantRole(models.Actor{}, 2, client.ID, models.RoleViewer)
+
+	apiKey, _, err := apiKeys.CreateAPIKey("reports", nil, &client.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err = svc.AuthorizeAPIKey(apiKey, 2); err != nil {
+		t.Errorf("expected the key to read its creator's property, got %v", err)
+	}
+
+	if err = svc.AuthorizeAPIKey(apiKey, 1); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("expected the key not to read other properties, got %v", err)
+	}
+
+	if err = NewUserService(UserServiceConfig{DB: db}).DeleteUser(client.ID); err != nil {
+		t.Fatalf("unexpected error deleting user: %v", err)
+	}
+
+	if err = svc.AuthorizeAPIKey(apiKey, 2); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("expected the key to stop working with its creator gone, got %v", err)
+	}
+
+	if keys, _ := apiKeys.ListAPIKeys(models.User{IsAdmin: true}); len(keys) != 0 {
+		t.Errorf("expected the deleted user's keys to be revoked, got %+v", keys)
+	}
+
+	// Keys from before user accounts keep working for every property
+	if err = svc.AuthorizeAPIKey(models.APIKey{}, 1); err != nil {
+		t.Errorf("unexpected error for a key without a creator: %v", err)
+	}
+}
+
+func TestPropertyService_RotateToken(t *testing.T) {
+	db := newTestDB(t)
+	properties := NewPropertyService(PropertyServiceConfig{DB: db})
+	tracker := NewTrackerService(TrackerServiceConfig{DB: db, VisitorSalt: "salt"})
+
+	track := func(token string) error {
+		_, err := tracker.TrackEvent(models.NewEvent{Token: token, Path: "/"})
+		return err
+	}
+
+	property, _ := properties.CreateProperty(models.Actor{}, "Blog", "blog.com")
+	original := property.Token
+
+	rotated, err := properties.RotateToken(models.Actor{}, property.ID, time.Hour)
+
+	if err != nil || rotated.Token == original || rotated.PreviousToken != original {
+		t.Fatalf("expected a new token that keeps the old one, got %+v, %v", rotated, err)
+	}
+
+	if err = track(rotated.Token); err != nil {
+		t.Errorf("expected the new token to be accepted, got %v", err)
+	}
+
+	if err = track(original); err != nil {
+		t.Errorf("expected the old token to be accepted during the grace period, got %v", err)
+	}
+
+	db.Model(&models.Property{}).Where("id = ?", property.ID).Update("previous_token_expires_at", time.Now().Add(-time.Minute))
+
+	if err = track(original); err == nil {
+		t.Errorf("expected the old token to be refused once the grace period ends")
+	}
+
+	second, _ := properties.RotateToken(models.Actor{}, property.ID, 0)
+
+	if second.PreviousToken != "" || track(rotated.Token) == nil {
+		t.Errorf("expected the old token to stop working immediately without a grace period, got %+v", second)
+	}
+}
+
+func TestPropertyService_ArchiveAndRestore(t *testing.T) {
+	now := time.Now()
+	db, properties, admin, client := newRoleTestData(t)
+	properties.archiveGrace = 24 * time.Hour
+	properties.now = func() time.Time { return now }
+	tracker := NewTrackerService(TrackerServiceConfig{DB: db, VisitorSalt: "salt"})
+
+	property, _ := properties.GetPropertyByDomain("client.com")
+	properties.RotateToken(models.Actor{}, property.ID, time.Hour)
+	properties.GrantRole(models.Actor{}, property.ID, client.ID, models.RoleOwner)
+
+	if err := properties.ArchiveProperty(models.Actor{}, property.ID); err != nil {
+		t.Fatalf("error archiving property: %v", err)
+	}
+
+	if list, _ := properties.ListProperties(client, ""); len(list) != 0 {
+		t.Errorf("expected an archived property to be hidden, got %+v", list)
+	}
+
+	if archived, _ := properties.ListArchivedProperties(client); len(archived) != 1 || !archived[0].Restorable(now) {
+		t.Errorf("expected the owner to see the archived property, got %+v", archived)
+	}
+
+	if archived, _ := properties.ListArchivedProperties(admin); len(archived) != 1 {
+		t.Errorf("expected a server admin to see the archived property, got %+v", archived)
+	}
+
+	if _, err := tracker.TrackEvent(models.NewEvent{Token: property.Token, Path: "/"}); err == nil {
+		t.Errorf("expected an archived property to stop collecting events")
+	}
+
+	if err := properties.RestoreProperty(models.Actor{}, property.ID); err != nil {
+		t.Fatalf("error restoring property: %v", err)
+	}
+
+	if _, err := tracker.TrackEvent(models.NewEvent{Token: property.Token, Path: "/"}); err != nil {
+		t.Errorf("expected a restored property to collect events, got %v", err)
+	}
+
+	properties.ArchiveProperty(models.Actor{}, property.ID)
+	now = now.Add(25 * time.Hour)
+
+	if err := properties.RestoreProperty(models.Actor{}, property.ID); !errors.Is(err, ErrPurgeStarted) {
+		t.Errorf("expected ErrPurgeStarted after the grace period, got %v", err)
+	}
+}
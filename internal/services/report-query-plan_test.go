@@ -0,0 +1,282 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	syntheticEvents     = 50_000
+	syntheticProperties = 10
+	syntheticDays       = 90
+)
+
+/*
+planCheckedTables are the tables that grow with traffic. A report query
+that reads one of them without an index gets slower every day.
+*/
+var planCheckedTables = []string{"events", "hourly_rollups", "daily_rollups"}
+
+var (
+	sqliteScanPattern   = regexp.MustCompile(`^SCAN (?:TABLE )?(\w+)`)
+	postgresScanPattern = regexp.MustCompile(`Seq Scan on (\w+)`)
+)
+
+/*
+TestReportService_QueryPlans runs the reports against a large synthetic
+event table, from raw events and from rollups, and fails if the database
+answers any of their queries by scanning a whole table.
+*/
+func TestReportService_QueryPlans(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *gorm.DB) {
+		now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+		seedSyntheticEvents(t, db, now)
+
+		recorder := &queryRecorder{}
+		recorded := db.Session(&gorm.Session{Logger: recorder})
+
+		// Raw events only
+		runSyntheticReports(t, NewReportService(ReportServiceConfig{DB: recorded}), now)
+
+		if err := NewRollupService(RollupServiceConfig{DB: db}).Aggregate(context.Background(), now); err != nil {
+			t.Fatalf("error building rollups: %v", err)
+		}
+
+		analyzeTables(t, db)
+
+		// Mostly rollups, with raw events at either end
+		runSyntheticReports(t, NewReportService(ReportServiceConfig{DB: recorded}), now)
+
+		checked := 0
+
+		for _, statement := range recorder.statements() {
+			if !strings.HasPrefix(statement, "SELECT") || !readsCheckedTable(statement) {
+				continue
+			}
+
+			checked++
+
+			if table := fullScan(t, db, statement); table != "" {
+				t.Errorf("full scan of %s in:\n%s", table, statement)
+			}
+		}
+
+		if checked == 0 {
+			t.Fatalf("no report queries were recorded")
+		}
+	})
+}
+
+func BenchmarkReportService_Reports(b *testing.B) {
+	db := newTestDB(b)
+	now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+	seedSyntheticEvents(b, db, now)
+
+	b.Run("events", func(b *testing.B) {
+		svc := NewReportService(ReportServiceConfig{DB: db})
+
+		for b.Loop() {
+			runSyntheticReports(b, svc, now)
+		}
+	})
+
+	if err := NewRollupService(RollupServiceConfig{DB: db}).Aggregate(context.Background(), now); err != nil {
+		b.Fatalf("error building rollups: %v", err)
+	}
+
+	analyzeTables(b, db)
+
+	b.Run("rollups", func(b *testing.B) {
+		svc := NewReportService(ReportServiceConfig{DB: db})
+
+		for b.Loop() {
+			runSyntheticReports(b, svc, now)
+		}
+	})
+}
+
+/*
+seedSyntheticEvents spreads syntheticEvents events over the properties and
+days before now, then updates the planner statistics.
+*/
+func seedSyntheticEvents(tb testing.TB, db *gorm.DB, now time.Time) {
+	tb.Helper()
+
+	browsers := []string{"Chrome", "Firefox", "Safari", "Edge", "Opera"}
+	countries := []string{"US", "DE", "FR", "GB", "NL", "JP", "BR", "IN", "CA", "AU"}
+	events := make([]models.Event, 0, 1000)
+	span := int64(syntheticDays * 24 * time.Hour)
+
+	for i := range syntheticEvents {
+		event := models.Event{
+			PropertyID:  uint(i%syntheticProperties + 1),
+			VisitorID:   fmt.Sprintf("visitor-%d", i%5000),
+			Path:        fmt.Sprintf("/page/%d", i%200),
+			Browser:     browsers[i%len(browsers)],
+			Country:     countries[i%len(countries)],
+			CountryCode: countries[i%len(countries)],
+		}
+
+		event.CreatedAt = now.Add(-time.Duration(int64(i) * 7919 % span))
+		event.UpdatedAt = event.CreatedAt
+		events = append(events, event)
+
+		if len(events) == cap(events) || i == syntheticEvents-1 {
+			if err := db.Create(&events).Error; err != nil {
+				tb.Fatalf("error seeding events: %v", err)
+			}
+
+			events = events[:0]
+		}
+	}
+
+	analyzeTables(tb, db)
+}
+
+func analyzeTables(tb testing.TB, db *gorm.DB) {
+	tb.Helper()
+
+	statement := "ANALYZE"
+
+	if db.Dialector.Name() == "mysql" {
+		statement = "ANALYZE TABLE " + strings.Join(planCheckedTables, ", ")
+	}
+
+	if err := db.Exec(statement).Error; err != nil {
+		tb.Fatalf("error analyzing tables: %v", err)
+	}
+}
+
+// runSyntheticReports runs every kind of report the dashboard and API use.
+func runSyntheticReports(tb testing.TB, svc *ReportService, now time.Time) {
+	tb.Helper()
+
+	start := now.AddDate(0, 0, -30).Add(-90 * time.Minute)
+	filters := []models.ReportFilter{{Dimension: "path", Values: []string{"/page/1*"}}}
+
+	check := func(err error) {
+		if err != nil {
+			tb.Fatalf("error running report: %v", err)
+		}
+	}
+
+	for _, filter := range [][]models.ReportFilter{nil, filters} {
+		_, err := svc.GetAggregate(3, start, now, filter)
+		check(err)
+
+		_, err = svc.GetTimeseries(3, start, now, "date", filter)
+		check(err)
+
+		_, err = svc.GetTimeseries(3, now.Add(-24*time.Hour), now, "hour", filter)
+		check(err)
+
+		for _, dimension := range []string{"path", "browser", "country"} {
+			_, err = svc.GetBreakdown(3, start, now, dimension, 10, filter)
+			check(err)
+		}
+	}
+}
+
+// readsCheckedTable returns true if a statement reads one of planCheckedTables.
+func readsCheckedTable(statement string) bool {
+	for _, table := range planCheckedTables {
+		if strings.Contains(statement, "FROM `"+table+"`") || strings.Contains(statement, `FROM "`+table+`"`) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+fullScan explains a statement and returns the name of a checked table
+the database would read in full, if any.
+*/
+func fullScan(t *testing.T, db *gorm.DB, statement string) string {
+	t.Helper()
+
+	var (
+		err   error
+		table string
+	)
+
+	switch db.Dialector.Name() {
+	case "sqlite":
+		var plan []struct{ Detail string }
+		err = db.Raw("EXPLAIN QUERY PLAN " + statement).Scan(&plan).Error
+
+		for _, step := range plan {
+			if match := sqliteScanPattern.FindStringSubmatch(step.Detail); match != nil && slices.Contains(planCheckedTables, match[1]) {
+				table = match[1]
+			}
+		}
+
+	case "postgres":
+		var plan []string
+		err = db.Raw("EXPLAIN " + statement).Scan(&plan).Error
+
+		for _, step := range plan {
+			if match := postgresScanPattern.FindStringSubmatch(step); match != nil && slices.Contains(planCheckedTables, match[1]) {
+				table = match[1]
+			}
+		}
+
+	case "mysql":
+		var plan []struct {
+			Table string
+			Type  string
+		}
+
+		err = db.Raw("EXPLAIN " + statement).Scan(&plan).Error
+
+		for _, step := range plan {
+			if step.Type == "ALL" && slices.Contains(planCheckedTables, step.Table) {
+				table = step.Table
+			}
+		}
+	}
+
+	if err != nil {
+		t.Fatalf("error explaining %s: %v", statement, err)
+	}
+
+	return table
+}
+
+// queryRecorder is a GORM logger that keeps the SQL of every statement run.
+type queryRecorder struct {
+	mutex sync.Mutex
+	sql   []string
+}
+
+func (r *queryRecorder) LogMode(logger.LogLevel) logger.Interface { return r }
+
+func (r *queryRecorder) Info(context.Context, string, ...any)  {}
+func (r *queryRecorder) Warn(context.Context, string, ...any)  {}
+func (r *queryRecorder) Error(context.Context, string, ...any) {}
+
+func (r *queryRecorder) Trace(_ context.Context, _ time.Time, fc func() (string, int64), _ error) {
+	statement, _ := fc()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sql = append(r.sql, statement)
+}
+
+func (r *queryRecorder) statements() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string(nil), r.sql...)
+}
@@ -1,76 +1,96 @@
 package services
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/adampresley/aletics/internal/models"
 	"gorm.io/gorm"
 )
 
+/*
+BreakdownDimensions maps the dimension names accepted by GetBreakdown to
+the event column they group by.
+*/
+var BreakdownDimensions = map[string]string{
+	"path":         "path",
+	"browser":      "browser",
+	"country":      "country",
+	"country_code": "country_code",
+}
+
+/*
+TimeseriesIntervals lists the bucket sizes accepted by GetTimeseries, and
+the Go layout of the labels each one produces.
+*/
+var TimeseriesIntervals = map[string]string{
+	"hour":  "2006-01-02 15:00:00",
+	"date":  "2006-01-02",
+	"month": "2006-01-02",
+}
+
 type ReportService struct {
-	db *gorm.DB
+	db         *gorm.DB
+	eventStore EventStore
+	rollups    bool
 }
 
 type ReportServiceConfig struct {
 	DB *gorm.DB
+
+	// EventStore is where raw events are read from. Defaults to the events
+	// table in DB.
+	EventStore EventStore
 }
 
 func NewReportService(config ReportServiceConfig) *ReportService {
-	return &ReportService{
-		db: config.DB,
+	result := &ReportService{
+		db:         config.DB,
+		eventStore: config.EventStore,
+	}
+
+	if result.eventStore == nil {
+		result.eventStore = NewGormEventStore(config.DB)
 	}
+
+	_, columnar := result.eventStore.(ColumnarEventStore)
+	result.rollups = !columnar
+
+	return result
 }
 
 /*
 GetViewsOverTime retrieves page view counts grouped by a specific time frame (day, hour).
-This function is database-agnostic and supports both SQLite and PostgreSQL.
+This function is database-agnostic and supports SQLite, PostgreSQL and MySQL.
 */
 func (s *ReportService) GetViewsOverTime(propertyID uint, start, end time.Time, timeframe string) ([]models.ViewsOverTimeItem, error) {
 	var (
-		err       error
-		results   []models.ViewsOverTimeItem
-		selectSQL string
-		baseQuery *gorm.DB
+		err      error
+		interval string
+		items    []models.TimeseriesItem
+		results  []models.ViewsOverTimeItem
 	)
 
-	switch s.db.Dialector.Name() {
-	case "sqlite":
-		switch timeframe {
-		case "hourly":
-			selectSQL = "strftime('%Y-%m-%d %H:00', created_at) as label, COUNT(*) as count"
-		case "daily":
-			selectSQL = "strftime('%Y-%m-%d', created_at) as label, COUNT(*) as count"
-		default:
-			return nil, fmt.Errorf("invalid timeframe for sqlite: %s", timeframe)
-		}
-
-	case "postgres":
-		switch timeframe {
-		case "hourly":
-			selectSQL = "DATE_TRUNC('hour', created_at) as label, COUNT(*) as count"
-		case "daily":
-			selectSQL = "DATE_TRUNC('day', created_at)::date as label, COUNT(*) as count"
-		default:
-			return nil, fmt.Errorf("invalid timeframe for postgres: %s", timeframe)
-		}
-
+	switch timeframe {
+	case "hourly":
+		interval = "hour"
+	case "daily":
+		interval = "date"
 	default:
-		return nil, fmt.Errorf("unsupported database dialect: %s", s.db.Dialector.Name())
+		return nil, fmt.Errorf("invalid timeframe: %s", timeframe)
 	}
 
-	baseQuery = s.db.
-		Model(&models.Event{}).
-		Select(selectSQL).
-		Where("property_id = ?", propertyID).
-		Where("created_at BETWEEN ? AND ?", start, end).
-		Group("label").
-		Order("label ASC")
-
-	if err = baseQuery.Scan(&results).Error; err != nil {
+	if items, err = s.GetTimeseries(propertyID, start, end, interval, nil); err != nil {
 		return nil, err
 	}
 
+	for _, item := range items {
+		results = append(results, models.ViewsOverTimeItem{Label: item.Label, Count: item.Pageviews})
+	}
+
 	return results, nil
 }
 
@@ -78,23 +98,18 @@ func (s *ReportService) GetViewsOverTime(propertyID uint, start, end time.Time,
 func (s *ReportService) GetTopPaths(propertyID uint, start, end time.Time) ([]models.TopPathItem, error) {
 	var (
 		err     error
+		items   []models.BreakdownItem
 		results []models.TopPathItem
 	)
 
-	err = s.db.
-		Model(&models.Event{}).
-		Select("path, COUNT(*) as count").
-		Where("property_id = ?", propertyID).
-		Where("created_at BETWEEN ? AND ?", start, end).
-		Group("path").
-		Order("count DESC").
-		Limit(10).
-		Scan(&results).Error
-
-	if err != nil {
+	if items, err = s.GetBreakdown(propertyID, start, end, "path", 10, nil); err != nil {
 		return nil, err
 	}
 
+	for _, item := range items {
+		results = append(results, models.TopPathItem{Path: item.Value, Count: item.Pageviews})
+	}
+
 	return results, nil
 }
 
@@ -102,22 +117,18 @@ func (s *ReportService) GetTopPaths(propertyID uint, start, end time.Time) ([]mo
 func (s *ReportService) GetBrowserCounts(propertyID uint, start, end time.Time) ([]models.BrowserCountItem, error) {
 	var (
 		err     error
+		items   []models.BreakdownItem
 		results []models.BrowserCountItem
 	)
 
-	err = s.db.
-		Model(&models.Event{}).
-		Select("browser, COUNT(*) as count").
-		Where("property_id = ?", propertyID).
-		Where("created_at BETWEEN ? AND ?", start, end).
-		Group("browser").
-		Order("count DESC").
-		Scan(&results).Error
-
-	if err != nil {
+	if items, err = s.GetBreakdown(propertyID, start, end, "browser", 0, nil); err != nil {
 		return nil, err
 	}
 
+	for _, item := range items {
+		results = append(results, models.BrowserCountItem{Browser: item.Value, Count: item.Pageviews})
+	}
+
 	return results, nil
 }
 
@@ -125,21 +136,484 @@ func (s *ReportService) GetBrowserCounts(propertyID uint, start, end time.Time)
 func (s *ReportService) GetCountryCounts(propertyID uint, start, end time.Time) ([]models.CountryCountItem, error) {
 	var (
 		err     error
+		items   []models.BreakdownItem
 		results []models.CountryCountItem
 	)
 
-	err = s.db.
-		Model(&models.Event{}).
-		Select("country, COUNT(*) as count").
-		Where("property_id = ?", propertyID).
-		Where("created_at BETWEEN ? AND ?", start, end).
-		Group("country").
-		Order("count DESC").
-		Scan(&results).Error
+	if items, err = s.GetBreakdown(propertyID, start, end, "country", 0, nil); err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		results = append(results, models.CountryCountItem{Country: item.Value, Count: item.Pageviews})
+	}
+
+	return results, nil
+}
+
+/*
+GetAggregate returns summary numbers for a property within a given time
+range. Imported site totals are included when there are no filters.
+*/
+func (s *ReportService) GetAggregate(propertyID uint, start, end time.Time, filters []models.ReportFilter) (models.AggregateStats, error) {
+	var (
+		err      error
+		segments []reportSegment
+		result   models.AggregateStats
+		imported models.AggregateStats
+	)
+
+	if segments, err = s.planSegments(start, end, filters, dailyRollups); err != nil {
+		return models.AggregateStats{}, err
+	}
+
+	for _, segment := range segments {
+		var stats models.AggregateStats
+
+		if segment.grain == nil {
+			stats, err = s.eventStore.Aggregate(segment.eventQuery(propertyID, filters))
+		} else {
+			err = s.segmentRollupsQuery(propertyID, segment, "").Select(summedMetricsSQL).Scan(&stats).Error
+		}
+
+		if err != nil {
+			return models.AggregateStats{}, err
+		}
+
+		result.Pageviews += stats.Pageviews
+		result.Visitors += stats.Visitors
+	}
+
+	if len(filters) == 0 {
+		err = s.importedStatsQuery(propertyID, start, end, "").
+			Select(summedMetricsSQL).
+			Scan(&imported).Error
+
+		if err != nil {
+			return models.AggregateStats{}, err
+		}
 
-	if err != nil {
+		result.Pageviews += imported.Pageviews
+		result.Visitors += imported.Visitors
+	}
+
+	return result, nil
+}
+
+/*
+GetTimeseries returns summary numbers for each time bucket in a range. The
+interval must be one of the keys in TimeseriesIntervals. Buckets with no
+events are included with zero counts. Imported site totals are added to
+daily and monthly buckets when there are no filters.
+*/
+func (s *ReportService) GetTimeseries(propertyID uint, start, end time.Time, interval string, filters []models.ReportFilter) ([]models.TimeseriesItem, error) {
+	var (
+		err             error
+		rollupsLabelSQL string
+		segments        []reportSegment
+		rows            []models.TimeseriesItem
+		imported        []models.ImportedStat
+	)
+
+	if rollupsLabelSQL, err = timeBucketSQL(s.db, interval, "bucket"); err != nil {
+		return nil, err
+	}
+
+	grain := dailyRollups
+
+	if interval == "hour" {
+		grain = hourlyRollups
+	}
+
+	if segments, err = s.planSegments(start, end, filters, grain); err != nil {
 		return nil, err
 	}
 
+	for _, segment := range segments {
+		var items []models.TimeseriesItem
+
+		if segment.grain == nil {
+			items, err = s.eventStore.Timeseries(segment.eventQuery(propertyID, filters), interval)
+		} else {
+			err = s.segmentRollupsQuery(propertyID, segment, "").
+				Select(rollupsLabelSQL + " as label, " + summedMetricsSQL).
+				Group("label").
+				Scan(&items).Error
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, items...)
+	}
+
+	if len(filters) == 0 && interval != "hour" {
+		if err = s.importedStatsQuery(propertyID, start, end, "").Find(&imported).Error; err != nil {
+			return nil, err
+		}
+
+		for _, stat := range imported {
+			day := stat.Date.UTC()
+
+			if interval == "month" {
+				day = time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+			}
+
+			rows = append(rows, models.TimeseriesItem{
+				Label:     day.Format(TimeseriesIntervals[interval]),
+				Pageviews: stat.Pageviews,
+				Visitors:  stat.Visitors,
+			})
+		}
+	}
+
+	return fillTimeseries(rows, start, end, interval), nil
+}
+
+/*
+GetBreakdown returns the number of views per value of a dimension for a
+property within a given time range. The dimension must be one of the keys
+in BreakdownDimensions. A limit of 0 or less returns all values. Imported
+stats for the same dimension are merged in when there are no filters.
+*/
+func (s *ReportService) GetBreakdown(propertyID uint, start, end time.Time, dimension string, limit int, filters []models.ReportFilter) ([]models.BreakdownItem, error) {
+	var (
+		err      error
+		ok       bool
+		segments []reportSegment
+		results  []models.BreakdownItem
+		imported []models.BreakdownItem
+	)
+
+	if _, ok = BreakdownDimensions[dimension]; !ok {
+		return nil, fmt.Errorf("invalid breakdown dimension: %s", dimension)
+	}
+
+	if len(filters) == 0 {
+		err = s.importedStatsQuery(propertyID, start, end, dimension).
+			Select("value, " + summedMetricsSQL).
+			Group("value").
+			Scan(&imported).Error
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if segments, err = s.planSegments(start, end, filters, dailyRollups); err != nil {
+		return nil, err
+	}
+
+	/*
+	 * When the numbers come from more than one place the limit has to be
+	 * applied after merging, otherwise a value that is only popular in
+	 * one of them could be cut off.
+	 */
+	merge := len(segments) > 1 || len(imported) > 0
+
+	for _, segment := range segments {
+		var items []models.BreakdownItem
+
+		if segment.grain == nil {
+			segmentLimit := limit
+
+			if merge {
+				segmentLimit = 0
+			}
+
+			items, err = s.eventStore.Breakdown(segment.eventQuery(propertyID, filters), dimension, segmentLimit)
+		} else {
+			err = s.segmentRollupsQuery(propertyID, segment, dimension).
+				Select("value, " + summedMetricsSQL).
+				Group("value").
+				Scan(&items).Error
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = mergeBreakdowns(results, items, 0)
+	}
+
+	if merge {
+		results = mergeBreakdowns(results, imported, limit)
+	}
+
 	return results, nil
 }
+
+const (
+	metricsSQL       string = "COUNT(*) as pageviews, COUNT(DISTINCT NULLIF(visitor_id, '')) as visitors"
+	summedMetricsSQL string = "COALESCE(SUM(pageviews), 0) as pageviews, COALESCE(SUM(visitors), 0) as visitors"
+)
+
+/*
+reportSegment is a part of a report's time range along with the rollup
+table its numbers come from. A nil grain means raw events. Raw segments
+include their end when inclusive is set, rollup segments never do.
+*/
+type reportSegment struct {
+	grain     *rollupGrain
+	start     time.Time
+	end       time.Time
+	inclusive bool
+}
+
+/*
+planSegments splits a time range so that the whole buckets of a rollup
+grain that have been rolled up are answered from its table, and only the
+partial buckets at either end come from raw events. Filtered reports
+always use raw events, as each rollup row only holds a single dimension.
+
+Visitors are unique within a bucket, so summing them over several buckets
+counts a returning visitor more than once. Reports therefore only use
+daily rollups, and so count a visitor at most once a day, except for
+hourly timeseries, where each bucket is a single hour.
+*/
+func (s *ReportService) planSegments(start, end time.Time, filters []models.ReportFilter, grain rollupGrain) ([]reportSegment, error) {
+	var (
+		err      error
+		state    models.RollupState
+		segments []reportSegment
+	)
+
+	raw := []reportSegment{{start: start, end: end, inclusive: true}}
+
+	if len(filters) > 0 || !s.rollups {
+		return raw, nil
+	}
+
+	if err = s.db.Where("name = ?", grain.name).Limit(1).Find(&state).Error; err != nil {
+		return nil, err
+	}
+
+	bucketStart := ceilBucket(grain, start)
+	bucketEnd := grain.truncate(minTime(end.Add(time.Nanosecond), state.CompleteThrough))
+
+	if !bucketStart.Before(bucketEnd) {
+		return raw, nil
+	}
+
+	if start.Before(bucketStart) {
+		segments = append(segments, reportSegment{start: start, end: bucketStart})
+	}
+
+	segments = append(segments, reportSegment{grain: &grain, start: bucketStart, end: bucketEnd})
+
+	if !bucketEnd.After(end) {
+		segments = append(segments, reportSegment{start: bucketEnd, end: end, inclusive: true})
+	}
+
+	return segments, nil
+}
+
+// eventQuery selects the raw events of a segment.
+func (segment reportSegment) eventQuery(propertyID uint, filters []models.ReportFilter) EventQuery {
+	return EventQuery{
+		PropertyID:   propertyID,
+		Start:        segment.start,
+		End:          segment.end,
+		InclusiveEnd: segment.inclusive,
+		Filters:      filters,
+	}
+}
+
+/*
+segmentRollupsQuery starts a query over the rollups of one dimension for a
+segment. A blank dimension selects the site totals.
+*/
+func (s *ReportService) segmentRollupsQuery(propertyID uint, segment reportSegment, dimension string) *gorm.DB {
+	return s.db.
+		Model(segment.grain.model).
+		Where("property_id = ?", propertyID).
+		Where("bucket >= ? AND bucket < ?", segment.start, segment.end).
+		Where("dimension = ?", dimension)
+}
+
+// ceilBucket returns the start of the first whole bucket at or after t.
+func ceilBucket(grain rollupGrain, t time.Time) time.Time {
+	bucket := grain.truncate(t)
+
+	if bucket.Before(t) {
+		bucket = grain.next(bucket)
+	}
+
+	return bucket
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+/*
+importedStatsQuery starts a query over the imported stats of one dimension
+for the days that overlap a time range. A blank dimension selects the
+imported site totals.
+*/
+func (s *ReportService) importedStatsQuery(propertyID uint, start, end time.Time, dimension string) *gorm.DB {
+	return s.db.
+		Model(&models.ImportedStat{}).
+		Where("property_id = ?", propertyID).
+		Where("date BETWEEN ? AND ?", startOfDay(start), end).
+		Where("dimension = ?", dimension)
+}
+
+/*
+mergeBreakdowns adds one set of breakdown items to another, e.g. imported
+to live ones, sorts the result the same way as the live query and applies
+the limit.
+*/
+func mergeBreakdowns(live, imported []models.BreakdownItem, limit int) []models.BreakdownItem {
+	byValue := make(map[string]int, len(live))
+
+	for i, item := range live {
+		byValue[item.Value] = i
+	}
+
+	for _, item := range imported {
+		if i, ok := byValue[item.Value]; ok {
+			live[i].Pageviews += item.Pageviews
+			live[i].Visitors += item.Visitors
+			continue
+		}
+
+		byValue[item.Value] = len(live)
+		live = append(live, item)
+	}
+
+	slices.SortFunc(live, func(a, b models.BreakdownItem) int {
+		return cmp.Or(cmp.Compare(b.Pageviews, a.Pageviews), cmp.Compare(a.Value, b.Value))
+	})
+
+	if limit > 0 && len(live) > limit {
+		live = live[:limit]
+	}
+
+	return live
+}
+
+/*
+timeBucketSQL returns a SQL expression that formats a timestamp column as
+the label of the time bucket it falls in. The labels match the layouts in
+TimeseriesIntervals.
+*/
+func timeBucketSQL(db *gorm.DB, interval, column string) (string, error) {
+	if _, ok := TimeseriesIntervals[interval]; !ok {
+		return "", fmt.Errorf("invalid interval: %s", interval)
+	}
+
+	switch db.Dialector.Name() {
+	case "sqlite":
+		return map[string]string{
+			"hour":  "strftime('%Y-%m-%d %H:00:00', " + column + ")",
+			"date":  "strftime('%Y-%m-%d', " + column + ")",
+			"month": "strftime('%Y-%m-01', " + column + ")",
+		}[interval], nil
+
+	case "postgres":
+		return map[string]string{
+			"hour":  "TO_CHAR(DATE_TRUNC('hour', " + column + "), 'YYYY-MM-DD HH24:00:00')",
+			"date":  "TO_CHAR(DATE_TRUNC('day', " + column + "), 'YYYY-MM-DD')",
+			"month": "TO_CHAR(DATE_TRUNC('month', " + column + "), 'YYYY-MM-01')",
+		}[interval], nil
+
+	case "mysql":
+		return map[string]string{
+			"hour":  "DATE_FORMAT(" + column + ", '%Y-%m-%d %H:00:00')",
+			"date":  "DATE_FORMAT(" + column + ", '%Y-%m-%d')",
+			"month": "DATE_FORMAT(" + column + ", '%Y-%m-01')",
+		}[interval], nil
+
+	default:
+		return "", fmt.Errorf("unsupported database dialect: %s", db.Dialector.Name())
+	}
+}
+
+/*
+likeSQL returns the dialect's LIKE clause for patterns made by
+wildcardToLike, with %s standing in for the column. MySQL treats a
+backslash in a string literal as an escape, so ESCAPE '\' is a syntax error
+there, but it is already MySQL's default LIKE escape character.
+*/
+func likeSQL(db *gorm.DB) string {
+	if db.Dialector.Name() == "mysql" {
+		return "%s LIKE ?"
+	}
+
+	return "%s LIKE ? ESCAPE '\\'"
+}
+
+/*
+wildcardToLike converts a value using "*" wildcards into a LIKE pattern,
+escaping any characters that LIKE would otherwise treat as special.
+*/
+func wildcardToLike(value string) string {
+	value = strings.NewReplacer("%", "\\%", "_", "\\_").Replace(value)
+
+	for strings.Contains(value, "**") {
+		value = strings.ReplaceAll(value, "**", "*")
+	}
+
+	return strings.ReplaceAll(value, "*", "%")
+}
+
+/*
+fillTimeseries returns one item per bucket between start and end, using
+the counts from rows where there are any and zeros everywhere else.
+*/
+func fillTimeseries(rows []models.TimeseriesItem, start, end time.Time, interval string) []models.TimeseriesItem {
+	var (
+		layout  = TimeseriesIntervals[interval]
+		byLabel = make(map[string]models.TimeseriesItem, len(rows))
+		result  = []models.TimeseriesItem{}
+		bucket  time.Time
+	)
+
+	for _, row := range rows {
+		item := byLabel[row.Label]
+		item.Label = row.Label
+		item.Pageviews += row.Pageviews
+		item.Visitors += row.Visitors
+		byLabel[row.Label] = item
+	}
+
+	start = start.UTC()
+	end = end.UTC()
+
+	switch interval {
+	case "hour":
+		bucket = start.Truncate(time.Hour)
+	case "date":
+		bucket = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	case "month":
+		bucket = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	for !bucket.After(end) {
+		label := bucket.Format(layout)
+		item, ok := byLabel[label]
+
+		if !ok {
+			item = models.TimeseriesItem{Label: label}
+		}
+
+		result = append(result, item)
+
+		switch interval {
+		case "hour":
+			bucket = bucket.Add(time.Hour)
+		case "date":
+			bucket = bucket.AddDate(0, 0, 1)
+		case "month":
+			bucket = bucket.AddDate(0, 1, 0)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+func seedReportEvents(t *testing.T, db *gorm.DB, createdAt time.Time) {
+	t.Helper()
+
+	events := []models.Event{
+		{PropertyID: 1, VisitorID: "a", Path: "/", Browser: "Chrome", Country: "United States", CountryCode: "US"},
+		{PropertyID: 1, VisitorID: "a", Path: "/blog/one", Browser: "Chrome", Country: "United States", CountryCode: "US"},
+		{PropertyID: 1, VisitorID: "b", Path: "/blog/two", Browser: "Firefox", Country: "Germany", CountryCode: "DE"},
+		{PropertyID: 1, VisitorID: "c", Path: "/about", Browser: "Safari", Country: "Germany", CountryCode: "DE"},
+		{PropertyID: 2, VisitorID: "d", Path: "/", Browser: "Chrome", Country: "France", CountryCode: "FR"},
+	}
+
+	for i := range events {
+		events[i].CreatedAt = createdAt
+	}
+
+	if err := db.Create(&events).Error; err != nil {
+		t.Fatalf("error seeding events: %v", err)
+	}
+}
+
+func TestReportService_GetAggregate(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	seedReportEvents(t, db, now)
+
+	svc := NewReportService(ReportServiceConfig{DB: db})
+	start, end := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		filters   []models.ReportFilter
+		pageviews int
+		visitors  int
+	}{
+		{name: "no filters", pageviews: 4, visitors: 3},
+		{name: "exact match", filters: []models.ReportFilter{{Dimension: "browser", Values: []string{"Chrome"}}}, pageviews: 2, visitors: 1},
+		{name: "wildcard", filters: []models.ReportFilter{{Dimension: "path", Values: []string{"/blog/*"}}}, pageviews: 2, visitors: 2},
+		{name: "negated or", filters: []models.ReportFilter{{Dimension: "browser", Negate: true, Values: []string{"Chrome", "Firefox"}}}, pageviews: 1, visitors: 1},
+		{
+			name: "combined",
+			filters: []models.ReportFilter{
+				{Dimension: "country_code", Values: []string{"DE"}},
+				{Dimension: "path", Values: []string{"/blog/**"}},
+			},
+			pageviews: 1,
+			visitors:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := svc.GetAggregate(1, start, end, tt.filters)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if stats.Pageviews != tt.pageviews || stats.Visitors != tt.visitors {
+				t.Errorf("expected %d pageviews and %d visitors, got %+v", tt.pageviews, tt.visitors, stats)
+			}
+		})
+	}
+}
+
+func TestReportService_GetAggregate_InvalidFilter(t *testing.T) {
+	svc := NewReportService(ReportServiceConfig{DB: newTestDB(t)})
+
+	_, err := svc.GetAggregate(1, time.Now().Add(-time.Hour), time.Now(), []models.ReportFilter{
+		{Dimension: "query_string; DROP TABLE events", Values: []string{"x"}},
+	})
+
+	if err == nil {
+		t.Fatal("expected an error for an unknown filter dimension")
+	}
+}
+
+func TestReportService_GetTimeseries_FillsEmptyBuckets(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	seedReportEvents(t, db, now)
+
+	svc := NewReportService(ReportServiceConfig{DB: db})
+	start := time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)
+
+	items, err := svc.GetTimeseries(1, start, end, "date", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []models.TimeseriesItem{
+		{Label: "2026-03-08"},
+		{Label: "2026-03-09"},
+		{Label: "2026-03-10", Pageviews: 4, Visitors: 3},
+	}
+
+	if len(items) != len(expected) {
+		t.Fatalf("expected %d items, got %+v", len(expected), items)
+	}
+
+	for i := range expected {
+		if items[i] != expected[i] {
+			t.Errorf("item %d: expected %+v, got %+v", i, expected[i], items[i])
+		}
+	}
+}
+
+func TestReportService_GetBreakdown(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	seedReportEvents(t, db, now)
+
+	svc := NewReportService(ReportServiceConfig{DB: db})
+
+	items, err := svc.GetBreakdown(1, now.Add(-time.Hour), now.Add(time.Hour), "country_code", 10, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []models.BreakdownItem{
+		{Value: "DE", Pageviews: 2, Visitors: 2},
+		{Value: "US", Pageviews: 2, Visitors: 1},
+	}
+
+	if len(items) != len(expected) {
+		t.Fatalf("expected %d items, got %+v", len(expected), items)
+	}
+
+	for i := range expected {
+		if items[i] != expected[i] {
+			t.Errorf("item %d: expected %+v, got %+v", i, expected[i], items[i])
+		}
+	}
+}
+
+/*
+TestReportService_Dialects runs the report queries against every database
+dialect, first from raw events and then from rollups.
+*/
+func TestReportService_Dialects(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *gorm.DB) {
+		now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+		start := now.AddDate(0, 0, -7)
+		seedRollupEvents(t, db, now)
+
+		svc := NewReportService(ReportServiceConfig{DB: db})
+
+		checkReports := func(t *testing.T) {
+			aggregate, err := svc.GetAggregate(1, start, now, nil)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if aggregate.Pageviews != 5 || aggregate.Visitors != 4 {
+				t.Errorf("expected 5 pageviews and 4 visitors, got %+v", aggregate)
+			}
+
+			timeseries := []struct {
+				interval string
+				start    time.Time
+				want     map[string]int
+			}{
+				{"hour", now.Add(-4 * time.Hour), map[string]int{"2026-04-15 11:00:00": 1, "2026-04-15 14:00:00": 1}},
+				{"date", start, map[string]int{"2026-04-12": 2, "2026-04-13": 1, "2026-04-15": 2}},
+				{"month", start, map[string]int{"2026-04-01": 5}},
+			}
+
+			for _, tt := range timeseries {
+				items, err := svc.GetTimeseries(1, tt.start, now, tt.interval, nil)
+
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %v", tt.interval, err)
+				}
+
+				got := map[string]int{}
+
+				for _, item := range items {
+					if item.Pageviews > 0 {
+						got[item.Label] = item.Pageviews
+					}
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s: expected %v, got %v", tt.interval, tt.want, got)
+				}
+			}
+
+			paths, err := svc.GetBreakdown(1, start, now, "path", 1, nil)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(paths) != 1 || paths[0].Value != "/" || paths[0].Pageviews != 3 {
+				t.Errorf("expected / with 3 pageviews, got %+v", paths)
+			}
+		}
+
+		t.Run("events", func(t *testing.T) {
+			checkReports(t)
+
+			filtered, err := svc.GetAggregate(1, start, now, []models.ReportFilter{
+				{Dimension: "path", Values: []string{"/d*"}},
+				{Dimension: "browser", Negate: true, Values: []string{"Chrome"}},
+			})
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if filtered.Pageviews != 1 || filtered.Visitors != 1 {
+				t.Errorf("expected 1 filtered pageview, got %+v", filtered)
+			}
+		})
+
+		t.Run("rollups", func(t *testing.T) {
+			if err := NewRollupService(RollupServiceConfig{DB: db}).Aggregate(context.Background(), now); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Only today is still read from raw events
+			db.Where("created_at < ?", startOfDay(now)).Delete(&models.Event{})
+			checkReports(t)
+		})
+	})
+}
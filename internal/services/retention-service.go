@@ -0,0 +1,533 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPruneBatchSize int           = 1000
+	defaultPruneBatchWait time.Duration = 50 * time.Millisecond
+)
+
+var (
+	ErrPruneRunning = errors.New("the retention job is already running")
+)
+
+type RetentionServiceConfig struct {
+	DB                   *gorm.DB
+	DefaultRetentionDays int
+
+	// EventStore is where events are pruned from when they are kept in a
+	// columnar store. Archiving is not supported there.
+	EventStore EventStore
+
+	// ArchiveDir, when set, is where pruned events are written before they
+	// are deleted. When empty, pruned events are discarded.
+	ArchiveDir string
+
+	// BatchSize and BatchWait bound how many events are deleted per
+	// transaction and how long to pause between transactions, so pruning
+	// never holds locks that block tracking for long.
+	BatchSize int
+	BatchWait time.Duration
+}
+
+/*
+RetentionService removes raw events that are older than the retention
+period of their property. Events are hard deleted, along with any that
+were soft deleted, so the events table stops growing forever. It also
+purges archived properties once they can no longer be restored.
+*/
+type RetentionService struct {
+	db                   *gorm.DB
+	columnarStore        ColumnarEventStore
+	defaultRetentionDays int
+	archiveDir           string
+	batchSize            int
+	batchWait            time.Duration
+
+	running sync.Mutex
+	mutex   sync.RWMutex
+	lastRun models.PruneResult
+}
+
+func NewRetentionService(config RetentionServiceConfig) *RetentionService {
+	result := &RetentionService{
+		db:                   config.DB,
+		defaultRetentionDays: config.DefaultRetentionDays,
+		archiveDir:           config.ArchiveDir,
+		batchSize:            config.BatchSize,
+		batchWait:            config.BatchWait,
+	}
+
+	if store, ok := config.EventStore.(ColumnarEventStore); ok {
+		result.columnarStore = store
+		result.archiveDir = ""
+	}
+
+	if result.batchSize <= 0 {
+		result.batchSize = defaultPruneBatchSize
+	}
+
+	if result.batchWait <= 0 {
+		result.batchWait = defaultPruneBatchWait
+	}
+
+	return result
+}
+
+// DefaultRetentionDays is the retention period for properties without their own.
+func (s *RetentionService) DefaultRetentionDays() int {
+	return s.defaultRetentionDays
+}
+
+/*
+RetentionDays returns the retention period in effect for a property. 0
+means its events are kept forever.
+*/
+func (s *RetentionService) RetentionDays(property models.Property) int {
+	if property.RetentionDays == models.RetentionForever {
+		return 0
+	}
+
+	if property.RetentionDays > 0 {
+		return property.RetentionDays
+	}
+
+	return max(s.defaultRetentionDays, 0)
+}
+
+// LastRun returns the outcome of the most recent prune.
+func (s *RetentionService) LastRun() models.PruneResult {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.lastRun
+}
+
+/*
+ListRetentionSummaries returns, for every property, its retention period,
+the date of its oldest event and how many events are stored.
+*/
+func (s *RetentionService) ListRetentionSummaries() ([]models.RetentionSummary, error) {
+	var (
+		err        error
+		properties []models.Property
+	)
+
+	if err = s.db.Order("LOWER(name) asc").Find(&properties).Error; err != nil {
+		return []models.RetentionSummary{}, err
+	}
+
+	result := make([]models.RetentionSummary, 0, len(properties))
+
+	for _, property := range properties {
+		var oldest models.Event
+
+		summary := models.RetentionSummary{
+			Property:      property,
+			RetentionDays: s.RetentionDays(property),
+		}
+
+		if s.columnarStore != nil {
+			if summary.Events, summary.OldestEvent, err = s.columnarStore.CountEvents(property.ID); err != nil {
+				return []models.RetentionSummary{}, fmt.Errorf("error counting events for property %d: %w", property.ID, err)
+			}
+
+			result = append(result, summary)
+			continue
+		}
+
+		if err = s.db.Model(&models.Event{}).Where("property_id = ?", property.ID).Count(&summary.Events).Error; err != nil {
+			return []models.RetentionSummary{}, fmt.Errorf("error counting events for property %d: %w", property.ID, err)
+		}
+
+		query := s.db.Select("created_at").Where("property_id = ?", property.ID).Order("created_at ASC").Limit(1).Find(&oldest)
+
+		if query.Error != nil {
+			return []models.RetentionSummary{}, fmt.Errorf("error getting oldest event for property %d: %w", property.ID, query.Error)
+		}
+
+		if query.RowsAffected > 0 {
+			summary.OldestEvent = &oldest.CreatedAt
+		}
+
+		result = append(result, summary)
+	}
+
+	return result, nil
+}
+
+/*
+Start prunes events immediately and then once every interval until ctx is
+cancelled. It blocks, so run it in its own goroutine.
+*/
+func (s *RetentionService) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("retention job is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Prune(ctx, time.Now()); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("error pruning events", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+Prune removes every event that is older than its property's retention
+period as of now, as well as any soft deleted events. Archived properties
+past their grace period are purged first. Those still in it are pruned
+like any other. Only one prune runs at a time, a second caller gets
+ErrPruneRunning.
+*/
+func (s *RetentionService) Prune(ctx context.Context, now time.Time) (models.PruneResult, error) {
+	var (
+		err        error
+		deleted    int64
+		properties []models.Property
+	)
+
+	if !s.running.TryLock() {
+		return models.PruneResult{}, ErrPruneRunning
+	}
+
+	defer s.running.Unlock()
+
+	result := models.PruneResult{
+		StartedAt: time.Now(),
+		Archived:  s.archiveDir != "",
+	}
+
+	defer func() {
+		result.FinishedAt = time.Now()
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		s.mutex.Lock()
+		s.lastRun = result
+		s.mutex.Unlock()
+	}()
+
+	if err = s.purgeArchivedProperties(ctx, now, &result); err != nil {
+		return result, err
+	}
+
+	if err = s.db.Unscoped().Find(&properties).Error; err != nil {
+		return result, fmt.Errorf("error listing properties: %w", err)
+	}
+
+	for _, property := range properties {
+		days := s.RetentionDays(property)
+
+		if days == 0 {
+			continue
+		}
+
+		cutoff := now.AddDate(0, 0, -days)
+
+		if s.columnarStore != nil {
+			deleted, err = s.columnarStore.DeleteEventsBefore(property.ID, cutoff)
+			result.Deleted += deleted
+
+			if err != nil {
+				return result, fmt.Errorf("error pruning events for property %d: %w", property.ID, err)
+			}
+
+			continue
+		}
+
+		deleted, err = s.pruneEvents(ctx, fmt.Sprintf("property-%d", property.ID), now, func(query *gorm.DB) *gorm.DB {
+			return query.Where("property_id = ? AND created_at < ?", property.ID, cutoff)
+		}, nil)
+
+		result.Deleted += deleted
+
+		if err != nil {
+			return result, fmt.Errorf("error pruning events for property %d: %w", property.ID, err)
+		}
+	}
+
+	if s.columnarStore != nil {
+		slog.Info("pruned events", "deleted", result.Deleted, "propertiesPurged", result.PropertiesPurged, "duration", time.Since(result.StartedAt))
+		return result, nil
+	}
+
+	deleted, err = s.pruneEvents(ctx, "deleted", now, func(query *gorm.DB) *gorm.DB {
+		return query.Where("deleted_at IS NOT NULL")
+	}, nil)
+
+	result.Deleted += deleted
+
+	if err != nil {
+		return result, fmt.Errorf("error pruning deleted events: %w", err)
+	}
+
+	slog.Info("pruned events", "deleted", result.Deleted, "archived", result.Archived, "propertiesPurged", result.PropertiesPurged, "duration", time.Since(result.StartedAt))
+	return result, nil
+}
+
+/*
+purgeArchivedProperties removes every event of each archived property
+whose grace period is over, recording progress as it goes, and then the
+property and everything else belonging to it.
+*/
+func (s *RetentionService) purgeArchivedProperties(ctx context.Context, now time.Time, result *models.PruneResult) error {
+	var (
+		err        error
+		deleted    int64
+		properties []models.Property
+	)
+
+	err = s.db.
+		Unscoped().
+		Where("deleted_at IS NOT NULL AND purge_after <= ?", now).
+		Find(&properties).Error
+
+	if err != nil {
+		return fmt.Errorf("error listing archived properties: %w", err)
+	}
+
+	for _, property := range properties {
+		slog.Info("purging archived property", "id", property.ID, "name", property.Name)
+
+		// An earlier run may have been interrupted part way through
+		purged := property.EventsPurged
+
+		if s.columnarStore != nil {
+			deleted, err = s.columnarStore.DeleteEventsBefore(property.ID, now.AddDate(100, 0, 0))
+		} else {
+			deleted, err = s.pruneEvents(ctx, fmt.Sprintf("property-%d", property.ID), now, func(query *gorm.DB) *gorm.DB {
+				return query.Where("property_id = ?", property.ID)
+			}, func(deleted int64) error {
+				return s.db.Unscoped().Model(&property).Update("events_purged", purged+deleted).Error
+			})
+		}
+
+		result.Deleted += deleted
+
+		if err != nil {
+			return fmt.Errorf("error purging events for property %d: %w", property.ID, err)
+		}
+
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			for _, model := range []any{&models.HourlyRollup{}, &models.DailyRollup{}, &models.ImportedStat{}, &models.PropertyRole{}} {
+				if err := tx.Where("property_id = ?", property.ID).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+
+			for _, model := range []any{&models.Import{}, &models.APIKey{}} {
+				if err := tx.Unscoped().Where("property_id = ?", property.ID).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Unscoped().Delete(&property).Error; err != nil {
+				return err
+			}
+
+			after := map[string]any{"events": purged + deleted}
+			return recordAudit(tx, models.Actor{}, models.AuditPropertyPurged, propertyAuditTarget(property), nil, after)
+		})
+
+		if err != nil {
+			return fmt.Errorf("error purging property %d: %w", property.ID, err)
+		}
+
+		result.PropertiesPurged++
+	}
+
+	return nil
+}
+
+/*
+pruneEvents deletes the events matched by scope in batches, each in its
+own short transaction. When archiving, each batch is written and flushed
+to the archive before it is deleted. progress, when not nil, is called
+after each batch with the number deleted so far.
+*/
+func (s *RetentionService) pruneEvents(ctx context.Context, label string, now time.Time, scope func(*gorm.DB) *gorm.DB, progress func(int64) error) (int64, error) {
+	var (
+		err     error
+		deleted int64
+		archive *eventArchive
+	)
+
+	defer func() {
+		if archive != nil {
+			if closeErr := archive.Close(); closeErr != nil {
+				slog.Error("error closing event archive", "path", archive.path, "error", closeErr)
+			}
+		}
+	}()
+
+	for {
+		var (
+			ids    []uint
+			events []models.Event
+		)
+
+		if err = ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		if err = scope(s.db.Unscoped().Model(&models.Event{})).Order("id").Limit(s.batchSize).Pluck("id", &ids).Error; err != nil {
+			return deleted, err
+		}
+
+		if len(ids) == 0 {
+			return deleted, nil
+		}
+
+		if s.archiveDir != "" {
+			if archive == nil {
+				if archive, err = newEventArchive(s.archiveDir, label, now); err != nil {
+					return deleted, err
+				}
+			}
+
+			if err = s.db.Unscoped().Preload("Props").Where("id IN ?", ids).Order("id").Find(&events).Error; err != nil {
+				return deleted, err
+			}
+
+			if err = archive.Write(events); err != nil {
+				return deleted, err
+			}
+		}
+
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("event_id IN ?", ids).Delete(&models.EventProp{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Unscoped().Where("id IN ?", ids).Delete(&models.Event{}).Error
+		})
+
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted += int64(len(ids))
+
+		if progress != nil {
+			if err = progress(deleted); err != nil {
+				return deleted, err
+			}
+		}
+
+		if len(ids) < s.batchSize {
+			return deleted, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return deleted, ctx.Err()
+		case <-time.After(s.batchWait):
+		}
+	}
+}
+
+/*
+openArchives holds the paths of the archives that a prune is writing to,
+so that visitor data requests do not rewrite them part way. archiveMutex
+guards it, and is held while an archive is rewritten.
+*/
+var (
+	archiveMutex sync.Mutex
+	openArchives = map[string]struct{}{}
+)
+
+/*
+eventArchive is a gzipped JSON lines file that pruned events are written
+to, one event per line.
+*/
+type eventArchive struct {
+	path    string
+	file    *os.File
+	writer  *gzip.Writer
+	encoder *json.Encoder
+}
+
+func newEventArchive(dir, label string, now time.Time) (*eventArchive, error) {
+	var (
+		err  error
+		file *os.File
+	)
+
+	if err = os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating archive directory: %w", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("events-%s-%s.jsonl.gz", label, now.UTC().Format("20060102-150405")))
+
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+
+	if file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640); err != nil {
+		return nil, fmt.Errorf("error creating archive file: %w", err)
+	}
+
+	openArchives[path] = struct{}{}
+
+	writer := gzip.NewWriter(file)
+
+	return &eventArchive{
+		path:    path,
+		file:    file,
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+	}, nil
+}
+
+// Write appends events to the archive and syncs them to disk.
+func (a *eventArchive) Write(events []models.Event) error {
+	for _, event := range events {
+		if err := a.encoder.Encode(event); err != nil {
+			return fmt.Errorf("error writing to archive: %w", err)
+		}
+	}
+
+	if err := a.writer.Flush(); err != nil {
+		return fmt.Errorf("error flushing archive: %w", err)
+	}
+
+	return a.file.Sync()
+}
+
+func (a *eventArchive) Close() error {
+	archiveMutex.Lock()
+	delete(openArchives, a.path)
+	archiveMutex.Unlock()
+
+	if err := a.writer.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+
+	return a.file.Close()
+}
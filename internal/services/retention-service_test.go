@@ -0,0 +1,253 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+func seedRetentionEvents(t *testing.T, db *gorm.DB, now time.Time) {
+	t.Helper()
+
+	properties := []models.Property{
+		{Name: "Short", Domain: "short.com", Token: "short", Active: true, RetentionDays: 30},
+		{Name: "Default", Domain: "default.com", Token: "default", Active: true},
+	}
+
+	if err := db.Create(&properties).Error; err != nil {
+		t.Fatalf("error seeding properties: %v", err)
+	}
+
+	events := []models.Event{
+		{PropertyID: properties[0].ID, Path: "/old", Props: []models.EventProp{{Key: "plan", Value: "pro"}}},
+		{PropertyID: properties[0].ID, Path: "/old"},
+		{PropertyID: properties[0].ID, Path: "/old"},
+		{PropertyID: properties[0].ID, Path: "/new"},
+		{PropertyID: properties[1].ID, Path: "/ancient"},
+		{PropertyID: properties[1].ID, Path: "/old"},
+	}
+
+	ages := []int{40, 35, 31, 1, 400, 40}
+
+	for i := range events {
+		events[i].CreatedAt = now.AddDate(0, 0, -ages[i])
+	}
+
+	if err := db.Create(&events).Error; err != nil {
+		t.Fatalf("error seeding events: %v", err)
+	}
+}
+
+func TestRetentionService_Prune(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	seedRetentionEvents(t, db, now)
+
+	// Soft deleted events are removed no matter how old they are
+	deletedEvent := models.Event{PropertyID: 2, Path: "/deleted"}
+	deletedEvent.CreatedAt = now
+	db.Create(&deletedEvent)
+	db.Delete(&deletedEvent)
+
+	svc := NewRetentionService(RetentionServiceConfig{DB: db, DefaultRetentionDays: 365, BatchSize: 2, BatchWait: time.Nanosecond})
+	result, err := svc.Prune(context.Background(), now)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Deleted != 5 {
+		t.Errorf("expected 5 deleted events, got %d", result.Deleted)
+	}
+
+	var paths []string
+	db.Unscoped().Model(&models.Event{}).Order("path").Pluck("path", &paths)
+
+	if len(paths) != 2 || paths[0] != "/new" || paths[1] != "/old" {
+		t.Errorf("expected /new and /old to remain, got %v", paths)
+	}
+
+	var props int64
+	db.Model(&models.EventProp{}).Count(&props)
+
+	if props != 0 {
+		t.Errorf("expected the props of pruned events to be deleted, got %d", props)
+	}
+
+	if svc.LastRun().Deleted != 5 || svc.LastRun().FinishedAt.IsZero() {
+		t.Errorf("expected the last run to be recorded, got %+v", svc.LastRun())
+	}
+}
+
+func TestRetentionService_PruneArchive(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	seedRetentionEvents(t, db, now)
+
+	dir := t.TempDir()
+	svc := NewRetentionService(RetentionServiceConfig{DB: db, ArchiveDir: dir, BatchSize: 2, BatchWait: time.Nanosecond})
+
+	if _, err := svc.Prune(context.Background(), now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "events-property-1-20260601-120000.jsonl.gz"))
+
+	if err != nil {
+		t.Fatalf("expected an archive file: %v", err)
+	}
+
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+
+	if err != nil {
+		t.Fatalf("error reading archive: %v", err)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		lines++
+	}
+
+	if lines != 3 {
+		t.Errorf("expected 3 archived events, got %d", lines)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "events-property-2-20260601-120000.jsonl.gz")); !os.IsNotExist(err) {
+		t.Errorf("expected no archive for a property that keeps events forever")
+	}
+}
+
+func TestRetentionService_PruneKeepsForever(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	seedRetentionEvents(t, db, now)
+
+	// The default property keeps its events forever, despite the server default
+	db.Model(&models.Property{}).Where("id = ?", 2).Update("retention_days", models.RetentionForever)
+
+	svc := NewRetentionService(RetentionServiceConfig{DB: db, DefaultRetentionDays: 30, BatchSize: 10, BatchWait: time.Nanosecond})
+
+	if days := svc.RetentionDays(models.Property{RetentionDays: models.RetentionForever}); days != 0 {
+		t.Errorf("expected a retention of 0 days, meaning forever, got %d", days)
+	}
+
+	result, err := svc.Prune(context.Background(), now)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Deleted != 3 {
+		t.Errorf("expected only the short property's 3 old events to be deleted, got %d", result.Deleted)
+	}
+
+	var count int64
+	db.Model(&models.Event{}).Where("property_id = ?", 2).Count(&count)
+
+	if count != 2 {
+		t.Errorf("expected the property kept forever to keep its 2 events, got %d", count)
+	}
+}
+
+func TestRetentionService_ListRetentionSummaries(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	seedRetentionEvents(t, db, now)
+
+	svc := NewRetentionService(RetentionServiceConfig{DB: db, DefaultRetentionDays: 90})
+	summaries, err := svc.ListRetentionSummaries()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(summaries) != 2 {
+		t.Fatalf("expected 2 summaries, got %d", len(summaries))
+	}
+
+	def, short := summaries[0], summaries[1]
+
+	if def.RetentionDays != 90 || def.Events != 2 || def.OldestEvent == nil || !def.OldestEvent.Equal(now.AddDate(0, 0, -400)) {
+		t.Errorf("unexpected summary for default property: %+v", def)
+	}
+
+	if short.RetentionDays != 30 || short.Events != 4 {
+		t.Errorf("unexpected summary for short property: %+v", short)
+	}
+}
+
+func TestRetentionService_PurgesArchivedProperties(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	seedRetentionEvents(t, db, now)
+
+	properties := NewPropertyService(PropertyServiceConfig{DB: db, ArchiveGrace: 24 * time.Hour, Now: func() time.Time { return now }})
+	propertyID := uint(2)
+	properties.GrantRole(models.Actor{}, propertyID, 1, models.RoleOwner)
+	db.Create(&models.DailyRollup{PropertyID: propertyID, Bucket: now, Pageviews: 1})
+	db.Create(&models.APIKey{Name: "Default", PropertyID: &propertyID})
+
+	if err := properties.ArchiveProperty(models.Actor{}, propertyID); err != nil {
+		t.Fatalf("error archiving property: %v", err)
+	}
+
+	svc := NewRetentionService(RetentionServiceConfig{DB: db, BatchSize: 1, BatchWait: time.Nanosecond})
+
+	// Nothing is purged during the grace period, though the other property is still pruned
+	if result, err := svc.Prune(context.Background(), now.Add(time.Hour)); err != nil || result.PropertiesPurged != 0 || result.Deleted != 3 {
+		t.Fatalf("expected nothing to be purged yet, got %+v, %v", result, err)
+	}
+
+	result, err := svc.Prune(context.Background(), now.Add(25*time.Hour))
+
+	if err != nil || result.PropertiesPurged != 1 || result.Deleted != 2 {
+		t.Fatalf("expected the property's 2 events to be purged, got %+v, %v", result, err)
+	}
+
+	belongings := map[string]any{
+		"events":   &models.Event{},
+		"rollups":  &models.DailyRollup{},
+		"roles":    &models.PropertyRole{},
+		"api keys": &models.APIKey{},
+	}
+
+	for name, model := range belongings {
+		var count int64
+		db.Unscoped().Model(model).Where("property_id = ?", propertyID).Count(&count)
+
+		if count != 0 {
+			t.Errorf("expected the property's %s to be removed, %d left", name, count)
+		}
+	}
+
+	var count int64
+	db.Unscoped().Model(&models.Property{}).Where("id = ?", propertyID).Count(&count)
+
+	if count != 0 {
+		t.Errorf("expected the property itself to be removed")
+	}
+
+	var remaining int64
+	db.Model(&models.Event{}).Where("property_id = ?", 1).Count(&remaining)
+
+	if remaining != 1 {
+		t.Errorf("expected the other property's events to be kept, got %d", remaining)
+	}
+
+	entries, _, _ := NewAuditService(AuditServiceConfig{DB: db}).ListEntries(models.AuditFilter{Action: models.AuditPropertyPurged, PageSize: 10})
+
+	if len(entries) != 1 || entries[0].TargetID != 2 || entries[0].After != `{"events":2}` {
+		t.Errorf("expected the purge to be audited, got %+v", entries)
+	}
+}
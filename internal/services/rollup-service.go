@@ -0,0 +1,468 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// rollupLateMargin covers events whose transaction was still open when
+	// a run started, so they are picked up as late events by the next run.
+	rollupLateMargin time.Duration = time.Minute
+)
+
+var (
+	ErrRollupRunning  = errors.New("the rollup aggregator is already running")
+	ErrRollupsMissing = errors.New("rollups have not been built yet, backfill all properties first")
+)
+
+/*
+rollupDimensions are the dimensions that are rolled up. The blank
+dimension holds the site totals.
+*/
+var rollupDimensions = []string{"", "path", "browser", "country", "country_code"}
+
+/*
+rollupGrain describes one rollup table: the size of its buckets and how
+many buckets a backfill rebuilds at a time.
+*/
+type rollupGrain struct {
+	name     string
+	table    string
+	interval string
+	model    any
+	truncate func(time.Time) time.Time
+	next     func(time.Time) time.Time
+	chunk    func(time.Time) time.Time
+}
+
+var (
+	hourlyRollups = rollupGrain{
+		name:     "hourly",
+		table:    "hourly_rollups",
+		interval: "hour",
+		model:    &models.HourlyRollup{},
+		truncate: func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) },
+		next:     func(t time.Time) time.Time { return t.Add(time.Hour) },
+		chunk:    func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	}
+
+	dailyRollups = rollupGrain{
+		name:     "daily",
+		table:    "daily_rollups",
+		interval: "date",
+		model:    &models.DailyRollup{},
+		truncate: startOfDay,
+		next:     func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+		chunk:    func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+	}
+
+	rollupGrains = []rollupGrain{hourlyRollups, dailyRollups}
+)
+
+// rollupRow is a row of either rollup table.
+type rollupRow struct {
+	PropertyID uint
+	Bucket     time.Time
+	Dimension  string
+	Value      string
+	Pageviews  int
+	Visitors   int
+}
+
+type rollupBucket struct {
+	PropertyID uint
+	Label      string
+}
+
+type RollupServiceConfig struct {
+	DB *gorm.DB
+}
+
+/*
+RollupService maintains the hourly and daily rollup tables that
+ReportService answers from instead of scanning raw events. Each bucket is
+rolled up once it is complete. Visitors are unique within a bucket, so
+like imported data, they are summed when a report spans several days.
+Hourly rollups only answer hourly timeseries.
+*/
+type RollupService struct {
+	db      *gorm.DB
+	running sync.Mutex
+}
+
+func NewRollupService(config RollupServiceConfig) *RollupService {
+	return &RollupService{
+		db: config.DB,
+	}
+}
+
+/*
+Start rolls up completed buckets immediately and then once every interval
+until ctx is cancelled. It blocks, so run it in its own goroutine.
+*/
+func (s *RollupService) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("rollup aggregator is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Aggregate(ctx, time.Now()); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("error aggregating rollups", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+Aggregate incrementally updates the rollups as of now. Buckets that
+completed since the last run are rolled up, and so are older buckets that
+received late events, such as backdated server-side events. The first run
+builds the rollups from all existing events.
+*/
+func (s *RollupService) Aggregate(ctx context.Context, now time.Time) error {
+	if !s.running.TryLock() {
+		return ErrRollupRunning
+	}
+
+	defer s.running.Unlock()
+
+	for _, grain := range rollupGrains {
+		if err := s.aggregate(ctx, grain, now); err != nil {
+			return fmt.Errorf("error aggregating %s rollups: %w", grain.name, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Backfill rebuilds the rollups from raw events, for one property or for all
+of them when propertyID is 0. Buckets from before a property's oldest
+remaining event are left alone, as their events may have been removed by
+the retention job.
+*/
+func (s *RollupService) Backfill(ctx context.Context, propertyID uint, now time.Time) error {
+	if !s.running.TryLock() {
+		return ErrRollupRunning
+	}
+
+	defer s.running.Unlock()
+
+	for _, grain := range rollupGrains {
+		state, found, err := s.loadState(grain)
+
+		if err != nil {
+			return err
+		}
+
+		if propertyID != 0 && !found {
+			return ErrRollupsMissing
+		}
+
+		complete := grain.truncate(now)
+
+		if propertyID != 0 {
+			complete = state.CompleteThrough
+		}
+
+		if err = s.backfill(ctx, grain, propertyID, complete); err != nil {
+			return fmt.Errorf("error backfilling %s rollups: %w", grain.name, err)
+		}
+
+		if propertyID == 0 {
+			if err = s.saveState(grain, complete, now.Add(-rollupLateMargin)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+RebuildBuckets rebuilds the rollups of a property for the buckets that
+contain times, after events in them have been deleted. Buckets that have
+not been rolled up yet are left for the next run.
+*/
+func (s *RollupService) RebuildBuckets(propertyID uint, times []time.Time) error {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	for _, grain := range rollupGrains {
+		state, found, err := s.loadState(grain)
+
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			continue
+		}
+
+		rebuilt := map[time.Time]bool{}
+
+		for _, t := range times {
+			bucket := grain.truncate(t)
+
+			if rebuilt[bucket] || !bucket.Before(state.CompleteThrough) {
+				continue
+			}
+
+			if err = s.rebuild(grain, propertyID, bucket, grain.next(bucket)); err != nil {
+				return fmt.Errorf("error rebuilding %s rollups: %w", grain.name, err)
+			}
+
+			rebuilt[bucket] = true
+		}
+	}
+
+	return nil
+}
+
+func (s *RollupService) aggregate(ctx context.Context, grain rollupGrain, now time.Time) error {
+	var (
+		err     error
+		found   bool
+		state   models.RollupState
+		buckets []rollupBucket
+		bucket  time.Time
+	)
+
+	complete := grain.truncate(now)
+
+	if state, found, err = s.loadState(grain); err != nil {
+		return err
+	}
+
+	if !found {
+		slog.Info("building rollups for the first time", "rollup", grain.name)
+
+		if err = s.backfill(ctx, grain, 0, complete); err != nil {
+			return err
+		}
+
+		return s.saveState(grain, complete, now.Add(-rollupLateMargin))
+	}
+
+	if buckets, err = s.dirtyBuckets(grain, state, complete); err != nil {
+		return err
+	}
+
+	for _, b := range buckets {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if bucket, err = time.ParseInLocation(TimeseriesIntervals[grain.interval], b.Label, time.UTC); err != nil {
+			return fmt.Errorf("error parsing bucket '%s': %w", b.Label, err)
+		}
+
+		if err = s.rebuild(grain, b.PropertyID, bucket, grain.next(bucket)); err != nil {
+			return err
+		}
+	}
+
+	return s.saveState(grain, complete, now.Add(-rollupLateMargin))
+}
+
+/*
+dirtyBuckets returns the buckets that need rolling up: those that have
+completed since the last run, and older ones with events recorded after
+the last run's watermark.
+*/
+func (s *RollupService) dirtyBuckets(grain rollupGrain, state models.RollupState, complete time.Time) ([]rollupBucket, error) {
+	var (
+		err      error
+		labelSQL string
+		result   []rollupBucket
+	)
+
+	if labelSQL, err = timeBucketSQL(s.db, grain.interval, "created_at"); err != nil {
+		return nil, err
+	}
+
+	err = s.db.
+		Model(&models.Event{}).
+		Select("property_id, "+labelSQL+" as label").
+		Where("(created_at >= ? AND created_at < ?) OR (updated_at > ? AND created_at < ?)",
+			state.CompleteThrough, complete, state.Watermark, state.CompleteThrough).
+		Group("property_id, label").
+		Scan(&result).Error
+
+	return result, err
+}
+
+/*
+backfill rebuilds the rollups of every bucket from each property's oldest
+event up to complete, a chunk of buckets at a time.
+*/
+func (s *RollupService) backfill(ctx context.Context, grain rollupGrain, propertyID uint, complete time.Time) error {
+	var (
+		err         error
+		propertyIDs []uint
+	)
+
+	query := s.db.Model(&models.Event{}).Distinct("property_id")
+
+	if propertyID != 0 {
+		query = query.Where("property_id = ?", propertyID)
+	}
+
+	if err = query.Pluck("property_id", &propertyIDs).Error; err != nil {
+		return err
+	}
+
+	for _, id := range propertyIDs {
+		var (
+			oldest models.Event
+			older  int64
+		)
+
+		if err = s.db.Select("created_at").Where("property_id = ?", id).Order("created_at ASC").Limit(1).Find(&oldest).Error; err != nil {
+			return err
+		}
+
+		start := grain.truncate(oldest.CreatedAt)
+
+		if err = s.db.Model(grain.model).Where("property_id = ? AND bucket <= ?", id, start).Count(&older).Error; err != nil {
+			return err
+		}
+
+		if older > 0 {
+			start = grain.next(start)
+		}
+
+		for chunkStart := start; chunkStart.Before(complete); {
+			chunkEnd := grain.chunk(chunkStart)
+
+			if chunkEnd.After(complete) {
+				chunkEnd = complete
+			}
+
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+
+			if err = s.rebuild(grain, id, chunkStart, chunkEnd); err != nil {
+				return err
+			}
+
+			chunkStart = chunkEnd
+		}
+
+		slog.Debug("backfilled rollups", "rollup", grain.name, "propertyID", id, "start", start, "end", complete)
+	}
+
+	return nil
+}
+
+/*
+rebuild replaces the rollups of a property for the buckets between start
+and end with numbers computed from raw events.
+*/
+func (s *RollupService) rebuild(grain rollupGrain, propertyID uint, start, end time.Time) error {
+	var (
+		err      error
+		labelSQL string
+		rows     []rollupRow
+	)
+
+	if labelSQL, err = timeBucketSQL(s.db, grain.interval, "created_at"); err != nil {
+		return err
+	}
+
+	for _, dimension := range rollupDimensions {
+		var items []struct {
+			Label     string
+			Value     string
+			Pageviews int
+			Visitors  int
+		}
+
+		valueSQL := "''"
+
+		if dimension != "" {
+			valueSQL = BreakdownDimensions[dimension]
+		}
+
+		err = s.db.
+			Model(&models.Event{}).
+			Select(labelSQL+" as label, "+valueSQL+" as value, "+metricsSQL).
+			Where("property_id = ?", propertyID).
+			Where("created_at >= ? AND created_at < ?", start, end).
+			Group("label, value").
+			Scan(&items).Error
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			bucket, err := time.ParseInLocation(TimeseriesIntervals[grain.interval], item.Label, time.UTC)
+
+			if err != nil {
+				return fmt.Errorf("error parsing bucket '%s': %w", item.Label, err)
+			}
+
+			rows = append(rows, rollupRow{
+				PropertyID: propertyID,
+				Bucket:     bucket,
+				Dimension:  dimension,
+				Value:      item.Value,
+				Pageviews:  item.Pageviews,
+				Visitors:   item.Visitors,
+			})
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("property_id = ? AND bucket >= ? AND bucket < ?", propertyID, start, end).Delete(grain.model).Error; err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		return tx.Table(grain.table).CreateInBatches(rows, 500).Error
+	})
+}
+
+func (s *RollupService) loadState(grain rollupGrain) (models.RollupState, bool, error) {
+	var (
+		state models.RollupState
+	)
+
+	query := s.db.Where("name = ?", grain.name).Limit(1).Find(&state)
+	return state, query.RowsAffected > 0, query.Error
+}
+
+func (s *RollupService) saveState(grain rollupGrain, complete, watermark time.Time) error {
+	return s.db.Save(&models.RollupState{
+		Name:            grain.name,
+		CompleteThrough: complete,
+		Watermark:       watermark,
+	}).Error
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
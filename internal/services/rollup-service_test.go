@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+func seedRollupEvents(t *testing.T, db *gorm.DB, now time.Time) {
+	t.Helper()
+
+	events := []models.Event{
+		{PropertyID: 1, VisitorID: "a", Path: "/", Browser: "Chrome"},
+		{PropertyID: 1, VisitorID: "a", Path: "/docs", Browser: "Chrome"},
+		{PropertyID: 1, VisitorID: "b", Path: "/", Browser: "Firefox"},
+		{PropertyID: 1, VisitorID: "c", Path: "/docs", Browser: "Safari"},
+		{PropertyID: 1, VisitorID: "d", Path: "/", Browser: "Chrome"},
+		{PropertyID: 2, VisitorID: "e", Path: "/", Browser: "Chrome"},
+	}
+
+	// Spread over three days before today, the current partial hour and
+	// a property that should not be mixed in
+	createdAt := []time.Time{
+		now.AddDate(0, 0, -3),
+		now.AddDate(0, 0, -3).Add(time.Hour),
+		now.AddDate(0, 0, -2),
+		now.Add(-3 * time.Hour),
+		now.Add(-time.Minute),
+		now.AddDate(0, 0, -2),
+	}
+
+	for i := range events {
+		events[i].CreatedAt = createdAt[i]
+	}
+
+	if err := db.Create(&events).Error; err != nil {
+		t.Fatalf("error seeding events: %v", err)
+	}
+}
+
+func TestRollupService_ReportsFromRollups(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+	seedRollupEvents(t, db, now)
+
+	if err := NewRollupService(RollupServiceConfig{DB: db}).Aggregate(context.Background(), now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var daily, hourly int64
+	db.Model(&models.DailyRollup{}).Where("dimension = ''").Count(&daily)
+	db.Model(&models.HourlyRollup{}).Where("dimension = ''").Count(&hourly)
+
+	// Days 12 and 13 for property 1, day 13 for property 2. The current
+	// day is incomplete and has no daily rollup
+	if daily != 3 {
+		t.Errorf("expected 3 daily total rows, got %d", daily)
+	}
+
+	// 12 10:30, 12 14:30, 13 14:30 and 15 11:30 for property 1, plus
+	// 13 14:30 for property 2. The current hour is incomplete
+	if hourly != 5 {
+		t.Errorf("expected 5 hourly total rows, got %d", hourly)
+	}
+
+	// Remove the raw events of the days that were rolled up. Reports must
+	// still find them
+	db.Where("created_at < ?", startOfDay(now)).Delete(&models.Event{})
+
+	svc := NewReportService(ReportServiceConfig{DB: db})
+	start := now.AddDate(0, 0, -7)
+
+	aggregate, err := svc.GetAggregate(1, start, now, nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if aggregate.Pageviews != 5 {
+		t.Errorf("expected 5 pageviews, got %d", aggregate.Pageviews)
+	}
+
+	paths, err := svc.GetBreakdown(1, start, now, "path", 1, nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(paths) != 1 || paths[0].Value != "/" || paths[0].Pageviews != 3 {
+		t.Errorf("expected / with 3 pageviews, got %+v", paths)
+	}
+
+	hours, err := svc.GetTimeseries(1, now.Add(-4*time.Hour), now, "hour", nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(hours) != 5 || hours[1].Pageviews != 1 || hours[4].Pageviews != 1 {
+		t.Errorf("unexpected hourly timeseries: %+v", hours)
+	}
+
+	// Filtered reports cannot use rollups and only see the remaining raw event
+	filtered, err := svc.GetAggregate(1, start, now, []models.ReportFilter{{Dimension: "browser", Values: []string{"Chrome"}}})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if filtered.Pageviews != 1 {
+		t.Errorf("expected 1 filtered pageview, got %d", filtered.Pageviews)
+	}
+}
+
+func TestRollupService_LateEvents(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+	seedRollupEvents(t, db, now)
+
+	svc := NewRollupService(RollupServiceConfig{DB: db})
+
+	if err := svc.Aggregate(context.Background(), now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A backdated server-side event for a day that was already rolled up
+	late := models.Event{PropertyID: 1, VisitorID: "z", Path: "/late"}
+	late.CreatedAt = now.AddDate(0, 0, -3)
+	late.UpdatedAt = now.Add(10 * time.Minute)
+	db.Create(&late)
+
+	if err := svc.Aggregate(context.Background(), now.Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var rollup models.DailyRollup
+	db.Where("property_id = 1 AND dimension = 'path' AND value = '/late'").First(&rollup)
+
+	if rollup.Pageviews != 1 {
+		t.Errorf("expected the late event to be rolled up, got %+v", rollup)
+	}
+
+	var totals models.HourlyRollup
+	db.Where("property_id = 1 AND dimension = '' AND bucket = ?", now.Truncate(time.Hour)).First(&totals)
+
+	if totals.Pageviews != 1 {
+		t.Errorf("expected the hour that just completed to be rolled up, got %+v", totals)
+	}
+}
+
+func TestReportService_PlanSegments(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+	db.Create(&models.RollupState{Name: "hourly", CompleteThrough: now.Truncate(time.Hour)})
+	db.Create(&models.RollupState{Name: "daily", CompleteThrough: time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC)})
+
+	svc := NewReportService(ReportServiceConfig{DB: db})
+	start := time.Date(2026, 4, 10, 8, 15, 0, 0, time.UTC)
+
+	tests := []struct {
+		grain rollupGrain
+		want  []string
+	}{
+		{dailyRollups, []string{
+			" 2026-04-10 08:15 2026-04-11 00:00",
+			"daily 2026-04-11 00:00 2026-04-15 00:00",
+			" 2026-04-15 00:00 2026-04-15 14:30",
+		}},
+		{hourlyRollups, []string{
+			" 2026-04-10 08:15 2026-04-10 09:00",
+			"hourly 2026-04-10 09:00 2026-04-15 14:00",
+			" 2026-04-15 14:00 2026-04-15 14:30",
+		}},
+	}
+
+	for _, tt := range tests {
+		segments, err := svc.planSegments(start, now, nil, tt.grain)
+
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		got := []string{}
+
+		for _, segment := range segments {
+			grain := ""
+
+			if segment.grain != nil {
+				grain = segment.grain.name
+			}
+
+			got = append(got, grain+" "+segment.start.Format("2006-01-02 15:04")+" "+segment.end.Format("2006-01-02 15:04"))
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected segments %q, got %q", tt.grain.name, tt.want, got)
+		}
+	}
+
+	filtered, _ := svc.planSegments(start, now, []models.ReportFilter{{Dimension: "path"}}, dailyRollups)
+
+	if len(filtered) != 1 || filtered[0].grain != nil {
+		t.Errorf("expected a single raw segment for a filtered report, got %+v", filtered)
+	}
+}
+
+func TestReportService_VisitorsFromRollups(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 4, 15, 14, 30, 0, 0, time.UTC)
+	day := time.Date(2026, 4, 13, 0, 0, 0, 0, time.UTC)
+
+	// One visitor comes back several times over the day
+	for _, hour := range []int{9, 10, 15, 22} {
+		event := models.Event{PropertyID: 1, VisitorID: "a", Path: "/", Browser: "Chrome"}
+		event.CreatedAt = day.Add(time.Duration(hour) * time.Hour)
+		db.Create(&event)
+	}
+
+	if err := NewRollupService(RollupServiceConfig{DB: db}).Aggregate(context.Background(), now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc := NewReportService(ReportServiceConfig{DB: db})
+
+	// From the daily rollups, then from a partial day of raw events
+	for _, start := range []time.Time{day.AddDate(0, 0, -1).Add(12 * time.Hour), day.Add(8 * time.Hour)} {
+		aggregate, err := svc.GetAggregate(1, start, now, nil)
+
+		if err != nil || aggregate.Pageviews != 4 || aggregate.Visitors != 1 {
+			t.Errorf("from %v: expected 4 pageviews by 1 visitor, got %+v, %v", start, aggregate, err)
+		}
+
+		paths, err := svc.GetBreakdown(1, start, now, "path", 0, nil)
+
+		if err != nil || len(paths) != 1 || paths[0].Visitors != 1 {
+			t.Errorf("from %v: expected / to have 1 visitor, got %+v, %v", start, paths, err)
+		}
+
+		days, err := svc.GetTimeseries(1, start, now, "date", nil)
+
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, item := range days {
+			if item.Label == "2026-04-13" && item.Visitors != 1 {
+				t.Errorf("from %v: expected 1 visitor on the day, got %+v", start, item)
+			}
+		}
+	}
+}
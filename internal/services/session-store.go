@@ -0,0 +1,350 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+)
+
+const (
+	// SessionUserIDKey is the session value holding the signed in user's
+	// ID. It is copied to the sessions table so that a user's sessions can
+	// be listed and ended.
+	SessionUserIDKey string = "user_id"
+
+	// sessionTouchInterval limits how often a session's last activity is
+	// written, so that every request does not update the database
+	sessionTouchInterval time.Duration = time.Minute
+)
+
+var ErrSessionEnded = errors.New("session has ended")
+
+type SessionStoreConfig struct {
+	DB *gorm.DB
+
+	// Secrets sign the session cookie. The first signs new cookies. The
+	// rest are old secrets that are still accepted, so that a secret can be
+	// rotated without signing everyone out.
+	Secrets []string
+
+	// IdleTimeout ends a session that has not been used for this long.
+	IdleTimeout time.Duration
+
+	// AbsoluteTimeout ends a session this long after it started, however
+	// much it is used.
+	AbsoluteTimeout time.Duration
+
+	// Secure cookies are only sent over HTTPS.
+	Secure bool
+
+	// PrivacyMode keeps only the name of a session's browser, rather than
+	// its full user agent.
+	PrivacyMode bool
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+/*
+SessionStore is a gorilla/sessions store that keeps session values in the
+database. The cookie only holds a signed, random session ID, so ending a
+session on the server ends it everywhere, even for a stolen cookie.
+*/
+type SessionStore struct {
+	db              *gorm.DB
+	codecs          []securecookie.Codec
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	options         sessions.Options
+	privacyMode     bool
+	now             func() time.Time
+}
+
+func NewSessionStore(config SessionStoreConfig) *SessionStore {
+	now := config.Now
+
+	if now == nil {
+		now = time.Now
+	}
+
+	keyPairs := [][]byte{}
+
+	for _, secret := range config.Secrets {
+		keyPairs = append(keyPairs, []byte(secret), nil)
+	}
+
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+
+	for _, codec := range codecs {
+		if c, ok := codec.(*securecookie.SecureCookie); ok {
+			c.MaxAge(int(config.AbsoluteTimeout.Seconds()))
+		}
+	}
+
+	return &SessionStore{
+		db:              config.DB,
+		codecs:          codecs,
+		idleTimeout:     config.IdleTimeout,
+		absoluteTimeout: config.AbsoluteTimeout,
+		options: sessions.Options{
+			Path:     "/",
+			MaxAge:   int(config.AbsoluteTimeout.Seconds()),
+			Secure:   config.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		privacyMode: config.PrivacyMode,
+		now:         now,
+	}
+}
+
+// Get returns the named session, loading it once per request.
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+/*
+New loads the session named in the request's cookie. A missing, invalid or
+expired session returns a new, empty one rather than an error.
+*/
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	var (
+		err    error
+		id     string
+		cookie *http.Cookie
+		record models.Session
+	)
+
+	session := sessions.NewSession(s, name)
+	options := s.options
+	session.Options = &options
+	session.IsNew = true
+
+	if cookie, err = r.Cookie(name); err != nil {
+		return session, nil
+	}
+
+	if err = securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		return session, nil
+	}
+
+	if err = s.db.Where("id = ? AND name = ?", hashSecret(id), name).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return session, nil
+		}
+
+		return session, err
+	}
+
+	now := s.now()
+
+	if s.expired(record, now) {
+		return session, s.db.Delete(&record).Error
+	}
+
+	if err = gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+
+	session.ID = id
+	session.IsNew = false
+
+	if now.Sub(record.LastSeenAt) >= sessionTouchInterval {
+		err = s.db.Model(&record).Update("last_seen_at", now).Error
+	}
+
+	return session, err
+}
+
+/*
+Save writes the session's values and sets its cookie. A session with a
+negative MaxAge is deleted instead. A new session without any values is
+not stored, so visitors who are not signed in, or signing in, leave no
+rows behind.
+*/
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	var (
+		err     error
+		data    bytes.Buffer
+		encoded string
+		result  *gorm.DB
+		userID  *uint
+	)
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err = s.db.Where("id = ?", hashSecret(session.ID)).Delete(&models.Session{}).Error; err != nil {
+				return err
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" && len(session.Values) == 0 {
+		return nil
+	}
+
+	if err = gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	now := s.now()
+
+	if id, ok := session.Values[SessionUserIDKey].(uint); ok {
+		userID = &id
+	}
+
+	if session.ID == "" {
+		if session.ID, err = newSessionID(); err != nil {
+			return err
+		}
+
+		lifetime := s.absoluteTimeout
+
+		if maxAge := time.Duration(session.Options.MaxAge) * time.Second; maxAge > 0 && maxAge < lifetime {
+			lifetime = maxAge
+		}
+
+		userAgent := r.UserAgent()
+
+		if s.privacyMode {
+			userAgent = BrowserFromUserAgent(userAgent)
+		}
+
+		if len(userAgent) > 255 {
+			userAgent = userAgent[:255]
+		}
+
+		record := models.Session{
+			ID:         hashSecret(session.ID),
+			Name:       session.Name(),
+			UserID:     userID,
+			Data:       data.Bytes(),
+			IP:         GetIP(r),
+			UserAgent:  userAgent,
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(lifetime),
+		}
+
+		if err = s.prune(now); err != nil {
+			return err
+		}
+
+		if err = s.db.Create(&record).Error; err != nil {
+			return err
+		}
+	} else {
+		result = s.db.Model(&models.Session{}).Where("id = ?", hashSecret(session.ID)).Updates(map[string]any{
+			"user_id":      userID,
+			"data":         data.Bytes(),
+			"last_seen_at": now,
+		})
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrSessionEnded
+		}
+	}
+
+	if encoded, err = securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+/*
+Renew gives the session a new ID, keeping its values, and ends the old
+one. Call it when someone signs in, so that an ID planted before then is
+no use to an attacker. The new ID is created when the session is saved.
+*/
+func (s *SessionStore) Renew(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+
+	err := s.db.Where("id = ?", hashSecret(session.ID)).Delete(&models.Session{}).Error
+	session.ID = ""
+	return err
+}
+
+/*
+ListUserSessions returns the user's active sessions, most recently used
+first. The one belonging to current is marked.
+*/
+func (s *SessionStore) ListUserSessions(userID uint, current *sessions.Session) ([]models.Session, error) {
+	var (
+		err    error
+		result []models.Session
+	)
+
+	now := s.now()
+
+	err = s.db.
+		Where("user_id = ? AND expires_at > ? AND last_seen_at > ?", userID, now, now.Add(-s.idleTimeout)).
+		Order("last_seen_at DESC").
+		Find(&result).Error
+
+	if current != nil && current.ID != "" {
+		currentID := hashSecret(current.ID)
+
+		for i := range result {
+			result[i].Current = result[i].ID == currentID
+		}
+	}
+
+	return result, err
+}
+
+// EndOtherUserSessions signs the user out everywhere except in current.
+func (s *SessionStore) EndOtherUserSessions(userID uint, current *sessions.Session) error {
+	query := s.db.Where("user_id = ?", userID)
+
+	if current != nil && current.ID != "" {
+		query = query.Where("id <> ?", hashSecret(current.ID))
+	}
+
+	return query.Delete(&models.Session{}).Error
+}
+
+// EndUserSessions signs the user out everywhere.
+func (s *SessionStore) EndUserSessions(userID uint) error {
+	return s.db.Where("user_id = ?", userID).Delete(&models.Session{}).Error
+}
+
+func (s *SessionStore) expired(record models.Session, now time.Time) bool {
+	return !now.Before(record.ExpiresAt) || now.Sub(record.LastSeenAt) >= s.idleTimeout
+}
+
+// prune deletes sessions that have expired, whether or not they come back.
+func (s *SessionStore) prune(now time.Time) error {
+	return s.db.
+		Where("expires_at <= ? OR last_seen_at <= ?", now, now.Add(-s.idleTimeout)).
+		Delete(&models.Session{}).Error
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
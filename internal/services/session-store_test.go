@@ -0,0 +1,200 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+)
+
+func newTestSessionStore(db *gorm.DB, now *time.Time, secrets ...string) *SessionStore {
+	return NewSessionStore(SessionStoreConfig{
+		DB:              db,
+		Secrets:         secrets,
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: 8 * time.Hour,
+		Now:             func() time.Time { return *now },
+	})
+}
+
+// saveTestSession saves a session for userID and returns its cookie.
+func saveTestSession(t *testing.T, store *SessionStore, userID uint) *http.Cookie {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, _ := store.Get(r, "test")
+	session.Values[SessionUserIDKey] = userID
+	session.Values["name"] = "Ada"
+
+	w := httptest.NewRecorder()
+
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("error saving session: %v", err)
+	}
+
+	return w.Result().Cookies()[0]
+}
+
+func loadTestSession(store *SessionStore, cookie *http.Cookie) *sessions.Session {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+
+	session, _ := store.Get(r, "test")
+	return session
+}
+
+func TestSessionStore_SavesValuesOnTheServer(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestSessionStore(newTestDB(t), &now, "secret")
+	cookie := saveTestSession(t, store, 7)
+
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge != int((8*time.Hour).Seconds()) {
+		t.Errorf("expected an HttpOnly, SameSite=Lax cookie lasting the absolute timeout, got %+v", cookie)
+	}
+
+	session := loadTestSession(store, cookie)
+
+	if session.IsNew || session.Values["name"] != "Ada" || session.Values[SessionUserIDKey] != uint(7) {
+		t.Errorf("expected the saved values, got %+v", session.Values)
+	}
+
+	forged := *cookie
+	forged.Value = "forged"
+
+	if session := loadTestSession(store, &forged); !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("expected a forged cookie to get a new session, got %+v", session.Values)
+	}
+}
+
+func TestSessionStore_AnonymousSessionsAreNotStored(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := newTestDB(t)
+	store := newTestSessionStore(db, &now, "secret")
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, _ := store.Get(r, "test")
+
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var count int64
+	db.Model(&models.Session{}).Count(&count)
+
+	if count != 0 || len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected no session row or cookie for an empty session, got %d rows and %+v", count, w.Result().Cookies())
+	}
+}
+
+func TestSessionStore_Timeouts(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestSessionStore(newTestDB(t), &now, "secret")
+	cookie := saveTestSession(t, store, 7)
+
+	// Using the session keeps it alive past the idle timeout
+	for range 8 {
+		now = now.Add(59 * time.Minute)
+
+		if session := loadTestSession(store, cookie); session.IsNew {
+			t.Fatalf("expected the session to be alive at %s", now)
+		}
+	}
+
+	now = now.Add(59 * time.Minute)
+
+	if session := loadTestSession(store, cookie); !session.IsNew {
+		t.Errorf("expected the session to end after the absolute timeout")
+	}
+
+	cookie = saveTestSession(t, store, 7)
+	now = now.Add(time.Hour)
+
+	if session := loadTestSession(store, cookie); !session.IsNew {
+		t.Errorf("expected the session to end after the idle timeout")
+	}
+}
+
+func TestSessionStore_RotatedSecretsAreStillAccepted(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := newTestDB(t)
+	cookie := saveTestSession(t, newTestSessionStore(db, &now, "old secret"), 7)
+
+	if session := loadTestSession(newTestSessionStore(db, &now, "new secret", "old secret"), cookie); session.IsNew {
+		t.Errorf("expected a cookie signed with a previous secret to be accepted")
+	}
+
+	if session := loadTestSession(newTestSessionStore(db, &now, "new secret"), cookie); !session.IsNew {
+		t.Errorf("expected a cookie signed with a retired secret to be refused")
+	}
+}
+
+func TestSessionStore_EndingSessions(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestSessionStore(newTestDB(t), &now, "secret")
+
+	laptop := saveTestSession(t, store, 7)
+	phone := saveTestSession(t, store, 7)
+	other := saveTestSession(t, store, 8)
+
+	current := loadTestSession(store, laptop)
+	list, err := store.ListUserSessions(7, current)
+
+	if err != nil || len(list) != 2 || list[0].Current == list[1].Current {
+		t.Fatalf("expected two sessions with one marked current, got %+v, %v", list, err)
+	}
+
+	if err = store.EndOtherUserSessions(7, current); err != nil {
+		t.Fatalf("error ending other sessions: %v", err)
+	}
+
+	if loadTestSession(store, laptop).IsNew || !loadTestSession(store, phone).IsNew || loadTestSession(store, other).IsNew {
+		t.Errorf("expected only the user's other session to end")
+	}
+
+	// Signing out deletes the session, so the old cookie no longer works
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(laptop)
+	session, _ := store.Get(r, "test")
+	session.Options.MaxAge = -1
+
+	if err = session.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatalf("error ending session: %v", err)
+	}
+
+	if !loadTestSession(store, laptop).IsNew {
+		t.Errorf("expected the session to be gone after signing out")
+	}
+}
+
+func TestSessionStore_RenewChangesTheID(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestSessionStore(newTestDB(t), &now, "secret")
+	planted := saveTestSession(t, store, 0)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(planted)
+	session, _ := store.Get(r, "test")
+
+	if err := store.Renew(session); err != nil {
+		t.Fatalf("error renewing session: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("error saving session: %v", err)
+	}
+
+	if !loadTestSession(store, planted).IsNew {
+		t.Errorf("expected the old ID to stop working")
+	}
+
+	if renewed := loadTestSession(store, w.Result().Cookies()[0]); renewed.IsNew || renewed.Values["name"] != "Ada" {
+		t.Errorf("expected the new ID to keep the values, got %+v", renewed.Values)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build clickhouse
+
+package services
+
+// The ClickHouse driver is only built in with the clickhouse tag.
+import (
+	_ "github.com/ClickHouse/clickhouse-go/v2"
+)
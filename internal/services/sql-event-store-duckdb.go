@@ -0,0 +1,8 @@
+//go:build duckdb
+
+package services
+
+// DuckDB needs cgo, so its driver is only built in with the duckdb tag.
+import (
+	_ "github.com/duckdb/duckdb-go/v2"
+)
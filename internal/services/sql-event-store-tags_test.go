@@ -0,0 +1,16 @@
+//go:build !duckdb && !clickhouse
+
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOpenEventStore_DriverNotBuilt(t *testing.T) {
+	for _, dsn := range []string{"duckdb:", "clickhouse://localhost:9000/aletics"} {
+		if _, err := OpenEventStore(dsn); !errors.Is(err, ErrEventStoreNotBuilt) {
+			t.Errorf("%s: expected ErrEventStoreNotBuilt, got %v", dsn, err)
+		}
+	}
+}
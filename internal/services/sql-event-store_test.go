@@ -0,0 +1,161 @@
+//go:build duckdb
+
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func newTestDuckDBStore(t *testing.T) *SQLEventStore {
+	t.Helper()
+
+	store, err := OpenEventStore("duckdb:")
+
+	if err != nil {
+		t.Fatalf("error opening duckdb: %v", err)
+	}
+
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+/*
+TestSQLEventStore_MatchesGormEventStore records the same events in DuckDB
+and the relational store and expects every report to agree.
+*/
+func TestSQLEventStore_MatchesGormEventStore(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	gormStore := NewGormEventStore(newTestDB(t))
+	duckStore := newTestDuckDBStore(t)
+
+	events := []models.Event{
+		{PropertyID: 1, VisitorID: "a", Path: "/", Browser: "Chrome", Country: "United States", CountryCode: "US"},
+		{PropertyID: 1, VisitorID: "a", Path: "/blog/one", Browser: "Chrome", Country: "United States", CountryCode: "US"},
+		{PropertyID: 1, VisitorID: "b", Path: "/blog/two", Browser: "Firefox", Country: "Germany", CountryCode: "DE"},
+		{PropertyID: 1, VisitorID: "c", Path: "/about_us", Browser: "Safari", Country: "Germany", CountryCode: "DE"},
+		{PropertyID: 1, VisitorID: "", Path: "/", Browser: "Safari", Country: "France", CountryCode: "FR"},
+		{PropertyID: 2, VisitorID: "d", Path: "/", Browser: "Chrome", Country: "France", CountryCode: "FR"},
+	}
+
+	for i, event := range events {
+		event.CreatedAt = now.Add(-time.Duration(i) * 5 * time.Hour)
+		event.Props = []models.EventProp{{Key: "plan", Value: "pro"}}
+		duckEvent := event
+
+		if err := gormStore.RecordEvent(&event); err != nil {
+			t.Fatalf("error recording event: %v", err)
+		}
+
+		if err := duckStore.RecordEvent(&duckEvent); err != nil {
+			t.Fatalf("error recording event in duckdb: %v", err)
+		}
+
+		if duckEvent.ID == 0 {
+			t.Errorf("expected the event ID to be set")
+		}
+	}
+
+	queries := []EventQuery{
+		{PropertyID: 1, Start: now.AddDate(0, 0, -2), End: now, InclusiveEnd: true},
+		{PropertyID: 1, Start: now.AddDate(0, 0, -2), End: now},
+		{PropertyID: 1, Start: now.AddDate(0, 0, -2), End: now, Filters: []models.ReportFilter{{Dimension: "path", Values: []string{"/blog/*"}}}},
+		{PropertyID: 1, Start: now.AddDate(0, 0, -2), End: now, InclusiveEnd: true, Filters: []models.ReportFilter{{Dimension: "path", Values: []string{"/about_*"}}}},
+		{PropertyID: 1, Start: now.AddDate(0, 0, -2), End: now, InclusiveEnd: true, Filters: []models.ReportFilter{{Dimension: "browser", Negate: true, Values: []string{"Chrome"}}}},
+	}
+
+	for i, query := range queries {
+		gormAggregate, err := gormStore.Aggregate(query)
+
+		if err != nil {
+			t.Fatalf("query %d: unexpected error: %v", i, err)
+		}
+
+		duckAggregate, err := duckStore.Aggregate(query)
+
+		if err != nil {
+			t.Fatalf("query %d: unexpected duckdb error: %v", i, err)
+		}
+
+		if gormAggregate != duckAggregate {
+			t.Errorf("query %d: aggregate %+v does not match %+v", i, duckAggregate, gormAggregate)
+		}
+
+		for _, interval := range []string{"hour", "date", "month"} {
+			gormSeries, _ := gormStore.Timeseries(query, interval)
+			duckSeries, err := duckStore.Timeseries(query, interval)
+
+			if err != nil {
+				t.Fatalf("query %d: unexpected duckdb error: %v", i, err)
+			}
+
+			if !reflect.DeepEqual(gormSeries, duckSeries) {
+				t.Errorf("query %d: %s timeseries %+v does not match %+v", i, interval, duckSeries, gormSeries)
+			}
+		}
+
+		for _, dimension := range []string{"path", "browser", "country_code"} {
+			gormBreakdown, _ := gormStore.Breakdown(query, dimension, 2)
+			duckBreakdown, err := duckStore.Breakdown(query, dimension, 2)
+
+			if err != nil {
+				t.Fatalf("query %d: unexpected duckdb error: %v", i, err)
+			}
+
+			if !reflect.DeepEqual(gormBreakdown, duckBreakdown) {
+				t.Errorf("query %d: %s breakdown %+v does not match %+v", i, dimension, duckBreakdown, gormBreakdown)
+			}
+		}
+	}
+}
+
+func TestSQLEventStore_ReportsAndRetention(t *testing.T) {
+	db := newTestDB(t)
+	store := newTestDuckDBStore(t)
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+
+	// Rollup state left over from the relational store must be ignored
+	db.Create(&models.RollupState{Name: "hourly", CompleteThrough: now})
+	db.Create(&models.Property{Name: "Test", Domain: "example.com", Token: "token", RetentionDays: 30})
+
+	for _, age := range []int{40, 31, 1, 0} {
+		event := models.Event{PropertyID: 1, VisitorID: "a", Path: "/"}
+		event.CreatedAt = now.AddDate(0, 0, -age)
+		store.RecordEvent(&event)
+	}
+
+	reports := NewReportService(ReportServiceConfig{DB: db, EventStore: store})
+	aggregate, err := reports.GetAggregate(1, now.AddDate(0, 0, -60), now, nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if aggregate.Pageviews != 4 {
+		t.Errorf("expected 4 pageviews, got %d", aggregate.Pageviews)
+	}
+
+	retention := NewRetentionService(RetentionServiceConfig{DB: db, EventStore: store})
+	result, err := retention.Prune(t.Context(), now)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Deleted != 2 {
+		t.Errorf("expected 2 deleted events, got %d", result.Deleted)
+	}
+
+	summaries, err := retention.ListRetentionSummaries()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(summaries) != 1 || summaries[0].Events != 2 || !summaries[0].OldestEvent.Equal(now.AddDate(0, 0, -1)) {
+		t.Errorf("unexpected summaries: %+v", summaries)
+	}
+}
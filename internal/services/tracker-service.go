@@ -1,29 +1,81 @@
 package services
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"maps"
+	"net/netip"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/adampresley/aletics/internal/models"
 	"gorm.io/gorm"
 )
 
+const (
+	maxEventProps      int           = 30
+	maxEventPropKeyLen int           = 100
+	maxEventPropValLen int           = 500
+	maxEventClockSkew  time.Duration = 5 * time.Minute
+
+	// MaxServerEventBatch is how many events one request to the server
+	// events API may send
+	MaxServerEventBatch int = 100
+)
+
+var (
+	ErrBatchTooLarge = fmt.Errorf("a batch may contain at most %d events", MaxServerEventBatch)
+)
+
 type TrackerService struct {
-	db *gorm.DB
+	db          *gorm.DB
+	eventStore  EventStore
+	geoLocator  *GeoLocator
+	privacyMode bool
+	visitorSalt string
 }
 
 type TrackerServiceConfig struct {
 	DB *gorm.DB
+
+	// EventStore is where events are written. Defaults to the events table
+	// in DB.
+	EventStore EventStore
+	GeoLocator *GeoLocator
+
+	// PrivacyMode truncates every client IP address, including those sent
+	// to the server events API, before it is located or hashed.
+	PrivacyMode bool
+	VisitorSalt string
 }
 
 func NewTrackerService(config TrackerServiceConfig) *TrackerService {
-	return &TrackerService{
-		db: config.DB,
+	result := &TrackerService{
+		db:          config.DB,
+		eventStore:  config.EventStore,
+		geoLocator:  config.GeoLocator,
+		privacyMode: config.PrivacyMode,
+		visitorSalt: config.VisitorSalt,
+	}
+
+	if result.eventStore == nil {
+		result.eventStore = NewGormEventStore(config.DB)
 	}
+
+	return result
 }
 
+/*
+TrackEvent records an event sent by the browser tracker script. The
+property is identified by its public token, or its previous token until
+a rotation's grace period ends. The request origin must match the
+property's domain.
+*/
 func (s *TrackerService) TrackEvent(newEvent models.NewEvent) (*models.Event, error) {
 	var (
 		err       error
@@ -35,7 +87,12 @@ func (s *TrackerService) TrackEvent(newEvent models.NewEvent) (*models.Event, er
 		return nil, fmt.Errorf("property 'token' is required")
 	}
 
-	if err = s.db.Where("token = ?", newEvent.Token).First(&property).Error; err != nil {
+	err = s.db.
+		Where("token = ?", newEvent.Token).
+		Or("previous_token = ? AND previous_token_expires_at > ?", newEvent.Token, time.Now()).
+		First(&property).Error
+
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, errors.New("property not found")
 		}
@@ -60,20 +117,206 @@ func (s *TrackerService) TrackEvent(newEvent models.NewEvent) (*models.Event, er
 		}
 	}
 
+	newEvent.Timestamp = time.Time{}
+	newEvent.Props = nil
+
+	return s.recordEvent(property, newEvent)
+}
+
+/*
+TrackServerEvents records a batch of events sent by a backend or mobile
+app on behalf of its users. Each event is validated and stored on its own,
+so one bad event does not reject the rest of the batch. The returned
+results are in the same order as the events.
+*/
+func (s *TrackerService) TrackServerEvents(property models.Property, serverEvents []models.ServerEvent) ([]models.ServerEventResult, error) {
+	var (
+		err     error
+		event   *models.Event
+		results = make([]models.ServerEventResult, 0, len(serverEvents))
+	)
+
+	if len(serverEvents) > MaxServerEventBatch {
+		return nil, ErrBatchTooLarge
+	}
+
+	if !property.Active {
+		return nil, fmt.Errorf("property is not active")
+	}
+
+	for index, serverEvent := range serverEvents {
+		result := models.ServerEventResult{Index: index}
+
+		if event, err = s.trackServerEvent(property, serverEvent); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.ID = event.ID
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (s *TrackerService) trackServerEvent(property models.Property, serverEvent models.ServerEvent) (*models.Event, error) {
+	var (
+		err      error
+		eventUrl *url.URL
+	)
+
+	if serverEvent.URL == "" {
+		return nil, fmt.Errorf("'url' is required")
+	}
+
+	if eventUrl, err = url.Parse(serverEvent.URL); err != nil || eventUrl.Path == "" && eventUrl.Host == "" {
+		return nil, fmt.Errorf("'url' must be a valid URL")
+	}
+
+	if eventUrl.Hostname() != "" && !strings.EqualFold(eventUrl.Hostname(), property.Domain) {
+		return nil, fmt.Errorf("url host '%s' does not match property domain '%s'", eventUrl.Hostname(), property.Domain)
+	}
+
+	// The address is looked up and hashed, so only a single plain IP
+	// address is accepted
+	if serverEvent.IP != "" {
+		addr, err := netip.ParseAddr(serverEvent.IP)
+
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("'ip' must be a single IP address")
+		}
+
+		serverEvent.IP = addr.Unmap().String()
+	}
+
+	newEvent := models.NewEvent{
+		IP:          serverEvent.IP,
+		UserAgent:   serverEvent.UserAgent,
+		Path:        eventUrl.Path,
+		QueryString: eventUrl.RawQuery,
+		Referrer:    serverEvent.Referrer,
+		Browser:     BrowserFromUserAgent(serverEvent.UserAgent),
+		Props:       serverEvent.Props,
+
+		PrivacySignal: serverEvent.PrivacySignal,
+	}
+
+	if newEvent.Path == "" {
+		newEvent.Path = "/"
+	}
+
+	if serverEvent.Timestamp != nil {
+		if serverEvent.Timestamp.After(time.Now().Add(maxEventClockSkew)) {
+			return nil, fmt.Errorf("'timestamp' cannot be in the future")
+		}
+
+		newEvent.Timestamp = *serverEvent.Timestamp
+	}
+
+	if len(newEvent.Props) > maxEventProps {
+		return nil, fmt.Errorf("an event may have at most %d props", maxEventProps)
+	}
+
+	for key, value := range newEvent.Props {
+		if key == "" || len(key) > maxEventPropKeyLen {
+			return nil, fmt.Errorf("prop keys must be between 1 and %d characters", maxEventPropKeyLen)
+		}
+
+		if len(value) > maxEventPropValLen {
+			return nil, fmt.Errorf("prop '%s' is longer than %d characters", key, maxEventPropValLen)
+		}
+	}
+
+	return s.recordEvent(property, newEvent)
+}
+
+/*
+recordEvent resolves the client's location and anonymous visitor ID, then
+stores the event and its props. Events the property excludes return
+ErrEventExcluded, and the query parameters it strips are removed first.
+
+When the visitor asked not to be tracked and the property honors it, the
+event is either excluded, or stored with only its path, browser and time.
+*/
+func (s *TrackerService) recordEvent(property models.Property, newEvent models.NewEvent) (*models.Event, error) {
+	var (
+		err      error
+		location models.GeoLocation
+	)
+
+	// Exclusions are checked before the address is truncated, so an
+	// excluded host does not also exclude its neighbours
+	if eventExcluded(property, cmp.Or(newEvent.ExclusionIP, newEvent.IP), newEvent.Path) {
+		return nil, ErrEventExcluded
+	}
+
+	if s.privacyMode {
+		newEvent.IP = AnonymizeIP(newEvent.IP)
+	}
+
+	if newEvent.PrivacySignal {
+		switch property.PrivacySignals {
+		case models.PrivacySignalsDrop:
+			return nil, ErrEventExcluded
+
+		case models.PrivacySignalsAnonymize:
+			newEvent.IP = ""
+			newEvent.UserAgent = ""
+			newEvent.QueryString = ""
+			newEvent.Referrer = ""
+			newEvent.Props = nil
+		}
+	}
+
+	if s.geoLocator != nil {
+		location = s.geoLocator.Locate(newEvent.IP)
+	}
+
+	createdAt := newEvent.Timestamp
+
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
 	queryString := newEvent.QueryString
 	queryString = strings.TrimPrefix(queryString, "?")
+	queryString = stripQueryParams(queryString, settingList(property.StrippedQueryParams))
 
 	event := &models.Event{
 		PropertyID:    property.ID,
+		VisitorID:     s.visitorID(property.ID, newEvent.IP, newEvent.UserAgent, createdAt),
 		Path:          newEvent.Path,
 		QueryString:   queryString,
+		Referrer:      newEvent.Referrer,
 		Browser:       newEvent.Browser,
-		Country:       newEvent.Country,
-		CountryCode:   newEvent.CountryCode,
-		Continent:     newEvent.Continent,
-		ContinentCode: newEvent.ContinentCode,
+		Country:       location.Country,
+		CountryCode:   location.CountryCode,
+		Continent:     location.Continent,
+		ContinentCode: location.ContinentCode,
+	}
+
+	event.CreatedAt = createdAt
+
+	for _, key := range slices.Sorted(maps.Keys(newEvent.Props)) {
+		event.Props = append(event.Props, models.EventProp{Key: key, Value: newEvent.Props[key]})
 	}
 
-	err = s.db.Create(event).Error
+	err = s.eventStore.RecordEvent(event)
 	return event, err
 }
+
+/*
+visitorID returns an anonymous identifier used to count unique visitors.
+It is a hash of the client IP and user agent mixed with a secret salt and
+the day of the event, so the same person cannot be followed across days or
+properties, and the IP and user agent themselves are never stored.
+*/
+func (s *TrackerService) visitorID(propertyID uint, ip, userAgent string, at time.Time) string {
+	if ip == "" && userAgent == "" {
+		return ""
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%d|%s|%s", s.visitorSalt, at.UTC().Format("2006-01-02"), propertyID, ip, userAgent)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
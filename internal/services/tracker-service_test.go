@@ -0,0 +1,195 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func TestTrackerService_TrackServerEvents(t *testing.T) {
+	db := newTestDB(t)
+	property := models.Property{Name: "Site", Domain: "example.com", Token: "token", Active: true}
+
+	if err := db.Create(&property).Error; err != nil {
+		t.Fatalf("error creating property: %v", err)
+	}
+
+	svc := NewTrackerService(TrackerServiceConfig{DB: db, VisitorSalt: "salt"})
+	timestamp := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	future := time.Now().Add(time.Hour)
+
+	results, err := svc.TrackServerEvents(property, []models.ServerEvent{
+		{
+			URL:       "https://example.com/pricing?plan=pro",
+			IP:        "203.0.113.7",
+			UserAgent: "Mozilla/5.0 Firefox/130.0",
+			Timestamp: &timestamp,
+			Props:     map[string]string{"plan": "pro", "variant": "b"},
+		},
+		{URL: ""},
+		{URL: "https://other.com/"},
+		{URL: "/signup", Timestamp: &future},
+		{URL: "/signup"},
+		{URL: "/signup", IP: "not an address"},
+		{URL: "/signup", IP: "203.0.113.7, 10.0.0.1"},
+		{URL: "/signup", IP: "fe80::1%eth0"},
+		{URL: "/signup", IP: "2001:db8::1"},
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedErrors := []bool{false, true, true, true, false, true, true, true, false}
+
+	for i, result := range results {
+		if result.Index != i {
+			t.Errorf("result %d: expected index %d, got %d", i, i, result.Index)
+		}
+
+		if (result.Error != "") != expectedErrors[i] {
+			t.Errorf("result %d: unexpected error state %+v", i, result)
+		}
+	}
+
+	var event models.Event
+
+	if err = db.Preload("Props").First(&event, results[0].ID).Error; err != nil {
+		t.Fatalf("error loading event: %v", err)
+	}
+
+	if event.Path != "/pricing" || event.QueryString != "plan=pro" || event.Browser != "Firefox" {
+		t.Errorf("unexpected event fields: %+v", event)
+	}
+
+	if !event.CreatedAt.Equal(timestamp) {
+		t.Errorf("expected created at %s, got %s", timestamp, event.CreatedAt)
+	}
+
+	if event.VisitorID == "" || event.VisitorID == "203.0.113.7" {
+		t.Errorf("expected an anonymous visitor id, got %q", event.VisitorID)
+	}
+
+	if len(event.Props) != 2 || event.Props[0].Key != "plan" || event.Props[1].Value != "b" {
+		t.Errorf("unexpected props: %+v", event.Props)
+	}
+}
+
+func TestTrackerService_TrackServerEvents_InactiveProperty(t *testing.T) {
+	svc := NewTrackerService(TrackerServiceConfig{DB: newTestDB(t)})
+
+	if _, err := svc.TrackServerEvents(models.Property{Domain: "example.com"}, []models.ServerEvent{{URL: "/"}}); err == nil {
+		t.Fatal("expected an error for an inactive property")
+	}
+}
+
+func TestTrackerService_TrackEvent_Exclusions(t *testing.T) {
+	db := newTestDB(t)
+
+	property := models.Property{
+		Name:                "Site",
+		Domain:              "example.com",
+		Token:               "token",
+		Active:              true,
+		ExcludedIPs:         "203.0.113.7\n10.0.0.0/8",
+		ExcludedPaths:       "/admin*\n/preview",
+		StrippedQueryParams: "token\nEmail",
+	}
+
+	if err := db.Create(&property).Error; err != nil {
+		t.Fatalf("error creating property: %v", err)
+	}
+
+	svc := NewTrackerService(TrackerServiceConfig{DB: db, VisitorSalt: "salt"})
+
+	tests := []struct {
+		name      string
+		event     models.NewEvent
+		excluded  bool
+		wantQuery string
+	}{
+		{"excluded ip", models.NewEvent{IP: "203.0.113.7", Path: "/"}, true, ""},
+		{"excluded range", models.NewEvent{IP: "10.1.2.3", Path: "/"}, true, ""},
+		{"excluded path prefix", models.NewEvent{IP: "198.51.100.1", Path: "/admin/users/1"}, true, ""},
+		{"excluded exact path", models.NewEvent{IP: "198.51.100.1", Path: "/preview"}, true, ""},
+		{"similar path", models.NewEvent{IP: "198.51.100.1", Path: "/preview/post"}, false, ""},
+		{"stripped params", models.NewEvent{IP: "198.51.100.1", Path: "/", QueryString: "?utm_source=x&token=abc&EMAIL=a%40b.com&page=2"}, false, "utm_source=x&page=2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event.Token = property.Token
+			event, err := svc.TrackEvent(tt.event)
+
+			if tt.excluded {
+				if !errors.Is(err, ErrEventExcluded) {
+					t.Errorf("expected ErrEventExcluded, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if event.QueryString != tt.wantQuery {
+				t.Errorf("expected query string %q, got %q", tt.wantQuery, event.QueryString)
+			}
+		})
+	}
+}
+
+func TestTrackerService_TrackEvent_PrivacySignals(t *testing.T) {
+	db := newTestDB(t)
+	svc := NewTrackerService(TrackerServiceConfig{DB: db, VisitorSalt: "salt"})
+
+	tests := []struct {
+		mode      models.PrivacySignalMode
+		signal    bool
+		dropped   bool
+		anonymous bool
+	}{
+		{models.PrivacySignalsIgnore, true, false, false},
+		{models.PrivacySignalsAnonymize, false, false, false},
+		{models.PrivacySignalsAnonymize, true, false, true},
+		{models.PrivacySignalsDrop, false, false, false},
+		{models.PrivacySignalsDrop, true, true, false},
+	}
+
+	for i, tt := range tests {
+		property := models.Property{Name: "Site", Domain: "example.com", Token: fmt.Sprintf("token-%d", i), Active: true, PrivacySignals: tt.mode}
+
+		if err := db.Create(&property).Error; err != nil {
+			t.Fatalf("error creating property: %v", err)
+		}
+
+		event, err := svc.TrackEvent(models.NewEvent{
+			Token:         property.Token,
+			IP:            "203.0.113.7",
+			UserAgent:     "Mozilla/5.0 Firefox/130.0",
+			Path:          "/pricing",
+			QueryString:   "plan=pro",
+			PrivacySignal: tt.signal,
+		})
+
+		if tt.dropped {
+			if !errors.Is(err, ErrEventExcluded) {
+				t.Errorf("%q with signal %v: expected the event to be dropped, got %v", tt.mode, tt.signal, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q with signal %v: unexpected error: %v", tt.mode, tt.signal, err)
+		}
+
+		if anonymous := event.VisitorID == "" && event.QueryString == ""; anonymous != tt.anonymous || event.Path != "/pricing" {
+			t.Errorf("%q with signal %v: expected anonymous %v, got %+v", tt.mode, tt.signal, tt.anonymous, event)
+		}
+	}
+}
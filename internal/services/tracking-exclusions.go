@@ -0,0 +1,168 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+const (
+	maxTrackingSettingLen int = 2000
+)
+
+var (
+	ErrEventExcluded          = errors.New("event excluded by the property's settings")
+	ErrInvalidExcludedIP      = errors.New("excluded IPs must be IP addresses or CIDR ranges")
+	ErrInvalidExcludedPath    = errors.New("excluded paths must start with /")
+	ErrInvalidPrivacySignals  = errors.New("invalid privacy signal setting")
+	ErrTrackingSettingTooLong = fmt.Errorf("exclusion lists may be at most %d characters", maxTrackingSettingLen)
+)
+
+/*
+normalizeTrackingSettings rewrites a property's exclusion lists with one
+entry per line, and checks that every entry and its privacy signal setting
+are valid.
+*/
+func normalizeTrackingSettings(property *models.Property) error {
+	if !property.PrivacySignals.Valid() {
+		return ErrInvalidPrivacySignals
+	}
+
+	for _, ip := range settingList(property.ExcludedIPs) {
+		if _, err := netip.ParsePrefix(ip); err == nil {
+			continue
+		}
+
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return fmt.Errorf("%w: '%s'", ErrInvalidExcludedIP, ip)
+		}
+	}
+
+	for _, pattern := range settingList(property.ExcludedPaths) {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("%w: '%s'", ErrInvalidExcludedPath, pattern)
+		}
+	}
+
+	property.ExcludedIPs = strings.Join(settingList(property.ExcludedIPs), "\n")
+	property.ExcludedPaths = strings.Join(settingList(property.ExcludedPaths), "\n")
+	property.StrippedQueryParams = strings.Join(settingList(property.StrippedQueryParams), "\n")
+
+	for _, value := range []string{property.ExcludedIPs, property.ExcludedPaths, property.StrippedQueryParams} {
+		if len(value) > maxTrackingSettingLen {
+			return ErrTrackingSettingTooLong
+		}
+	}
+
+	return nil
+}
+
+// settingList splits a list setting into its entries, which are separated by lines or commas.
+func settingList(value string) []string {
+	result := []string{}
+
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == '\r' || r == ',' }) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+// eventExcluded returns true when an event from ip for path must not be recorded.
+func eventExcluded(property models.Property, ip, path string) bool {
+	return ipExcluded(settingList(property.ExcludedIPs), ip) ||
+		slices.ContainsFunc(settingList(property.ExcludedPaths), func(pattern string) bool { return pathMatches(pattern, path) })
+}
+
+// ipExcluded returns true when ip is one of entries, or inside one of their ranges.
+func ipExcluded(entries []string, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+
+	for _, entry := range entries {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			if prefix.Contains(addr) {
+				return true
+			}
+
+			continue
+		}
+
+		if excluded, err := netip.ParseAddr(entry); err == nil && excluded.Unmap() == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+pathMatches compares a path with a pattern in which * matches any run of
+characters, slashes included, so /admin* matches /admin and everything
+under it. Without a *, the whole path must match.
+*/
+func pathMatches(pattern, path string) bool {
+	parts := strings.Split(pattern, "*")
+
+	if len(parts) == 1 {
+		return pattern == path
+	}
+
+	last := parts[len(parts)-1]
+
+	if len(path) < len(parts[0])+len(last) || !strings.HasPrefix(path, parts[0]) || !strings.HasSuffix(path, last) {
+		return false
+	}
+
+	rest := path[len(parts[0]) : len(path)-len(last)]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(rest, part)
+
+		if index < 0 {
+			return false
+		}
+
+		rest = rest[index+len(part):]
+	}
+
+	return true
+}
+
+/*
+stripQueryParams removes the named parameters from a query string, in any
+case. The rest of the query string is kept exactly as it was sent.
+*/
+func stripQueryParams(query string, params []string) string {
+	if query == "" || len(params) == 0 {
+		return query
+	}
+
+	kept := []string{}
+
+	for pair := range strings.SplitSeq(query, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+
+		if !slices.ContainsFunc(params, func(param string) bool { return strings.EqualFold(param, key) }) {
+			kept = append(kept, pair)
+		}
+	}
+
+	return strings.Join(kept, "&")
+}
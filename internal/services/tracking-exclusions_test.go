@@ -0,0 +1,57 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func TestPathMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/admin", "/admin", true},
+		{"/admin", "/admin/users", false},
+		{"/admin*", "/admin", true},
+		{"/admin*", "/admin/users/1", true},
+		{"/admin*", "/blog/admin", false},
+		{"*/edit", "/posts/1/edit", true},
+		{"/posts/*/edit", "/posts/1/edit", true},
+		{"/posts/*/edit", "/posts/1/delete", false},
+		{"/a*b*a", "/aba", true},
+		{"/a*a", "/a", false},
+	}
+
+	for _, tt := range tests {
+		if got := pathMatches(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("pathMatches(%q, %q): expected %v, got %v", tt.pattern, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestNormalizeTrackingSettings(t *testing.T) {
+	property := models.Property{
+		ExcludedIPs:         " 203.0.113.7, 10.0.0.0/8\r\n\r\n::1 ",
+		ExcludedPaths:       "/admin*\n",
+		StrippedQueryParams: "token,email",
+	}
+
+	if err := normalizeTrackingSettings(&property); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if property.ExcludedIPs != "203.0.113.7\n10.0.0.0/8\n::1" || property.ExcludedPaths != "/admin*" || property.StrippedQueryParams != "token\nemail" {
+		t.Errorf("expected one entry per line, got %+v", property)
+	}
+
+	if err := normalizeTrackingSettings(&models.Property{ExcludedIPs: "10.0.0.300"}); !errors.Is(err, ErrInvalidExcludedIP) {
+		t.Errorf("expected ErrInvalidExcludedIP, got %v", err)
+	}
+
+	if err := normalizeTrackingSettings(&models.Property{ExcludedPaths: "admin"}); !errors.Is(err, ErrInvalidExcludedPath) {
+		t.Errorf("expected ErrInvalidExcludedPath, got %v", err)
+	}
+}
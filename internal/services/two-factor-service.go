@@ -0,0 +1,400 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+const (
+	totpPeriod uint = 30
+
+	// totpSkew accepts codes from one step either side of now, for clocks
+	// that are slightly off
+	totpSkew int64 = 1
+
+	recoveryCodeCount int = 10
+)
+
+var (
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotStarted  = errors.New("two-factor enrollment has not been started")
+)
+
+type TwoFactorServiceConfig struct {
+	DB *gorm.DB
+
+	// Issuer is the name authenticator apps show next to the code.
+	Issuer string
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+/*
+TwoFactorService manages TOTP two-factor authentication. Users enroll by
+scanning a QR code into an authenticator app and entering the first code
+it shows. They then get one-time recovery codes for when they lose it.
+*/
+type TwoFactorService struct {
+	db     *gorm.DB
+	issuer string
+	now    func() time.Time
+}
+
+/*
+TOTPEnrollment is what someone needs to add their account to an
+authenticator app, either by scanning the QR code or typing the secret.
+*/
+type TOTPEnrollment struct {
+	Secret    string
+	URL       string
+	QRCodePNG []byte
+}
+
+func NewTwoFactorService(config TwoFactorServiceConfig) *TwoFactorService {
+	now := config.Now
+
+	if now == nil {
+		now = time.Now
+	}
+
+	return &TwoFactorService{
+		db:     config.DB,
+		issuer: config.Issuer,
+		now:    now,
+	}
+}
+
+/*
+StartEnrollment gives a user a TOTP secret to add to their authenticator
+app. It does not take effect until EnableTwoFactor is called with a code
+from the app. Calling it again before then returns the same secret.
+*/
+func (s *TwoFactorService) StartEnrollment(user models.User) (TOTPEnrollment, error) {
+	var (
+		err    error
+		key    *otp.Key
+		secret []byte
+	)
+
+	if user.TwoFactorEnabled() {
+		return TOTPEnrollment{}, ErrTwoFactorEnabled
+	}
+
+	opts := totp.GenerateOpts{
+		Issuer:      s.issuer,
+		AccountName: user.Email,
+		Period:      totpPeriod,
+	}
+
+	if user.TOTPSecret != "" {
+		if secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(user.TOTPSecret); err != nil {
+			return TOTPEnrollment{}, fmt.Errorf("error decoding TOTP secret: %w", err)
+		}
+
+		opts.Secret = secret
+	}
+
+	if key, err = totp.Generate(opts); err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("error generating TOTP secret: %w", err)
+	}
+
+	if user.TOTPSecret == "" {
+		if err = s.db.Model(&models.User{}).Where("id = ?", user.ID).Update("totp_secret", key.Secret()).Error; err != nil {
+			return TOTPEnrollment{}, fmt.Errorf("error saving TOTP secret: %w", err)
+		}
+	}
+
+	image, err := key.Image(256, 256)
+
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("error drawing QR code: %w", err)
+	}
+
+	qrCode := bytes.Buffer{}
+
+	if err = png.Encode(&qrCode, image); err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("error encoding QR code: %w", err)
+	}
+
+	return TOTPEnrollment{
+		Secret:    key.Secret(),
+		URL:       key.URL(),
+		QRCodePNG: qrCode.Bytes(),
+	}, nil
+}
+
+/*
+EnableTwoFactor finishes enrolling once the user enters a code from their
+authenticator app. It returns their recovery codes, which are only ever
+shown this once.
+*/
+func (s *TwoFactorService) EnableTwoFactor(userID uint, code string) ([]string, error) {
+	var (
+		err           error
+		user          models.User
+		step          int64
+		recoveryCodes []string
+	)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err = tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		if user.TwoFactorEnabled() {
+			return ErrTwoFactorEnabled
+		}
+
+		if user.TOTPSecret == "" {
+			return ErrTwoFactorNotStarted
+		}
+
+		if step, err = s.matchTOTP(user, code); err != nil {
+			return err
+		}
+
+		err = tx.Model(&user).Updates(map[string]any{
+			"totp_enabled_at": s.now(),
+			"totp_last_step":  step,
+		}).Error
+
+		if err != nil {
+			return err
+		}
+
+		recoveryCodes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, nil
+}
+
+/*
+DisableTwoFactor removes a user's second factor and recovery codes. Admins
+use this for users who have lost both.
+*/
+func (s *TwoFactorService) DisableTwoFactor(userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]any{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+/*
+RegenerateRecoveryCodes replaces a user's recovery codes with new ones,
+for when they have used most of them or think they have leaked.
+*/
+func (s *TwoFactorService) RegenerateRecoveryCodes(userID uint) ([]string, error) {
+	var (
+		err           error
+		user          models.User
+		recoveryCodes []string
+	)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err = tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		if !user.TwoFactorEnabled() {
+			return ErrTwoFactorNotEnabled
+		}
+
+		recoveryCodes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, nil
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes a user has.
+func (s *TwoFactorService) RemainingRecoveryCodes(userID uint) (int64, error) {
+	var (
+		err   error
+		count int64
+	)
+
+	err = s.db.
+		Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&count).Error
+
+	return count, err
+}
+
+/*
+Verify checks the second factor of someone signing in. The code is either
+from their authenticator app or one of their recovery codes. Each code
+only works once. Any wrong code returns ErrInvalidTwoFactorCode.
+*/
+func (s *TwoFactorService) Verify(userID uint, code string) error {
+	var (
+		err  error
+		user models.User
+		step int64
+	)
+
+	if err = s.db.First(&user, userID).Error; err != nil {
+		return err
+	}
+
+	if !user.TwoFactorEnabled() {
+		return ErrTwoFactorNotEnabled
+	}
+
+	code = normalizeTwoFactorCode(code)
+
+	if len(code) != int(otp.DigitsSix) {
+		return s.useRecoveryCode(userID, code)
+	}
+
+	if step, err = s.matchTOTP(user, code); err != nil {
+		return err
+	}
+
+	// Only one request can move the step forward, so a code that is
+	// sent twice at once is still only accepted once
+	result := s.db.
+		Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+/*
+matchTOTP returns the time step of a valid code from the user's app that
+is newer than the last one they used.
+*/
+func (s *TwoFactorService) matchTOTP(user models.User, code string) (int64, error) {
+	code = normalizeTwoFactorCode(code)
+	now := s.now()
+	current := now.Unix() / int64(totpPeriod)
+
+	for offset := -totpSkew; offset <= totpSkew; offset++ {
+		step := current + offset
+
+		if step <= user.TOTPLastStep {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(user.TOTPSecret, time.Unix(step*int64(totpPeriod), 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+
+		if err != nil {
+			return 0, fmt.Errorf("error generating TOTP code: %w", err)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+
+	return 0, ErrInvalidTwoFactorCode
+}
+
+func (s *TwoFactorService) useRecoveryCode(userID uint, code string) error {
+	if code == "" {
+		return ErrInvalidTwoFactorCode
+	}
+
+	result := s.db.
+		Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashSecret(code)).
+		Update("used_at", s.now())
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	var (
+		err   error
+		codes = make([]string, 0, recoveryCodeCount)
+	)
+
+	if err = tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	records := make([]models.RecoveryCode, 0, recoveryCodeCount)
+
+	for range recoveryCodeCount {
+		code := newRecoveryCode()
+		codes = append(codes, code)
+		records = append(records, models.RecoveryCode{UserID: userID, CodeHash: hashSecret(normalizeTwoFactorCode(code))})
+	}
+
+	if err = tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// newRecoveryCode returns a random code like "k7q2m-xw4rt".
+func newRecoveryCode() string {
+	text := strings.ToLower(rand.Text())
+	return text[:5] + "-" + text[5:10]
+}
+
+// normalizeTwoFactorCode ignores case, spaces and dashes people type.
+func normalizeTwoFactorCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
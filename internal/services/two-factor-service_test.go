@@ -0,0 +1,167 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/pquerna/otp/totp"
+)
+
+// newTwoFactorTestData returns a service whose clock the test controls, and a user.
+func newTwoFactorTestData(t *testing.T) (*TwoFactorService, *UserService, *time.Time, models.User) {
+	t.Helper()
+
+	db := newTestDB(t)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	users := NewUserService(UserServiceConfig{DB: db})
+
+	svc := NewTwoFactorService(TwoFactorServiceConfig{
+		DB:     db,
+		Issuer: "Aletics",
+		Now:    func() time.Time { return now },
+	})
+
+	user, err := users.CreateFirstAdmin(models.User{Email: "ada@example.com"}, "correct horse")
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+
+	return svc, users, &now, user
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.GenerateCode(secret, at)
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+
+	return code
+}
+
+func TestTwoFactorService_Enroll(t *testing.T) {
+	svc, users, now, user := newTwoFactorTestData(t)
+
+	enrollment, err := svc.StartEnrollment(user)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if enrollment.Secret == "" || len(enrollment.QRCodePNG) == 0 || !strings.HasPrefix(enrollment.URL, "otpauth://totp/Aletics:ada@example.com") {
+		t.Errorf("expected a secret, QR code and otpauth URL, got %+v", enrollment)
+	}
+
+	// Reloading the page shows the same secret until enrollment is finished
+	user, _ = users.GetUser(user.ID)
+	again, _ := svc.StartEnrollment(user)
+
+	if again.Secret != enrollment.Secret {
+		t.Errorf("expected the pending secret to be reused")
+	}
+
+	if _, err = svc.EnableTwoFactor(user.ID, "000000"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected ErrInvalidTwoFactorCode, got %v", err)
+	}
+
+	recoveryCodes, err := svc.EnableTwoFactor(user.ID, totpCode(t, enrollment.Secret, *now))
+	if err != nil {
+		t.Fatalf("unexpected error enabling: %v", err)
+	}
+
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %v", recoveryCodeCount, recoveryCodes)
+	}
+
+	if user, _ = users.GetUser(user.ID); !user.TwoFactorEnabled() {
+		t.Error("expected two-factor authentication to be enabled")
+	}
+
+	if _, err = svc.StartEnrollment(user); !errors.Is(err, ErrTwoFactorEnabled) {
+		t.Errorf("expected ErrTwoFactorEnabled, got %v", err)
+	}
+}
+
+func TestTwoFactorService_Verify(t *testing.T) {
+	svc, users, now, user := newTwoFactorTestData(t)
+	enrollment, _ := svc.StartEnrollment(user)
+	recoveryCodes, _ := svc.EnableTwoFactor(user.ID, totpCode(t, enrollment.Secret, *now))
+
+	// The code used to enroll cannot be used again
+	if err := svc.Verify(user.ID, totpCode(t, enrollment.Secret, *now)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected a replayed code to fail, got %v", err)
+	}
+
+	*now = now.Add(30 * time.Second)
+
+	if err := svc.Verify(user.ID, " "+totpCode(t, enrollment.Secret, *now)+" "); err != nil {
+		t.Errorf("expected the next code to work, got %v", err)
+	}
+
+	*now = now.Add(5 * time.Minute)
+
+	if err := svc.Verify(user.ID, totpCode(t, enrollment.Secret, now.Add(-30*time.Second))); err != nil {
+		t.Errorf("expected a code from a slightly slow clock to work, got %v", err)
+	}
+
+	if err := svc.Verify(user.ID, totpCode(t, enrollment.Secret, now.Add(-2*time.Minute))); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected an old code to fail, got %v", err)
+	}
+
+	if err := svc.Verify(user.ID, strings.ToUpper(recoveryCodes[0])); err != nil {
+		t.Errorf("expected a recovery code to work, got %v", err)
+	}
+
+	if err := svc.Verify(user.ID, recoveryCodes[0]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected a used recovery code to fail, got %v", err)
+	}
+
+	if remaining, _ := svc.RemainingRecoveryCodes(user.ID); remaining != int64(recoveryCodeCount-1) {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, remaining)
+	}
+
+	other, _ := users.CreateUser(models.User{Email: "bob@example.com"}, "correct horse")
+
+	if err := svc.Verify(other.ID, recoveryCodes[1]); !errors.Is(err, ErrTwoFactorNotEnabled) {
+		t.Errorf("expected ErrTwoFactorNotEnabled, got %v", err)
+	}
+}
+
+func TestTwoFactorService_RecoveryCodesAndDisable(t *testing.T) {
+	svc, users, now, user := newTwoFactorTestData(t)
+	enrollment, _ := svc.StartEnrollment(user)
+	oldCodes, _ := svc.EnableTwoFactor(user.ID, totpCode(t, enrollment.Secret, *now))
+
+	newCodes, err := svc.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err = svc.Verify(user.ID, oldCodes[0]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected old recovery codes to stop working, got %v", err)
+	}
+
+	if err = svc.Verify(user.ID, newCodes[0]); err != nil {
+		t.Errorf("expected new recovery codes to work, got %v", err)
+	}
+
+	if err = svc.DisableTwoFactor(user.ID); err != nil {
+		t.Fatalf("unexpected error disabling: %v", err)
+	}
+
+	if user, _ = users.GetUser(user.ID); user.TwoFactorEnabled() || user.TOTPSecret != "" {
+		t.Errorf("expected two-factor authentication to be removed, got %+v", user)
+	}
+
+	if remaining, _ := svc.RemainingRecoveryCodes(user.ID); remaining != 0 {
+		t.Errorf("expected recovery codes to be removed, got %d", remaining)
+	}
+
+	// Enrolling again starts with a new secret
+	if enrollment2, _ := svc.StartEnrollment(user); enrollment2.Secret == enrollment.Secret {
+		t.Error("expected a new secret")
+	}
+}
@@ -0,0 +1,25 @@
+package services
+
+import "strings"
+
+/*
+BrowserFromUserAgent returns a browser name for a user agent string. It
+uses the same rules as the browser tracker script so events from both
+sources group together.
+*/
+func BrowserFromUserAgent(ua string) string {
+	switch {
+	case ua == "":
+		return "Unknown"
+	case strings.Contains(ua, "Firefox"):
+		return "Firefox"
+	case strings.Contains(ua, "Edg"):
+		return "Edge"
+	case strings.Contains(ua, "Chrome"):
+		return "Chrome"
+	case strings.Contains(ua, "Safari"):
+		return "Safari"
+	}
+
+	return "Unknown"
+}
@@ -0,0 +1,482 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	minPasswordLength int = 8
+
+	// bcrypt ignores everything after the first 72 bytes of a password
+	maxPasswordBytes int = 72
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrEmailTaken         = errors.New("a user with that email already exists")
+	ErrPasswordTooShort   = fmt.Errorf("passwords must be at least %d characters", minPasswordLength)
+	ErrPasswordTooLong    = fmt.Errorf("passwords must be at most %d bytes", maxPasswordBytes)
+	ErrLastAdmin          = errors.New("there must be at least one admin")
+	ErrSetupComplete      = errors.New("the first admin has already been created")
+)
+
+/*
+dummyPasswordHash is compared against when someone signs in with an email
+that does not exist, so that the response takes as long as a wrong
+password and does not reveal which emails have accounts.
+*/
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	return hash
+})
+
+type UserServiceConfig struct {
+	DB *gorm.DB
+}
+
+type UserService struct {
+	db *gorm.DB
+}
+
+func NewUserService(config UserServiceConfig) *UserService {
+	return &UserService{
+		db: config.DB,
+	}
+}
+
+/*
+HasAdmin returns true once a server admin exists. Until then first-run
+setup stays open, even when people have signed in with single sign-on.
+*/
+func (s *UserService) HasAdmin() (bool, error) {
+	var (
+		err   error
+		count int64
+	)
+
+	if err = s.db.Model(&models.User{}).Where("is_admin = ?", true).Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (s *UserService) ListUsers() ([]models.User, error) {
+	var (
+		err   error
+		users []models.User
+	)
+
+	if err = s.db.Order("LOWER(email) asc").Find(&users).Error; err != nil {
+		return []models.User{}, err
+	}
+
+	return users, nil
+}
+
+func (s *UserService) GetUser(id uint) (models.User, error) {
+	var (
+		err  error
+		user models.User
+	)
+
+	if err = s.db.First(&user, id).Error; err != nil {
+		return models.User{}, err
+	}
+
+	return user, nil
+}
+
+// GetUserByEmail finds a user by email, ignoring case.
+func (s *UserService) GetUserByEmail(email string) (models.User, error) {
+	var (
+		err  error
+		user models.User
+	)
+
+	if err = s.db.Where("email = ?", strings.ToLower(strings.TrimSpace(email))).First(&user).Error; err != nil {
+		return models.User{}, err
+	}
+
+	return user, nil
+}
+
+/*
+CreateUser adds a user who signs in with the given password. Emails are
+compared case-insensitively.
+*/
+func (s *UserService) CreateUser(user models.User, password string) (models.User, error) {
+	return s.createUser(s.db, user, password)
+}
+
+/*
+CreateFirstAdmin creates the initial admin during first-run setup. It
+fails with ErrSetupComplete if an admin already exists.
+*/
+func (s *UserService) CreateFirstAdmin(user models.User, password string) (models.User, error) {
+	var (
+		err     error
+		created models.User
+	)
+
+	user.IsAdmin = true
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+
+		if err := tx.Model(&models.User{}).Where("is_admin = ?", true).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return ErrSetupComplete
+		}
+
+		created, err = s.createUser(tx, user, password)
+		return err
+	})
+
+	return created, err
+}
+
+func (s *UserService) createUser(db *gorm.DB, user models.User, password string) (models.User, error) {
+	var (
+		err   error
+		hash  []byte
+		count int64
+	)
+
+	if user.Email, err = normalizeEmail(user.Email); err != nil {
+		return models.User{}, err
+	}
+
+	if hash, err = hashPassword(password); err != nil {
+		return models.User{}, err
+	}
+
+	// Emails are unique across soft deleted users too
+	if err = db.Unscoped().Model(&models.User{}).Where("email = ?", user.Email).Count(&count).Error; err != nil {
+		return models.User{}, err
+	}
+
+	if count > 0 {
+		return models.User{}, ErrEmailTaken
+	}
+
+	user.Name = strings.TrimSpace(user.Name)
+	user.PasswordHash = string(hash)
+
+	if err = db.Create(&user).Error; err != nil {
+		return models.User{}, err
+	}
+
+	return user, nil
+}
+
+/*
+UpdateUser changes a user's email, name and admin flag, and their password
+if one is given. The last admin cannot be demoted.
+*/
+func (s *UserService) UpdateUser(id uint, user models.User, password string) error {
+	var (
+		err      error
+		existing models.User
+		count    int64
+		hash     []byte
+	)
+
+	if user.Email, err = normalizeEmail(user.Email); err != nil {
+		return err
+	}
+
+	if password != "" {
+		if hash, err = hashPassword(password); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err = tx.First(&existing, id).Error; err != nil {
+			return err
+		}
+
+		if err = tx.Unscoped().Model(&models.User{}).Where("email = ? AND id <> ?", user.Email, id).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return ErrEmailTaken
+		}
+
+		if existing.IsAdmin && !user.IsAdmin {
+			if err = ensureAnotherAdmin(tx, id); err != nil {
+				return err
+			}
+		}
+
+		existing.Email = user.Email
+		existing.Name = strings.TrimSpace(user.Name)
+		existing.IsAdmin = user.IsAdmin
+
+		if hash != nil {
+			existing.PasswordHash = string(hash)
+		}
+
+		return tx.Save(&existing).Error
+	})
+}
+
+func (s *UserService) SetPassword(id uint, password string) error {
+	var (
+		err  error
+		hash []byte
+	)
+
+	if hash, err = hashPassword(password); err != nil {
+		return err
+	}
+
+	result := s.db.Model(&models.User{}).Where("id = ?", id).Update("password_hash", string(hash))
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+/*
+DeleteUser removes a user for good, so that their email can be used
+again, along with their roles and recovery codes. Their API keys are revoked. The last
+admin cannot be deleted.
+*/
+func (s *UserService) DeleteUser(id uint) error {
+	var (
+		err  error
+		user models.User
+	)
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err = tx.First(&user, id).Error; err != nil {
+			return err
+		}
+
+		if user.IsAdmin {
+			if err = ensureAnotherAdmin(tx, id); err != nil {
+				return err
+			}
+		}
+
+		if err = tx.Where("user_id = ?", id).Delete(&models.PropertyRole{}).Error; err != nil {
+			return err
+		}
+
+		if err = tx.Where("user_id = ?", id).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		if err = tx.Where("user_id = ?", id).Delete(&models.Session{}).Error; err != nil {
+			return err
+		}
+
+		err = tx.
+			Model(&models.APIKey{}).
+			Where("user_id = ? AND revoked_at IS NULL", id).
+			Update("revoked_at", time.Now()).Error
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&user).Error
+	})
+}
+
+/*
+Authenticate checks an email and password. On success the user's last
+login time is updated. Any failure that is the caller's fault returns
+ErrInvalidCredentials.
+*/
+func (s *UserService) Authenticate(email, password string) (models.User, error) {
+	var (
+		err  error
+		user models.User
+	)
+
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	if err = s.db.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+			return models.User{}, ErrInvalidCredentials
+		}
+
+		return models.User{}, fmt.Errorf("error retrieving user: %w", err)
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return models.User{}, ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	user.LastLoginAt = &now
+
+	if err = s.db.Model(&user).Update("last_login_at", now).Error; err != nil {
+		return models.User{}, fmt.Errorf("error updating last login time: %w", err)
+	}
+
+	return user, nil
+}
+
+/*
+ExternalIdentity is a user as described by a single sign-on provider. The
+Email must have been verified by the provider. IsAdmin is nil when the
+provider does not decide who is a server admin.
+*/
+type ExternalIdentity struct {
+	Subject string
+	Email   string
+	Name    string
+	IsAdmin *bool
+}
+
+/*
+SignInExternal returns the local user for someone who signed in with a
+single sign-on provider. They are found by their subject, then by email,
+in which case the account is linked to the subject. If there is no such
+user, one is created without a password and without any roles. Nobody
+becomes an admin by signing in first, as anyone with an account at the
+provider may be able to, so the first admin is created with the setup
+token unless the provider decides who is an admin.
+*/
+func (s *UserService) SignInExternal(identity ExternalIdentity) (models.User, error) {
+	var (
+		err  error
+		user models.User
+	)
+
+	if identity.Subject == "" {
+		return models.User{}, errors.New("missing subject")
+	}
+
+	if identity.Email, err = normalizeEmail(identity.Email); err != nil {
+		return models.User{}, err
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("oidc_subject = ?", identity.Subject).First(&user).Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = tx.Where("email = ? AND oidc_subject IS NULL", identity.Email).First(&user).Error
+		}
+
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			// The email belongs to a user linked to another subject, or to a
+			// soft deleted one
+			var count int64
+
+			if err = tx.Unscoped().Model(&models.User{}).Where("email = ?", identity.Email).Count(&count).Error; err != nil {
+				return err
+			}
+
+			if count > 0 {
+				return ErrEmailTaken
+			}
+
+			user = models.User{Email: identity.Email, Name: strings.TrimSpace(identity.Name)}
+
+		case err != nil:
+			return err
+		}
+
+		user.OIDCSubject = &identity.Subject
+		now := time.Now()
+		user.LastLoginAt = &now
+
+		if identity.IsAdmin != nil && *identity.IsAdmin != user.IsAdmin {
+			user.IsAdmin = *identity.IsAdmin
+
+			// Never demote the last admin, or nobody could manage users
+			if !user.IsAdmin && user.ID != 0 && errors.Is(ensureAnotherAdmin(tx, user.ID), ErrLastAdmin) {
+				user.IsAdmin = true
+			}
+		}
+
+		return tx.Save(&user).Error
+	})
+
+	if err != nil {
+		return models.User{}, err
+	}
+
+	return user, nil
+}
+
+// ensureAnotherAdmin returns ErrLastAdmin if the given user is the only admin.
+func ensureAnotherAdmin(tx *gorm.DB, id uint) error {
+	var (
+		err   error
+		count int64
+	)
+
+	if err = tx.Model(&models.User{}).Where("is_admin = ? AND id <> ?", true, id).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrLastAdmin
+	}
+
+	return nil
+}
+
+func normalizeEmail(email string) (string, error) {
+	var (
+		err     error
+		address *mail.Address
+	)
+
+	email = strings.TrimSpace(email)
+
+	if address, err = mail.ParseAddress(email); err != nil || address.Address != email {
+		return "", ErrInvalidEmail
+	}
+
+	return strings.ToLower(email), nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len([]rune(password)) < minPasswordLength {
+		return nil, ErrPasswordTooShort
+	}
+
+	if len(password) > maxPasswordBytes {
+		return nil, ErrPasswordTooLong
+	}
+
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+/*
+NewSetupToken returns a random token for first-run setup. Whoever creates
+the first admin must enter it, so that a freshly started server cannot be
+claimed by anyone who happens to find it first.
+*/
+func NewSetupToken() (string, error) {
+	return generateSecret("")
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+func TestUserService_CreateAndAuthenticate(t *testing.T) {
+	svc := NewUserService(UserServiceConfig{DB: newTestDB(t)})
+
+	user, err := svc.CreateUser(models.User{Email: " Ada@Example.com ", Name: "Ada"}, "correct horse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if user.Email != "ada@example.com" {
+		t.Errorf("expected email to be normalized, got %q", user.Email)
+	}
+
+	if user.PasswordHash == "" || strings.Contains(user.PasswordHash, "correct horse") {
+		t.Error("expected only a hash of the password to be stored")
+	}
+
+	authenticated, err := svc.Authenticate("ADA@example.com", "correct horse")
+	if err != nil {
+		t.Fatalf("unexpected error authenticating: %v", err)
+	}
+
+	if authenticated.ID != user.ID || authenticated.LastLoginAt == nil {
+		t.Errorf("expected user %d with a last login time, got %+v", user.ID, authenticated)
+	}
+
+	for _, credentials := range [][2]string{{"ada@example.com", "wrong horse"}, {"bob@example.com", "correct horse"}} {
+		if _, err = svc.Authenticate(credentials[0], credentials[1]); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%v: expected ErrInvalidCredentials, got %v", credentials, err)
+		}
+	}
+}
+
+func TestUserService_Validation(t *testing.T) {
+	svc := NewUserService(UserServiceConfig{DB: newTestDB(t)})
+
+	if _, err := svc.CreateUser(models.User{Email: "ada@example.com"}, "correct horse"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		email    string
+		password string
+		want     error
+	}{
+		{"not an email", "correct horse", ErrInvalidEmail},
+		{"Ada <ada@example.com>", "correct horse", ErrInvalidEmail},
+		{"bob@example.com", "short", ErrPasswordTooShort},
+		{"bob@example.com", strings.Repeat("a", 73), ErrPasswordTooLong},
+		{"ADA@example.com", "correct horse", ErrEmailTaken},
+	}
+
+	for _, tt := range tests {
+		if _, err := svc.CreateUser(models.User{Email: tt.email}, tt.password); !errors.Is(err, tt.want) {
+			t.Errorf("%q, %q: expected %v, got %v", tt.email, tt.password, tt.want, err)
+		}
+	}
+}
+
+func TestUserService_CreateFirstAdmin(t *testing.T) {
+	svc := NewUserService(UserServiceConfig{DB: newTestDB(t)})
+
+	if hasAdmin, _ := svc.HasAdmin(); hasAdmin {
+		t.Fatal("expected no admin")
+	}
+
+	admin, err := svc.CreateFirstAdmin(models.User{Email: "ada@example.com"}, "correct horse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !admin.IsAdmin {
+		t.Error("expected the first user to be an admin")
+	}
+
+	if _, err = svc.CreateFirstAdmin(models.User{Email: "bob@example.com"}, "correct horse"); !errors.Is(err, ErrSetupComplete) {
+		t.Errorf("expected ErrSetupComplete, got %v", err)
+	}
+}
+
+func TestUserService_LastAdmin(t *testing.T) {
+	svc := NewUserService(UserServiceConfig{DB: newTestDB(t)})
+
+	admin, _ := svc.CreateFirstAdmin(models.User{Email: "ada@example.com"}, "correct horse")
+	viewer, _ := svc.CreateUser(models.User{Email: "bob@example.com"}, "correct horse")
+
+	if err := svc.UpdateUser(admin.ID, models.User{Email: admin.Email}, ""); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected ErrLastAdmin demoting the only admin, got %v", err)
+	}
+
+	if err := svc.DeleteUser(admin.ID); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected ErrLastAdmin deleting the only admin, got %v", err)
+	}
+
+	if err := svc.UpdateUser(viewer.ID, models.User{Email: viewer.Email, IsAdmin: true}, "new password"); err != nil {
+		t.Fatalf("unexpected error promoting: %v", err)
+	}
+
+	if _, err := svc.Authenticate(viewer.Email, "new password"); err != nil {
+		t.Errorf("expected the new password to work, got %v", err)
+	}
+
+	if err := svc.DeleteUser(admin.ID); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+
+	// Deleted users are removed for good, so their email can be reused
+	if _, err := svc.CreateUser(models.User{Email: admin.Email}, "correct horse"); err != nil {
+		t.Errorf("expected the email to be reusable, got %v", err)
+	}
+}
+
+func TestUserService_SoftDeletedEmailIsTaken(t *testing.T) {
+	db := newTestDB(t)
+	svc := NewUserService(UserServiceConfig{DB: db})
+
+	admin, _ := svc.CreateFirstAdmin(models.User{Email: "ada@example.com"}, "correct horse")
+	viewer, _ := svc.CreateUser(models.User{Email: "bob@example.com"}, "correct horse")
+
+	// Users are only ever hard deleted here, but a soft deleted row still
+	// holds its email in the unique index
+	db.Delete(&viewer)
+
+	if _, err := svc.CreateUser(models.User{Email: "Bob@example.com"}, "correct horse"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken creating a user, got %v", err)
+	}
+
+	if err := svc.UpdateUser(admin.ID, models.User{Email: "bob@example.com", IsAdmin: true}, ""); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken updating a user, got %v", err)
+	}
+
+	if _, err := svc.SignInExternal(ExternalIdentity{Subject: "bob", Email: "bob@example.com"}); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken signing in with single sign-on, got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/adampresley/aletics/internal/models"
+)
+
+var (
+	ErrArchiveInUse = errors.New("an event archive is being written by the retention job")
+)
+
+/*
+archiveFiles returns the archives that may hold events of the property:
+its own, and those of soft deleted events, which hold every property's.
+*/
+func (s *VisitorDataService) archiveFiles(propertyID uint) ([]string, error) {
+	var (
+		result []string
+	)
+
+	if s.archiveDir == "" {
+		return nil, nil
+	}
+
+	for _, pattern := range []string{fmt.Sprintf("events-property-%d-*.jsonl.gz", propertyID), "events-deleted-*.jsonl.gz"} {
+		paths, err := filepath.Glob(filepath.Join(s.archiveDir, pattern))
+
+		if err != nil {
+			return nil, fmt.Errorf("error listing event archives: %w", err)
+		}
+
+		result = append(result, paths...)
+	}
+
+	slices.Sort(result)
+	return result, nil
+}
+
+/*
+eachArchivedMatch calls fn with every archived event matching criteria,
+one archive at a time.
+*/
+func (s *VisitorDataService) eachArchivedMatch(criteria models.VisitorDataCriteria, fn func(models.Event) error) error {
+	paths, err := s.archiveFiles(criteria.PropertyID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		archiveMutex.Lock()
+		_, writing := openArchives[path]
+		archiveMutex.Unlock()
+
+		err = readEventArchive(path, !writing, func(event models.Event) error {
+			if !archivedEventMatches(criteria, event) {
+				return nil
+			}
+
+			return fn(event)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+deleteArchivedEvents rewrites every archive holding events that match
+criteria without them, and removes archives left empty. Archives a prune
+is still writing to are skipped and ErrArchiveInUse is returned, so the
+request can be repeated once it has finished. It returns how many events
+were removed.
+*/
+func (s *VisitorDataService) deleteArchivedEvents(criteria models.VisitorDataCriteria) (int64, error) {
+	var (
+		err     error
+		deleted int64
+		inUse   bool
+	)
+
+	paths, err := s.archiveFiles(criteria.PropertyID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, path := range paths {
+		var (
+			removed int64
+			skipped bool
+		)
+
+		removed, skipped, err = rewriteEventArchive(path, criteria)
+		deleted += removed
+
+		if err != nil {
+			return deleted, err
+		}
+
+		inUse = inUse || skipped
+	}
+
+	if inUse {
+		err = ErrArchiveInUse
+	}
+
+	return deleted, err
+}
+
+/*
+rewriteEventArchive writes the events of the archive at path that do not
+match criteria to a new file, which then replaces it. Nothing is written
+when no event matches. It returns how many events were removed, and true
+when the archive was skipped because a prune is writing to it.
+*/
+func rewriteEventArchive(path string, criteria models.VisitorDataCriteria) (int64, bool, error) {
+	var (
+		err     error
+		removed int64
+		temp    *os.File
+	)
+
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+
+	if _, ok := openArchives[path]; ok {
+		return 0, true, nil
+	}
+
+	// Most archives hold nothing of the visitor's, so they are read once
+	// before anything is written
+	err = readEventArchive(path, true, func(event models.Event) error {
+		if archivedEventMatches(criteria, event) {
+			removed++
+		}
+
+		return nil
+	})
+
+	if err != nil || removed == 0 {
+		return 0, false, err
+	}
+
+	if temp, err = os.CreateTemp(filepath.Dir(path), ".rewrite-*.jsonl.gz"); err != nil {
+		return 0, false, fmt.Errorf("error creating event archive: %w", err)
+	}
+
+	defer os.Remove(temp.Name())
+
+	kept := int64(0)
+	writer := gzip.NewWriter(temp)
+	encoder := json.NewEncoder(writer)
+
+	err = readEventArchive(path, true, func(event models.Event) error {
+		if archivedEventMatches(criteria, event) {
+			return nil
+		}
+
+		kept++
+		return encoder.Encode(event)
+	})
+
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err == nil {
+		err = temp.Chmod(0o640)
+	}
+
+	if err == nil {
+		err = temp.Sync()
+	}
+
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return 0, false, fmt.Errorf("error rewriting event archive %s: %w", filepath.Base(path), err)
+	}
+
+	if kept == 0 {
+		err = os.Remove(path)
+	} else {
+		err = os.Rename(temp.Name(), path)
+	}
+
+	if err != nil {
+		return 0, false, fmt.Errorf("error replacing event archive %s: %w", filepath.Base(path), err)
+	}
+
+	return removed, false, nil
+}
+
+/*
+readEventArchive calls fn with each event in the archive at path. An
+archive that a prune is still writing to has no gzip footer yet, so unless
+it is complete, ending part way is treated as its end.
+*/
+func readEventArchive(path string, complete bool, fn func(models.Event) error) error {
+	var (
+		err    error
+		file   *os.File
+		reader *gzip.Reader
+	)
+
+	if file, err = os.Open(path); err != nil {
+		return fmt.Errorf("error opening event archive: %w", err)
+	}
+
+	defer file.Close()
+
+	if reader, err = gzip.NewReader(file); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		return fmt.Errorf("error reading event archive %s: %w", filepath.Base(path), err)
+	}
+
+	decoder := json.NewDecoder(reader)
+
+	for {
+		var event models.Event
+
+		if err = decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) || !complete && errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+
+			return fmt.Errorf("error reading event archive %s: %w", filepath.Base(path), err)
+		}
+
+		if err = fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+archivedEventMatches checks every part of criteria against an archived
+event, as the database is not there to match the property, time range
+and custom property.
+*/
+func archivedEventMatches(criteria models.VisitorDataCriteria, event models.Event) bool {
+	if event.PropertyID != criteria.PropertyID {
+		return false
+	}
+
+	if !criteria.From.IsZero() && event.CreatedAt.Before(criteria.From) {
+		return false
+	}
+
+	if !criteria.To.IsZero() && !event.CreatedAt.Before(criteria.To) {
+		return false
+	}
+
+	if criteria.PropKey != "" {
+		found := slices.ContainsFunc(event.Props, func(prop models.EventProp) bool {
+			return prop.Key == criteria.PropKey && (criteria.PropValue == "" || prop.Value == criteria.PropValue)
+		})
+
+		if !found {
+			return false
+		}
+	}
+
+	return visitorDataMatches(criteria, event)
+}
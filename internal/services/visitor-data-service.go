@@ -0,0 +1,380 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultVisitorDataBatchSize int = 1000
+)
+
+var (
+	ErrNoCriteria          = errors.New("choose a time range, path, query parameter or custom property to match")
+	ErrVisitorDataColumnar = errors.New("visitor data requests are not supported with a columnar analytics store")
+)
+
+type VisitorDataServiceConfig struct {
+	DB         *gorm.DB
+	EventStore EventStore
+
+	// RollupService rebuilds the rollups that deleted events were counted in.
+	RollupService *RollupService
+
+	// ArchiveDir is where the retention job writes pruned events. Events
+	// archived there are searched, exported and deleted too.
+	ArchiveDir string
+
+	// BatchSize bounds how many events are read or deleted at a time.
+	BatchSize int
+}
+
+/*
+VisitorDataService answers requests from visitors to see or remove the
+data recorded about them. Matching raw events can be previewed, exported
+as JSON lines, and hard deleted along with the rollups they were counted
+in. Events the retention job has archived are matched as well, and deleting
+them rewrites their archives. Exports and deletions are recorded in the
+audit log.
+*/
+type VisitorDataService struct {
+	db            *gorm.DB
+	rollupService *RollupService
+	archiveDir    string
+	columnar      bool
+	batchSize     int
+}
+
+func NewVisitorDataService(config VisitorDataServiceConfig) *VisitorDataService {
+	result := &VisitorDataService{
+		db:            config.DB,
+		rollupService: config.RollupService,
+		archiveDir:    config.ArchiveDir,
+		batchSize:     config.BatchSize,
+	}
+
+	if _, ok := config.EventStore.(ColumnarEventStore); ok {
+		result.columnar = true
+	}
+
+	if result.batchSize <= 0 {
+		result.batchSize = defaultVisitorDataBatchSize
+	}
+
+	return result
+}
+
+/*
+PreviewEvents returns up to limit of the events matching criteria, oldest
+first with archived events after them, and how many match in total.
+*/
+func (s *VisitorDataService) PreviewEvents(criteria models.VisitorDataCriteria, limit int) ([]models.Event, int64, error) {
+	var (
+		err   error
+		total int64
+	)
+
+	result := []models.Event{}
+
+	err = s.eachMatchingBatch(criteria, true, func(events []models.Event) error {
+		total += int64(len(events))
+
+		if room := limit - len(result); room > 0 {
+			result = append(result, events[:min(room, len(events))]...)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return result, total, err
+	}
+
+	err = s.eachArchivedMatch(criteria, func(event models.Event) error {
+		total++
+
+		if len(result) < limit {
+			result = append(result, event)
+		}
+
+		return nil
+	})
+
+	return result, total, err
+}
+
+/*
+ExportEvents writes every event matching criteria to w, archived events
+included, one JSON object per line, and records the export in the audit
+log. It returns how many events were written.
+*/
+func (s *VisitorDataService) ExportEvents(actor models.Actor, criteria models.VisitorDataCriteria, w io.Writer) (int64, error) {
+	var (
+		err      error
+		exported int64
+		archived int64
+		property models.Property
+	)
+
+	if property, err = s.getProperty(criteria.PropertyID); err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(w)
+
+	err = s.eachMatchingBatch(criteria, true, func(events []models.Event) error {
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return fmt.Errorf("error writing export: %w", err)
+			}
+
+			exported++
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		err = s.eachArchivedMatch(criteria, func(event models.Event) error {
+			if err := encoder.Encode(event); err != nil {
+				return fmt.Errorf("error writing export: %w", err)
+			}
+
+			exported++
+			archived++
+			return nil
+		})
+	}
+
+	// Whatever was written has left the server, so it is recorded even
+	// when the export stopped part way
+	if exported > 0 || err == nil {
+		after := map[string]any{"criteria": criteria, "events": exported, "archivedEvents": archived}
+
+		if auditErr := recordAudit(s.db, actor, models.AuditVisitorDataExported, propertyAuditTarget(property), nil, after); auditErr != nil {
+			return exported, errors.Join(err, fmt.Errorf("error recording export: %w", auditErr))
+		}
+	}
+
+	return exported, err
+}
+
+/*
+DeleteEvents hard deletes every event matching criteria, and their custom
+properties, then rebuilds the rollups they were counted in so reports no
+longer include them. Matching events are then removed from the archives.
+Rollups of archived events are left alone, as their raw events are no
+longer there to rebuild them from. The deletion is recorded in the audit
+log. It returns how many events were deleted, archived events included.
+*/
+func (s *VisitorDataService) DeleteEvents(actor models.Actor, criteria models.VisitorDataCriteria) (int64, error) {
+	var (
+		err      error
+		deleted  int64
+		archived int64
+		property models.Property
+	)
+
+	// Only the hours the events were in are kept, as that is all the
+	// rollups need to be rebuilt for
+	hours := map[time.Time]bool{}
+
+	if property, err = s.getProperty(criteria.PropertyID); err != nil {
+		return 0, err
+	}
+
+	// Batches are read after the last ID of the one before, so deleting
+	// each as it is read does not skip any
+	err = s.eachMatchingBatch(criteria, false, func(events []models.Event) error {
+		ids := make([]uint, 0, len(events))
+
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("event_id IN ?", ids).Delete(&models.EventProp{}).Error; err != nil {
+				return err
+			}
+
+			return tx.Unscoped().Where("id IN ?", ids).Delete(&models.Event{}).Error
+		})
+
+		if err != nil {
+			return fmt.Errorf("error deleting events: %w", err)
+		}
+
+		for _, event := range events {
+			hours[hourlyRollups.truncate(event.CreatedAt)] = true
+		}
+
+		deleted += int64(len(ids))
+		return nil
+	})
+
+	if err == nil {
+		archived, err = s.deleteArchivedEvents(criteria)
+	}
+
+	if deleted == 0 && archived == 0 && err != nil {
+		return 0, err
+	}
+
+	if s.rollupService != nil && deleted > 0 {
+		buckets := slices.SortedFunc(maps.Keys(hours), time.Time.Compare)
+
+		if rollupErr := s.rollupService.RebuildBuckets(property.ID, buckets); rollupErr != nil {
+			err = errors.Join(err, fmt.Errorf("error rebuilding rollups: %w", rollupErr))
+		}
+	}
+
+	deleted += archived
+
+	after := map[string]any{"criteria": criteria, "events": deleted, "archivedEvents": archived}
+
+	if auditErr := recordAudit(s.db, actor, models.AuditVisitorDataDeleted, propertyAuditTarget(property), nil, after); auditErr != nil {
+		err = errors.Join(err, fmt.Errorf("error recording deletion: %w", auditErr))
+	}
+
+	return deleted, err
+}
+
+// getProperty returns the property, even when it has been archived.
+func (s *VisitorDataService) getProperty(id uint) (models.Property, error) {
+	var (
+		property models.Property
+	)
+
+	err := s.db.Unscoped().First(&property, id).Error
+	return property, err
+}
+
+/*
+eachMatchingBatch calls fn with the events matching criteria, a batch at a
+time in ID order, including events that were soft deleted. The property,
+time range and custom property are matched by the database, the path and
+query string here.
+*/
+func (s *VisitorDataService) eachMatchingBatch(criteria models.VisitorDataCriteria, preload bool, fn func([]models.Event) error) error {
+	var (
+		err    error
+		lastID uint
+	)
+
+	if s.columnar {
+		return ErrVisitorDataColumnar
+	}
+
+	if !criteria.Narrowed() {
+		return ErrNoCriteria
+	}
+
+	for {
+		var (
+			events  []models.Event
+			matched []models.Event
+		)
+
+		query := s.scope(criteria).Where("id > ?", lastID).Order("id").Limit(s.batchSize)
+
+		if preload {
+			query = query.Preload("Props")
+		}
+
+		if err = query.Find(&events).Error; err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		lastID = events[len(events)-1].ID
+
+		for _, event := range events {
+			if visitorDataMatches(criteria, event) {
+				matched = append(matched, event)
+			}
+		}
+
+		if len(matched) > 0 {
+			if err = fn(matched); err != nil {
+				return err
+			}
+		}
+
+		if len(events) < s.batchSize {
+			return nil
+		}
+	}
+}
+
+func (s *VisitorDataService) scope(criteria models.VisitorDataCriteria) *gorm.DB {
+	query := s.db.Unscoped().Where("property_id = ?", criteria.PropertyID)
+
+	if !criteria.From.IsZero() {
+		query = query.Where("created_at >= ?", criteria.From)
+	}
+
+	if !criteria.To.IsZero() {
+		query = query.Where("created_at < ?", criteria.To)
+	}
+
+	if criteria.PropKey != "" {
+		props := s.db.Model(&models.EventProp{}).Select("event_id").Where(&models.EventProp{Key: criteria.PropKey})
+
+		if criteria.PropValue != "" {
+			props = props.Where(&models.EventProp{Value: criteria.PropValue})
+		}
+
+		query = query.Where("id IN (?)", props)
+	}
+
+	return query
+}
+
+/*
+visitorDataMatches checks the parts of criteria the database does not. A
+query parameter matches in any case, like stripped parameters, and without
+a value it matches whatever value was sent.
+*/
+func visitorDataMatches(criteria models.VisitorDataCriteria, event models.Event) bool {
+	if criteria.PathPattern != "" && !pathMatches(criteria.PathPattern, event.Path) {
+		return false
+	}
+
+	if criteria.QueryParam == "" {
+		return true
+	}
+
+	// Browsers send the query string with its leading ?
+	query, _ := url.ParseQuery(strings.TrimPrefix(event.QueryString, "?"))
+
+	for key, values := range query {
+		if !strings.EqualFold(key, criteria.QueryParam) {
+			continue
+		}
+
+		if criteria.QueryValue == "" {
+			return true
+		}
+
+		for _, value := range values {
+			if value == criteria.QueryValue {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/aletics/internal/models"
+	"gorm.io/gorm"
+)
+
+func seedVisitorDataEvents(t *testing.T, db *gorm.DB, now time.Time) models.Property {
+	t.Helper()
+
+	property := models.Property{Name: "Site", Domain: "site.com", Token: "site", Active: true}
+
+	if err := db.Create(&property).Error; err != nil {
+		t.Fatalf("error seeding property: %v", err)
+	}
+
+	events := []models.Event{
+		{PropertyID: property.ID, VisitorID: "a", Path: "/account/42", QueryString: "?user=42&ref=mail"},
+		{PropertyID: property.ID, VisitorID: "a", Path: "/pricing", QueryString: "?USER=42", Props: []models.EventProp{{Key: "customer", Value: "42"}}},
+		{PropertyID: property.ID, VisitorID: "b", Path: "/account/7", QueryString: "?user=7"},
+		{PropertyID: property.ID, VisitorID: "b", Path: "/", Props: []models.EventProp{{Key: "customer", Value: "7"}}},
+		{PropertyID: property.ID + 1, VisitorID: "c", Path: "/account/42", QueryString: "?user=42"},
+	}
+
+	for i := range events {
+		events[i].CreatedAt = now.AddDate(0, 0, -3).Add(time.Duration(i) * time.Hour)
+	}
+
+	if err := db.Create(&events).Error; err != nil {
+		t.Fatalf("error seeding events: %v", err)
+	}
+
+	return property
+}
+
+func TestVisitorDataService_PreviewEvents(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	property := seedVisitorDataEvents(t, db, now)
+	svc := NewVisitorDataService(VisitorDataServiceConfig{DB: db, BatchSize: 2})
+
+	tests := []struct {
+		name     string
+		criteria models.VisitorDataCriteria
+		want     []string
+	}{
+		{"path pattern", models.VisitorDataCriteria{PathPattern: "/account/*"}, []string{"/account/42", "/account/7"}},
+		{"query parameter in any case", models.VisitorDataCriteria{QueryParam: "user", QueryValue: "42"}, []string{"/account/42", "/pricing"}},
+		{"query parameter with any value", models.VisitorDataCriteria{QueryParam: "ref"}, []string{"/account/42"}},
+		{"custom property", models.VisitorDataCriteria{PropKey: "customer", PropValue: "7"}, []string{"/"}},
+		{"time range", models.VisitorDataCriteria{From: now.AddDate(0, 0, -3).Add(time.Hour), To: now.AddDate(0, 0, -3).Add(3 * time.Hour)}, []string{"/pricing", "/account/7"}},
+		{"everything", models.VisitorDataCriteria{PathPattern: "/account/*", QueryParam: "user", QueryValue: "7"}, []string{"/account/7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.criteria.PropertyID = property.ID
+			events, total, err := svc.PreviewEvents(tt.criteria, 10)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := []string{}
+
+			for _, event := range events {
+				got = append(got, event.Path)
+			}
+
+			if total != int64(len(tt.want)) || strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("expected %v, got %v (%d in total)", tt.want, got, total)
+			}
+		})
+	}
+
+	// The preview is limited, but still counts everything
+	events, total, _ := svc.PreviewEvents(models.VisitorDataCriteria{PropertyID: property.ID, PathPattern: "/*"}, 1)
+
+	if len(events) != 1 || total != 4 {
+		t.Errorf("expected 1 event of 4, got %d of %d", len(events), total)
+	}
+
+	if _, _, err := svc.PreviewEvents(models.VisitorDataCriteria{PropertyID: property.ID}, 10); !errors.Is(err, ErrNoCriteria) {
+		t.Errorf("expected ErrNoCriteria, got %v", err)
+	}
+}
+
+func TestVisitorDataService_ExportEvents(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	property := seedVisitorDataEvents(t, db, now)
+	svc := NewVisitorDataService(VisitorDataServiceConfig{DB: db})
+
+	var out bytes.Buffer
+	criteria := models.VisitorDataCriteria{PropertyID: property.ID, QueryParam: "user", QueryValue: "42"}
+
+	exported, err := svc.ExportEvents(models.Actor{UserID: 1, Email: "admin@example.com"}, criteria, &out)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	if exported != 2 || len(lines) != 2 {
+		t.Fatalf("expected 2 events exported, got %d in %d lines", exported, len(lines))
+	}
+
+	var event models.Event
+
+	if err = json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatalf("error reading export: %v", err)
+	}
+
+	if event.Path != "/pricing" || len(event.Props) != 1 || event.Props[0].Value != "42" {
+		t.Errorf("expected the event with its custom properties, got %+v", event)
+	}
+
+	var entry models.AuditEntry
+	db.Where("action = ?", models.AuditVisitorDataExported).First(&entry)
+
+	if entry.TargetID != property.ID || !strings.Contains(entry.After, `"events":2`) || !strings.Contains(entry.After, `"queryValue":"42"`) {
+		t.Errorf("expected the export to be audited with its criteria, got %+v", entry)
+	}
+}
+
+func TestVisitorDataService_DeleteEvents(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	property := seedVisitorDataEvents(t, db, now)
+	rollupService := NewRollupService(RollupServiceConfig{DB: db})
+
+	if err := rollupService.Aggregate(context.Background(), now); err != nil {
+		t.Fatalf("error building rollups: %v", err)
+	}
+
+	svc := NewVisitorDataService(VisitorDataServiceConfig{DB: db, RollupService: rollupService, BatchSize: 1})
+	criteria := models.VisitorDataCriteria{PropertyID: property.ID, QueryParam: "user", QueryValue: "42"}
+
+	deleted, err := svc.DeleteEvents(models.Actor{UserID: 1, Email: "admin@example.com"}, criteria)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if deleted != 2 {
+		t.Errorf("expected 2 events deleted, got %d", deleted)
+	}
+
+	var events, props int64
+	db.Unscoped().Model(&models.Event{}).Count(&events)
+	db.Model(&models.EventProp{}).Count(&props)
+
+	// The other property's event with the same query string is kept
+	if events != 3 || props != 1 {
+		t.Errorf("expected 3 events and 1 custom property left, got %d and %d", events, props)
+	}
+
+	var pageviews int64
+	db.Model(&models.DailyRollup{}).Where("property_id = ? AND dimension = ''", property.ID).Select("COALESCE(SUM(pageviews), 0)").Scan(&pageviews)
+
+	if pageviews != 2 {
+		t.Errorf("expected the daily rollups to count the 2 remaining pageviews, got %d", pageviews)
+	}
+
+	var paths []string
+	db.Model(&models.HourlyRollup{}).Where("property_id = ? AND dimension = 'path'", property.ID).Order("value").Pluck("value", &paths)
+
+	if strings.Join(paths, " ") != "/ /account/7" {
+		t.Errorf("expected the hourly rollups to drop the deleted paths, got %v", paths)
+	}
+
+	var entry models.AuditEntry
+	db.Where("action = ?", models.AuditVisitorDataDeleted).First(&entry)
+
+	if entry.ActorEmail != "admin@example.com" || entry.TargetID != property.ID || !strings.Contains(entry.After, `"events":2`) {
+		t.Errorf("expected the deletion to be audited, got %+v", entry)
+	}
+}
+
+func writeTestArchive(t *testing.T, dir, label string, now time.Time, events []models.Event) string {
+	t.Helper()
+
+	archive, err := newEventArchive(dir, label, now)
+
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+
+	if err = archive.Write(events); err != nil {
+		t.Fatalf("error writing archive: %v", err)
+	}
+
+	if err = archive.Close(); err != nil {
+		t.Fatalf("error closing archive: %v", err)
+	}
+
+	return archive.path
+}
+
+func TestVisitorDataService_ArchivedEvents(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	property := seedVisitorDataEvents(t, db, now)
+	dir := t.TempDir()
+	old := now.AddDate(-1, 0, 0)
+
+	ownArchive := writeTestArchive(t, dir, fmt.Sprintf("property-%d", property.ID), old, []models.Event{
+		{PropertyID: property.ID, Path: "/account/42", QueryString: "?user=42"},
+		{PropertyID: property.ID, Path: "/about"},
+	})
+
+	deletedArchive := writeTestArchive(t, dir, "deleted", old, []models.Event{
+		{PropertyID: property.ID, Path: "/", Props: []models.EventProp{{Key: "customer", Value: "42"}}},
+		{PropertyID: property.ID + 1, Path: "/account/42", QueryString: "?user=42"},
+	})
+
+	svc := NewVisitorDataService(VisitorDataServiceConfig{DB: db, ArchiveDir: dir})
+	byQuery := models.VisitorDataCriteria{PropertyID: property.ID, QueryParam: "user", QueryValue: "42"}
+	byProp := models.VisitorDataCriteria{PropertyID: property.ID, PropKey: "customer", PropValue: "42"}
+
+	events, total, err := svc.PreviewEvents(byQuery, 10)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if total != 3 || len(events) != 3 || events[2].Path != "/account/42" {
+		t.Errorf("expected the 2 stored events and 1 archived one, got %d: %+v", total, events)
+	}
+
+	var out bytes.Buffer
+
+	if exported, err := svc.ExportEvents(models.Actor{UserID: 1}, byProp, &out); err != nil || exported != 2 {
+		t.Errorf("expected 2 events exported, 1 of them archived, got %d: %v", exported, err)
+	}
+
+	var entry models.AuditEntry
+	db.Where("action = ?", models.AuditVisitorDataExported).First(&entry)
+
+	if !strings.Contains(entry.After, `"archivedEvents":1`) {
+		t.Errorf("expected the export of archived events to be audited, got %s", entry.After)
+	}
+
+	// An archive the retention job is still writing to is left alone
+	writing, err := newEventArchive(dir, fmt.Sprintf("property-%d", property.ID), now)
+
+	if err != nil {
+		t.Fatalf("error creating archive: %v", err)
+	}
+
+	if err = writing.Write([]models.Event{{PropertyID: property.ID, Path: "/account/42", QueryString: "?user=42"}}); err != nil {
+		t.Fatalf("error writing archive: %v", err)
+	}
+
+	deleted, err := svc.DeleteEvents(models.Actor{UserID: 1}, byQuery)
+
+	if !errors.Is(err, ErrArchiveInUse) || deleted != 3 {
+		t.Errorf("expected 3 events deleted and ErrArchiveInUse, got %d: %v", deleted, err)
+	}
+
+	if err = writing.Close(); err != nil {
+		t.Fatalf("error closing archive: %v", err)
+	}
+
+	if deleted, err = svc.DeleteEvents(models.Actor{UserID: 1}, byQuery); err != nil || deleted != 1 {
+		t.Errorf("expected the last archived event to be deleted once the archive was closed, got %d: %v", deleted, err)
+	}
+
+	// The stored event with the custom property went with the query
+	// parameter, so only the archived one is left
+	if deleted, err = svc.DeleteEvents(models.Actor{UserID: 1}, byProp); err != nil || deleted != 1 {
+		t.Errorf("expected 1 archived event deleted by custom property, got %d: %v", deleted, err)
+	}
+
+	paths := []string{}
+
+	for _, path := range []string{ownArchive, deletedArchive, writing.path} {
+		readEventArchive(path, true, func(event models.Event) error {
+			paths = append(paths, fmt.Sprintf("%d%s", event.PropertyID, event.Path))
+			return nil
+		})
+	}
+
+	want := []string{fmt.Sprintf("%d/about", property.ID), fmt.Sprintf("%d/account/42", property.ID+1)}
+
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("expected the archives to keep %v, got %v", want, paths)
+	}
+
+	if _, err = os.Stat(writing.path); !os.IsNotExist(err) {
+		t.Errorf("expected an archive left empty to be removed, got %v", err)
+	}
+
+	var deletion models.AuditEntry
+	db.Where("action = ?", models.AuditVisitorDataDeleted).First(&deletion)
+
+	if !strings.Contains(deletion.After, `"archivedEvents":1`) || !strings.Contains(deletion.After, `"events":3`) {
+		t.Errorf("expected the deletion of archived events to be audited, got %s", deletion.After)
+	}
+}
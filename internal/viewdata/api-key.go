@@ -0,0 +1,24 @@
+package viewdata
+
+import (
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/rendering"
+)
+
+type ManageApiKeys struct {
+	rendering.BaseViewModel
+	Nav
+	ApiKeys    []models.APIKey
+	Properties []models.Property
+
+	// IsAdmin shows who created each key to server admins, who see them all
+	IsAdmin bool
+
+	// Form values for creating a new key
+	Name       string
+	PropertyID uint
+
+	// NewKey is the plaintext of a key that was just created. It is only
+	// ever shown once.
+	NewKey string
+}
@@ -0,0 +1,50 @@
+package viewdata
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/rendering"
+)
+
+type AuditLog struct {
+	rendering.BaseViewModel
+	Nav
+	Entries     []models.AuditEntry
+	Actions     []models.AuditAction
+	TargetTypes []string
+
+	// The filters, as entered
+	Action     string
+	Actor      string
+	TargetType string
+	From       string
+	To         string
+
+	Page        int
+	HasNextPage bool
+}
+
+// NewerPageURL links to the previous page, keeping the filters.
+func (v AuditLog) NewerPageURL() string {
+	return v.pageURL(v.Page - 1)
+}
+
+// OlderPageURL links to the next page, keeping the filters.
+func (v AuditLog) OlderPageURL() string {
+	return v.pageURL(v.Page + 1)
+}
+
+func (v AuditLog) pageURL(page int) string {
+	query := url.Values{}
+
+	for name, value := range map[string]string{"action": v.Action, "actor": v.Actor, "target_type": v.TargetType, "from": v.From, "to": v.To} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	query.Set("page", strconv.Itoa(page))
+	return "/audit-log?" + query.Encode()
+}
@@ -9,6 +9,7 @@ import (
 
 type Dashboard struct {
 	rendering.BaseViewModel
+	Nav
 
 	// Fields for filter controls
 	Properties         []models.Property
@@ -28,5 +29,8 @@ type Dashboard struct {
 
 type Login struct {
 	rendering.BaseViewModel
-	Password string
+	Email string
+
+	// SSOEnabled shows the single sign-on button
+	SSOEnabled bool
 }
@@ -0,0 +1,19 @@
+package viewdata
+
+import (
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/rendering"
+)
+
+type ManageImports struct {
+	rendering.BaseViewModel
+	Nav
+	Imports    []models.Import
+	Properties []models.Property
+	Sources    []string
+
+	// Form values for uploading a new import
+	PropertyID uint
+	Source     string
+	Date       string
+}
@@ -0,0 +1,12 @@
+package viewdata
+
+import (
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/rendering"
+)
+
+type ManageLoginAttempts struct {
+	rendering.BaseViewModel
+	Nav
+	Attempts []models.LoginAttempt
+}
@@ -0,0 +1,11 @@
+package viewdata
+
+/*
+Nav is part of the view data of every page using the main layout, and
+decides which of its links are shown.
+*/
+type Nav struct {
+	// ShowAdminLinks is true for server admins, the only ones who can open
+	// the pages those links go to
+	ShowAdminLinks bool
+}
@@ -1,6 +1,8 @@
 package viewdata
 
 import (
+	"time"
+
 	"html/template"
 
 	"github.com/adampresley/aletics/internal/models"
@@ -9,17 +11,59 @@ import (
 
 type ManageProperties struct {
 	rendering.BaseViewModel
+	Nav
 	Properties []models.Property
 	Name       string
+
+	// Roles holds the signed in user's role on each property, by ID
+	Roles map[uint]models.Role
+
+	// IsAdmin is true for server admins, who can create properties
+	IsAdmin bool
+
+	// ArchivedProperties are the deleted properties the user owns, which
+	// can be restored until their data is purged
+	ArchivedProperties []models.Property
+}
+
+// Restorable is true until an archived property's data starts being purged.
+func (v ManageProperties) Restorable(property models.Property) bool {
+	return property.Restorable(time.Now())
 }
 
 type CreateProperty struct {
 	rendering.BaseViewModel
+	Nav
 	models.Property
 }
 
 type EditProperty struct {
 	rendering.BaseViewModel
+	Nav
 	models.Property
 	TrackerScript template.JS
+
+	// NewSecretKey is the plaintext of a secret key that was just
+	// generated. It is only ever shown once.
+	NewSecretKey string
+
+	// Role is the signed in user's role on the property
+	Role models.Role
+}
+
+// PreviousTokenAccepted is true during the grace period after the token is rotated.
+func (v EditProperty) PreviousTokenAccepted() bool {
+	return v.Property.PreviousTokenValid(time.Now())
+}
+
+type PropertyMembers struct {
+	rendering.BaseViewModel
+	Nav
+	Property      models.Property
+	PropertyRoles []models.PropertyRole
+	Roles         []models.Role
+
+	// Form values for granting a role
+	Email string
+	Role  models.Role
 }
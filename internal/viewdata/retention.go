@@ -0,0 +1,14 @@
+package viewdata
+
+import (
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/rendering"
+)
+
+type ManageRetention struct {
+	rendering.BaseViewModel
+	Nav
+	Summaries            []models.RetentionSummary
+	DefaultRetentionDays int
+	LastRun              models.PruneResult
+}
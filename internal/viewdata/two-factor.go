@@ -0,0 +1,27 @@
+package viewdata
+
+import (
+	"html/template"
+
+	"github.com/adampresley/rendering"
+)
+
+type TwoFactorLogin struct {
+	rendering.BaseViewModel
+}
+
+type ManageTwoFactor struct {
+	rendering.BaseViewModel
+	Nav
+
+	Enabled  bool
+	Required bool
+
+	// Secret and QRCode are shown while enrolling
+	Secret string
+	QRCode template.URL
+
+	// RecoveryCodes are only shown right after they are generated
+	RecoveryCodes          []string
+	RemainingRecoveryCodes int64
+}
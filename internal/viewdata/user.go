@@ -0,0 +1,42 @@
+package viewdata
+
+import (
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/rendering"
+)
+
+type Setup struct {
+	rendering.BaseViewModel
+	Email string
+	Name  string
+}
+
+type ManageUsers struct {
+	rendering.BaseViewModel
+	Nav
+	Users         []models.User
+	CurrentUserID uint
+}
+
+type CreateUser struct {
+	rendering.BaseViewModel
+	Nav
+	models.User
+}
+
+type EditUser struct {
+	rendering.BaseViewModel
+	Nav
+	models.User
+
+	// IsCurrentUser is true when admins edit themselves. They cannot
+	// remove their own admin rights.
+	IsCurrentUser bool
+}
+
+type Account struct {
+	rendering.BaseViewModel
+	Nav
+	models.User
+	Sessions []models.Session
+}
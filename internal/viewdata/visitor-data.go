@@ -0,0 +1,34 @@
+package viewdata
+
+import (
+	"github.com/adampresley/aletics/internal/models"
+	"github.com/adampresley/rendering"
+)
+
+type VisitorData struct {
+	rendering.BaseViewModel
+	Nav
+	Properties []models.Property
+
+	// The criteria, as entered
+	PropertyID  uint
+	From        string
+	To          string
+	PathPattern string
+	QueryParam  string
+	QueryValue  string
+	PropKey     string
+	PropValue   string
+
+	// Previewed is true once the criteria have been checked, even when
+	// nothing matched
+	Previewed    bool
+	Events       []models.Event
+	Total        int64
+	PreviewLimit int
+}
+
+// More is true when more events match than the preview shows.
+func (v VisitorData) More() bool {
+	return v.Total > int64(len(v.Events))
+}
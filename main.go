@@ -1,26 +1,30 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/adampresley/aletics/internal/commands"
 	"github.com/adampresley/aletics/internal/configuration"
 	"github.com/adampresley/aletics/internal/handlers"
 	"github.com/adampresley/aletics/internal/models"
 	"github.com/adampresley/aletics/internal/services"
+	"github.com/adampresley/httphelpers/requests"
+	"github.com/adampresley/httphelpers/responses"
 	"github.com/adampresley/mux"
 	"github.com/adampresley/rendering"
 	"github.com/adampresley/rester/clientoptions"
-	"github.com/gorilla/sessions"
 	"github.com/jellydator/ttlcache/v3"
-	"gorm.io/driver/postgres"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -32,12 +36,34 @@ var (
 
 	db       *gorm.DB
 	renderer rendering.TemplateRenderer
-	store    *sessions.CookieStore
-
-	dashboardHandler   *handlers.DashboardHandler
-	propertyHandler    *handlers.PropertyHandler
-	trackerHandler     *handlers.TrackerHandler
-	userScriptsHandler *handlers.UserScriptsHandler
+	store    *services.SessionStore
+
+	// csrfExemptPrefixes are called by tracked sites and API clients,
+	// which authenticate with keys instead of the session cookie
+	csrfExemptPrefixes = []string{"/aletics/", "/api/", "/static/"}
+
+	// requireTwoFactor sends users without two-factor authentication to
+	// set it up before they can do anything else
+	requireTwoFactor bool
+
+	apiKeyService   *services.ApiKeyService
+	propertyService *services.PropertyService
+	userService     *services.UserService
+
+	apiKeyHandler       *handlers.ApiKeyHandler
+	auditHandler        *handlers.AuditHandler
+	dashboardHandler    *handlers.DashboardHandler
+	importHandler       *handlers.ImportHandler
+	loginAttemptHandler *handlers.LoginAttemptHandler
+	oidcHandler         *handlers.OIDCHandler
+	propertyHandler     *handlers.PropertyHandler
+	retentionHandler    *handlers.RetentionHandler
+	statsApiHandler     *handlers.StatsApiHandler
+	trackerHandler      *handlers.TrackerHandler
+	twoFactorHandler    *handlers.TwoFactorHandler
+	userHandler         *handlers.UserHandler
+	userScriptsHandler  *handlers.UserScriptsHandler
+	visitorDataHandler  *handlers.VisitorDataHandler
 )
 
 func main() {
@@ -48,17 +74,27 @@ func main() {
 
 	config := configuration.LoadConfig()
 	setupLogging(&config)
+
+	// Anyone who knows the default secret could forge cookies
+	if Version != "development" && (config.CookieSecret == "" || config.CookieSecret == "password") {
+		slog.Error("COOKIE_SECRET must be set to a long, random value")
+		os.Exit(1)
+	}
+
+	trustedProxies, err := services.ParseTrustedProxies(configuration.SplitList(config.TrustedProxies))
+
+	if err != nil {
+		slog.Error("invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
 	shutdownCtx, stopApp := context.WithCancel(context.Background())
 
 	/*
 	 * Database
 	 */
-	if strings.HasPrefix(config.DSN, "file:") {
-		dialect = sqlite.Open(config.DSN)
-	} else if strings.HasPrefix(config.DSN, "postgres:") || strings.HasPrefix(config.DSN, "postgresql:") {
-		dialect = postgres.Open(config.DSN)
-	} else {
-		panic("Unsupported database dialect")
+	if dialect, err = services.OpenDialector(config.DSN); err != nil {
+		slog.Error("error opening database", "error", err)
+		os.Exit(1)
 	}
 
 	if db, err = gorm.Open(dialect, &gorm.Config{}); err != nil {
@@ -66,17 +102,68 @@ func main() {
 		os.Exit(1)
 	}
 
+	migrationService := services.NewMigrationService(services.MigrationServiceConfig{
+		DB: db,
+	})
+
+	// migrate runs before anything touches the schema, so that it can
+	// report pending migrations and roll back
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		err = commands.NewMigrateCommand(commands.MigrateCommandConfig{
+			MigrationService: migrationService,
+			Out:              os.Stdout,
+		}).Run(args[1:])
+
+		if err != nil {
+			slog.Error("error running command", "command", args[0], "error", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	slog.Info("Database connection established. Running migrations...")
 
-	db.AutoMigrate(
-		&models.Property{}, &models.Event{},
-	)
+	if _, err = migrationService.Up(0); err != nil {
+		slog.Error("error migrating database", "error", err)
+		os.Exit(1)
+	}
+
+	/*
+	 * Events can be kept in a columnar store instead of the main database
+	 */
+	var eventStore services.EventStore = services.NewGormEventStore(db)
+
+	if config.AnalyticsDSN != "" {
+		columnarStore, err := services.OpenEventStore(config.AnalyticsDSN)
+
+		if err != nil {
+			slog.Error("error opening analytics store", "error", err)
+			os.Exit(1)
+		}
+
+		defer columnarStore.Close()
+		eventStore = columnarStore
+	}
+
+	_, columnar := eventStore.(services.ColumnarEventStore)
 
 	if renderer, err = rendering.NewGoTemplateRenderer(appFS); err != nil {
 		panic(err)
 	}
 
-	store = sessions.NewCookieStore([]byte(config.CookieSecret))
+	cookieSecrets := append([]string{config.CookieSecret}, configuration.SplitList(config.PreviousCookieSecrets)...)
+
+	store = services.NewSessionStore(services.SessionStoreConfig{
+		DB:              db,
+		Secrets:         cookieSecrets,
+		IdleTimeout:     config.SessionIdleTimeout,
+		AbsoluteTimeout: config.SessionAbsoluteTimeout,
+		Secure:          strings.HasPrefix(config.BaseURL(), "https://"),
+		PrivacyMode:     config.PrivacyMode,
+	})
+
+	requireTwoFactor = config.RequireTwoFactor
 
 	/*
 	 * Services
@@ -87,18 +174,6 @@ func main() {
 
 	go ipCache.Start()
 
-	propertyService := services.NewPropertyService(services.PropertyServiceConfig{
-		DB: db,
-	})
-
-	trackerService := services.NewTrackerService(services.TrackerServiceConfig{
-		DB: db,
-	})
-
-	reportService := services.NewReportService(services.ReportServiceConfig{
-		DB: db,
-	})
-
 	restConfig := clientoptions.New(
 		services.MaxmindBaseUrl,
 		clientoptions.WithBasicAuth(config.MaxmindAccountID, config.MaxmindApiKey),
@@ -113,48 +188,269 @@ func main() {
 		RestConfig:   restConfig,
 	})
 
+	geoLocator := services.NewGeoLocator(services.GeoLocatorConfig{
+		IpCache:         ipCache,
+		IpLookupService: ipLookupService,
+	})
+
+	auditService := services.NewAuditService(services.AuditServiceConfig{
+		DB:            db,
+		RetentionDays: config.AuditRetentionDays,
+	})
+
+	propertyService = services.NewPropertyService(services.PropertyServiceConfig{
+		DB:           db,
+		ArchiveGrace: config.PropertyDeleteGrace,
+	})
+
+	trackerService := services.NewTrackerService(services.TrackerServiceConfig{
+		DB:          db,
+		EventStore:  eventStore,
+		GeoLocator:  geoLocator,
+		PrivacyMode: config.PrivacyMode,
+		VisitorSalt: cmp.Or(config.VisitorSalt, config.CookieSecret),
+	})
+
+	reportService := services.NewReportService(services.ReportServiceConfig{
+		DB:         db,
+		EventStore: eventStore,
+	})
+
+	apiKeyService = services.NewApiKeyService(services.ApiKeyServiceConfig{
+		DB: db,
+	})
+
+	importService := services.NewImportService(services.ImportServiceConfig{
+		DB: db,
+	})
+
+	retentionService := services.NewRetentionService(services.RetentionServiceConfig{
+		DB:                   db,
+		DefaultRetentionDays: config.RetentionDays,
+		ArchiveDir:           config.ArchiveDir,
+		EventStore:           eventStore,
+	})
+
+	rollupService := services.NewRollupService(services.RollupServiceConfig{
+		DB: db,
+	})
+
+	visitorDataService := services.NewVisitorDataService(services.VisitorDataServiceConfig{
+		DB:            db,
+		EventStore:    eventStore,
+		RollupService: rollupService,
+		ArchiveDir:    config.ArchiveDir,
+	})
+
+	userService = services.NewUserService(services.UserServiceConfig{
+		DB: db,
+	})
+
+	loginAttemptService := services.NewLoginAttemptService(services.LoginAttemptServiceConfig{
+		DB:               db,
+		MaxAttempts:      config.LoginMaxAttempts,
+		MaxAttemptsPerIP: config.LoginMaxAttemptsPerIP,
+		LockoutDuration:  config.LoginLockoutDuration,
+		PrivacyMode:      config.PrivacyMode,
+	})
+
+	twoFactorService := services.NewTwoFactorService(services.TwoFactorServiceConfig{
+		DB:     db,
+		Issuer: "Aletics",
+	})
+
+	partitionService := services.NewPartitionService(services.PartitionServiceConfig{
+		DB:               db,
+		RetentionService: retentionService,
+		MonthsAhead:      config.PartitionMonths,
+	})
+
+	/*
+	 * Commands. Anything left on the command line after the flags is a
+	 * command to run instead of starting the server.
+	 */
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "import":
+			err = commands.NewImportCommand(commands.ImportCommandConfig{
+				ImportService:   importService,
+				PropertyService: propertyService,
+				Out:             os.Stdout,
+			}).Run(args[1:])
+
+		case "backfill-rollups":
+			if columnar {
+				err = errors.New("rollups are not used with a columnar analytics store")
+				break
+			}
+
+			err = commands.NewBackfillCommand(commands.BackfillCommandConfig{
+				PropertyService: propertyService,
+				RollupService:   rollupService,
+				Out:             os.Stdout,
+			}).Run(shutdownCtx, args[1:])
+
+		case "partition-events":
+			if columnar {
+				err = errors.New("events are kept in the columnar analytics store")
+				break
+			}
+
+			err = commands.NewPartitionCommand(commands.PartitionCommandConfig{
+				PartitionService: partitionService,
+				Out:              os.Stdout,
+			}).Run(args[1:])
+
+		default:
+			err = fmt.Errorf("unknown command '%s'", args[0])
+		}
+
+		if err != nil {
+			slog.Error("error running command", "command", args[0], "error", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	/*
+	 * Until the first admin exists, anyone who finds the server could
+	 * create it, so setup requires a token that only appears in the log
+	 */
+	var setupToken string
+
+	if hasAdmin, err := userService.HasAdmin(); err != nil {
+		slog.Error("error checking for an admin", "error", err)
+		os.Exit(1)
+	} else if !hasAdmin {
+		if setupToken, err = services.NewSetupToken(); err != nil {
+			slog.Error("error generating setup token", "error", err)
+			os.Exit(1)
+		}
+
+		slog.Warn("No admin exists yet. Visit /setup and enter this setup token to create the first admin", "setupToken", setupToken)
+	}
+
+	/*
+	 * Single sign-on is enabled by configuring an OpenID Connect issuer
+	 */
+	var oidcService *services.OIDCService
+
+	if config.OIDCIssuerURL != "" {
+		oidcService, err = services.NewOIDCService(shutdownCtx, services.OIDCServiceConfig{
+			IssuerURL:      config.OIDCIssuerURL,
+			ClientID:       config.OIDCClientID,
+			ClientSecret:   config.OIDCClientSecret,
+			RedirectURL:    cmp.Or(config.OIDCRedirectURL, config.BaseURL()+"/login/oidc/callback"),
+			Scopes:         configuration.SplitList(config.OIDCScopes),
+			AllowedDomains: configuration.SplitList(config.OIDCAllowedDomains),
+			AllowedGroups:  configuration.SplitList(config.OIDCAllowedGroups),
+			AdminGroups:    configuration.SplitList(config.OIDCAdminGroups),
+			GroupsClaim:    config.OIDCGroupsClaim,
+			UserService:    userService,
+		})
+
+		if err != nil {
+			slog.Error("error setting up single sign-on", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	/*
 	 * Handlers
 	 */
+	apiKeyHandler = handlers.NewApiKeyHandler(handlers.ApiKeyHandlerConfig{
+		AuditService:    auditService,
+		ApiKeyService:   apiKeyService,
+		PropertyService: propertyService,
+		Renderer:        renderer,
+	})
+
+	auditHandler = handlers.NewAuditHandler(handlers.AuditHandlerConfig{
+		AuditService: auditService,
+		PageSize:     config.PageSize,
+		Renderer:     renderer,
+	})
+
 	dashboardHandler = handlers.NewDashboardHandler(handlers.DashboardHandlerConfig{
+		AuditService:        auditService,
+		LoginAttemptService: loginAttemptService,
+		PropertyService:     propertyService,
+		ReportService:       reportService,
+		Renderer:            renderer,
+		SSOEnabled:          oidcService != nil,
+		Store:               store,
+		UserService:         userService,
+	})
+
+	importHandler = handlers.NewImportHandler(handlers.ImportHandlerConfig{
+		ImportService:   importService,
 		PropertyService: propertyService,
-		ReportService:   reportService,
 		Renderer:        renderer,
-		ServerPassword:  config.ServerPassword,
-		Store:           store,
+	})
+
+	loginAttemptHandler = handlers.NewLoginAttemptHandler(handlers.LoginAttemptHandlerConfig{
+		LoginAttemptService: loginAttemptService,
+		Renderer:            renderer,
+	})
+
+	oidcHandler = handlers.NewOIDCHandler(handlers.OIDCHandlerConfig{
+		AuditService: auditService,
+		OIDCService:  oidcService,
+		Renderer:     renderer,
+		Store:        store,
 	})
 
 	propertyHandler = handlers.NewPropertyHandler(handlers.PropertyHandlerConfig{
 		PropertyService: propertyService,
 		Renderer:        renderer,
 		TLD:             config.TLD,
+		UserService:     userService,
+	})
+
+	retentionHandler = handlers.NewRetentionHandler(handlers.RetentionHandlerConfig{
+		RetentionService: retentionService,
+		Renderer:         renderer,
+	})
+
+	statsApiHandler = handlers.NewStatsApiHandler(handlers.StatsApiHandlerConfig{
+		PropertyService: propertyService,
+		ReportService:   reportService,
 	})
 
 	trackerHandler = handlers.NewTrackerHandler(handlers.TrackerHandlerConfig{
-		IpCache:         ipCache,
-		IpLookupService: ipLookupService,
-		TrackerService:  trackerService,
+		TrackerService: trackerService,
+	})
+
+	twoFactorHandler = handlers.NewTwoFactorHandler(handlers.TwoFactorHandlerConfig{
+		AuditService:        auditService,
+		LoginAttemptService: loginAttemptService,
+		Renderer:            renderer,
+		Required:            config.RequireTwoFactor,
+		Store:               store,
+		TwoFactorService:    twoFactorService,
+		UserService:         userService,
+	})
+
+	userHandler = handlers.NewUserHandler(handlers.UserHandlerConfig{
+		AuditService: auditService,
+		Renderer:     renderer,
+		SetupToken:   setupToken,
+		Store:        store,
+		UserService:  userService,
 	})
 
 	userScriptsHandler = handlers.NewUserScriptsHandler(handlers.UserScriptsHandlerConfig{
 		FS: appFS,
 	})
 
-	routes := []mux.Route{
-		{Path: "GET /aletics/v1/tracker.js", HandlerFunc: userScriptsHandler.TrackerScript, Middlewares: []mux.MiddlewareFunc{trackerCorsMiddleware}},
-		{Path: "POST /aletics/v1/track", HandlerFunc: trackerHandler.TrackEvent, Middlewares: []mux.MiddlewareFunc{trackerCorsMiddleware}},
+	visitorDataHandler = handlers.NewVisitorDataHandler(handlers.VisitorDataHandlerConfig{
+		PropertyService:    propertyService,
+		Renderer:           renderer,
+		VisitorDataService: visitorDataService,
+	})
 
-		{Path: "/", HandlerFunc: dashboardHandler.DashboardPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
-		{Path: "GET /login", HandlerFunc: dashboardHandler.LoginPage},
-		{Path: "POST /login", HandlerFunc: dashboardHandler.LoginAction},
-		{Path: "GET /logout", HandlerFunc: dashboardHandler.LogoutAction},
-		{Path: "GET /properties", HandlerFunc: propertyHandler.ManagePropertiesPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
-		{Path: "GET /properties/create", HandlerFunc: propertyHandler.CreatePropertyPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
-		{Path: "POST /properties/create", HandlerFunc: propertyHandler.CreatePropertyAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
-		{Path: "GET /properties/edit/{id}", HandlerFunc: propertyHandler.EditPropertyPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
-		{Path: "POST /properties/edit/{id}", HandlerFunc: propertyHandler.EditPropertyAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
-		{Path: "DELETE /properties/delete/{id}", HandlerFunc: propertyHandler.DeleteProperty, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
-	}
+	routes := newRoutes(oidcService != nil)
 
 	muxer := mux.Setup(
 		&config,
@@ -174,6 +470,36 @@ func main() {
 		),
 	)
 
+	// CSRF tokens are checked before anything else, so that forged
+	// requests never reach a handler
+	muxer.Server.Handler = handlers.NewCSRFMiddleware(handlers.CSRFMiddlewareConfig{
+		Store:          store,
+		Secrets:        cookieSecrets,
+		ExemptPrefixes: csrfExemptPrefixes,
+	})(muxer.Server.Handler)
+
+	// In privacy mode, IP addresses are truncated before anything else,
+	// including the CSRF middleware's logging, sees them
+	if config.PrivacyMode {
+		muxer.Server.Handler = handlers.AnonymizeIPMiddleware(muxer.Server.Handler)
+	}
+
+	// The address sign in attempts are throttled by is found first, while
+	// the proxy headers are still there
+	muxer.Server.Handler = handlers.NewThrottleIPMiddleware(trustedProxies)(muxer.Server.Handler)
+
+	go retentionService.Start(shutdownCtx, config.RetentionInterval)
+	go auditService.Start(shutdownCtx, config.RetentionInterval)
+
+	if !columnar {
+		go rollupService.Start(shutdownCtx, config.RollupInterval)
+	}
+
+	// Partitions are only maintained once partition-events has been run
+	if !columnar && db.Dialector.Name() == "postgres" {
+		go partitionService.Start(shutdownCtx, config.RetentionInterval)
+	}
+
 	muxer.Start()
 }
 
@@ -216,26 +542,209 @@ func trackerCorsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+/*
+newRoutes returns every route the server handles. Single sign-on routes
+are only added when it is configured.
+*/
+func newRoutes(ssoEnabled bool) []mux.Route {
+	// Route middlewares wrap the handler in order, so the last one runs first
+	adminOnly := []mux.MiddlewareFunc{adminMiddleware, authMiddleware}
+
+	routes := []mux.Route{
+		{Path: "GET /aletics/v1/tracker.js", HandlerFunc: userScriptsHandler.TrackerScript, Middlewares: []mux.MiddlewareFunc{trackerCorsMiddleware}},
+		{Path: "POST /aletics/v1/track", HandlerFunc: trackerHandler.TrackEvent, Middlewares: []mux.MiddlewareFunc{trackerCorsMiddleware}},
+
+		{Path: "POST /api/v1/events", HandlerFunc: trackerHandler.TrackServerEvents, Middlewares: []mux.MiddlewareFunc{secretKeyMiddleware}},
+		{Path: "GET /api/v1/stats/aggregate", HandlerFunc: statsApiHandler.Aggregate, Middlewares: []mux.MiddlewareFunc{apiKeyMiddleware}},
+		{Path: "GET /api/v1/stats/timeseries", HandlerFunc: statsApiHandler.Timeseries, Middlewares: []mux.MiddlewareFunc{apiKeyMiddleware}},
+		{Path: "GET /api/v1/stats/breakdown", HandlerFunc: statsApiHandler.Breakdown, Middlewares: []mux.MiddlewareFunc{apiKeyMiddleware}},
+
+		{Path: "/", HandlerFunc: dashboardHandler.DashboardPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /login", HandlerFunc: dashboardHandler.LoginPage},
+		{Path: "POST /login", HandlerFunc: dashboardHandler.LoginAction},
+		{Path: "GET /login/two-factor", HandlerFunc: twoFactorHandler.LoginPage},
+		{Path: "POST /login/two-factor", HandlerFunc: twoFactorHandler.LoginAction},
+		{Path: "GET /logout", HandlerFunc: dashboardHandler.LogoutAction},
+		{Path: "GET /setup", HandlerFunc: userHandler.SetupPage},
+		{Path: "POST /setup", HandlerFunc: userHandler.SetupAction},
+		{Path: "GET /account", HandlerFunc: userHandler.AccountPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /account/password", HandlerFunc: userHandler.ChangePasswordAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /account/sessions/end-others", HandlerFunc: userHandler.EndOtherSessionsAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /account/two-factor", HandlerFunc: twoFactorHandler.ManagePage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /account/two-factor", HandlerFunc: twoFactorHandler.EnableAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /account/two-factor/recovery-codes", HandlerFunc: twoFactorHandler.RecoveryCodesAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /account/two-factor/disable", HandlerFunc: twoFactorHandler.DisableAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /properties", HandlerFunc: propertyHandler.ManagePropertiesPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /properties/create", HandlerFunc: propertyHandler.CreatePropertyPage, Middlewares: adminOnly},
+		{Path: "POST /properties/create", HandlerFunc: propertyHandler.CreatePropertyAction, Middlewares: adminOnly},
+		{Path: "GET /properties/edit/{id}", HandlerFunc: propertyHandler.EditPropertyPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /properties/edit/{id}", HandlerFunc: propertyHandler.EditPropertyAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /properties/rotate-token/{id}", HandlerFunc: propertyHandler.RotateTokenAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /properties/secret-key/{id}", HandlerFunc: propertyHandler.GenerateSecretKeyAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "DELETE /properties/delete/{id}", HandlerFunc: propertyHandler.DeleteProperty, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /properties/restore/{id}", HandlerFunc: propertyHandler.RestorePropertyAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /properties/members/{id}", HandlerFunc: propertyHandler.MembersPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /properties/members/{id}", HandlerFunc: propertyHandler.GrantRoleAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "DELETE /properties/members/{id}/{userID}", HandlerFunc: propertyHandler.RevokeRole, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /imports", HandlerFunc: importHandler.ManageImportsPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /imports/upload", HandlerFunc: importHandler.UploadImportAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "DELETE /imports/delete/{id}", HandlerFunc: importHandler.DeleteImport, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /retention", HandlerFunc: retentionHandler.ManageRetentionPage, Middlewares: adminOnly},
+		{Path: "POST /retention/prune", HandlerFunc: retentionHandler.PruneNowAction, Middlewares: adminOnly},
+		{Path: "GET /visitor-data", HandlerFunc: visitorDataHandler.VisitorDataPage, Middlewares: adminOnly},
+		{Path: "POST /visitor-data/preview", HandlerFunc: visitorDataHandler.PreviewAction, Middlewares: adminOnly},
+		{Path: "POST /visitor-data/export", HandlerFunc: visitorDataHandler.ExportAction, Middlewares: adminOnly},
+		{Path: "POST /visitor-data/delete", HandlerFunc: visitorDataHandler.DeleteAction, Middlewares: adminOnly},
+		{Path: "GET /api-keys", HandlerFunc: apiKeyHandler.ManageApiKeysPage, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "POST /api-keys/create", HandlerFunc: apiKeyHandler.CreateApiKeyAction, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "DELETE /api-keys/revoke/{id}", HandlerFunc: apiKeyHandler.RevokeApiKey, Middlewares: []mux.MiddlewareFunc{authMiddleware}},
+		{Path: "GET /users", HandlerFunc: userHandler.ManageUsersPage, Middlewares: adminOnly},
+		{Path: "GET /users/create", HandlerFunc: userHandler.CreateUserPage, Middlewares: adminOnly},
+		{Path: "POST /users/create", HandlerFunc: userHandler.CreateUserAction, Middlewares: adminOnly},
+		{Path: "GET /users/edit/{id}", HandlerFunc: userHandler.EditUserPage, Middlewares: adminOnly},
+		{Path: "POST /users/edit/{id}", HandlerFunc: userHandler.EditUserAction, Middlewares: adminOnly},
+		{Path: "DELETE /users/delete/{id}", HandlerFunc: userHandler.DeleteUser, Middlewares: adminOnly},
+		{Path: "DELETE /users/two-factor/{id}", HandlerFunc: twoFactorHandler.ResetAction, Middlewares: adminOnly},
+		{Path: "GET /login-attempts", HandlerFunc: loginAttemptHandler.ManageLoginAttemptsPage, Middlewares: adminOnly},
+		{Path: "GET /audit-log", HandlerFunc: auditHandler.AuditLogPage, Middlewares: adminOnly},
+	}
+
+	if ssoEnabled {
+		routes = append(routes,
+			mux.Route{Path: "GET /login/oidc", HandlerFunc: oidcHandler.LoginAction},
+			mux.Route{Path: "GET /login/oidc/callback", HandlerFunc: oidcHandler.CallbackAction},
+		)
+	}
+
+	return routes
+}
+
+/*
+authMiddleware only lets signed in users through, and puts the user on
+the request context. Users who have been deleted are signed out. When
+two-factor authentication is required, users without it can only reach
+their account pages.
+*/
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
-			err     error
-			session *sessions.Session
+			err    error
+			userID uint
+			user   models.User
 		)
 
 		slog.Debug("authMiddleware", "request", r.URL.Path)
 
-		if session, err = store.Get(r, "aletics_session"); err != nil {
+		if userID, err = handlers.SessionUserID(store, r); err != nil {
 			slog.Error("error retrieving session in authMiddleware", "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		if _, ok := session.Values["authenticated"]; !ok {
+		if userID == 0 {
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		if user, err = userService.GetUser(userID); err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				slog.Error("error retrieving user in authMiddleware", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			_ = handlers.EndSession(store, w, r)
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 			return
 		}
 
+		if requireTwoFactor && !user.TwoFactorEnabled() && !strings.HasPrefix(r.URL.Path, "/account") {
+			http.Redirect(w, r, "/account/two-factor", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(handlers.WithUser(r.Context(), user)))
+	})
+}
+
+// adminMiddleware must run after authMiddleware.
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := handlers.UserFromContext(r.Context()); !ok || !user.IsAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err       error
+			plaintext string
+			apiKey    models.APIKey
+		)
+
+		if plaintext, err = requests.AuthorizationBearer(r); err != nil {
+			responses.JsonUnauthorized(w, map[string]string{"error": "missing API key. Please use a valid Plausible compatible API key as a Bearer token"})
+			return
+		}
+
+		if apiKey, err = authenticateStatsKey(plaintext); err != nil {
+			if !errors.Is(err, services.ErrInvalidAPIKey) {
+				slog.Error("error authenticating api key", "error", err)
+			}
+
+			responses.JsonUnauthorized(w, map[string]string{"error": "invalid api key or site id. Please make sure you're using a valid api key with access to the site you've requested"})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(handlers.WithAPIKey(r.Context(), apiKey)))
+	})
+}
+
+/*
+authenticateStatsKey accepts an API key, or a property's secret key, which
+may only read that property's stats.
+*/
+func authenticateStatsKey(plaintext string) (models.APIKey, error) {
+	property, err := propertyService.AuthenticateSecretKey(plaintext)
+
+	if err == nil {
+		return models.APIKey{Name: "property secret key", PropertyID: &property.ID}, nil
+	}
+
+	if !errors.Is(err, services.ErrInvalidSecretKey) {
+		return models.APIKey{}, err
+	}
+
+	return apiKeyService.Authenticate(plaintext)
+}
+
+func secretKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err       error
+			plaintext string
+			property  models.Property
+		)
+
+		if plaintext, err = requests.AuthorizationBearer(r); err != nil {
+			responses.JsonErrorMessage(w, http.StatusUnauthorized, "missing property secret key. Send it as a Bearer token")
+			return
+		}
+
+		if property, err = propertyService.AuthenticateSecretKey(plaintext); err != nil {
+			if !errors.Is(err, services.ErrInvalidSecretKey) {
+				slog.Error("error authenticating property secret key", "error", err)
+			}
+
+			responses.JsonErrorMessage(w, http.StatusUnauthorized, "invalid property secret key")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(handlers.WithProperty(r.Context(), property)))
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/adampresley/aletics/internal/handlers"
+	"github.com/gorilla/sessions"
+)
+
+/*
+TestRoutesRequireCSRFToken sends every route that changes something
+through the CSRF middleware as a forged request, and again with the
+session's token. Only the tracker and API routes, which authenticate with
+keys instead of the session cookie, may skip it.
+*/
+func TestRoutesRequireCSRFToken(t *testing.T) {
+	reached := false
+	mux := http.NewServeMux()
+
+	for _, route := range newRoutes(true) {
+		mux.HandleFunc(route.Path, func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	handler := handlers.NewCSRFMiddleware(handlers.CSRFMiddlewareConfig{
+		Store:          sessions.NewCookieStore([]byte("test secret")),
+		Secrets:        []string{"test secret"},
+		ExemptPrefixes: csrfExemptPrefixes,
+	})(mux)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+
+	cookies := w.Result().Cookies()
+	token := ""
+
+	for _, cookie := range cookies {
+		if cookie.Name == handlers.CSRFCookieName {
+			token = cookie.Value
+		}
+	}
+
+	mutating := 0
+
+	for _, route := range newRoutes(true) {
+		method, path, found := strings.Cut(route.Path, " ")
+
+		if !found || method == http.MethodGet {
+			continue
+		}
+
+		path = strings.NewReplacer("{id}", "1", "{userID}", "2").Replace(path)
+		exempt := slices.ContainsFunc(csrfExemptPrefixes, func(prefix string) bool { return strings.HasPrefix(path, prefix) })
+		mutating++
+
+		t.Run(route.Path, func(t *testing.T) {
+			for _, withToken := range []bool{false, true} {
+				reached = false
+				r := httptest.NewRequest(method, path, nil)
+
+				for _, cookie := range cookies {
+					r.AddCookie(cookie)
+				}
+
+				if withToken {
+					r.Header.Set(handlers.CSRFHeaderName, token)
+				}
+
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if shouldReach := withToken || exempt; reached != shouldReach {
+					t.Errorf("with token %v: expected the handler to be reached %v, got status %d", withToken, shouldReach, w.Code)
+				}
+
+				if !withToken && !exempt && w.Code != http.StatusForbidden {
+					t.Errorf("expected a forged request to get 403, got %d", w.Code)
+				}
+			}
+		})
+	}
+
+	if mutating == 0 {
+		t.Fatal("expected routes that change something")
+	}
+}